@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/eciccone/rh/api/service"
+	"github.com/gin-gonic/gin"
+)
+
+type AdminHandler struct {
+	adminService service.AdminService
+}
+
+func NewAdminHandler(s service.AdminService) AdminHandler {
+	return AdminHandler{s}
+}
+
+type moderationInput struct {
+	Reason string `json:"reason"`
+}
+
+type roleInput struct {
+	Role string `json:"role"`
+}
+
+type hiddenInput struct {
+	Hidden bool   `json:"hidden"`
+	Reason string `json:"reason"`
+}
+
+// get /admin/profiles
+func (h *AdminHandler) GetProfiles(c *gin.Context) error {
+	limit, _ := strconv.ParseInt(c.DefaultQuery("limit", "10"), 10, 64)
+	offset, _ := strconv.ParseInt(c.DefaultQuery("offset", "0"), 10, 64)
+
+	page, err := h.adminService.SearchProfiles(c.Query("q"), int(offset), int(limit))
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":      "profiles found",
+		"profiles": page.Profiles,
+		"limit":    page.Limit,
+		"offset":   page.Offset,
+		"total":    page.Total,
+	})
+
+	return nil
+}
+
+// put /admin/profiles/:username/suspension
+func (h *AdminHandler) PutSuspension(c *gin.Context) error {
+	return h.suspend(c, true)
+}
+
+// delete /admin/profiles/:username/suspension
+func (h *AdminHandler) DeleteSuspension(c *gin.Context) error {
+	return h.suspend(c, false)
+}
+
+func (h *AdminHandler) suspend(c *gin.Context, suspended bool) error {
+	actorId := c.GetString("sub")
+	if actorId == "" {
+		return errors.New("suspend failed to get subject, should have been set in middleware")
+	}
+
+	// the reason is optional
+	var input moderationInput
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			return ErrInvalidJSON
+		}
+	}
+
+	result, err := h.adminService.SuspendProfile(actorId, c.Param("username"), suspended, input.Reason)
+	if err != nil {
+		return err
+	}
+
+	msg := "profile suspended"
+	if !suspended {
+		msg = "profile suspension lifted"
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":     msg,
+		"profile": result,
+	})
+
+	return nil
+}
+
+// put /admin/profiles/:username/role
+func (h *AdminHandler) PutRole(c *gin.Context) error {
+	actorId := c.GetString("sub")
+	if actorId == "" {
+		return errors.New("PutRole failed to get subject, should have been set in middleware")
+	}
+
+	var input roleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	result, err := h.adminService.SetRole(actorId, c.Param("username"), input.Role)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":     "role updated",
+		"profile": result,
+	})
+
+	return nil
+}
+
+// put /admin/recipes/:id/hidden
+func (h *AdminHandler) PutRecipeHidden(c *gin.Context) error {
+	actorId := c.GetString("sub")
+	if actorId == "" {
+		return errors.New("PutRecipeHidden failed to get subject, should have been set in middleware")
+	}
+
+	var input hiddenInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	result, err := h.adminService.HideRecipe(actorId, id, input.Hidden, input.Reason)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":    "recipe updated",
+		"recipe": result,
+	})
+
+	return nil
+}
+
+// delete /admin/recipes/:id
+func (h *AdminHandler) DeleteRecipe(c *gin.Context) error {
+	actorId := c.GetString("sub")
+	if actorId == "" {
+		return errors.New("DeleteRecipe failed to get subject, should have been set in middleware")
+	}
+
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	if err := h.adminService.RemoveRecipe(actorId, id, c.Query("reason")); err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "recipe deleted",
+	})
+
+	return nil
+}
+
+// get /admin/stats
+func (h *AdminHandler) GetStats(c *gin.Context) error {
+	stats, err := h.adminService.GetStats()
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":   "stats found",
+		"stats": stats,
+	})
+
+	return nil
+}
+
+// get /admin/audit
+func (h *AdminHandler) GetAuditLog(c *gin.Context) error {
+	limit, _ := strconv.ParseInt(c.DefaultQuery("limit", "10"), 10, 64)
+	offset, _ := strconv.ParseInt(c.DefaultQuery("offset", "0"), 10, 64)
+
+	page, err := h.adminService.GetAuditLog(int(offset), int(limit))
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":     "audit log found",
+		"entries": page.Entries,
+		"limit":   page.Limit,
+		"offset":  page.Offset,
+		"total":   page.Total,
+	})
+
+	return nil
+}
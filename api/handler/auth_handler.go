@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/eciccone/rh/api/service"
+	"github.com/gin-gonic/gin"
+)
+
+type AuthHandler struct {
+	authService service.AuthService
+}
+
+func NewAuthHandler(s service.AuthService) AuthHandler {
+	return AuthHandler{s}
+}
+
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type refreshTokenInput struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// post /auth/register
+func (h *AuthHandler) PostRegister(c *gin.Context) error {
+	var input credentials
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	result, err := h.authService.Register(input.Username, input.Password)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"msg":    "account registered",
+		"tokens": result,
+	})
+
+	return nil
+}
+
+// post /auth/login
+func (h *AuthHandler) PostLogin(c *gin.Context) error {
+	var input credentials
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	result, err := h.authService.Login(input.Username, input.Password)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":    "logged in",
+		"tokens": result,
+	})
+
+	return nil
+}
+
+// post /auth/refresh
+func (h *AuthHandler) PostRefresh(c *gin.Context) error {
+	var input refreshTokenInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	result, err := h.authService.Refresh(input.RefreshToken)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":    "tokens refreshed",
+		"tokens": result,
+	})
+
+	return nil
+}
+
+// post /auth/logout
+func (h *AuthHandler) PostLogout(c *gin.Context) error {
+	var input refreshTokenInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	if err := h.authService.Logout(input.RefreshToken); err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "logged out",
+	})
+
+	return nil
+}
+
+// put /auth/password
+func (h *AuthHandler) PutPassword(c *gin.Context) error {
+	subject := c.GetString("subject")
+	if subject == "" {
+		return errors.New("PutPassword failed to get subject, should have been set in middleware")
+	}
+
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		Password        string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	if err := h.authService.ChangePassword(c.GetString("issuer"), subject, input.CurrentPassword, input.Password); err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "password changed",
+	})
+
+	return nil
+}
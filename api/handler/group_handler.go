@@ -0,0 +1,267 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/eciccone/rh/api/service"
+	"github.com/gin-gonic/gin"
+)
+
+type GroupHandler struct {
+	groupService service.GroupService
+}
+
+func NewGroupHandler(s service.GroupService) GroupHandler {
+	return GroupHandler{s}
+}
+
+type groupInput struct {
+	Name string `json:"name"`
+}
+
+type inviteInput struct {
+	Expires *time.Time `json:"expires_at"`
+}
+
+type joinInput struct {
+	Code string `json:"code"`
+}
+
+// get /groups
+func (h *GroupHandler) GetGroups(c *gin.Context) error {
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("GetGroups failed to get subject, should have been set in middleware")
+	}
+
+	groups, err := h.groupService.GetGroups(profileId)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":    "groups found",
+		"groups": groups,
+	})
+
+	return nil
+}
+
+// post /groups
+func (h *GroupHandler) PostGroup(c *gin.Context) error {
+	var input groupInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("PostGroup failed to get subject, should have been set in middleware")
+	}
+
+	result, err := h.groupService.CreateGroup(profileId, input.Name)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"msg":   "group created",
+		"group": result,
+	})
+
+	return nil
+}
+
+// get /groups/:id
+func (h *GroupHandler) GetGroup(c *gin.Context) error {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("GetGroup failed to get subject, should have been set in middleware")
+	}
+
+	result, err := h.groupService.GetGroup(id, profileId)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":   "group found",
+		"group": result,
+	})
+
+	return nil
+}
+
+// put /groups/:id
+func (h *GroupHandler) PutGroup(c *gin.Context) error {
+	var input groupInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("PutGroup failed to get subject, should have been set in middleware")
+	}
+
+	result, err := h.groupService.RenameGroup(id, profileId, input.Name)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":   "group updated",
+		"group": result,
+	})
+
+	return nil
+}
+
+// delete /groups/:id
+func (h *GroupHandler) DeleteGroup(c *gin.Context) error {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("DeleteGroup failed to get subject, should have been set in middleware")
+	}
+
+	if err := h.groupService.DeleteGroup(id, profileId); err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "group deleted",
+	})
+
+	return nil
+}
+
+// post /groups/:id/invites
+func (h *GroupHandler) PostInvite(c *gin.Context) error {
+	// the expiry is optional
+	var input inviteInput
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			return ErrInvalidJSON
+		}
+	}
+
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("PostInvite failed to get subject, should have been set in middleware")
+	}
+
+	result, err := h.groupService.CreateInvite(id, profileId, input.Expires)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"msg":    "invite created, it won't be shown again",
+		"invite": result,
+	})
+
+	return nil
+}
+
+// delete /groups/:id/invites
+func (h *GroupHandler) DeleteInvites(c *gin.Context) error {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("DeleteInvites failed to get subject, should have been set in middleware")
+	}
+
+	if err := h.groupService.RevokeInvites(id, profileId); err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "invites revoked",
+	})
+
+	return nil
+}
+
+// post /groups/join
+func (h *GroupHandler) PostJoin(c *gin.Context) error {
+	var input joinInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("PostJoin failed to get subject, should have been set in middleware")
+	}
+
+	result, err := h.groupService.JoinGroup(profileId, input.Code)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":   "group joined",
+		"group": result,
+	})
+
+	return nil
+}
+
+// put /groups/:id/members/:username
+func (h *GroupHandler) PutMember(c *gin.Context) error {
+	var input roleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("PutMember failed to get subject, should have been set in middleware")
+	}
+
+	members, err := h.groupService.SetMemberRole(id, profileId, c.Param("username"), input.Role)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":     "member updated",
+		"members": members,
+	})
+
+	return nil
+}
+
+// delete /groups/:id/members/:username
+func (h *GroupHandler) DeleteMember(c *gin.Context) error {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("DeleteMember failed to get subject, should have been set in middleware")
+	}
+
+	if err := h.groupService.RemoveMember(id, profileId, c.Param("username")); err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "member removed",
+	})
+
+	return nil
+}
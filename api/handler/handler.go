@@ -10,8 +10,10 @@ import (
 )
 
 var (
-	ErrInvalidJSON = errors.New("invalid json data")
-	ErrMissingFile = errors.New("requires file")
+	ErrInvalidJSON  = errors.New("invalid json data")
+	ErrInvalidQuery = errors.New("invalid query parameters")
+	ErrInvalidForm  = errors.New("invalid form data")
+	ErrMissingFile  = errors.New("requires file")
 )
 
 func Handler(h func(c *gin.Context) error) gin.HandlerFunc {
@@ -23,30 +25,63 @@ func Handler(h func(c *gin.Context) error) gin.HandlerFunc {
 
 		// handle 400
 		if errors.Is(err, ErrInvalidJSON) ||
+			errors.Is(err, ErrInvalidQuery) ||
+			errors.Is(err, ErrInvalidForm) ||
 			errors.Is(err, service.ErrProfileExists) ||
 			errors.Is(err, service.ErrProfileData) ||
+			errors.Is(err, service.ErrProfileDetails) ||
 			errors.Is(err, service.ErrRecipeData) ||
 			errors.Is(err, service.ErrIngredientData) ||
+			errors.Is(err, service.ErrSubrecipeData) ||
+			errors.Is(err, service.ErrSubrecipeCycle) ||
+			errors.Is(err, service.ErrRecipeMetadata) ||
+			errors.Is(err, service.ErrRecipeQuery) ||
+			errors.Is(err, service.ErrRecipeImageData) ||
+			errors.Is(err, service.ErrImageType) ||
+			errors.Is(err, service.ErrFollowSelf) ||
+			errors.Is(err, service.ErrNotificationType) ||
+			errors.Is(err, service.ErrAccountData) ||
+			errors.Is(err, service.ErrAccountExists) ||
+			errors.Is(err, service.ErrTokenData) ||
+			errors.Is(err, service.ErrRoleData) ||
+			errors.Is(err, service.ErrRecipeShareData) ||
+			errors.Is(err, service.ErrGroupData) ||
+			errors.Is(err, service.ErrInvalidInvite) ||
+			errors.Is(err, service.ErrReportData) ||
+			errors.Is(err, service.ErrReportExists) ||
+			errors.Is(err, service.ErrReportResolved) ||
 			errors.Is(err, ErrMissingFile) {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-				"msg": err.Error(),
-			})
+			c.AbortWithStatusJSON(http.StatusBadRequest, errorBody(err))
+			return
+		}
+
+		// handle 401
+		if errors.Is(err, service.ErrInvalidCredentials) || errors.Is(err, service.ErrInvalidRefreshToken) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, errorBody(err))
+			return
+		}
+
+		// handle 413
+		if errors.Is(err, service.ErrImageTooLarge) {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, errorBody(err))
 			return
 		}
 
 		// handle 403
-		if errors.Is(err, service.ErrRecipeForbidden) || errors.Is(err, service.ErrUsernameForbidden) {
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
-				"msg": err.Error(),
-			})
+		if errors.Is(err, service.ErrRecipeForbidden) || errors.Is(err, service.ErrUsernameForbidden) || errors.Is(err, service.ErrImageURL) || errors.Is(err, service.ErrRoleForbidden) || errors.Is(err, service.ErrGroupForbidden) {
+			c.AbortWithStatusJSON(http.StatusForbidden, errorBody(err))
+			return
+		}
+
+		// handle 429
+		if errors.Is(err, service.ErrUsernameTooSoon) || errors.Is(err, service.ErrAccountLocked) {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, errorBody(err))
 			return
 		}
 
 		// handle 404
-		if errors.Is(err, service.ErrNoRecipe) || errors.Is(err, service.ErrNoProfile) {
-			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
-				"msg": err.Error(),
-			})
+		if errors.Is(err, service.ErrNoRecipe) || errors.Is(err, service.ErrNoProfile) || errors.Is(err, service.ErrNoRecipeImage) || errors.Is(err, service.ErrNoNotification) || errors.Is(err, service.ErrNoAccount) || errors.Is(err, service.ErrNoToken) || errors.Is(err, service.ErrNoCollaborator) || errors.Is(err, service.ErrNoGroup) || errors.Is(err, service.ErrNoMember) || errors.Is(err, service.ErrNoReport) {
+			c.AbortWithStatusJSON(http.StatusNotFound, errorBody(err))
 			return
 		}
 
@@ -56,3 +91,16 @@ func Handler(h func(c *gin.Context) error) gin.HandlerFunc {
 		})
 	}
 }
+
+// The body of an error response, along with which fields are invalid and why when the error
+// says so.
+func errorBody(err error) gin.H {
+	body := gin.H{"msg": err.Error()}
+
+	var validationErr *service.ValidationError
+	if errors.As(err, &validationErr) {
+		body["fields"] = validationErr.Fields
+	}
+
+	return body
+}
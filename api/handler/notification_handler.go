@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/eciccone/rh/api/service"
+	"github.com/gin-gonic/gin"
+)
+
+type NotificationHandler struct {
+	notificationService service.NotificationService
+}
+
+func NewNotificationHandler(s service.NotificationService) NotificationHandler {
+	return NotificationHandler{s}
+}
+
+// get /notifications
+func (h *NotificationHandler) GetNotifications(c *gin.Context) error {
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("GetNotifications failed to get subject, should have been set in middleware")
+	}
+
+	limit, _ := strconv.ParseInt(c.DefaultQuery("limit", "10"), 10, 64)
+	offset, _ := strconv.ParseInt(c.DefaultQuery("offset", "0"), 10, 64)
+	unreadOnly, _ := strconv.ParseBool(c.DefaultQuery("unread", "false"))
+
+	page, err := h.notificationService.GetNotifications(profileId, unreadOnly, int(offset), int(limit))
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":           "notifications found",
+		"notifications": page.Notifications,
+		"limit":         page.Limit,
+		"offset":        page.Offset,
+		"total":         page.Total,
+		"unread":        page.Unread,
+	})
+
+	return nil
+}
+
+// put /notifications/:id/read
+func (h *NotificationHandler) PutNotificationRead(c *gin.Context) error {
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("PutNotificationRead failed to get subject, should have been set in middleware")
+	}
+
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	if err := h.notificationService.MarkRead(profileId, id); err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "notification read",
+	})
+
+	return nil
+}
+
+// put /notifications/read
+func (h *NotificationHandler) PutNotificationsRead(c *gin.Context) error {
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("PutNotificationsRead failed to get subject, should have been set in middleware")
+	}
+
+	if err := h.notificationService.MarkAllRead(profileId); err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "notifications read",
+	})
+
+	return nil
+}
+
+// get /notifications/preferences
+func (h *NotificationHandler) GetPreferences(c *gin.Context) error {
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("GetPreferences failed to get subject, should have been set in middleware")
+	}
+
+	result, err := h.notificationService.GetPreferences(profileId)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":         "preferences found",
+		"preferences": result,
+	})
+
+	return nil
+}
+
+// put /notifications/preferences
+func (h *NotificationHandler) PutPreferences(c *gin.Context) error {
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("PutPreferences failed to get subject, should have been set in middleware")
+	}
+
+	var input map[string]bool
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	result, err := h.notificationService.UpdatePreferences(profileId, input)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":         "preferences updated",
+		"preferences": result,
+	})
+
+	return nil
+}
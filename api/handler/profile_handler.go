@@ -2,7 +2,10 @@ package handler
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
 
 	"github.com/eciccone/rh/api/repo/profile"
 	"github.com/eciccone/rh/api/service"
@@ -60,3 +63,224 @@ func (h *ProfileHandler) PostProfile(c *gin.Context) error {
 
 	return nil
 }
+
+// put /profile
+func (h *ProfileHandler) PutProfile(c *gin.Context) error {
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("PutProfile failed to get subject, should have been set in middleware")
+	}
+
+	var data profile.Profile
+	if err := c.ShouldBindJSON(&data); err != nil {
+		return ErrInvalidJSON
+	}
+
+	result, err := h.profileService.UpdateProfile(profileId, data)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":     "profile updated",
+		"profile": result,
+	})
+
+	return nil
+}
+
+// put /profile/avatar
+func (h *ProfileHandler) PutProfileAvatar(c *gin.Context) error {
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("PutProfileAvatar failed to get subject, should have been set in middleware")
+	}
+
+	file, err := c.FormFile("image")
+	if errors.Is(err, http.ErrMissingFile) {
+		return ErrMissingFile
+	}
+	if err != nil {
+		return fmt.Errorf("PutProfileAvatar failed to get file: %w", err)
+	}
+
+	result, err := h.profileService.UpdateProfileAvatar(profileId, file)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":     "profile avatar updated",
+		"profile": result,
+	})
+
+	return nil
+}
+
+// put /profile/username
+func (h *ProfileHandler) PutProfileUsername(c *gin.Context) error {
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("PutProfileUsername failed to get subject, should have been set in middleware")
+	}
+
+	var data struct {
+		Username string `json:"username"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		return ErrInvalidJSON
+	}
+
+	result, err := h.profileService.ChangeUsername(profileId, data.Username)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":     "profile username updated",
+		"profile": result,
+	})
+
+	return nil
+}
+
+// get /users/:username
+func (h *ProfileHandler) GetUser(c *gin.Context) error {
+	username := c.Param("username")
+
+	result, err := h.profileService.FindProfile(username)
+	if err != nil {
+		return err
+	}
+
+	// found by a previous username, send links to the current one
+	if result.Username != username {
+		c.Redirect(http.StatusMovedPermanently, "/users/"+url.PathEscape(result.Username))
+		return nil
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":     "profile found",
+		"profile": result,
+	})
+
+	return nil
+}
+
+// delete /profile
+func (h *ProfileHandler) DeleteProfile(c *gin.Context) error {
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("DeleteProfile failed to get subject, should have been set in middleware")
+	}
+
+	result, err := h.profileService.DeleteProfile(profileId)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":     "profile scheduled for deletion",
+		"profile": result,
+	})
+
+	return nil
+}
+
+// post /profile/restore
+func (h *ProfileHandler) PostProfileRestore(c *gin.Context) error {
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("PostProfileRestore failed to get subject, should have been set in middleware")
+	}
+
+	result, err := h.profileService.RestoreProfile(profileId)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":     "profile deletion cancelled",
+		"profile": result,
+	})
+
+	return nil
+}
+
+// put /users/:username/follow
+func (h *ProfileHandler) PutFollow(c *gin.Context) error {
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("PutFollow failed to get subject, should have been set in middleware")
+	}
+
+	if err := h.profileService.Follow(profileId, c.Param("username")); err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "profile followed",
+	})
+
+	return nil
+}
+
+// delete /users/:username/follow
+func (h *ProfileHandler) DeleteFollow(c *gin.Context) error {
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("DeleteFollow failed to get subject, should have been set in middleware")
+	}
+
+	if err := h.profileService.Unfollow(profileId, c.Param("username")); err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "profile unfollowed",
+	})
+
+	return nil
+}
+
+// get /users/:username/followers
+func (h *ProfileHandler) GetFollowers(c *gin.Context) error {
+	limit, _ := strconv.ParseInt(c.DefaultQuery("limit", "10"), 10, 64)
+	offset, _ := strconv.ParseInt(c.DefaultQuery("offset", "0"), 10, 64)
+
+	page, err := h.profileService.GetFollowers(c.Param("username"), int(offset), int(limit))
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":      "followers found",
+		"profiles": page.Profiles,
+		"limit":    page.Limit,
+		"offset":   page.Offset,
+		"total":    page.Total,
+	})
+
+	return nil
+}
+
+// get /users/:username/following
+func (h *ProfileHandler) GetFollowing(c *gin.Context) error {
+	limit, _ := strconv.ParseInt(c.DefaultQuery("limit", "10"), 10, 64)
+	offset, _ := strconv.ParseInt(c.DefaultQuery("offset", "0"), 10, 64)
+
+	page, err := h.profileService.GetFollowing(c.Param("username"), int(offset), int(limit))
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":      "following found",
+		"profiles": page.Profiles,
+		"limit":    page.Limit,
+		"offset":   page.Offset,
+		"total":    page.Total,
+	})
+
+	return nil
+}
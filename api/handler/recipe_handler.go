@@ -87,8 +87,128 @@ func (h *RecipeHandler) PutRecipeImage(c *gin.Context) error {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"msg":    "recipe image updated",
-		"recipe": imagename,
+		"msg":        "recipe image updated",
+		"recipe":     imagename,
+		"image_urls": h.recipeService.ImageURLs(imagename),
+	})
+
+	return nil
+}
+
+// post /recipes/:id/images
+func (h *RecipeHandler) PostRecipeGalleryImage(c *gin.Context) error {
+	recipeId, _ := strconv.Atoi(c.Param("id"))
+
+	username := c.GetString("username")
+	if username == "" {
+		return errors.New("PostRecipeGalleryImage failed to get username, should have been set in middleware")
+	}
+
+	file, err := c.FormFile("image")
+	if errors.Is(err, http.ErrMissingFile) {
+		return ErrMissingFile
+	}
+	if err != nil {
+		return fmt.Errorf("PostRecipeGalleryImage failed to get file: %w", err)
+	}
+
+	var stepNumber *int
+	if step := c.PostForm("step"); step != "" {
+		n, err := strconv.Atoi(step)
+		if err != nil {
+			return ErrInvalidForm
+		}
+		stepNumber = &n
+	}
+
+	image, err := h.recipeService.AddRecipeImage(recipeId, username, file, c.PostForm("caption"), stepNumber)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":   "recipe image added",
+		"image": image,
+	})
+
+	return nil
+}
+
+type imageOrder struct {
+	Order []int `json:"order"`
+}
+
+// put /recipes/:id/images
+func (h *RecipeHandler) PutRecipeGalleryOrder(c *gin.Context) error {
+	var input imageOrder
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	recipeId, _ := strconv.Atoi(c.Param("id"))
+
+	username := c.GetString("username")
+	if username == "" {
+		return errors.New("PutRecipeGalleryOrder failed to get username, should have been set in middleware")
+	}
+
+	images, err := h.recipeService.ReorderRecipeImages(recipeId, username, input.Order)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":    "recipe images reordered",
+		"images": images,
+	})
+
+	return nil
+}
+
+// put /recipes/:id/images/:imageid
+func (h *RecipeHandler) PutRecipeGalleryImage(c *gin.Context) error {
+	var input recipe.Image
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	recipeId, _ := strconv.Atoi(c.Param("id"))
+	input.Id, _ = strconv.Atoi(c.Param("imageid"))
+
+	username := c.GetString("username")
+	if username == "" {
+		return errors.New("PutRecipeGalleryImage failed to get username, should have been set in middleware")
+	}
+
+	image, err := h.recipeService.EditRecipeImage(recipeId, username, input)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":   "recipe image updated",
+		"image": image,
+	})
+
+	return nil
+}
+
+// delete /recipes/:id/images/:imageid
+func (h *RecipeHandler) DeleteRecipeGalleryImage(c *gin.Context) error {
+	recipeId, _ := strconv.Atoi(c.Param("id"))
+	imageId, _ := strconv.Atoi(c.Param("imageid"))
+
+	username := c.GetString("username")
+	if username == "" {
+		return errors.New("DeleteRecipeGalleryImage failed to get username, should have been set in middleware")
+	}
+
+	if err := h.recipeService.RemoveRecipeImage(recipeId, imageId, username); err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "recipe image deleted",
 	})
 
 	return nil
@@ -119,11 +239,17 @@ func (h *RecipeHandler) PostRecipe(c *gin.Context) error {
 	return nil
 }
 
-// get /recipes/:id
+// get /recipes/:id[?expand=subrecipes]
 func (h *RecipeHandler) GetRecipe(c *gin.Context) error {
 	recipeId, _ := strconv.Atoi(c.Param("id"))
 
-	recipe, err := h.recipeService.GetRecipe(recipeId)
+	var recipe recipe.Recipe
+	var err error
+	if c.Query("expand") == "subrecipes" {
+		recipe, err = h.recipeService.GetRecipeWithSubrecipes(recipeId, c.GetString("username"))
+	} else {
+		recipe, err = h.recipeService.GetRecipeForUsername(recipeId, c.GetString("username"))
+	}
 	if err != nil {
 		return err
 	}
@@ -136,17 +262,56 @@ func (h *RecipeHandler) GetRecipe(c *gin.Context) error {
 	return nil
 }
 
-// get /recipes[&limit=][&offset=]
+// get /images/:name?expires=&signature=
+func (h *RecipeHandler) GetImage(c *gin.Context) error {
+	file, err := h.recipeService.OpenRecipeImage(c.Param("name"), c.Query("expires"), c.Query("signature"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// signed urls stay the same for a while, so the image can be cached for as long
+	c.DataFromReader(http.StatusOK, -1, "image/jpeg", file, map[string]string{
+		"Cache-Control":          "private, max-age=3600",
+		"X-Content-Type-Options": "nosniff",
+	})
+
+	return nil
+}
+
+// get /recipes[&limit=][&offset=][&sort=][&max_total_time=][&difficulty=][&cuisine=][&course=]
 func (h *RecipeHandler) GetRecipes(c *gin.Context) error {
 	limit, _ := strconv.ParseInt(c.DefaultQuery("limit", "10"), 10, 64)
 	offset, _ := strconv.ParseInt(c.DefaultQuery("offset", "0"), 10, 64)
 
+	filter := recipe.Filter{
+		Difficulty: c.Query("difficulty"),
+		Cuisine:    c.Query("cuisine"),
+		Course:     c.Query("course"),
+	}
+
+	if maxTotalTime := c.Query("max_total_time"); maxTotalTime != "" {
+		d, err := recipe.ParseDuration(maxTotalTime)
+		if err != nil {
+			return fmt.Errorf("%w: max_total_time: %v", ErrInvalidQuery, err)
+		}
+		filter.MaxTotalTime = d
+	}
+
+	if group := c.Query("group"); group != "" {
+		id, err := strconv.Atoi(group)
+		if err != nil {
+			return fmt.Errorf("%w: group: %v", ErrInvalidQuery, err)
+		}
+		filter.Group = id
+	}
+
 	username := c.GetString("username")
 	if username == "" {
 		return errors.New("GetRecipes failed to get username, should have been set in middleware")
 	}
 
-	recipePage, err := h.recipeService.GetRecipesForUsername(username, "", int(offset), int(limit))
+	recipePage, err := h.recipeService.GetRecipesForUsername(username, filter, c.Query("sort"), int(offset), int(limit))
 	if err != nil {
 		return err
 	}
@@ -161,3 +326,26 @@ func (h *RecipeHandler) GetRecipes(c *gin.Context) error {
 
 	return nil
 }
+
+// get /feed
+func (h *RecipeHandler) GetFeed(c *gin.Context) error {
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("GetFeed failed to get subject, should have been set in middleware")
+	}
+
+	limit, _ := strconv.ParseInt(c.DefaultQuery("limit", "10"), 10, 64)
+
+	page, err := h.recipeService.GetFeed(profileId, c.Query("cursor"), int(limit))
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":         "feed found",
+		"recipes":     page.Recipes,
+		"next_cursor": page.NextCursor,
+	})
+
+	return nil
+}
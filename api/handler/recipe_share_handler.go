@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type collaboratorRole struct {
+	Role string `json:"role"`
+}
+
+type recipeOwner struct {
+	Username string `json:"username"`
+}
+
+// get /recipes/:id/collaborators
+func (h *RecipeHandler) GetCollaborators(c *gin.Context) error {
+	recipeId, _ := strconv.Atoi(c.Param("id"))
+
+	username := c.GetString("username")
+	if username == "" {
+		return errors.New("GetCollaborators failed to get username, should have been set in middleware")
+	}
+
+	collaborators, err := h.recipeService.GetCollaborators(recipeId, username)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":           "collaborators found",
+		"collaborators": collaborators,
+	})
+
+	return nil
+}
+
+// put /recipes/:id/collaborators/:username
+func (h *RecipeHandler) PutCollaborator(c *gin.Context) error {
+	var input collaboratorRole
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	recipeId, _ := strconv.Atoi(c.Param("id"))
+
+	username := c.GetString("username")
+	if username == "" {
+		return errors.New("PutCollaborator failed to get username, should have been set in middleware")
+	}
+
+	collaborators, err := h.recipeService.ShareRecipe(recipeId, username, c.Param("username"), input.Role)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":           "recipe shared",
+		"collaborators": collaborators,
+	})
+
+	return nil
+}
+
+// delete /recipes/:id/collaborators/:username
+func (h *RecipeHandler) DeleteCollaborator(c *gin.Context) error {
+	recipeId, _ := strconv.Atoi(c.Param("id"))
+
+	username := c.GetString("username")
+	if username == "" {
+		return errors.New("DeleteCollaborator failed to get username, should have been set in middleware")
+	}
+
+	if err := h.recipeService.UnshareRecipe(recipeId, username, c.Param("username")); err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "recipe unshared",
+	})
+
+	return nil
+}
+
+// post /recipes/:id/transfer
+func (h *RecipeHandler) PostTransfer(c *gin.Context) error {
+	var input recipeOwner
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	recipeId, _ := strconv.Atoi(c.Param("id"))
+
+	username := c.GetString("username")
+	if username == "" {
+		return errors.New("PostTransfer failed to get username, should have been set in middleware")
+	}
+
+	result, err := h.recipeService.TransferRecipe(recipeId, username, input.Username)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":    "recipe transferred",
+		"recipe": result,
+	})
+
+	return nil
+}
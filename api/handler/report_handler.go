@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/eciccone/rh/api/service"
+	"github.com/gin-gonic/gin"
+)
+
+type ReportHandler struct {
+	reportService service.ReportService
+}
+
+func NewReportHandler(s service.ReportService) ReportHandler {
+	return ReportHandler{s}
+}
+
+type reportInput struct {
+	Type    string `json:"type"`
+	Id      string `json:"id"`
+	Reason  string `json:"reason"`
+	Details string `json:"details"`
+}
+
+type triageInput struct {
+	Status     string `json:"status"`
+	Action     string `json:"action"`
+	Resolution string `json:"resolution"`
+}
+
+// post /reports
+func (h *ReportHandler) PostReport(c *gin.Context) error {
+	var input reportInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("PostReport failed to get subject, should have been set in middleware")
+	}
+
+	result, err := h.reportService.CreateReport(profileId, input.Type, input.Id, input.Reason, input.Details)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"msg":    "report sent to the moderators",
+		"report": result,
+	})
+
+	return nil
+}
+
+// get /profile/reports
+func (h *ReportHandler) GetOwnReports(c *gin.Context) error {
+	limit, _ := strconv.ParseInt(c.DefaultQuery("limit", "10"), 10, 64)
+	offset, _ := strconv.ParseInt(c.DefaultQuery("offset", "0"), 10, 64)
+
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("GetOwnReports failed to get subject, should have been set in middleware")
+	}
+
+	page, err := h.reportService.GetOwnReports(profileId, int(offset), int(limit))
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":     "reports found",
+		"reports": page.Reports,
+		"limit":   page.Limit,
+		"offset":  page.Offset,
+		"total":   page.Total,
+	})
+
+	return nil
+}
+
+// get /admin/reports
+func (h *ReportHandler) GetReports(c *gin.Context) error {
+	limit, _ := strconv.ParseInt(c.DefaultQuery("limit", "10"), 10, 64)
+	offset, _ := strconv.ParseInt(c.DefaultQuery("offset", "0"), 10, 64)
+
+	page, err := h.reportService.GetReportQueue(c.Query("status"), int(offset), int(limit))
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":     "reports found",
+		"reports": page.Reports,
+		"limit":   page.Limit,
+		"offset":  page.Offset,
+		"total":   page.Total,
+	})
+
+	return nil
+}
+
+// put /admin/reports/:id
+func (h *ReportHandler) PutReport(c *gin.Context) error {
+	var input triageInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	actorId := c.GetString("sub")
+	if actorId == "" {
+		return errors.New("PutReport failed to get subject, should have been set in middleware")
+	}
+
+	result, err := h.reportService.TriageReport(actorId, id, input.Status, input.Action, input.Resolution)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":    "report updated",
+		"report": result,
+	})
+
+	return nil
+}
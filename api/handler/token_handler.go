@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/eciccone/rh/api/service"
+	"github.com/gin-gonic/gin"
+)
+
+type TokenHandler struct {
+	tokenService service.TokenService
+}
+
+func NewTokenHandler(s service.TokenService) TokenHandler {
+	return TokenHandler{s}
+}
+
+type tokenInput struct {
+	Name    string     `json:"name"`
+	Scopes  []string   `json:"scopes"`
+	Expires *time.Time `json:"expires_at"`
+}
+
+// get /profile/tokens
+func (h *TokenHandler) GetTokens(c *gin.Context) error {
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("GetTokens failed to get subject, should have been set in middleware")
+	}
+
+	tokens, err := h.tokenService.ListTokens(profileId)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":    "access tokens found",
+		"tokens": tokens,
+	})
+
+	return nil
+}
+
+// post /profile/tokens
+func (h *TokenHandler) PostToken(c *gin.Context) error {
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("PostToken failed to get subject, should have been set in middleware")
+	}
+
+	var input tokenInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		return ErrInvalidJSON
+	}
+
+	result, err := h.tokenService.CreateToken(profileId, input.Name, input.Scopes, input.Expires)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"msg":   "access token created, it won't be shown again",
+		"token": result,
+	})
+
+	return nil
+}
+
+// delete /profile/tokens/:id
+func (h *TokenHandler) DeleteToken(c *gin.Context) error {
+	profileId := c.GetString("sub")
+	if profileId == "" {
+		return errors.New("DeleteToken failed to get subject, should have been set in middleware")
+	}
+
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	if err := h.tokenService.RevokeToken(profileId, id); err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "access token revoked",
+	})
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"net/http"
+
+	_ "image/gif"
+	_ "image/png"
+)
+
+var (
+	ErrFormat   = errors.New("unsupported image format")
+	ErrTooLarge = errors.New("image dimensions too large")
+)
+
+// largest number of pixels an upload may decode to, guards against decompression bombs
+const MaxPixels = 50_000_000
+
+// content types that can be decoded, as sniffed by http.DetectContentType
+var decodable = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// Sniffs the content type of data and decodes it, applying the EXIF orientation of JPEGs so the
+// result is upright. Only pixels are kept, metadata such as EXIF and GPS is dropped.
+// Returns ErrFormat if data is not a supported image.
+// Returns ErrTooLarge if the image has more than MaxPixels pixels.
+func Decode(data []byte) (image.Image, error) {
+	contentType := http.DetectContentType(data)
+	if !decodable[contentType] {
+		return nil, ErrFormat
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrFormat
+	}
+
+	if config.Width*config.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrFormat
+	}
+
+	if contentType == "image/jpeg" {
+		img = Orient(img, jpegOrientation(data))
+	}
+
+	return img, nil
+}
+
+// Encodes an image as a JPEG. Transparent areas are flattened onto white.
+func EncodeJPEG(w io.Writer, img image.Image) error {
+	return jpeg.Encode(w, flatten(img), &jpeg.Options{Quality: 85})
+}
+
+// Draws an image onto white, the way EncodeJPEG stores it.
+func flatten(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(flat, flat.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, b.Min, draw.Over)
+	return flat
+}
+
+// Scales an image down so neither side is longer than size, keeping its aspect ratio.
+// Images that already fit are returned as they are.
+func Fit(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := FitSize(b.Dx(), b.Dy(), size)
+	if w == b.Dx() && h == b.Dy() {
+		return img
+	}
+
+	return resize(toRGBA(img), w, h)
+}
+
+// Returns the dimensions Fit scales a w x h image to.
+func FitSize(w, h, size int) (int, int) {
+	if w <= size && h <= size {
+		return w, h
+	}
+
+	if w >= h {
+		return size, maxInt(1, h*size/w)
+	}
+	return maxInt(1, w*size/h), size
+}
+
+// Downscales src to w x h by averaging the source pixels each destination pixel covers.
+func resize(src *image.RGBA, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, maxInt((y+1)*sh/h, y*sh/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, maxInt((x+1)*sw/w, x*sw/w+1)
+
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(src.Pix[i])
+					g += uint32(src.Pix[i+1])
+					b += uint32(src.Pix[i+2])
+					a += uint32(src.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
+
+// Copies any image into an RGBA image whose bounds start at the origin.
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	result := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(result, result.Bounds(), img, b.Min, draw.Src)
+	return result
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,98 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Builds a JPEG with an EXIF APP1 segment holding the given orientation.
+func jpegWithOrientation(t *testing.T, img image.Image, orientation byte) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, orientation, 0, 0, 0, 0, 0, 0}
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := append([]byte{0xFF, 0xE1, byte((len(segment) + 2) >> 8), byte(len(segment) + 2)}, segment...)
+
+	data := buf.Bytes()
+	return append(append(append([]byte{}, data[:2]...), app1...), data[2:]...)
+}
+
+func Test_Decode(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+
+	var pngData bytes.Buffer
+	png.Encode(&pngData, img)
+
+	result, err := Decode(pngData.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 40, 20), result.Bounds())
+
+	_, err = Decode([]byte("#!/bin/sh\necho not an image\n"))
+	assert.ErrorIs(t, err, ErrFormat)
+
+	// claims to be a PNG but is cut short
+	_, err = Decode(pngData.Bytes()[:20])
+	assert.ErrorIs(t, err, ErrFormat)
+}
+
+func Test_DecodeAppliesOrientation(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+
+	result, err := Decode(jpegWithOrientation(t, img, 6))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 20, result.Bounds().Dx())
+	assert.Equal(t, 40, result.Bounds().Dy())
+}
+
+func Test_Orient(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	img.Set(0, 0, color.RGBA{255, 0, 0, 255})
+
+	// rotate 90 degrees clockwise, the top left corner becomes the top right corner
+	result := Orient(img, 6)
+	assert.Equal(t, image.Rect(0, 0, 2, 3), result.Bounds())
+	assert.Equal(t, color.RGBA{255, 0, 0, 255}, result.At(1, 0))
+
+	// mirrored horizontally
+	result = Orient(img, 2)
+	assert.Equal(t, color.RGBA{255, 0, 0, 255}, result.At(2, 0))
+
+	assert.Equal(t, img, Orient(img, 1))
+}
+
+func Test_Fit(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 400, 100))
+
+	assert.Equal(t, image.Rect(0, 0, 200, 50), Fit(img, 200).Bounds())
+	assert.Equal(t, image.Rect(0, 0, 40, 10), Fit(img, 40).Bounds())
+	assert.Equal(t, img, Fit(img, 1000))
+
+	tall := image.NewRGBA(image.Rect(0, 0, 10, 500))
+	assert.Equal(t, image.Rect(0, 0, 2, 100), Fit(tall, 100).Bounds())
+
+	w, h := FitSize(3000, 2000, 1600)
+	assert.Equal(t, []int{1600, 1066}, []int{w, h})
+	w, h = FitSize(300, 200, 1600)
+	assert.Equal(t, []int{300, 200}, []int{w, h})
+}
+
+func Test_EncodeJPEGStripsMetadata(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	data := jpegWithOrientation(t, img, 6)
+	assert.Equal(t, 6, jpegOrientation(data))
+
+	var buf bytes.Buffer
+	assert.NoError(t, EncodeJPEG(&buf, img))
+	assert.Equal(t, 1, jpegOrientation(buf.Bytes()))
+	assert.NotContains(t, buf.String(), "Exif")
+}
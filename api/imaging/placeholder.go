@@ -0,0 +1,158 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+// Placeholders are computed from a copy of the image scaled down to this size, which is more
+// than enough detail for a blurred preview and keeps the cost independent of the upload.
+const placeholderSize = 64
+
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Encodes an image as a blurhash (https://blurha.sh) with four components along its longer
+// side and three along the shorter one. Transparent areas are flattened onto white, the way
+// EncodeJPEG stores them.
+func Blurhash(img image.Image) string {
+	xComponents, yComponents := 4, 3
+	if b := img.Bounds(); b.Dy() > b.Dx() {
+		xComponents, yComponents = 3, 4
+	}
+
+	return blurhash(flatten(Fit(img, placeholderSize)), xComponents, yComponents)
+}
+
+func blurhash(img *image.RGBA, xComponents, yComponents int) string {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+
+	// the image in linear light, so basis functions average it correctly
+	linear := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := img.PixOffset(x, y)
+			linear[y*w+x] = [3]float64{
+				srgbToLinear(img.Pix[i]),
+				srgbToLinear(img.Pix[i+1]),
+				srgbToLinear(img.Pix[i+2]),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := normalisation * math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					p := linear[y*w+x]
+					f[0] += basis * p[0]
+					f[1] += basis * p[1]
+					f[2] += basis * p[2]
+				}
+			}
+
+			scale := 1 / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var sb strings.Builder
+	encode83(&sb, (xComponents-1)+(yComponents-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+
+	maximum := 1.0
+	if len(ac) > 0 {
+		var actual float64
+		for _, f := range ac {
+			actual = math.Max(actual, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+
+		quantised := int(math.Max(0, math.Min(82, math.Floor(actual*166-0.5))))
+		maximum = float64(quantised+1) / 166
+		encode83(&sb, quantised, 1)
+	} else {
+		encode83(&sb, 0, 1)
+	}
+
+	encode83(&sb, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+
+	for _, f := range ac {
+		encode83(&sb, quantiseAC(f[0], maximum)*19*19+quantiseAC(f[1], maximum)*19+quantiseAC(f[2], maximum), 2)
+	}
+
+	return sb.String()
+}
+
+func encode83(sb *strings.Builder, value int, length int) {
+	for i := length - 1; i >= 0; i-- {
+		digit := value
+		for j := 0; j < i; j++ {
+			digit /= 83
+		}
+		sb.WriteByte(base83[digit%83])
+	}
+}
+
+func quantiseAC(value float64, maximum float64) int {
+	v := value / maximum
+	return int(math.Max(0, math.Min(18, math.Floor(math.Copysign(math.Sqrt(math.Abs(v)), v)*9+9.5))))
+}
+
+func srgbToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// Returns the most common color of an image as a hex string like "#a0522d". Similar colors
+// are counted together and averaged, so noise and gradients don't split the vote.
+// Transparent areas are flattened onto white, the way EncodeJPEG stores them.
+func DominantColor(img image.Image) string {
+	small := flatten(Fit(img, placeholderSize))
+
+	// 4 bits per channel
+	var counts [4096]int
+	var sums [4096][3]int
+
+	best := 0
+	for i := 0; i+3 < len(small.Pix); i += 4 {
+		r, g, b := int(small.Pix[i]), int(small.Pix[i+1]), int(small.Pix[i+2])
+		bucket := r>>4<<8 | g>>4<<4 | b>>4
+
+		counts[bucket]++
+		sums[bucket][0] += r
+		sums[bucket][1] += g
+		sums[bucket][2] += b
+
+		if counts[bucket] > counts[best] {
+			best = bucket
+		}
+	}
+
+	n := counts[best]
+	if n == 0 {
+		return "#ffffff"
+	}
+
+	return fmt.Sprintf("#%02x%02x%02x", sums[best][0]/n, sums[best][1]/n, sums[best][2]/n)
+}
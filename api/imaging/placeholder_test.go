@@ -0,0 +1,46 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Blurhash(t *testing.T) {
+	red := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	draw.Draw(red, red.Bounds(), &image.Uniform{color.RGBA{255, 0, 0, 255}}, image.Point{}, draw.Src)
+
+	// a single component is just the average color
+	assert.Equal(t, "00TI:j", blurhash(red, 1, 1))
+
+	// 4x3 components for landscape images, starting with the average color
+	hash := Blurhash(red)
+	assert.Len(t, hash, 6+2*(4*3-1))
+	assert.Equal(t, "L", hash[:1])
+	assert.Equal(t, "TI:j", hash[2:6])
+
+	// 3x4 components for portrait images
+	tall := image.NewRGBA(image.Rect(0, 0, 30, 40))
+	assert.Equal(t, "T", Blurhash(tall)[:1])
+
+	// details change the hash but not its length
+	striped := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	draw.Draw(striped, striped.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+	draw.Draw(striped, image.Rect(0, 0, 20, 30), &image.Uniform{color.Black}, image.Point{}, draw.Src)
+	assert.Len(t, Blurhash(striped), len(hash))
+	assert.NotEqual(t, hash, Blurhash(striped))
+}
+
+func Test_DominantColor(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{160, 82, 45, 255}}, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 30, 100), &image.Uniform{color.RGBA{0, 0, 255, 255}}, image.Point{}, draw.Src)
+
+	assert.Equal(t, "#a0522d", DominantColor(img))
+
+	// transparent images are stored on white
+	assert.Equal(t, "#ffffff", DominantColor(image.NewRGBA(image.Rect(0, 0, 10, 10))))
+}
@@ -1,16 +1,13 @@
 package middleware
 
 import (
-	"context"
-	"fmt"
+	"errors"
 	"log"
 	"net/http"
-	"os"
 	"strings"
-	"time"
 
+	"github.com/eciccone/rh/api/service"
 	"github.com/gin-gonic/gin"
-	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/lestrrat-go/jwx/jwt"
 )
 
@@ -18,7 +15,25 @@ type authorizationHeader struct {
 	IDToken string `header:"Authorization"`
 }
 
-func Validate() gin.HandlerFunc {
+// The id of the profile of a user. Users are identified by issuer and subject together, so
+// users of different issuers with the same subject have different profiles. Providers with
+// ProviderConfig.LegacySubject use the bare subject instead.
+func ProfileId(issuer string, subject string) string {
+	return issuer + "#" + subject
+}
+
+// Validate requires an access token verified by the provider of its issuer. It sets issuer and
+// subject from the token, and sub to the id of the user's profile.
+//
+// Personal access tokens are accepted too when tokens is not nil, setting sub to the profile
+// the token belongs to, token to its id and scopes to what the token may do. RequireScopes
+// limits where they can be used.
+func Validate(providers []Provider, tokens service.TokenService) gin.HandlerFunc {
+	byIssuer := make(map[string]Provider, len(providers))
+	for _, p := range providers {
+		byIssuer[p.Issuer()] = p
+	}
+
 	return func(c *gin.Context) {
 		header := &authorizationHeader{}
 
@@ -37,12 +52,33 @@ func Validate() gin.HandlerFunc {
 			return
 		}
 
-		token, err := jwt.Parse(
-			[]byte(bearerAndToken[1]),
-			jwt.WithKeySet(fetchTenantKeys()),
-			jwt.WithValidate(true),
-			jwt.WithAudience(os.Getenv("AUTH0_AUDIENCE")),
-			jwt.WithAcceptableSkew(time.Minute))
+		if tokens != nil && strings.HasPrefix(bearerAndToken[1], service.PersonalTokenPrefix) {
+			personal, err := tokens.Authenticate(bearerAndToken[1])
+			if err != nil {
+				if errors.Is(err, service.ErrInvalidPersonalToken) {
+					c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+						"msg": "invalid access token",
+					})
+				} else {
+					log.Printf("failed to authenticate personal access token: %v", err)
+					c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+						"msg": "internal server error",
+					})
+				}
+				return
+			}
+
+			c.Set("sub", personal.ProfileId)
+			c.Set("token", personal.Id)
+			c.Set("scopes", personal.Scopes)
+			c.Next()
+			return
+		}
+
+		token := []byte(bearerAndToken[1])
+
+		// the token is only trusted once the provider of the issuer it claims verified it
+		unverified, err := jwt.Parse(token)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 				"msg": "invalid access token",
@@ -50,17 +86,33 @@ func Validate() gin.HandlerFunc {
 			return
 		}
 
-		c.Set("sub", token.Subject())
-		c.Next()
-	}
+		provider, ok := byIssuer[unverified.Issuer()]
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"msg": "invalid access token",
+			})
+			return
+		}
 
-}
+		subject, err := provider.Verify(c.Request.Context(), token)
+		if err != nil {
+			if errors.Is(err, ErrKeysUnavailable) {
+				log.Printf("failed to get json web keys: %v", err)
+				c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+					"msg": "authentication unavailable",
+				})
+				return
+			}
+
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"msg": "invalid access token",
+			})
+			return
+		}
 
-func fetchTenantKeys() jwk.Set {
-	urlString := fmt.Sprintf("https://%s/.well-known/jwks.json", os.Getenv("AUTH0_DOMAIN"))
-	set, err := jwk.Fetch(context.Background(), urlString)
-	if err != nil {
-		log.Fatalf("failed to parse tenant json web keys: %s\n", err)
+		c.Set("issuer", provider.Issuer())
+		c.Set("subject", subject)
+		c.Set("sub", provider.ProfileId(subject))
+		c.Next()
 	}
-	return set
 }
@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+var ErrKeysUnavailable = errors.New("json web keys unavailable")
+
+// least time between refreshes caused by tokens signed with unknown keys, so forged tokens
+// can't make every request fetch the key set
+const minKeyRefreshInterval = 10 * time.Second
+
+// KeySet gives the keys access tokens are verified with.
+type KeySet interface {
+	// Returns the keys to verify a token signed with the key kid. The keys are returned even if
+	// none of them is kid, the token is invalid then.
+	// Returns ErrKeysUnavailable if no keys have been fetched.
+	Keys(ctx context.Context, kid string) (jwk.Set, error)
+
+	// Fetches the keys again, keeping the ones it has if it fails.
+	Refresh(ctx context.Context) error
+}
+
+// KeyCache keeps the last key set fetched from a JWKS url. It is refreshed when asked for a key
+// it doesn't have, and keeps serving the keys it has while the url can't be reached.
+type KeyCache struct {
+	url        string
+	client     *http.Client
+	minRefresh time.Duration
+
+	// serializes fetches, attempted is when the last one started
+	fetchMu   sync.Mutex
+	attempted time.Time
+
+	mu  sync.RWMutex
+	set jwk.Set
+}
+
+func NewKeyCache(url string) *KeyCache {
+	return &KeyCache{
+		url:        url,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		minRefresh: minKeyRefreshInterval,
+	}
+}
+
+// Returns the keys to verify a token signed with the key kid, refreshing them first if kid is
+// not one of them.
+// Returns ErrKeysUnavailable if no keys have been fetched.
+func (k *KeyCache) Keys(ctx context.Context, kid string) (jwk.Set, error) {
+	if set := k.current(); set != nil {
+		if _, ok := set.LookupKeyID(kid); ok {
+			return set, nil
+		}
+	}
+
+	// the keys may have been rotated, the error is logged and the keys already fetched are used
+	k.refresh(ctx, false)
+
+	set := k.current()
+	if set == nil {
+		return nil, ErrKeysUnavailable
+	}
+
+	return set, nil
+}
+
+// Fetches the key set, keeping the one fetched before if it fails.
+func (k *KeyCache) Refresh(ctx context.Context) error {
+	return k.refresh(ctx, true)
+}
+
+func (k *KeyCache) refresh(ctx context.Context, force bool) error {
+	k.fetchMu.Lock()
+	defer k.fetchMu.Unlock()
+
+	if !force && time.Since(k.attempted) < k.minRefresh {
+		return nil
+	}
+	k.attempted = time.Now()
+
+	set, err := jwk.Fetch(ctx, k.url, jwk.WithHTTPClient(k.client))
+	if err != nil {
+		log.Printf("failed to refresh json web keys, keeping the keys fetched before: %v", err)
+		return fmt.Errorf("Refresh failed to fetch json web keys: %w", err)
+	}
+
+	k.mu.Lock()
+	k.set = set
+	k.mu.Unlock()
+
+	return nil
+}
+
+func (k *KeyCache) current() jwk.Set {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.set
+}
@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+// jwksServer serves the public keys of the keys it was given, or 500 while down.
+type jwksServer struct {
+	mu      sync.Mutex
+	keys    []jwk.Key
+	down    bool
+	fetches int
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fetches++
+	if s.down {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	set := jwk.NewSet()
+	for _, key := range s.keys {
+		public, _ := jwk.PublicKeyOf(key)
+		set.Add(public)
+	}
+	json.NewEncoder(w).Encode(set)
+}
+
+func (s *jwksServer) set(down bool, keys ...jwk.Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+	s.keys = keys
+}
+
+func newSigningKey(t *testing.T, kid string) jwk.Key {
+	raw, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	key, err := jwk.New(raw)
+	assert.NoError(t, err)
+	key.Set(jwk.KeyIDKey, kid)
+	key.Set(jwk.AlgorithmKey, jwa.RS256)
+
+	return key
+}
+
+// Signs an access token for the subject test-id, with claims overriding the defaults.
+func newAccessToken(t *testing.T, key jwk.Key, claims map[string]interface{}) string {
+	token := jwt.New()
+	token.Set(jwt.IssuerKey, "test-issuer")
+	token.Set(jwt.SubjectKey, "test-id")
+	token.Set(jwt.AudienceKey, "test-audience")
+	token.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+	for k, v := range claims {
+		token.Set(k, v)
+	}
+
+	signed, err := jwt.Sign(token, jwa.RS256, key)
+	assert.NoError(t, err)
+
+	return string(signed)
+}
+
+func Test_KeyCache(t *testing.T) {
+	first, second := newSigningKey(t, "first"), newSigningKey(t, "second")
+	server := &jwksServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	keys := NewKeyCache(ts.URL)
+	keys.minRefresh = 0
+
+	// no keys could ever be fetched
+	server.set(true)
+	_, err := keys.Keys(context.Background(), "first")
+	assert.ErrorIs(t, err, ErrKeysUnavailable)
+
+	server.set(false, first)
+	set, err := keys.Keys(context.Background(), "first")
+	assert.NoError(t, err)
+	_, ok := set.LookupKeyID("first")
+	assert.True(t, ok)
+
+	// known keys are not fetched again
+	fetches := server.fetches
+	_, err = keys.Keys(context.Background(), "first")
+	assert.NoError(t, err)
+	assert.Equal(t, fetches, server.fetches)
+
+	// rotated keys are fetched when asked for one not seen before
+	server.set(false, second)
+	set, err = keys.Keys(context.Background(), "second")
+	assert.NoError(t, err)
+	_, ok = set.LookupKeyID("second")
+	assert.True(t, ok)
+
+	// keys already fetched keep being served while the key set can't be fetched
+	server.set(true)
+	assert.Error(t, keys.Refresh(context.Background()))
+	set, err = keys.Keys(context.Background(), "forged")
+	assert.NoError(t, err)
+	_, ok = set.LookupKeyID("second")
+	assert.True(t, ok)
+}
+
+func Test_KeyCacheRefreshLimit(t *testing.T) {
+	server := &jwksServer{}
+	server.set(false, newSigningKey(t, "first"))
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	keys := NewKeyCache(ts.URL)
+	assert.NoError(t, keys.Refresh(context.Background()))
+
+	// unknown keys don't cause another fetch right after the last one
+	set, err := keys.Keys(context.Background(), "unknown")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, set.Len())
+	assert.Equal(t, 1, server.fetches)
+}
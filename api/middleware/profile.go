@@ -8,13 +8,19 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// Profile requires the user to have a profile that is not suspended. It sets username and role
+// from the profile. A user whose profile was deleted is told so, and can create a new one.
 func Profile(ps service.ProfileService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		profileID := c.GetString("sub")
 
 		profile, err := ps.FetchProfile(profileID)
 		if err != nil {
-			if errors.Is(err, service.ErrNoProfile) {
+			if errors.Is(err, service.ErrProfileDeleted) {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+					"msg": "profile deleted",
+				})
+			} else if errors.Is(err, service.ErrNoProfile) {
 				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
 					"msg": "profile not found",
 				})
@@ -26,7 +32,15 @@ func Profile(ps service.ProfileService) gin.HandlerFunc {
 			return
 		}
 
+		if profile.Suspended {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"msg": "profile suspended",
+			})
+			return
+		}
+
 		c.Set("username", profile.Username)
+		c.Set("role", profile.Role)
 		c.Next()
 	}
 }
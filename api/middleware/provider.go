@@ -0,0 +1,319 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+// Provider verifies the access tokens of one issuer.
+type Provider interface {
+	// Issuer the tokens of the provider are issued by, as in their iss claim.
+	Issuer() string
+
+	// Verifies an access token and returns the subject it identifies.
+	// Returns ErrKeysUnavailable if the keys to verify it with could not be fetched.
+	Verify(ctx context.Context, token []byte) (string, error)
+
+	// The id of the profile of the user with subject.
+	ProfileId(subject string) string
+
+	// Fetches the keys of the provider again, keeping the ones it has if it fails.
+	Refresh(ctx context.Context) error
+}
+
+// ProviderConfig describes a provider. Its keys are read from KeysFile if set, fetched from
+// JWKSURL if set, and otherwise found through the OpenID Connect discovery document of Issuer.
+type ProviderConfig struct {
+	Issuer       string `json:"issuer"`
+	Audience     string `json:"audience"`
+	SubjectClaim string `json:"subject_claim"`
+	JWKSURL      string `json:"jwks_url"`
+	KeysFile     string `json:"keys_file"`
+
+	// profiles of the provider are identified by the bare subject, like they were when the
+	// Auth0 tenant was the only issuer, so they keep the profiles created back then
+	LegacySubject bool `json:"legacy_subject"`
+}
+
+// Gets the providers from AUTH_PROVIDERS, a json array of ProviderConfig. Without it, the
+// Auth0 tenant in AUTH0_DOMAIN and AUTH0_AUDIENCE is the only provider, if there is one, and
+// identifies profiles by the bare subject as it always did.
+func ProvidersFromEnv() ([]Provider, error) {
+	var configs []ProviderConfig
+
+	if value := os.Getenv("AUTH_PROVIDERS"); value != "" {
+		if err := json.Unmarshal([]byte(value), &configs); err != nil {
+			return nil, fmt.Errorf("invalid AUTH_PROVIDERS: %w", err)
+		}
+	} else if domain := os.Getenv("AUTH0_DOMAIN"); domain != "" {
+		configs = append(configs, ProviderConfig{
+			Issuer:        fmt.Sprintf("https://%s/", domain),
+			Audience:      os.Getenv("AUTH0_AUDIENCE"),
+			JWKSURL:       fmt.Sprintf("https://%s/.well-known/jwks.json", domain),
+			LegacySubject: true,
+		})
+	}
+
+	issuers := map[string]bool{}
+	result := make([]Provider, len(configs))
+	for i, config := range configs {
+		if issuers[config.Issuer] {
+			return nil, fmt.Errorf("issuer %q is configured more than once", config.Issuer)
+		}
+		issuers[config.Issuer] = true
+
+		p, err := NewProvider(config)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = p
+	}
+
+	return result, nil
+}
+
+func NewProvider(config ProviderConfig) (Provider, error) {
+	if config.Issuer == "" {
+		return nil, errors.New("provider must have an issuer")
+	}
+
+	var keys KeySet
+	switch {
+	case config.KeysFile != "":
+		static, err := ReadKeys(config.KeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keys of %s: %w", config.Issuer, err)
+		}
+		keys = static
+	case config.JWKSURL != "":
+		keys = NewKeyCache(config.JWKSURL)
+	default:
+		keys = newDiscoveryKeys(config.Issuer)
+	}
+
+	return NewKeysProvider(config, keys), nil
+}
+
+// Makes a provider that verifies tokens with keys, whatever config says about where its keys
+// come from.
+func NewKeysProvider(config ProviderConfig, keys KeySet) Provider {
+	if config.SubjectClaim == "" {
+		config.SubjectClaim = jwt.SubjectKey
+	}
+
+	return &jwtProvider{config, keys}
+}
+
+type jwtProvider struct {
+	config ProviderConfig
+	keys   KeySet
+}
+
+func (p *jwtProvider) Issuer() string {
+	return p.config.Issuer
+}
+
+// Verifies an access token and returns the subject it identifies.
+// Returns ErrKeysUnavailable if the keys to verify it with could not be fetched.
+func (p *jwtProvider) Verify(ctx context.Context, token []byte) (string, error) {
+	msg, err := jws.Parse(token)
+	if err != nil || len(msg.Signatures()) == 0 {
+		return "", errors.New("access token is not signed")
+	}
+
+	set, err := p.keys.Keys(ctx, msg.Signatures()[0].ProtectedHeaders().KeyID())
+	if err != nil {
+		return "", err
+	}
+
+	options := []jwt.ParseOption{
+		jwt.WithKeySet(set),
+		jwt.WithValidate(true),
+		jwt.WithIssuer(p.config.Issuer),
+		jwt.WithAcceptableSkew(time.Minute),
+	}
+	if p.config.Audience != "" {
+		options = append(options, jwt.WithAudience(p.config.Audience))
+	}
+
+	// static keys rarely have an id or algorithm. That is only safe to make up for when there is
+	// a single key to verify with, anything else has to name the key and algorithm it is for.
+	if _, static := p.keys.(*staticKeys); static && set.Len() == 1 {
+		options = append(options, jwt.UseDefaultKey(true), jwt.InferAlgorithmFromKey(true))
+	}
+
+	parsed, err := jwt.Parse(token, options...)
+	if err != nil {
+		return "", err
+	}
+
+	if p.config.SubjectClaim == jwt.SubjectKey {
+		if parsed.Subject() == "" {
+			return "", errors.New("access token has no subject")
+		}
+		return parsed.Subject(), nil
+	}
+
+	claim, _ := parsed.Get(p.config.SubjectClaim)
+	subject, ok := claim.(string)
+	if !ok || subject == "" {
+		return "", fmt.Errorf("access token has no %s claim", p.config.SubjectClaim)
+	}
+
+	return subject, nil
+}
+
+func (p *jwtProvider) ProfileId(subject string) string {
+	if p.config.LegacySubject {
+		return subject
+	}
+
+	return ProfileId(p.config.Issuer, subject)
+}
+
+func (p *jwtProvider) Refresh(ctx context.Context) error {
+	return p.keys.Refresh(ctx)
+}
+
+// Keys that never change, for issuers without a JWKS url.
+type staticKeys struct {
+	set jwk.Set
+}
+
+// Reads keys from a file of PEM encoded public keys, or of a JWK or JWK set.
+func ReadKeys(path string) (KeySet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	isJSON := bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+	set, err := jwk.Parse(data, jwk.WithPEM(!isJSON))
+	if err != nil {
+		return nil, err
+	}
+
+	if set.Len() == 0 {
+		return nil, errors.New("no keys found")
+	}
+
+	return NewStaticKeys(set), nil
+}
+
+func NewStaticKeys(set jwk.Set) KeySet {
+	return &staticKeys{set}
+}
+
+func (k *staticKeys) Keys(ctx context.Context, kid string) (jwk.Set, error) {
+	return k.set, nil
+}
+
+func (k *staticKeys) Refresh(ctx context.Context) error {
+	return nil
+}
+
+// Keys of an OpenID Connect issuer, found through its discovery document. The document is
+// fetched when the keys are first needed, so the issuer does not have to be up when the api
+// starts.
+type discoveryKeys struct {
+	issuer string
+	client *http.Client
+
+	mu        sync.Mutex
+	attempted time.Time
+	keys      *KeyCache
+}
+
+func newDiscoveryKeys(issuer string) *discoveryKeys {
+	return &discoveryKeys{issuer: issuer, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (k *discoveryKeys) Keys(ctx context.Context, kid string) (jwk.Set, error) {
+	keys := k.discover(ctx)
+	if keys == nil {
+		return nil, ErrKeysUnavailable
+	}
+
+	return keys.Keys(ctx, kid)
+}
+
+func (k *discoveryKeys) Refresh(ctx context.Context) error {
+	keys := k.discover(ctx)
+	if keys == nil {
+		return ErrKeysUnavailable
+	}
+
+	return keys.Refresh(ctx)
+}
+
+func (k *discoveryKeys) discover(ctx context.Context) *KeyCache {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.keys != nil || time.Since(k.attempted) < minKeyRefreshInterval {
+		return k.keys
+	}
+	k.attempted = time.Now()
+
+	jwksURL, err := k.fetchJWKSURL(ctx)
+	if err != nil {
+		log.Printf("failed to discover json web keys of %s: %v", k.issuer, err)
+		return nil
+	}
+
+	k.keys = NewKeyCache(jwksURL)
+
+	return k.keys
+}
+
+func (k *discoveryKeys) fetchJWKSURL(ctx context.Context) (string, error) {
+	url := strings.TrimSuffix(k.issuer, "/") + "/.well-known/openid-configuration"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := k.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("discovery document returned %s", res.Status)
+	}
+
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return "", fmt.Errorf("invalid discovery document: %w", err)
+	}
+
+	// the issuer must be the one the document is for, or tokens could be accepted from another
+	if doc.Issuer != k.issuer {
+		return "", fmt.Errorf("discovery document is for issuer %q", doc.Issuer)
+	}
+
+	if doc.JWKSURI == "" {
+		return "", errors.New("discovery document has no jwks_uri")
+	}
+
+	return doc.JWKSURI, nil
+}
@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Validate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// a provider with a JWKS url
+	signing := newSigningKey(t, "first")
+	server := &jwksServer{}
+	server.set(false, signing)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	jwksProvider, err := NewProvider(ProviderConfig{Issuer: "test-issuer", Audience: "test-audience", JWKSURL: ts.URL})
+	assert.NoError(t, err)
+
+	// a self hosted provider with a static PEM key and no key ids, identifying users by email
+	raw, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&raw.PublicKey)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "keys.pem")
+	assert.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+
+	staticProvider, err := NewProvider(ProviderConfig{Issuer: "self-hosted", KeysFile: path, SubjectClaim: "email"})
+	assert.NoError(t, err)
+
+	// the Auth0 tenant users signed in with before there were other issuers
+	legacyKeys := jwk.NewSet()
+	public, err := jwk.PublicKeyOf(signing)
+	assert.NoError(t, err)
+	legacyKeys.Add(public)
+	legacyProvider := NewKeysProvider(ProviderConfig{Issuer: "legacy", LegacySubject: true}, NewStaticKeys(legacyKeys))
+
+	// a provider whose keys can't be fetched
+	down := httptest.NewServer(server)
+	down.Close()
+	downProvider, err := NewProvider(ProviderConfig{Issuer: "down", JWKSURL: down.URL})
+	assert.NoError(t, err)
+
+	r := gin.New()
+	r.Use(Validate([]Provider{jwksProvider, staticProvider, legacyProvider, downProvider}, nil))
+	r.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("sub"))
+	})
+
+	get := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get(newAccessToken(t, signing, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "test-issuer#test-id", w.Body.String())
+
+	unsigned := jwt.New()
+	unsigned.Set(jwt.IssuerKey, "self-hosted")
+	unsigned.Set(jwt.SubjectKey, "ignored")
+	unsigned.Set("email", "cook@example.com")
+	token, err := jwt.Sign(unsigned, jwa.RS256, raw)
+	assert.NoError(t, err)
+	w = get(string(token))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "self-hosted#cook@example.com", w.Body.String())
+
+	w = get(newAccessToken(t, signing, map[string]interface{}{jwt.IssuerKey: "legacy"}))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "test-id", w.Body.String())
+
+	// tokens of providers with a JWKS have to name their key, even when there is only one
+	var rawSigning rsa.PrivateKey
+	assert.NoError(t, signing.Raw(&rawSigning))
+	noKid := jwt.New()
+	noKid.Set(jwt.IssuerKey, "test-issuer")
+	noKid.Set(jwt.AudienceKey, "test-audience")
+	noKid.Set(jwt.SubjectKey, "test-id")
+	token, err = jwt.Sign(noKid, jwa.RS256, &rawSigning)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, get(string(token)).Code)
+
+	assert.Equal(t, http.StatusServiceUnavailable, get(newAccessToken(t, signing, map[string]interface{}{jwt.IssuerKey: "down"})).Code)
+
+	// unknown issuers, issuers with the wrong keys, wrong audiences and missing subjects
+	assert.Equal(t, http.StatusBadRequest, get(newAccessToken(t, signing, map[string]interface{}{jwt.IssuerKey: "unknown"})).Code)
+	assert.Equal(t, http.StatusBadRequest, get(newAccessToken(t, signing, map[string]interface{}{jwt.IssuerKey: "self-hosted", "email": "cook@example.com"})).Code)
+	assert.Equal(t, http.StatusBadRequest, get(newAccessToken(t, signing, map[string]interface{}{jwt.AudienceKey: "other"})).Code)
+	assert.Equal(t, http.StatusBadRequest, get(newAccessToken(t, signing, map[string]interface{}{jwt.SubjectKey: ""})).Code)
+	assert.Equal(t, http.StatusBadRequest, get(newAccessToken(t, newSigningKey(t, "forged"), nil)).Code)
+	assert.Equal(t, http.StatusBadRequest, get("not a token").Code)
+}
+
+func Test_DiscoveryProvider(t *testing.T) {
+	signing := newSigningKey(t, "first")
+	server := &jwksServer{}
+	server.set(false, signing)
+
+	mux := http.NewServeMux()
+	mux.Handle("/jwks.json", server)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	issuer := ts.URL + "/"
+	discovery := func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": issuer, "jwks_uri": ts.URL + "/jwks.json"})
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", discovery)
+	mux.HandleFunc("/other/.well-known/openid-configuration", discovery)
+
+	p, err := NewProvider(ProviderConfig{Issuer: issuer})
+	assert.NoError(t, err)
+
+	subject, err := p.Verify(context.Background(), []byte(newAccessToken(t, signing, map[string]interface{}{jwt.IssuerKey: issuer})))
+	assert.NoError(t, err)
+	assert.Equal(t, "test-id", subject)
+
+	// the discovery document must be for the issuer
+	other, err := NewProvider(ProviderConfig{Issuer: ts.URL + "/other"})
+	assert.NoError(t, err)
+	_, err = other.Verify(context.Background(), []byte(newAccessToken(t, signing, map[string]interface{}{jwt.IssuerKey: ts.URL + "/other"})))
+	assert.ErrorIs(t, err, ErrKeysUnavailable)
+}
+
+func Test_ProvidersFromEnv(t *testing.T) {
+	defer os.Unsetenv("AUTH_PROVIDERS")
+	defer os.Unsetenv("AUTH0_DOMAIN")
+
+	os.Setenv("AUTH0_DOMAIN", "tenant.auth0.com")
+	providers, err := ProvidersFromEnv()
+	assert.NoError(t, err)
+	assert.Len(t, providers, 1)
+	assert.Equal(t, "https://tenant.auth0.com/", providers[0].Issuer())
+	assert.Equal(t, "auth0|test-id", providers[0].ProfileId("auth0|test-id"))
+
+	os.Setenv("AUTH_PROVIDERS", `[{"issuer": "https://a.example.com"}, {"issuer": "https://b.example.com", "jwks_url": "https://b.example.com/keys"}]`)
+	providers, err = ProvidersFromEnv()
+	assert.NoError(t, err)
+	assert.Len(t, providers, 2)
+	assert.Equal(t, "https://a.example.com#test-id", providers[0].ProfileId("test-id"))
+
+	os.Setenv("AUTH_PROVIDERS", `[{"issuer": "https://a.example.com"}, {"issuer": "https://a.example.com"}]`)
+	_, err = ProvidersFromEnv()
+	assert.Error(t, err)
+
+	os.Setenv("AUTH_PROVIDERS", `[{"audience": "rh"}]`)
+	_, err = ProvidersFromEnv()
+	assert.Error(t, err)
+
+	// local accounts may be the only way to sign in
+	os.Unsetenv("AUTH_PROVIDERS")
+	os.Unsetenv("AUTH0_DOMAIN")
+	providers, err = ProvidersFromEnv()
+	assert.NoError(t, err)
+	assert.Empty(t, providers)
+}
+
+// keys in a JWK set file are read as they are
+func Test_ReadKeys(t *testing.T) {
+	set := jwk.NewSet()
+	public, _ := jwk.PublicKeyOf(newSigningKey(t, "first"))
+	set.Add(public)
+	data, _ := json.Marshal(set)
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	assert.NoError(t, ioutil.WriteFile(path, data, 0600))
+
+	keys, err := ReadKeys(path)
+	assert.NoError(t, err)
+	result, err := keys.Keys(context.Background(), "first")
+	assert.NoError(t, err)
+	_, ok := result.LookupKeyID("first")
+	assert.True(t, ok)
+
+	_, err = ReadKeys(filepath.Join(t.TempDir(), "missing.pem"))
+	assert.Error(t, err)
+}
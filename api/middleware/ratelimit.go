@@ -0,0 +1,184 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limit lets a principal make Requests requests at once, and Requests more every Per after.
+// The zero Limit doesn't limit anything.
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (l Limit) unlimited() bool {
+	return l.Requests <= 0 || l.Per <= 0
+}
+
+// Reads a limit like {"requests": 30, "per": "1m"}.
+func (l *Limit) UnmarshalJSON(data []byte) error {
+	var input struct {
+		Requests int    `json:"requests"`
+		Per      string `json:"per"`
+	}
+	if err := json.Unmarshal(data, &input); err != nil {
+		return err
+	}
+
+	l.Requests = input.Requests
+	l.Per = 0
+	if input.Per != "" {
+		per, err := time.ParseDuration(input.Per)
+		if err != nil {
+			return fmt.Errorf("invalid per: %w", err)
+		}
+		l.Per = per
+	}
+
+	return nil
+}
+
+// RateLimits are the limits of a group of routes for each kind of principal. Users are limited
+// by profile, personal access tokens each have their own limit, and requests without either by
+// client ip.
+type RateLimits struct {
+	User      Limit `json:"user"`
+	Token     Limit `json:"token"`
+	Anonymous Limit `json:"anonymous"`
+}
+
+// DefaultRateLimits are the limits of each group of routes unless RATE_LIMITS changes them.
+var DefaultRateLimits = map[string]RateLimits{
+	// signing in and registering, before there is an access token
+	"auth": {Anonymous: Limit{Requests: 10, Per: time.Minute}},
+
+	// every end point that requires an access token, by client ip before the token is validated
+	// so requests with made up tokens are limited too, many users can share an ip
+	"validate": {Anonymous: Limit{Requests: 600, Per: time.Minute}},
+
+	// every end point that requires an access token
+	"api": {User: Limit{Requests: 300, Per: time.Minute}, Token: Limit{Requests: 120, Per: time.Minute}},
+
+	// every end point that requires an access token and changes something
+	"write": {User: Limit{Requests: 60, Per: time.Minute}, Token: Limit{Requests: 30, Per: time.Minute}},
+
+	// end points that upload images
+	"images": {User: Limit{Requests: 10, Per: time.Minute}, Token: Limit{Requests: 10, Per: time.Minute}},
+}
+
+// Gets the limits of each group of routes, DefaultRateLimits with the groups in RATE_LIMITS, a
+// json object of RateLimits keyed by group, replacing theirs. A group set to {} is not limited.
+func RateLimitsFromEnv() (map[string]RateLimits, error) {
+	result := make(map[string]RateLimits, len(DefaultRateLimits))
+	for group, limits := range DefaultRateLimits {
+		result[group] = limits
+	}
+
+	if value := os.Getenv("RATE_LIMITS"); value != "" {
+		var configured map[string]RateLimits
+		if err := json.Unmarshal([]byte(value), &configured); err != nil {
+			return nil, fmt.Errorf("invalid RATE_LIMITS: %w", err)
+		}
+
+		for group, limits := range configured {
+			result[group] = limits
+		}
+	}
+
+	return result, nil
+}
+
+// RateLimiter limits how often each principal can use each group of routes.
+type RateLimiter struct {
+	store  RateLimitStore
+	groups map[string]RateLimits
+	now    func() time.Time
+}
+
+func NewRateLimiter(store RateLimitStore, groups map[string]RateLimits) *RateLimiter {
+	return &RateLimiter{store, groups, time.Now}
+}
+
+// Limit takes a token from the bucket the principal of a request has for group, answering with
+// 429 when it is empty. The RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers
+// describe the bucket, and Retry-After says when to try again. Users and personal access tokens
+// are only told apart after Validate, before it every request is limited by client ip, as the
+// engine determines it.
+//
+// A route in more than one group takes a token from each, the headers are those of the group
+// limited last.
+func (l *RateLimiter) Limit(group string) gin.HandlerFunc {
+	limits := l.groups[group]
+
+	return func(c *gin.Context) {
+		kind, id, limit := principal(c, limits)
+		if limit.unlimited() {
+			c.Next()
+			return
+		}
+
+		result, err := l.store.Take(group+"|"+kind+":"+id, limit, l.now())
+		if err != nil {
+			// a store that can't be reached shouldn't take the api down with it
+			log.Printf("failed to take rate limit token: %v", err)
+			c.Next()
+			return
+		}
+
+		c.Header("RateLimit-Limit", strconv.Itoa(limit.Requests))
+		c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("RateLimit-Reset", ceilSeconds(result.Reset))
+
+		if !result.Allowed {
+			c.Header("Retry-After", ceilSeconds(result.RetryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"msg": "too many requests, try again later",
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// LimitWrites is Limit for requests other than GET, HEAD and OPTIONS, so every route of a group
+// that changes something is limited without listing each of them.
+func (l *RateLimiter) LimitWrites(group string) gin.HandlerFunc {
+	limit := l.Limit(group)
+
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+		default:
+			limit(c)
+		}
+	}
+}
+
+// the kind of principal that made a request, who it is and their limit
+func principal(c *gin.Context, limits RateLimits) (string, string, Limit) {
+	if id, ok := c.Get("token"); ok {
+		return "token", fmt.Sprint(id), limits.Token
+	}
+
+	if sub := c.GetString("sub"); sub != "" {
+		return "user", sub, limits.User
+	}
+
+	return "ip", c.ClientIP(), limits.Anonymous
+}
+
+// headers count whole seconds, rounding up so clients don't retry too early
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
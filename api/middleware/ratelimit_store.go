@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// how often the memory store forgets the buckets that have refilled
+const bucketSweepInterval = time.Minute
+
+// RateLimitStore keeps a token bucket for each key. It is an interface so instances of the api
+// can share their buckets through a store of their own.
+type RateLimitStore interface {
+	// Takes a token from the bucket of key for a request made at now. The bucket holds up to
+	// limit.Requests tokens, starts full and refills completely every limit.Per.
+	Take(key string, limit Limit, now time.Time) (RateLimitResult, error)
+}
+
+// RateLimitResult is whether a request was allowed and the state of its bucket afterwards.
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+
+	// until the bucket has a token again, when the request was not allowed
+	RetryAfter time.Duration
+
+	// until the bucket is full again
+	Reset time.Duration
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// MemoryStore keeps token buckets in memory, so they are per instance and lost on restart.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]*bucket{}}
+}
+
+// Takes a token from the bucket of key for a request made at now.
+func (s *MemoryStore) Take(key string, limit Limit, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	capacity := float64(limit.Requests)
+	perSecond := capacity / limit.Per.Seconds()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		s.buckets[key] = b
+	}
+
+	// requests may be handled slightly out of order, a bucket never refills backwards
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = math.Min(capacity, b.tokens+elapsed.Seconds()*perSecond)
+		b.updated = now
+	}
+
+	var result RateLimitResult
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.tokens) / perSecond)
+	}
+
+	result.Remaining = int(b.tokens)
+	result.Reset = seconds((capacity - b.tokens) / perSecond)
+	b.full = b.updated.Add(result.Reset)
+
+	s.sweep(now)
+
+	return result, nil
+}
+
+// forgets the buckets that are full by now, they are the same as new ones
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.swept) < bucketSweepInterval {
+		return
+	}
+	s.swept = now
+
+	for key, b := range s.buckets {
+		if !b.full.After(now) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,168 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type failingStore struct{}
+
+func (failingStore) Take(key string, limit Limit, now time.Time) (RateLimitResult, error) {
+	return RateLimitResult{}, errors.New("unreachable")
+}
+
+func Test_MemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	limit := Limit{Requests: 2, Per: 10 * time.Second}
+	start := time.Unix(1700000000, 0)
+
+	result, _ := s.Take("a", limit, start)
+	assert.Equal(t, RateLimitResult{Allowed: true, Remaining: 1, Reset: 5 * time.Second}, result)
+	result, _ = s.Take("a", limit, start)
+	assert.Equal(t, RateLimitResult{Allowed: true, Remaining: 0, Reset: 10 * time.Second}, result)
+
+	result, _ = s.Take("a", limit, start.Add(time.Second))
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 4*time.Second, result.RetryAfter)
+
+	// other keys have buckets of their own
+	result, _ = s.Take("b", limit, start.Add(time.Second))
+	assert.True(t, result.Allowed)
+
+	result, _ = s.Take("a", limit, start.Add(5*time.Second))
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+
+	// refilled buckets are forgotten
+	s.Take("c", limit, start.Add(time.Hour))
+	assert.Len(t, s.buckets, 1)
+}
+
+func Test_RateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	limiter := NewRateLimiter(NewMemoryStore(), map[string]RateLimits{
+		"write": {
+			User:      Limit{Requests: 2, Per: time.Minute},
+			Token:     Limit{Requests: 1, Per: time.Minute},
+			Anonymous: Limit{Requests: 1, Per: time.Hour},
+		},
+	})
+	now := time.Unix(1700000000, 0)
+	limiter.now = func() time.Time { return now }
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		if sub := c.GetHeader("X-Sub"); sub != "" {
+			c.Set("sub", sub)
+		}
+		if token := c.GetHeader("X-Token"); token != "" {
+			c.Set("token", token)
+		}
+	})
+	ok := func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	}
+	r.POST("/recipes", limiter.Limit("write"), ok)
+	r.GET("/recipes", limiter.Limit("read"), ok)
+
+	send := func(method string, sub string, token string, ip string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/recipes", nil)
+		req.Header.Set("X-Sub", sub)
+		req.Header.Set("X-Token", token)
+		req.RemoteAddr = ip + ":1234"
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send(http.MethodPost, "cook-id", "", "10.0.0.1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", w.Header().Get("RateLimit-Reset"))
+
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "cook-id", "", "10.0.0.1").Code)
+	w = send(http.MethodPost, "cook-id", "", "10.0.0.2")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+	// personal access tokens of the same user have limits of their own
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "cook-id", "1", "10.0.0.1").Code)
+	assert.Equal(t, http.StatusTooManyRequests, send(http.MethodPost, "cook-id", "1", "10.0.0.1").Code)
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "cook-id", "2", "10.0.0.1").Code)
+
+	// anonymous requests are limited by ip
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "", "", "10.0.0.1").Code)
+	assert.Equal(t, http.StatusTooManyRequests, send(http.MethodPost, "", "", "10.0.0.1").Code)
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "", "", "10.0.0.2").Code)
+
+	// groups without limits let everything through
+	w = send(http.MethodGet, "cook-id", "", "10.0.0.1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "cook-id", "", "10.0.0.1").Code)
+
+	// a store that fails lets requests through
+	limiter.store = failingStore{}
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "", "", "10.0.0.1").Code)
+}
+
+func Test_LimitWrites(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	limiter := NewRateLimiter(NewMemoryStore(), map[string]RateLimits{
+		"write": {Anonymous: Limit{Requests: 1, Per: time.Hour}},
+	})
+
+	r := gin.New()
+	r.Use(limiter.LimitWrites("write"))
+	ok := func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	}
+	r.GET("/groups/:id", ok)
+	r.PUT("/groups/:id", ok)
+	r.DELETE("/groups/:id", ok)
+
+	send := func(method string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, "/groups/1", nil))
+		return w.Code
+	}
+
+	// every write of the group shares the bucket, reads don't take from it
+	assert.Equal(t, http.StatusOK, send(http.MethodGet))
+	assert.Equal(t, http.StatusOK, send(http.MethodPut))
+	assert.Equal(t, http.StatusTooManyRequests, send(http.MethodDelete))
+	assert.Equal(t, http.StatusOK, send(http.MethodGet))
+}
+
+func Test_RateLimitsFromEnv(t *testing.T) {
+	defer os.Unsetenv("RATE_LIMITS")
+
+	limits, err := RateLimitsFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultRateLimits, limits)
+
+	os.Setenv("RATE_LIMITS", `{"write": {"user": {"requests": 5, "per": "10s"}}, "images": {}}`)
+	limits, err = RateLimitsFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, RateLimits{User: Limit{Requests: 5, Per: 10 * time.Second}}, limits["write"])
+	assert.Equal(t, RateLimits{}, limits["images"])
+	assert.Equal(t, DefaultRateLimits["api"], limits["api"])
+	assert.Equal(t, Limit{Requests: 120, Per: time.Minute}, DefaultRateLimits["api"].Token)
+
+	os.Setenv("RATE_LIMITS", `{"write": {"user": {"requests": 5, "per": "soon"}}}`)
+	_, err = RateLimitsFromEnv()
+	assert.Error(t, err)
+}
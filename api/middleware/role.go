@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/eciccone/rh/api/service"
+	"github.com/gin-gonic/gin"
+)
+
+// RequireRole requires the user's profile to have role or one that can do more, it must come
+// after Profile.
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !service.HasRole(c.GetString("role"), role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"msg": "requires " + role + " role",
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
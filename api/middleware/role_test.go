@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eciccone/rh/api/repo/profile"
+	"github.com/eciccone/rh/api/service"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// fetches the profile whose id is the sub set by the test
+type profileServiceStub struct {
+	service.ProfileService
+	profiles map[string]profile.Profile
+}
+
+func (s *profileServiceStub) FetchProfile(id string) (profile.Profile, error) {
+	p, ok := s.profiles[id]
+	if !ok {
+		return profile.Profile{}, service.ErrNoProfile
+	}
+	return p, nil
+}
+
+func Test_RequireRole(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	ps := &profileServiceStub{profiles: map[string]profile.Profile{
+		"admin-id":     {Username: "admin", Role: service.RoleAdmin},
+		"moderator-id": {Username: "moderator", Role: service.RoleModerator},
+		"cook-id":      {Username: "cook", Role: service.RoleUser},
+		"spammer-id":   {Username: "spammer", Role: service.RoleUser, Suspended: true},
+	}}
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("sub", c.GetHeader("X-Sub"))
+	})
+	r.Use(Profile(ps))
+	ok := func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("username"))
+	}
+	r.GET("/recipes", ok)
+	r.GET("/admin/profiles", RequireRole(service.RoleModerator), ok)
+	r.GET("/admin/stats", RequireRole(service.RoleAdmin), ok)
+
+	get := func(path string, sub string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Sub", sub)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, get("/recipes", "cook-id"))
+	assert.Equal(t, http.StatusForbidden, get("/admin/profiles", "cook-id"))
+	assert.Equal(t, http.StatusOK, get("/admin/profiles", "moderator-id"))
+	assert.Equal(t, http.StatusForbidden, get("/admin/stats", "moderator-id"))
+	assert.Equal(t, http.StatusOK, get("/admin/stats", "admin-id"))
+
+	// suspended profiles can't use anything behind Profile
+	assert.Equal(t, http.StatusForbidden, get("/recipes", "spammer-id"))
+	assert.Equal(t, http.StatusNotFound, get("/recipes", "nobody-id"))
+}
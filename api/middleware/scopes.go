@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scopes is the scope a personal access token needs for each end point it can use, keyed by
+// method and route, e.g. "GET /recipes/:id".
+type Scopes map[string]string
+
+// RequireScopes limits requests made with a personal access token to the end points in scopes,
+// and only when the token carries the scope they need. Any other end point can only be used
+// with an access token from a provider, so tokens can't manage the profile they belong to.
+func RequireScopes(scopes Scopes) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		granted, ok := c.Get("scopes")
+		if !ok {
+			// access tokens from providers can do anything the user can
+			c.Next()
+			return
+		}
+
+		required, ok := scopes[c.Request.Method+" "+c.FullPath()]
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"msg": "personal access tokens can't be used here",
+			})
+			return
+		}
+
+		for _, scope := range granted.([]string) {
+			if scope == required {
+				c.Next()
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"msg":   "access token is missing scope " + required,
+			"scope": required,
+		})
+	}
+}
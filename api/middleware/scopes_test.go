@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eciccone/rh/api/repo/token"
+	"github.com/eciccone/rh/api/service"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// authenticates rhp_read, rhp_write and fails rhp_broken
+type tokenServiceStub struct {
+	service.TokenService
+}
+
+func (s *tokenServiceStub) Authenticate(raw string) (token.PersonalToken, error) {
+	switch raw {
+	case "rhp_read":
+		return token.PersonalToken{ProfileId: "test-issuer#test-id", Scopes: []string{service.ScopeRecipesRead}}, nil
+	case "rhp_write":
+		return token.PersonalToken{ProfileId: "test-issuer#test-id", Scopes: []string{service.ScopeRecipesRead, service.ScopeRecipesWrite}}, nil
+	case "rhp_broken":
+		return token.PersonalToken{}, errors.New("failed")
+	}
+	return token.PersonalToken{}, service.ErrInvalidPersonalToken
+}
+
+func Test_RequireScopes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	signing := newSigningKey(t, "first")
+	server := &jwksServer{}
+	server.set(false, signing)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	provider, err := NewProvider(ProviderConfig{Issuer: "test-issuer", Audience: "test-audience", JWKSURL: ts.URL})
+	assert.NoError(t, err)
+
+	r := gin.New()
+	r.Use(Validate([]Provider{provider}, &tokenServiceStub{}))
+	r.Use(RequireScopes(Scopes{
+		"GET /recipes/:id": service.ScopeRecipesRead,
+		"PUT /recipes/:id": service.ScopeRecipesWrite,
+	}))
+	ok := func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("sub"))
+	}
+	r.GET("/recipes/:id", ok)
+	r.PUT("/recipes/:id", ok)
+	r.GET("/profile", ok)
+
+	do := func(method string, path string, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodGet, "/recipes/1", "rhp_read")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "test-issuer#test-id", w.Body.String())
+
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPut, "/recipes/1", "rhp_read").Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "/recipes/1", "rhp_write").Code)
+
+	// end points without a scope are off limits to personal access tokens
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/profile", "rhp_write").Code)
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/recipes/1", "rhp_unknown").Code)
+	assert.Equal(t, http.StatusInternalServerError, do(http.MethodGet, "/recipes/1", "rhp_broken").Code)
+
+	// access tokens from providers can use every end point
+	jwt := newAccessToken(t, signing, nil)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/profile", jwt).Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "/recipes/1", jwt).Code)
+}
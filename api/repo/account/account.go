@@ -0,0 +1,24 @@
+package account
+
+import "time"
+
+// Account of a user who signs in with a username and password.
+type Account struct {
+	Id           string
+	Username     string
+	PasswordHash string
+	FailedLogins int
+	LockedUntil  time.Time
+	Created      time.Time
+}
+
+// RefreshToken is stored by the hash of the token, Id. Used tokens have been exchanged for new
+// ones of the same Family.
+type RefreshToken struct {
+	Id        string
+	AccountId string
+	Family    string
+	Used      bool
+	Expires   time.Time
+	Created   time.Time
+}
@@ -0,0 +1,176 @@
+package account
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eciccone/rh/api/repo"
+)
+
+type AccountRepository interface {
+	InsertAccount(a Account) (bool, error)
+	SelectAccountById(id string) (Account, error)
+	SelectAccountByUsername(username string) (Account, error)
+	UpdateAccountFailedLogin(id string, maxFailed int, lockedUntil time.Time) error
+	UpdateAccountLoggedIn(id string) error
+	UpdateAccountPassword(id string, passwordHash string) error
+
+	InsertRefreshToken(t RefreshToken) error
+	SelectRefreshToken(id string) (RefreshToken, error)
+	UpdateRefreshTokenUsed(id string) (bool, error)
+	DeleteRefreshTokenFamily(family string) error
+}
+
+type accountRepo struct {
+	db *sql.DB
+}
+
+func NewRepo(db *sql.DB) AccountRepository {
+	return &accountRepo{db}
+}
+
+// Inserts an account. Returns false if the username is already registered.
+func (r *accountRepo) InsertAccount(a Account) (bool, error) {
+	result, err := r.db.Exec("INSERT INTO account(id, username, passwordhash, created) VALUES (?, ?, ?, ?) ON CONFLICT(username) DO NOTHING",
+		a.Id, a.Username, a.PasswordHash, a.Created.Unix())
+	if err != nil {
+		return false, fmt.Errorf("InsertAccount failed to insert account: %w", err)
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("InsertAccount failed to get rows affected: %w", err)
+	}
+
+	return inserted > 0, nil
+}
+
+func (r *accountRepo) SelectAccountById(id string) (Account, error) {
+	return r.selectAccount("SELECT id, username, passwordhash, failedlogins, lockeduntil, created FROM account WHERE id = ?", id)
+}
+
+func (r *accountRepo) SelectAccountByUsername(username string) (Account, error) {
+	return r.selectAccount("SELECT id, username, passwordhash, failedlogins, lockeduntil, created FROM account WHERE username = ?", username)
+}
+
+func (r *accountRepo) selectAccount(query string, arg string) (Account, error) {
+	var result Account
+	var lockedUntil, created int64
+
+	err := r.db.QueryRow(query, arg).Scan(&result.Id, &result.Username, &result.PasswordHash, &result.FailedLogins, &lockedUntil, &created)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Account{}, err
+		}
+
+		return Account{}, fmt.Errorf("selectAccount failed to select account: %w", err)
+	}
+
+	if lockedUntil != 0 {
+		result.LockedUntil = time.Unix(lockedUntil, 0)
+	}
+	result.Created = time.Unix(created, 0)
+
+	return result, nil
+}
+
+// Counts a failed login. The maxFailed-th one in a row locks the account until lockedUntil and
+// starts counting again.
+func (r *accountRepo) UpdateAccountFailedLogin(id string, maxFailed int, lockedUntil time.Time) error {
+	_, err := r.db.Exec("UPDATE account SET lockeduntil = CASE WHEN failedlogins + 1 >= ? THEN ? ELSE lockeduntil END, failedlogins = CASE WHEN failedlogins + 1 >= ? THEN 0 ELSE failedlogins + 1 END WHERE id = ?",
+		maxFailed, lockedUntil.Unix(), maxFailed, id)
+	if err != nil {
+		return fmt.Errorf("UpdateAccountFailedLogin failed to update account: %w", err)
+	}
+
+	return nil
+}
+
+// Forgets the failed logins of an account.
+func (r *accountRepo) UpdateAccountLoggedIn(id string) error {
+	_, err := r.db.Exec("UPDATE account SET failedlogins = 0, lockeduntil = 0 WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("UpdateAccountLoggedIn failed to update account: %w", err)
+	}
+
+	return nil
+}
+
+// Changes the password of an account and revokes all of its refresh tokens.
+func (r *accountRepo) UpdateAccountPassword(id string, passwordHash string) error {
+	return repo.Tx(r.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE account SET passwordhash = ? WHERE id = ?", passwordHash, id); err != nil {
+			return fmt.Errorf("UpdateAccountPassword failed to update account: %w", err)
+		}
+
+		if _, err := tx.Exec("DELETE FROM refresh_token WHERE accountid = ?", id); err != nil {
+			return fmt.Errorf("UpdateAccountPassword failed to delete refresh tokens: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// Inserts a refresh token, deleting the ones of the account that expired before it was created.
+func (r *accountRepo) InsertRefreshToken(t RefreshToken) error {
+	return repo.Tx(r.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM refresh_token WHERE accountid = ? AND expires < ?", t.AccountId, t.Created.Unix()); err != nil {
+			return fmt.Errorf("InsertRefreshToken failed to delete expired refresh tokens: %w", err)
+		}
+
+		if _, err := tx.Exec("INSERT INTO refresh_token(id, accountid, family, expires, created) VALUES (?, ?, ?, ?, ?)",
+			t.Id, t.AccountId, t.Family, t.Expires.Unix(), t.Created.Unix()); err != nil {
+			return fmt.Errorf("InsertRefreshToken failed to insert refresh token: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func (r *accountRepo) SelectRefreshToken(id string) (RefreshToken, error) {
+	var result RefreshToken
+	var expires, created int64
+
+	err := r.db.QueryRow("SELECT id, accountid, family, used, expires, created FROM refresh_token WHERE id = ?", id).
+		Scan(&result.Id, &result.AccountId, &result.Family, &result.Used, &expires, &created)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return RefreshToken{}, err
+		}
+
+		return RefreshToken{}, fmt.Errorf("SelectRefreshToken failed to select refresh token: %w", err)
+	}
+
+	result.Expires = time.Unix(expires, 0)
+	result.Created = time.Unix(created, 0)
+
+	return result, nil
+}
+
+// Marks a refresh token used. Returns false if it already was, so a token can only be exchanged
+// once even by concurrent requests.
+func (r *accountRepo) UpdateRefreshTokenUsed(id string) (bool, error) {
+	result, err := r.db.Exec("UPDATE refresh_token SET used = 1 WHERE id = ? AND used = 0", id)
+	if err != nil {
+		return false, fmt.Errorf("UpdateRefreshTokenUsed failed to update refresh token: %w", err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("UpdateRefreshTokenUsed failed to get rows affected: %w", err)
+	}
+
+	return updated > 0, nil
+}
+
+// Revokes every refresh token rotated from the same login.
+func (r *accountRepo) DeleteRefreshTokenFamily(family string) error {
+	_, err := r.db.Exec("DELETE FROM refresh_token WHERE family = ?", family)
+	if err != nil {
+		return fmt.Errorf("DeleteRefreshTokenFamily failed to delete refresh tokens: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package account
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_InsertAccount(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	ar := NewRepo(db)
+	created := time.Unix(1700000000, 0)
+
+	mock.ExpectExec("INSERT INTO account(id, username, passwordhash, created) VALUES (?, ?, ?, ?) ON CONFLICT(username) DO NOTHING").
+		WithArgs("test-id", "cook", "hash", created.Unix()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO account(id, username, passwordhash, created) VALUES (?, ?, ?, ?) ON CONFLICT(username) DO NOTHING").
+		WithArgs("other-id", "cook", "hash", created.Unix()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	inserted, err := ar.InsertAccount(Account{Id: "test-id", Username: "cook", PasswordHash: "hash", Created: created})
+	assert.NoError(t, err)
+	assert.True(t, inserted)
+
+	inserted, err = ar.InsertAccount(Account{Id: "other-id", Username: "cook", PasswordHash: "hash", Created: created})
+	assert.NoError(t, err)
+	assert.False(t, inserted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectAccount(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	ar := NewRepo(db)
+	columns := []string{"id", "username", "passwordhash", "failedlogins", "lockeduntil", "created"}
+
+	mock.ExpectQuery("SELECT id, username, passwordhash, failedlogins, lockeduntil, created FROM account WHERE username = ?").
+		WithArgs("cook").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("test-id", "cook", "hash", 2, 0, 1700000000))
+	mock.ExpectQuery("SELECT id, username, passwordhash, failedlogins, lockeduntil, created FROM account WHERE id = ?").
+		WithArgs("test-id").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("test-id", "cook", "hash", 0, 1700000900, 1700000000))
+	mock.ExpectQuery("SELECT id, username, passwordhash, failedlogins, lockeduntil, created FROM account WHERE id = ?").
+		WithArgs("missing").
+		WillReturnError(sql.ErrNoRows)
+
+	result, err := ar.SelectAccountByUsername("cook")
+	assert.NoError(t, err)
+	assert.Equal(t, Account{Id: "test-id", Username: "cook", PasswordHash: "hash", FailedLogins: 2, Created: time.Unix(1700000000, 0)}, result)
+
+	result, err = ar.SelectAccountById("test-id")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Unix(1700000900, 0), result.LockedUntil)
+
+	_, err = ar.SelectAccountById("missing")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateAccountLogins(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	ar := NewRepo(db)
+	lockedUntil := time.Unix(1700000900, 0)
+
+	mock.ExpectExec("UPDATE account SET lockeduntil = CASE WHEN failedlogins + 1 >= ? THEN ? ELSE lockeduntil END, failedlogins = CASE WHEN failedlogins + 1 >= ? THEN 0 ELSE failedlogins + 1 END WHERE id = ?").
+		WithArgs(5, lockedUntil.Unix(), 5, "test-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE account SET failedlogins = 0, lockeduntil = 0 WHERE id = ?").
+		WithArgs("test-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(t, ar.UpdateAccountFailedLogin("test-id", 5, lockedUntil))
+	assert.NoError(t, ar.UpdateAccountLoggedIn("test-id"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateAccountPassword(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	ar := NewRepo(db)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE account SET passwordhash = ? WHERE id = ?").
+		WithArgs("hash", "test-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM refresh_token WHERE accountid = ?").
+		WithArgs("test-id").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE account SET passwordhash = ? WHERE id = ?").
+		WithArgs("hash", "test-id").
+		WillReturnError(errors.New("failed"))
+	mock.ExpectRollback()
+
+	assert.NoError(t, ar.UpdateAccountPassword("test-id", "hash"))
+	assert.Error(t, ar.UpdateAccountPassword("test-id", "hash"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_RefreshTokens(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	ar := NewRepo(db)
+	token := RefreshToken{Id: "hash", AccountId: "test-id", Family: "family", Expires: time.Unix(1700086400, 0), Created: time.Unix(1700000000, 0)}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM refresh_token WHERE accountid = ? AND expires < ?").
+		WithArgs("test-id", token.Created.Unix()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO refresh_token(id, accountid, family, expires, created) VALUES (?, ?, ?, ?, ?)").
+		WithArgs("hash", "test-id", "family", token.Expires.Unix(), token.Created.Unix()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery("SELECT id, accountid, family, used, expires, created FROM refresh_token WHERE id = ?").
+		WithArgs("hash").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "accountid", "family", "used", "expires", "created"}).
+			AddRow("hash", "test-id", "family", false, token.Expires.Unix(), token.Created.Unix()))
+	mock.ExpectExec("UPDATE refresh_token SET used = 1 WHERE id = ? AND used = 0").
+		WithArgs("hash").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE refresh_token SET used = 1 WHERE id = ? AND used = 0").
+		WithArgs("hash").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM refresh_token WHERE family = ?").
+		WithArgs("family").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	assert.NoError(t, ar.InsertRefreshToken(token))
+
+	result, err := ar.SelectRefreshToken("hash")
+	assert.NoError(t, err)
+	assert.Equal(t, token, result)
+
+	used, err := ar.UpdateRefreshTokenUsed("hash")
+	assert.NoError(t, err)
+	assert.True(t, used)
+
+	used, err = ar.UpdateRefreshTokenUsed("hash")
+	assert.NoError(t, err)
+	assert.False(t, used)
+
+	assert.NoError(t, ar.DeleteRefreshTokenFamily("family"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
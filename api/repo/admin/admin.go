@@ -0,0 +1,51 @@
+package admin
+
+import "time"
+
+// AuditEntry records something a moderator or admin did to a profile or recipe.
+type AuditEntry struct {
+	Id            int       `json:"id"`
+	ActorId       string    `json:"actor_id"`
+	ActorUsername string    `json:"actor_username,omitempty"`
+	Action        string    `json:"action"`
+	TargetType    string    `json:"target_type"`
+	TargetId      string    `json:"target_id"`
+	Details       string    `json:"details,omitempty"`
+	Created       time.Time `json:"created"`
+}
+
+// Stats counts what is stored.
+type Stats struct {
+	Profiles          int `json:"profiles"`
+	SuspendedProfiles int `json:"suspended_profiles"`
+	DeletingProfiles  int `json:"deleting_profiles"`
+	Recipes           int `json:"recipes"`
+	PublicRecipes     int `json:"public_recipes"`
+	HiddenRecipes     int `json:"hidden_recipes"`
+	Images            int `json:"images"`
+	UnresolvedReports int `json:"unresolved_reports"`
+}
+
+// Report is a profile telling moderators that a recipe or profile is abusive.
+type Report struct {
+	Id               int       `json:"id"`
+	ReporterId       string    `json:"reporter_id,omitempty"`
+	ReporterUsername string    `json:"reporter_username,omitempty"`
+	TargetType       string    `json:"target_type"`
+	TargetId         string    `json:"target_id"`
+	OwnerId          string    `json:"-"`
+	Reason           string    `json:"reason"`
+	Details          string    `json:"details,omitempty"`
+	Status           string    `json:"status"`
+	Resolution       string    `json:"resolution,omitempty"`
+	HandlerId        string    `json:"handler_id,omitempty"`
+	Created          time.Time `json:"created"`
+	Updated          time.Time `json:"updated"`
+}
+
+// Moderation is what a moderator does about the content of a report when they action it. Neither
+// is done when the fields are zero.
+type Moderation struct {
+	HideRecipeId     int
+	SuspendProfileId string
+}
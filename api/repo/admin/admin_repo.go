@@ -0,0 +1,102 @@
+package admin
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type AdminRepository interface {
+	InsertAuditEntry(entry AuditEntry) error
+	SelectAuditEntries(offset int, limit int) ([]AuditEntry, error)
+	SelectAuditEntryCount() (int, error)
+	SelectStats() (Stats, error)
+
+	UpdateProfileSuspended(id string, suspended bool, entry AuditEntry) error
+	UpdateProfileRole(id string, role string, entry AuditEntry) error
+	UpdateRecipeHidden(id int, hidden bool, entry AuditEntry) error
+	DeleteRecipe(id int, entry AuditEntry) error
+
+	InsertReport(report Report) (Report, bool, error)
+	SelectReports(statuses []string, offset int, limit int) ([]Report, error)
+	SelectReportCount(statuses []string) (int, error)
+	SelectReportsByOwner(ownerId string, offset int, limit int) ([]Report, error)
+	SelectReportCountByOwner(ownerId string) (int, error)
+	SelectReport(id int) (Report, error)
+	TriageReport(report Report, moderation Moderation, entries []AuditEntry) error
+}
+
+type adminRepo struct {
+	db *sql.DB
+}
+
+func NewRepo(db *sql.DB) AdminRepository {
+	return &adminRepo{db}
+}
+
+func (r *adminRepo) InsertAuditEntry(entry AuditEntry) error {
+	_, err := r.db.Exec("INSERT INTO audit_log(actorid, action, targettype, targetid, details, created) VALUES (?, ?, ?, ?, ?, ?)",
+		entry.ActorId, entry.Action, entry.TargetType, entry.TargetId, entry.Details, entry.Created.Unix())
+	if err != nil {
+		return fmt.Errorf("InsertAuditEntry failed to insert entry: %w", err)
+	}
+
+	return nil
+}
+
+// Selects a page of the audit log, most recent first, with the current username of each actor
+// whose profile still exists.
+func (r *adminRepo) SelectAuditEntries(offset int, limit int) ([]AuditEntry, error) {
+	rows, err := r.db.Query(`SELECT audit_log.id, audit_log.actorid, COALESCE(profile.username, ''), audit_log.action, audit_log.targettype, audit_log.targetid, audit_log.details, audit_log.created
+		FROM audit_log LEFT JOIN profile ON profile.id = audit_log.actorid
+		ORDER BY audit_log.id DESC LIMIT ?, ?`, offset, limit)
+	if err != nil {
+		return nil, fmt.Errorf("SelectAuditEntries failed to select entries: %w", err)
+	}
+	defer rows.Close()
+
+	result := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var created int64
+		if err := rows.Scan(&e.Id, &e.ActorId, &e.ActorUsername, &e.Action, &e.TargetType, &e.TargetId, &e.Details, &created); err != nil {
+			return nil, fmt.Errorf("SelectAuditEntries failed to scan entry: %w", err)
+		}
+		e.Created = time.Unix(created, 0)
+		result = append(result, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectAuditEntries failed to iterate entries: %w", err)
+	}
+
+	return result, nil
+}
+
+func (r *adminRepo) SelectAuditEntryCount() (int, error) {
+	var count int
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM audit_log").Scan(&count); err != nil {
+		return 0, fmt.Errorf("SelectAuditEntryCount failed to count entries: %w", err)
+	}
+
+	return count, nil
+}
+
+func (r *adminRepo) SelectStats() (Stats, error) {
+	var s Stats
+	err := r.db.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM profile),
+		(SELECT COUNT(*) FROM profile WHERE suspended = 1),
+		(SELECT COUNT(*) FROM profile WHERE deleteafter <> 0),
+		(SELECT COUNT(*) FROM recipe),
+		(SELECT COUNT(*) FROM recipe WHERE visibility = 'public'),
+		(SELECT COUNT(*) FROM recipe WHERE hidden = 1),
+		(SELECT COUNT(*) FROM image),
+		(SELECT COUNT(*) FROM report WHERE status IN ('open', 'reviewing'))`).
+		Scan(&s.Profiles, &s.SuspendedProfiles, &s.DeletingProfiles, &s.Recipes, &s.PublicRecipes, &s.HiddenRecipes, &s.Images, &s.UnresolvedReports)
+	if err != nil {
+		return Stats{}, fmt.Errorf("SelectStats failed to count: %w", err)
+	}
+
+	return s, nil
+}
@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_InsertAuditEntry(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	ar := NewRepo(db)
+	created := time.Unix(1700000000, 0)
+
+	mock.ExpectExec("INSERT INTO audit_log(actorid, action, targettype, targetid, details, created) VALUES (?, ?, ?, ?, ?, ?)").
+		WithArgs("admin-id", "recipe.hide", "recipe", "4", "spam", created.Unix()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO audit_log(actorid, action, targettype, targetid, details, created) VALUES (?, ?, ?, ?, ?, ?)").
+		WithArgs("admin-id", "recipe.hide", "recipe", "4", "", created.Unix()).
+		WillReturnError(errors.New("failed"))
+
+	assert.NoError(t, ar.InsertAuditEntry(AuditEntry{ActorId: "admin-id", Action: "recipe.hide", TargetType: "recipe", TargetId: "4", Details: "spam", Created: created}))
+	assert.Error(t, ar.InsertAuditEntry(AuditEntry{ActorId: "admin-id", Action: "recipe.hide", TargetType: "recipe", TargetId: "4", Created: created}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectAuditEntries(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	ar := NewRepo(db)
+
+	mock.ExpectQuery(`SELECT audit_log.id, audit_log.actorid, COALESCE(profile.username, ''), audit_log.action, audit_log.targettype, audit_log.targetid, audit_log.details, audit_log.created
+		FROM audit_log LEFT JOIN profile ON profile.id = audit_log.actorid
+		ORDER BY audit_log.id DESC LIMIT ?, ?`).
+		WithArgs(0, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "actorid", "username", "action", "targettype", "targetid", "details", "created"}).
+			AddRow(2, "admin-id", "admin", "profile.suspend", "profile", "cook-id", "", 1700000000).
+			AddRow(1, "gone-id", "", "recipe.delete", "recipe", "4", "spam", 1690000000))
+	mock.ExpectQuery("SELECT COUNT(*) FROM audit_log").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+
+	result, err := ar.SelectAuditEntries(0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []AuditEntry{
+		{Id: 2, ActorId: "admin-id", ActorUsername: "admin", Action: "profile.suspend", TargetType: "profile", TargetId: "cook-id", Created: time.Unix(1700000000, 0)},
+		{Id: 1, ActorId: "gone-id", Action: "recipe.delete", TargetType: "recipe", TargetId: "4", Details: "spam", Created: time.Unix(1690000000, 0)},
+	}, result)
+
+	count, err := ar.SelectAuditEntryCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectStats(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	ar := NewRepo(db)
+
+	mock.ExpectQuery(`SELECT
+		(SELECT COUNT(*) FROM profile),
+		(SELECT COUNT(*) FROM profile WHERE suspended = 1),
+		(SELECT COUNT(*) FROM profile WHERE deleteafter <> 0),
+		(SELECT COUNT(*) FROM recipe),
+		(SELECT COUNT(*) FROM recipe WHERE visibility = 'public'),
+		(SELECT COUNT(*) FROM recipe WHERE hidden = 1),
+		(SELECT COUNT(*) FROM image),
+		(SELECT COUNT(*) FROM report WHERE status IN ('open', 'reviewing'))`).
+		WillReturnRows(sqlmock.NewRows([]string{"a", "b", "c", "d", "e", "f", "g", "h"}).AddRow(10, 1, 2, 30, 12, 3, 40, 5))
+
+	result, err := ar.SelectStats()
+	assert.NoError(t, err)
+	assert.Equal(t, Stats{Profiles: 10, SuspendedProfiles: 1, DeletingProfiles: 2, Recipes: 30, PublicRecipes: 12, HiddenRecipes: 3, Images: 40, UnresolvedReports: 5}, result)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,63 @@
+package admin
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/eciccone/rh/api/repo"
+)
+
+// Suspends a profile, or lifts its suspension, writing entry to the audit log along with it so
+// there is never one without the other. The same goes for every change moderators make.
+func (r *adminRepo) UpdateProfileSuspended(id string, suspended bool, entry AuditEntry) error {
+	return repo.Tx(r.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE profile SET suspended = ? WHERE id = ?", suspended, id); err != nil {
+			return fmt.Errorf("UpdateProfileSuspended failed to update profile: %w", err)
+		}
+
+		return insertAuditEntry(tx, entry)
+	})
+}
+
+// Changes the role of a profile, writing entry to the audit log along with it.
+func (r *adminRepo) UpdateProfileRole(id string, role string, entry AuditEntry) error {
+	return repo.Tx(r.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE profile SET role = ? WHERE id = ?", role, id); err != nil {
+			return fmt.Errorf("UpdateProfileRole failed to update profile: %w", err)
+		}
+
+		return insertAuditEntry(tx, entry)
+	})
+}
+
+// Hides a recipe, or shows it again, writing entry to the audit log along with it.
+func (r *adminRepo) UpdateRecipeHidden(id int, hidden bool, entry AuditEntry) error {
+	return repo.Tx(r.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE recipe SET hidden = ? WHERE id = ?", hidden, id); err != nil {
+			return fmt.Errorf("UpdateRecipeHidden failed to update recipe: %w", err)
+		}
+
+		return insertAuditEntry(tx, entry)
+	})
+}
+
+// Deletes a recipe whoever owns it, writing entry to the audit log along with it.
+func (r *adminRepo) DeleteRecipe(id int, entry AuditEntry) error {
+	return repo.Tx(r.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM recipe WHERE id = ?", id); err != nil {
+			return fmt.Errorf("DeleteRecipe failed to delete recipe: %w", err)
+		}
+
+		return insertAuditEntry(tx, entry)
+	})
+}
+
+func insertAuditEntry(tx *sql.Tx, entry AuditEntry) error {
+	_, err := tx.Exec("INSERT INTO audit_log(actorid, action, targettype, targetid, details, created) VALUES (?, ?, ?, ?, ?, ?)",
+		entry.ActorId, entry.Action, entry.TargetType, entry.TargetId, entry.Details, entry.Created.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to write %s to the audit log: %w", entry.Action, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package admin
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+const insertAuditEntryQuery = "INSERT INTO audit_log(actorid, action, targettype, targetid, details, created) VALUES (?, ?, ?, ?, ?, ?)"
+
+func Test_UpdateProfileSuspended(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	ar := NewRepo(db)
+	entry := AuditEntry{ActorId: "admin-id", Action: "profile.suspend", TargetType: "profile", TargetId: "cook-id", Details: "spam", Created: time.Unix(1700000000, 0)}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE profile SET suspended = ? WHERE id = ?").
+		WithArgs(true, "cook-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertAuditEntryQuery).
+		WithArgs("admin-id", "profile.suspend", "profile", "cook-id", "spam", int64(1700000000)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	// the suspension is rolled back when the audit log can't be written
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE profile SET suspended = ? WHERE id = ?").
+		WithArgs(true, "cook-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertAuditEntryQuery).
+		WithArgs("admin-id", "profile.suspend", "profile", "cook-id", "spam", int64(1700000000)).
+		WillReturnError(errors.New("failed"))
+	mock.ExpectRollback()
+
+	assert.NoError(t, ar.UpdateProfileSuspended("cook-id", true, entry))
+	assert.Error(t, ar.UpdateProfileSuspended("cook-id", true, entry))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateProfileRole(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	ar := NewRepo(db)
+	entry := AuditEntry{ActorId: "admin-id", Action: "profile.role", TargetType: "profile", TargetId: "cook-id", Details: "user to moderator", Created: time.Unix(1700000000, 0)}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE profile SET role = ? WHERE id = ?").
+		WithArgs("moderator", "cook-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertAuditEntryQuery).
+		WithArgs("admin-id", "profile.role", "profile", "cook-id", "user to moderator", int64(1700000000)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE profile SET role = ? WHERE id = ?").
+		WithArgs("moderator", "cook-id").
+		WillReturnError(errors.New("failed"))
+	mock.ExpectRollback()
+
+	assert.NoError(t, ar.UpdateProfileRole("cook-id", "moderator", entry))
+	assert.Error(t, ar.UpdateProfileRole("cook-id", "moderator", entry))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateRecipeHidden(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	ar := NewRepo(db)
+	entry := AuditEntry{ActorId: "admin-id", Action: "recipe.hide", TargetType: "recipe", TargetId: "4", Created: time.Unix(1700000000, 0)}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE recipe SET hidden = ? WHERE id = ?").
+		WithArgs(true, 4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertAuditEntryQuery).
+		WithArgs("admin-id", "recipe.hide", "recipe", "4", "", int64(1700000000)).
+		WillReturnError(errors.New("failed"))
+	mock.ExpectRollback()
+
+	assert.Error(t, ar.UpdateRecipeHidden(4, true, entry))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_DeleteRecipe(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	ar := NewRepo(db)
+	entry := AuditEntry{ActorId: "admin-id", Action: "recipe.delete", TargetType: "recipe", TargetId: "4", Details: `"Soup" by cook`, Created: time.Unix(1700000000, 0)}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM recipe WHERE id = ?").
+		WithArgs(4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertAuditEntryQuery).
+		WithArgs("admin-id", "recipe.delete", "recipe", "4", `"Soup" by cook`, int64(1700000000)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, ar.DeleteRecipe(4, entry))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,197 @@
+package admin
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/eciccone/rh/api/repo"
+)
+
+// columns selected for a report, in the order scanReport expects them
+const reportColumns = "report.id, report.reporterid, COALESCE(profile.username, ''), report.targettype, report.targetid, report.ownerid, report.reason, report.details, report.status, report.resolution, report.handlerid, report.created, report.updated"
+
+// the reporter may have deleted their profile since
+const reportFrom = "FROM report LEFT JOIN profile ON profile.id = report.reporterid"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanReport(row scanner, r *Report) error {
+	var created, updated int64
+	if err := row.Scan(&r.Id, &r.ReporterId, &r.ReporterUsername, &r.TargetType, &r.TargetId, &r.OwnerId, &r.Reason, &r.Details, &r.Status, &r.Resolution, &r.HandlerId, &created, &updated); err != nil {
+		return err
+	}
+
+	r.Created = time.Unix(created, 0)
+	r.Updated = time.Unix(updated, 0)
+
+	return nil
+}
+
+// Inserts an open report. Returns false if the reporter already has an unresolved report about
+// the same content, leaving it as it was.
+func (r *adminRepo) InsertReport(report Report) (Report, bool, error) {
+	result, err := r.db.Exec("INSERT INTO report(reporterid, targettype, targetid, ownerid, reason, details, status, created, updated) VALUES (?, ?, ?, ?, ?, ?, 'open', ?, ?) ON CONFLICT DO NOTHING",
+		report.ReporterId, report.TargetType, report.TargetId, report.OwnerId, report.Reason, report.Details, report.Created.Unix(), report.Created.Unix())
+	if err != nil {
+		return Report{}, false, fmt.Errorf("InsertReport failed to insert report: %w", err)
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return Report{}, false, fmt.Errorf("InsertReport failed to get rows affected: %w", err)
+	}
+
+	if inserted == 0 {
+		return Report{}, false, nil
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Report{}, false, fmt.Errorf("InsertReport failed to get report id: %w", err)
+	}
+
+	report.Id = int(id)
+	report.Status = "open"
+	report.Updated = report.Created
+
+	return report, true, nil
+}
+
+// Selects a page of the reports with one of statuses, oldest first so the queue is worked
+// through in the order it was filled.
+func (r *adminRepo) SelectReports(statuses []string, offset int, limit int) ([]Report, error) {
+	where, args := statusClause(statuses)
+
+	rows, err := r.db.Query("SELECT "+reportColumns+" "+reportFrom+" WHERE "+where+" ORDER BY report.id LIMIT ?, ?", append(args, offset, limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("SelectReports failed to select reports: %w", err)
+	}
+
+	return scanReports(rows, "SelectReports")
+}
+
+func (r *adminRepo) SelectReportCount(statuses []string) (int, error) {
+	where, args := statusClause(statuses)
+
+	var count int
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM report WHERE "+where, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("SelectReportCount failed to count reports: %w", err)
+	}
+
+	return count, nil
+}
+
+// Selects a page of the reports about the content of a profile, most recent first.
+func (r *adminRepo) SelectReportsByOwner(ownerId string, offset int, limit int) ([]Report, error) {
+	rows, err := r.db.Query("SELECT "+reportColumns+" "+reportFrom+" WHERE report.ownerid = ? ORDER BY report.id DESC LIMIT ?, ?", ownerId, offset, limit)
+	if err != nil {
+		return nil, fmt.Errorf("SelectReportsByOwner failed to select reports: %w", err)
+	}
+
+	return scanReports(rows, "SelectReportsByOwner")
+}
+
+func (r *adminRepo) SelectReportCountByOwner(ownerId string) (int, error) {
+	var count int
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM report WHERE ownerid = ?", ownerId).Scan(&count); err != nil {
+		return 0, fmt.Errorf("SelectReportCountByOwner failed to count reports: %w", err)
+	}
+
+	return count, nil
+}
+
+func (r *adminRepo) SelectReport(id int) (Report, error) {
+	var result Report
+
+	row := r.db.QueryRow("SELECT "+reportColumns+" "+reportFrom+" WHERE report.id = ?", id)
+	if err := scanReport(row, &result); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Report{}, err
+		}
+
+		return Report{}, fmt.Errorf("SelectReport failed to select report: %w", err)
+	}
+
+	return result, nil
+}
+
+// Updates the status, resolution and handler of a report, applying moderation and writing
+// entries to the audit log along with it, so a report is never settled without what was done
+// about it or the other way around. Actioning a report gives every other unresolved report about
+// the same content its status, resolution and handler too.
+func (r *adminRepo) TriageReport(report Report, moderation Moderation, entries []AuditEntry) error {
+	return repo.Tx(r.db, func(tx *sql.Tx) error {
+		if moderation.HideRecipeId != 0 {
+			if _, err := tx.Exec("UPDATE recipe SET hidden = 1 WHERE id = ?", moderation.HideRecipeId); err != nil {
+				return fmt.Errorf("TriageReport failed to hide recipe: %w", err)
+			}
+		}
+
+		if moderation.SuspendProfileId != "" {
+			if _, err := tx.Exec("UPDATE profile SET suspended = 1 WHERE id = ?", moderation.SuspendProfileId); err != nil {
+				return fmt.Errorf("TriageReport failed to suspend profile: %w", err)
+			}
+		}
+
+		_, err := tx.Exec("UPDATE report SET status = ?, resolution = ?, handlerid = ?, updated = ? WHERE id = ?",
+			report.Status, report.Resolution, report.HandlerId, report.Updated.Unix(), report.Id)
+		if err != nil {
+			return fmt.Errorf("TriageReport failed to update report: %w", err)
+		}
+
+		if report.Status == "actioned" {
+			_, err := tx.Exec("UPDATE report SET status = ?, resolution = ?, handlerid = ?, updated = ? WHERE targettype = ? AND targetid = ? AND status IN ('open', 'reviewing')",
+				report.Status, report.Resolution, report.HandlerId, report.Updated.Unix(), report.TargetType, report.TargetId)
+			if err != nil {
+				return fmt.Errorf("TriageReport failed to resolve other reports: %w", err)
+			}
+		}
+
+		for _, entry := range entries {
+			if err := insertAuditEntry(tx, entry); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// builds the condition matching reports with one of statuses, or every report when there are
+// none
+func statusClause(statuses []string) (string, []interface{}) {
+	if len(statuses) == 0 {
+		return "1 = 1", nil
+	}
+
+	args := make([]interface{}, len(statuses))
+	for i, status := range statuses {
+		args[i] = status
+	}
+
+	return "report.status IN (?" + strings.Repeat(", ?", len(statuses)-1) + ")", args
+}
+
+func scanReports(rows *sql.Rows, caller string) ([]Report, error) {
+	defer rows.Close()
+
+	result := []Report{}
+	for rows.Next() {
+		var report Report
+		if err := scanReport(rows, &report); err != nil {
+			return nil, fmt.Errorf("%s failed to scan report: %w", caller, err)
+		}
+		result = append(result, report)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s failed to iterate reports: %w", caller, err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,174 @@
+package admin
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var reportColumnNames = []string{"id", "reporterid", "username", "targettype", "targetid", "ownerid", "reason", "details", "status", "resolution", "handlerid", "created", "updated"}
+
+func Test_InsertReport(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	ar := NewRepo(db)
+	created := time.Unix(1700000000, 0)
+	query := "INSERT INTO report(reporterid, targettype, targetid, ownerid, reason, details, status, created, updated) VALUES (?, ?, ?, ?, ?, ?, 'open', ?, ?) ON CONFLICT DO NOTHING"
+
+	mock.ExpectExec(query).
+		WithArgs("test-id", "recipe", "4", "cook-id", "spam", "ads", created.Unix(), created.Unix()).
+		WillReturnResult(sqlmock.NewResult(7, 1))
+	mock.ExpectExec(query).
+		WithArgs("test-id", "recipe", "4", "cook-id", "spam", "ads", created.Unix(), created.Unix()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	report := Report{ReporterId: "test-id", TargetType: "recipe", TargetId: "4", OwnerId: "cook-id", Reason: "spam", Details: "ads", Created: created}
+
+	result, inserted, err := ar.InsertReport(report)
+	assert.NoError(t, err)
+	assert.True(t, inserted)
+	assert.Equal(t, 7, result.Id)
+	assert.Equal(t, "open", result.Status)
+	assert.Equal(t, created, result.Updated)
+
+	_, inserted, err = ar.InsertReport(report)
+	assert.NoError(t, err)
+	assert.False(t, inserted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectReports(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	ar := NewRepo(db)
+
+	mock.ExpectQuery("SELECT report.id, report.reporterid, COALESCE(profile.username, ''), report.targettype, report.targetid, report.ownerid, report.reason, report.details, report.status, report.resolution, report.handlerid, report.created, report.updated FROM report LEFT JOIN profile ON profile.id = report.reporterid WHERE report.status IN (?, ?) ORDER BY report.id LIMIT ?, ?").
+		WithArgs("open", "reviewing", 0, 10).
+		WillReturnRows(sqlmock.NewRows(reportColumnNames).
+			AddRow(7, "test-id", "Test User", "recipe", "4", "cook-id", "spam", "", "open", "", "", 1700000000, 1700000000))
+	mock.ExpectQuery("SELECT COUNT(*) FROM report WHERE report.status IN (?, ?)").
+		WithArgs("open", "reviewing").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery("SELECT COUNT(*) FROM report WHERE 1 = 1").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+
+	result, err := ar.SelectReports([]string{"open", "reviewing"}, 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []Report{{
+		Id: 7, ReporterId: "test-id", ReporterUsername: "Test User", TargetType: "recipe", TargetId: "4", OwnerId: "cook-id",
+		Reason: "spam", Status: "open", Created: time.Unix(1700000000, 0), Updated: time.Unix(1700000000, 0),
+	}}, result)
+
+	count, err := ar.SelectReportCount([]string{"open", "reviewing"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	count, err = ar.SelectReportCount(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectReportsByOwner(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	ar := NewRepo(db)
+
+	mock.ExpectQuery("SELECT report.id, report.reporterid, COALESCE(profile.username, ''), report.targettype, report.targetid, report.ownerid, report.reason, report.details, report.status, report.resolution, report.handlerid, report.created, report.updated FROM report LEFT JOIN profile ON profile.id = report.reporterid WHERE report.ownerid = ? ORDER BY report.id DESC LIMIT ?, ?").
+		WithArgs("cook-id", 0, 10).
+		WillReturnRows(sqlmock.NewRows(reportColumnNames).
+			AddRow(7, "gone-id", "", "profile", "cook-id", "cook-id", "harassment", "", "dismissed", "not abusive", "moderator-id", 1700000000, 1700000500))
+	mock.ExpectQuery("SELECT COUNT(*) FROM report WHERE ownerid = ?").
+		WithArgs("cook-id").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	result, err := ar.SelectReportsByOwner("cook-id", 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []Report{{
+		Id: 7, ReporterId: "gone-id", TargetType: "profile", TargetId: "cook-id", OwnerId: "cook-id", Reason: "harassment",
+		Status: "dismissed", Resolution: "not abusive", HandlerId: "moderator-id", Created: time.Unix(1700000000, 0), Updated: time.Unix(1700000500, 0),
+	}}, result)
+
+	count, err := ar.SelectReportCountByOwner("cook-id")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectReport(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	ar := NewRepo(db)
+	query := "SELECT report.id, report.reporterid, COALESCE(profile.username, ''), report.targettype, report.targetid, report.ownerid, report.reason, report.details, report.status, report.resolution, report.handlerid, report.created, report.updated FROM report LEFT JOIN profile ON profile.id = report.reporterid WHERE report.id = ?"
+
+	mock.ExpectQuery(query).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows(reportColumnNames).
+			AddRow(7, "test-id", "Test User", "recipe", "4", "cook-id", "spam", "", "reviewing", "", "moderator-id", 1700000000, 1700000500))
+	mock.ExpectQuery(query).WithArgs(8).WillReturnError(sql.ErrNoRows)
+
+	result, err := ar.SelectReport(7)
+	assert.NoError(t, err)
+	assert.Equal(t, "reviewing", result.Status)
+	assert.Equal(t, "moderator-id", result.HandlerId)
+
+	_, err = ar.SelectReport(8)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_TriageReport(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	ar := NewRepo(db)
+	updated := time.Unix(1700000500, 0)
+	updateQuery := "UPDATE report SET status = ?, resolution = ?, handlerid = ?, updated = ? WHERE id = ?"
+	resolveQuery := "UPDATE report SET status = ?, resolution = ?, handlerid = ?, updated = ? WHERE targettype = ? AND targetid = ? AND status IN ('open', 'reviewing')"
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE recipe SET hidden = 1 WHERE id = ?").
+		WithArgs(4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(updateQuery).
+		WithArgs("actioned", "hidden", "moderator-id", updated.Unix(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(resolveQuery).
+		WithArgs("actioned", "hidden", "moderator-id", updated.Unix(), "recipe", "4").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(insertAuditEntryQuery).
+		WithArgs("moderator-id", "recipe.hide", "recipe", "4", "report 7: hidden", updated.Unix()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(insertAuditEntryQuery).
+		WithArgs("moderator-id", "report.resolve", "report", "7", "actioned: hidden", updated.Unix()).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectCommit()
+
+	// the suspension is rolled back when the report can't be updated
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE profile SET suspended = 1 WHERE id = ?").
+		WithArgs("cook-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(updateQuery).
+		WithArgs("actioned", "", "moderator-id", updated.Unix(), 8).
+		WillReturnError(errors.New("failed"))
+	mock.ExpectRollback()
+
+	// reports under review don't settle the others
+	mock.ExpectBegin()
+	mock.ExpectExec(updateQuery).
+		WithArgs("reviewing", "", "moderator-id", updated.Unix(), 9).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	report := Report{Id: 7, TargetType: "recipe", TargetId: "4", Status: "actioned", Resolution: "hidden", HandlerId: "moderator-id", Updated: updated}
+	entries := []AuditEntry{
+		{ActorId: "moderator-id", Action: "recipe.hide", TargetType: "recipe", TargetId: "4", Details: "report 7: hidden", Created: updated},
+		{ActorId: "moderator-id", Action: "report.resolve", TargetType: "report", TargetId: "7", Details: "actioned: hidden", Created: updated},
+	}
+	assert.NoError(t, ar.TriageReport(report, Moderation{HideRecipeId: 4}, entries))
+
+	report = Report{Id: 8, TargetType: "profile", TargetId: "cook-id", Status: "actioned", HandlerId: "moderator-id", Updated: updated}
+	assert.Error(t, ar.TriageReport(report, Moderation{SuspendProfileId: "cook-id"}, nil))
+
+	report = Report{Id: 9, TargetType: "recipe", TargetId: "4", Status: "reviewing", HandlerId: "moderator-id", Updated: updated}
+	assert.NoError(t, ar.TriageReport(report, Moderation{}, nil))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,32 @@
+package group
+
+import "time"
+
+// Group is a set of profiles, like a household, that own recipes together.
+type Group struct {
+	Id      int       `json:"id"`
+	Name    string    `json:"name"`
+	Role    string    `json:"role,omitempty"`
+	Created time.Time `json:"created"`
+	Members []Member  `json:"members,omitempty"`
+}
+
+// A profile in a group, as an owner or a member.
+type Member struct {
+	ProfileId   string            `json:"-"`
+	Username    string            `json:"username"`
+	DisplayName string            `json:"display_name,omitempty"`
+	AvatarName  string            `json:"-"`
+	AvatarURLs  map[string]string `json:"avatar_urls,omitempty"`
+	Role        string            `json:"role"`
+	Joined      time.Time         `json:"joined"`
+}
+
+// Invite lets anyone with its code join a group until it expires. Only the hash of the code is
+// kept.
+type Invite struct {
+	CodeHash string
+	GroupId  int
+	Created  time.Time
+	Expires  time.Time
+}
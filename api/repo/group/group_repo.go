@@ -0,0 +1,260 @@
+package group
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eciccone/rh/api/repo"
+)
+
+type GroupRepository interface {
+	InsertGroup(g Group, ownerId string) (Group, error)
+	SelectGroups(profileId string) ([]Group, error)
+	SelectGroup(id int, profileId string) (Group, error)
+	UpdateGroupName(id int, name string) error
+	DeleteGroup(id int) error
+
+	SelectMembers(groupId int) ([]Member, error)
+	InsertMember(groupId int, profileId string, role string, joined time.Time) (bool, error)
+	UpdateMemberRole(groupId int, username string, role string) (bool, error)
+	DeleteMember(groupId int, username string) (bool, error)
+
+	InsertInvite(i Invite) error
+	SelectInvite(codeHash string) (Invite, error)
+	DeleteInvites(groupId int) error
+}
+
+// columns selected for a group along with the role of a member, in the order scanGroup expects
+// them
+const groupColumns = "profile_group.id, profile_group.name, profile_group.created, group_member.role"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanGroup(row scanner, g *Group) error {
+	var created int64
+	if err := row.Scan(&g.Id, &g.Name, &created, &g.Role); err != nil {
+		return err
+	}
+
+	g.Created = time.Unix(created, 0)
+
+	return nil
+}
+
+type groupRepo struct {
+	db *sql.DB
+}
+
+func NewRepo(db *sql.DB) GroupRepository {
+	return &groupRepo{db}
+}
+
+// Inserts a group with the profile creating it as its owner.
+func (r *groupRepo) InsertGroup(g Group, ownerId string) (Group, error) {
+	err := repo.Tx(r.db, func(tx *sql.Tx) error {
+		result, err := tx.Exec("INSERT INTO profile_group(name, created) VALUES (?, ?)", g.Name, g.Created.Unix())
+		if err != nil {
+			return fmt.Errorf("InsertGroup failed to insert group: %w", err)
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("InsertGroup failed to get group id: %w", err)
+		}
+		g.Id = int(id)
+
+		_, err = tx.Exec("INSERT INTO group_member(groupid, profileid, role, joined) VALUES (?, ?, 'owner', ?)", g.Id, ownerId, g.Created.Unix())
+		if err != nil {
+			return fmt.Errorf("InsertGroup failed to insert owner: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return Group{}, err
+	}
+
+	g.Role = "owner"
+
+	return g, nil
+}
+
+// Selects the groups a profile is in, by name.
+func (r *groupRepo) SelectGroups(profileId string) ([]Group, error) {
+	rows, err := r.db.Query("SELECT "+groupColumns+" FROM group_member JOIN profile_group ON profile_group.id = group_member.groupid WHERE group_member.profileid = ? ORDER BY profile_group.name COLLATE NOCASE, profile_group.id", profileId)
+	if err != nil {
+		return nil, fmt.Errorf("SelectGroups failed to select groups: %w", err)
+	}
+	defer rows.Close()
+
+	result := []Group{}
+	for rows.Next() {
+		var g Group
+		if err := scanGroup(rows, &g); err != nil {
+			return nil, fmt.Errorf("SelectGroups failed to scan group: %w", err)
+		}
+		result = append(result, g)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectGroups failed to iterate groups: %w", err)
+	}
+
+	return result, nil
+}
+
+// Selects a group along with the role of the profile in it. Returns sql.ErrNoRows if the
+// profile is not in the group.
+func (r *groupRepo) SelectGroup(id int, profileId string) (Group, error) {
+	var result Group
+
+	row := r.db.QueryRow("SELECT "+groupColumns+" FROM group_member JOIN profile_group ON profile_group.id = group_member.groupid WHERE group_member.groupid = ? AND group_member.profileid = ?", id, profileId)
+	if err := scanGroup(row, &result); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Group{}, err
+		}
+
+		return Group{}, fmt.Errorf("SelectGroup failed to select group: %w", err)
+	}
+
+	return result, nil
+}
+
+func (r *groupRepo) UpdateGroupName(id int, name string) error {
+	if _, err := r.db.Exec("UPDATE profile_group SET name = ? WHERE id = ?", name, id); err != nil {
+		return fmt.Errorf("UpdateGroupName failed to update group: %w", err)
+	}
+
+	return nil
+}
+
+// Deletes a group along with its members and invites. Its recipes are left with the profiles
+// that created them.
+func (r *groupRepo) DeleteGroup(id int) error {
+	if _, err := r.db.Exec("DELETE FROM profile_group WHERE id = ?", id); err != nil {
+		return fmt.Errorf("DeleteGroup failed to delete group: %w", err)
+	}
+
+	return nil
+}
+
+// Selects the members of a group, in the order they joined.
+func (r *groupRepo) SelectMembers(groupId int) ([]Member, error) {
+	rows, err := r.db.Query("SELECT profile.id, profile.username, profile.displayname, profile.avatarname, group_member.role, group_member.joined FROM group_member JOIN profile ON profile.id = group_member.profileid WHERE group_member.groupid = ? ORDER BY group_member.joined, profile.username", groupId)
+	if err != nil {
+		return nil, fmt.Errorf("SelectMembers failed to select members: %w", err)
+	}
+	defer rows.Close()
+
+	result := []Member{}
+	for rows.Next() {
+		var m Member
+		var joined int64
+		if err := rows.Scan(&m.ProfileId, &m.Username, &m.DisplayName, &m.AvatarName, &m.Role, &joined); err != nil {
+			return nil, fmt.Errorf("SelectMembers failed to scan member: %w", err)
+		}
+		m.Joined = time.Unix(joined, 0)
+		result = append(result, m)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectMembers failed to iterate members: %w", err)
+	}
+
+	return result, nil
+}
+
+// Adds a profile to a group. Returns false if the profile is already in it, leaving its role as
+// it was.
+func (r *groupRepo) InsertMember(groupId int, profileId string, role string, joined time.Time) (bool, error) {
+	result, err := r.db.Exec("INSERT INTO group_member(groupid, profileid, role, joined) VALUES (?, ?, ?, ?) ON CONFLICT(groupid, profileid) DO NOTHING", groupId, profileId, role, joined.Unix())
+	if err != nil {
+		return false, fmt.Errorf("InsertMember failed to insert member: %w", err)
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("InsertMember failed to get rows affected: %w", err)
+	}
+
+	return inserted > 0, nil
+}
+
+// Changes the role of a member. Returns false if no member of the group has the username.
+func (r *groupRepo) UpdateMemberRole(groupId int, username string, role string) (bool, error) {
+	result, err := r.db.Exec("UPDATE group_member SET role = ? WHERE groupid = ? AND profileid = (SELECT id FROM profile WHERE username = ?)", role, groupId, username)
+	if err != nil {
+		return false, fmt.Errorf("UpdateMemberRole failed to update member: %w", err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("UpdateMemberRole failed to get rows affected: %w", err)
+	}
+
+	return updated > 0, nil
+}
+
+// Removes a member from a group. Returns false if no member of the group has the username.
+func (r *groupRepo) DeleteMember(groupId int, username string) (bool, error) {
+	result, err := r.db.Exec("DELETE FROM group_member WHERE groupid = ? AND profileid = (SELECT id FROM profile WHERE username = ?)", groupId, username)
+	if err != nil {
+		return false, fmt.Errorf("DeleteMember failed to delete member: %w", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("DeleteMember failed to get rows affected: %w", err)
+	}
+
+	return deleted > 0, nil
+}
+
+// Inserts an invite, deleting the invites of its group that have expired by the time it was
+// created.
+func (r *groupRepo) InsertInvite(i Invite) error {
+	return repo.Tx(r.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM group_invite WHERE groupid = ? AND expires <= ?", i.GroupId, i.Created.Unix()); err != nil {
+			return fmt.Errorf("InsertInvite failed to delete expired invites: %w", err)
+		}
+
+		_, err := tx.Exec("INSERT INTO group_invite(codehash, groupid, created, expires) VALUES (?, ?, ?, ?)", i.CodeHash, i.GroupId, i.Created.Unix(), i.Expires.Unix())
+		if err != nil {
+			return fmt.Errorf("InsertInvite failed to insert invite: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func (r *groupRepo) SelectInvite(codeHash string) (Invite, error) {
+	var result Invite
+	var created, expires int64
+
+	err := r.db.QueryRow("SELECT codehash, groupid, created, expires FROM group_invite WHERE codehash = ?", codeHash).Scan(&result.CodeHash, &result.GroupId, &created, &expires)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Invite{}, err
+		}
+
+		return Invite{}, fmt.Errorf("SelectInvite failed to select invite: %w", err)
+	}
+
+	result.Created = time.Unix(created, 0)
+	result.Expires = time.Unix(expires, 0)
+
+	return result, nil
+}
+
+// Deletes every invite of a group, so none of their codes can be used to join it any more.
+func (r *groupRepo) DeleteInvites(groupId int) error {
+	if _, err := r.db.Exec("DELETE FROM group_invite WHERE groupid = ?", groupId); err != nil {
+		return fmt.Errorf("DeleteInvites failed to delete invites: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package group
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var columns = []string{"id", "name", "created", "role"}
+
+func Test_InsertGroup(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	gr := NewRepo(db)
+	created := time.Unix(1700000000, 0)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO profile_group(name, created) VALUES (?, ?)").
+		WithArgs("Home", created.Unix()).
+		WillReturnResult(sqlmock.NewResult(3, 1))
+	mock.ExpectExec("INSERT INTO group_member(groupid, profileid, role, joined) VALUES (?, ?, 'owner', ?)").
+		WithArgs(3, "test-id", created.Unix()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO profile_group(name, created) VALUES (?, ?)").
+		WithArgs("Home", created.Unix()).
+		WillReturnResult(sqlmock.NewResult(4, 1))
+	mock.ExpectExec("INSERT INTO group_member(groupid, profileid, role, joined) VALUES (?, ?, 'owner', ?)").
+		WithArgs(4, "missing-id", created.Unix()).
+		WillReturnError(errors.New("FOREIGN KEY constraint failed"))
+	mock.ExpectRollback()
+
+	result, err := gr.InsertGroup(Group{Name: "Home", Created: created}, "test-id")
+	assert.NoError(t, err)
+	assert.Equal(t, Group{Id: 3, Name: "Home", Role: "owner", Created: created}, result)
+
+	_, err = gr.InsertGroup(Group{Name: "Home", Created: created}, "missing-id")
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectGroups(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	gr := NewRepo(db)
+
+	mock.ExpectQuery("SELECT profile_group.id, profile_group.name, profile_group.created, group_member.role FROM group_member JOIN profile_group ON profile_group.id = group_member.groupid WHERE group_member.profileid = ? ORDER BY profile_group.name COLLATE NOCASE, profile_group.id").
+		WithArgs("test-id").
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(3, "Home", 1700000000, "owner").
+			AddRow(5, "Work", 1700000500, "member"))
+	mock.ExpectQuery("SELECT profile_group.id, profile_group.name, profile_group.created, group_member.role FROM group_member JOIN profile_group ON profile_group.id = group_member.groupid WHERE group_member.groupid = ? AND group_member.profileid = ?").
+		WithArgs(3, "stranger-id").
+		WillReturnError(sql.ErrNoRows)
+
+	result, err := gr.SelectGroups("test-id")
+	assert.NoError(t, err)
+	assert.Equal(t, []Group{
+		{Id: 3, Name: "Home", Role: "owner", Created: time.Unix(1700000000, 0)},
+		{Id: 5, Name: "Work", Role: "member", Created: time.Unix(1700000500, 0)},
+	}, result)
+
+	_, err = gr.SelectGroup(3, "stranger-id")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectMembers(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	gr := NewRepo(db)
+
+	mock.ExpectQuery("SELECT profile.id, profile.username, profile.displayname, profile.avatarname, group_member.role, group_member.joined FROM group_member JOIN profile ON profile.id = group_member.profileid WHERE group_member.groupid = ? ORDER BY group_member.joined, profile.username").
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "displayname", "avatarname", "role", "joined"}).
+			AddRow("test-id", "Test User", "Test", "avatar.jpg", "owner", 1700000000))
+
+	result, err := gr.SelectMembers(3)
+	assert.NoError(t, err)
+	assert.Equal(t, []Member{{ProfileId: "test-id", Username: "Test User", DisplayName: "Test", AvatarName: "avatar.jpg", Role: "owner", Joined: time.Unix(1700000000, 0)}}, result)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_InsertMember(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	gr := NewRepo(db)
+	joined := time.Unix(1700000000, 0)
+	query := "INSERT INTO group_member(groupid, profileid, role, joined) VALUES (?, ?, ?, ?) ON CONFLICT(groupid, profileid) DO NOTHING"
+
+	mock.ExpectExec(query).WithArgs(3, "new-id", "member", joined.Unix()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(query).WithArgs(3, "test-id", "member", joined.Unix()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	inserted, err := gr.InsertMember(3, "new-id", "member", joined)
+	assert.NoError(t, err)
+	assert.True(t, inserted)
+
+	inserted, err = gr.InsertMember(3, "test-id", "member", joined)
+	assert.NoError(t, err)
+	assert.False(t, inserted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateAndDeleteMember(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	gr := NewRepo(db)
+
+	mock.ExpectExec("UPDATE group_member SET role = ? WHERE groupid = ? AND profileid = (SELECT id FROM profile WHERE username = ?)").
+		WithArgs("owner", 3, "Test User").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM group_member WHERE groupid = ? AND profileid = (SELECT id FROM profile WHERE username = ?)").
+		WithArgs(3, "stranger").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	updated, err := gr.UpdateMemberRole(3, "Test User", "owner")
+	assert.NoError(t, err)
+	assert.True(t, updated)
+
+	deleted, err := gr.DeleteMember(3, "stranger")
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Invites(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	gr := NewRepo(db)
+	created, expires := time.Unix(1700000000, 0), time.Unix(1700600000, 0)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM group_invite WHERE groupid = ? AND expires <= ?").
+		WithArgs(3, created.Unix()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("INSERT INTO group_invite(codehash, groupid, created, expires) VALUES (?, ?, ?, ?)").
+		WithArgs("hash", 3, created.Unix(), expires.Unix()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery("SELECT codehash, groupid, created, expires FROM group_invite WHERE codehash = ?").
+		WithArgs("hash").
+		WillReturnRows(sqlmock.NewRows([]string{"codehash", "groupid", "created", "expires"}).AddRow("hash", 3, created.Unix(), expires.Unix()))
+	mock.ExpectQuery("SELECT codehash, groupid, created, expires FROM group_invite WHERE codehash = ?").
+		WithArgs("missing").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("DELETE FROM group_invite WHERE groupid = ?").
+		WithArgs(3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	invite := Invite{CodeHash: "hash", GroupId: 3, Created: created, Expires: expires}
+	assert.NoError(t, gr.InsertInvite(invite))
+
+	result, err := gr.SelectInvite("hash")
+	assert.NoError(t, err)
+	assert.Equal(t, invite, result)
+
+	_, err = gr.SelectInvite("missing")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	assert.NoError(t, gr.DeleteInvites(3))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,32 @@
+package imageref
+
+import "time"
+
+// ImageRef counts the rows referencing a stored image file.
+type ImageRef struct {
+	Name    string
+	Refs    int
+	Created time.Time
+}
+
+// Placeholder describes an image well enough for clients to lay it out and show a preview of it
+// before it loads.
+type Placeholder struct {
+	Blurhash string `json:"blurhash"`
+	Color    string `json:"color"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+}
+
+const (
+	FileOpCreate = "create"
+	FileOpDelete = "delete"
+)
+
+// FileOp is an image file operation waiting for the database change it belongs to.
+type FileOp struct {
+	Id      int
+	Op      string
+	Name    string
+	Created time.Time
+}
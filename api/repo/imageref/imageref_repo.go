@@ -0,0 +1,198 @@
+package imageref
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/eciccone/rh/api/repo"
+)
+
+type ImageRefRepository interface {
+	InsertImageRef(name string, created time.Time, placeholder Placeholder) error
+	SelectImageRefs() ([]ImageRef, error)
+	SelectPlaceholders(names []string) (map[string]Placeholder, error)
+	UpdateImageRefCounts() error
+	DeleteUnreferencedImageRef(name string, createdBefore time.Time) (bool, error)
+
+	InsertFileOp(op FileOp) (FileOp, error)
+	SelectFileOps(createdBefore time.Time) ([]FileOp, error)
+	DeleteFileOp(id int) error
+	SelectImageInUse(name string, ignoreOpId int) (bool, error)
+}
+
+type imageRefRepo struct {
+	db *sql.DB
+}
+
+func NewRepo(db *sql.DB) ImageRefRepository {
+	return &imageRefRepo{db}
+}
+
+// Records an image file that is about to be stored along with its placeholder. Storing the same
+// file again refreshes created, so garbage collection leaves it alone until it is referenced.
+func (r *imageRefRepo) InsertImageRef(name string, created time.Time, placeholder Placeholder) error {
+	_, err := r.db.Exec("INSERT INTO image(name, refs, created, blurhash, color, width, height) VALUES (?, 0, ?, ?, ?, ?, ?) ON CONFLICT(name) DO UPDATE SET created = excluded.created, blurhash = excluded.blurhash, color = excluded.color, width = excluded.width, height = excluded.height",
+		name, created.Unix(), placeholder.Blurhash, placeholder.Color, placeholder.Width, placeholder.Height)
+	if err != nil {
+		return fmt.Errorf("InsertImageRef failed to insert image: %w", err)
+	}
+
+	return nil
+}
+
+func (r *imageRefRepo) SelectImageRefs() ([]ImageRef, error) {
+	var result []ImageRef
+
+	rows, err := r.db.Query("SELECT name, refs, created FROM image")
+	if err != nil {
+		return nil, fmt.Errorf("SelectImageRefs failed to select images: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i ImageRef
+		var created int64
+		if err := rows.Scan(&i.Name, &i.Refs, &created); err != nil {
+			return nil, fmt.Errorf("SelectImageRefs failed to scan image: %w", err)
+		}
+		i.Created = time.Unix(created, 0)
+		result = append(result, i)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectImageRefs failed to select images: %w", err)
+	}
+
+	return result, nil
+}
+
+// Selects the placeholders of images by name. Images stored before placeholders existed have
+// none and are left out.
+func (r *imageRefRepo) SelectPlaceholders(names []string) (map[string]Placeholder, error) {
+	result := map[string]Placeholder{}
+	if len(names) == 0 {
+		return result, nil
+	}
+
+	args := make([]interface{}, len(names))
+	for i, n := range names {
+		args[i] = n
+	}
+	in := strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ")
+
+	rows, err := r.db.Query("SELECT name, blurhash, color, width, height FROM image WHERE blurhash <> '' AND name IN ("+in+")", args...)
+	if err != nil {
+		return nil, fmt.Errorf("SelectPlaceholders failed to select images: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var p Placeholder
+		if err := rows.Scan(&name, &p.Blurhash, &p.Color, &p.Width, &p.Height); err != nil {
+			return nil, fmt.Errorf("SelectPlaceholders failed to scan image: %w", err)
+		}
+		result[name] = p
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectPlaceholders failed to select images: %w", err)
+	}
+
+	return result, nil
+}
+
+// Recounts the references of every image from the rows referencing them, adding images that
+// are referenced but were never recorded, such as those uploaded before images were counted.
+func (r *imageRefRepo) UpdateImageRefCounts() error {
+	return repo.Tx(r.db, func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT INTO image(name, refs, created) SELECT imagename, 0, ? FROM (SELECT imagename FROM recipe WHERE imagename <> '' UNION SELECT imagename FROM recipe_image UNION SELECT avatarname FROM profile WHERE avatarname <> '') WHERE true ON CONFLICT(name) DO NOTHING", time.Now().Unix())
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE image SET refs = (SELECT COUNT(*) FROM recipe WHERE imagename = image.name) + (SELECT COUNT(*) FROM recipe_image WHERE imagename = image.name) + (SELECT COUNT(*) FROM profile WHERE avatarname = image.name)")
+		return err
+	})
+}
+
+// Deletes an image that nothing references and that was created before createdBefore.
+// Returns false when the image was referenced or stored again in the meantime.
+func (r *imageRefRepo) DeleteUnreferencedImageRef(name string, createdBefore time.Time) (bool, error) {
+	res, err := r.db.Exec("DELETE FROM image WHERE name = ? AND refs = 0 AND created < ?", name, createdBefore.Unix())
+	if err != nil {
+		return false, fmt.Errorf("DeleteUnreferencedImageRef failed to delete image: %w", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+func (r *imageRefRepo) InsertFileOp(op FileOp) (FileOp, error) {
+	res, err := r.db.Exec("INSERT INTO file_op(op, name, created) VALUES (?, ?, ?)", op.Op, op.Name, op.Created.Unix())
+	if err != nil {
+		return FileOp{}, fmt.Errorf("InsertFileOp failed to insert operation: %w", err)
+	}
+
+	id, _ := res.LastInsertId()
+	if id == 0 {
+		return FileOp{}, errors.New("InsertFileOp no id was generated for operation")
+	}
+
+	op.Id = int(id)
+	return op, nil
+}
+
+// Selects the operations recorded before createdBefore, oldest first.
+func (r *imageRefRepo) SelectFileOps(createdBefore time.Time) ([]FileOp, error) {
+	var result []FileOp
+
+	rows, err := r.db.Query("SELECT id, op, name, created FROM file_op WHERE created < ? ORDER BY id", createdBefore.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("SelectFileOps failed to select operations: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var op FileOp
+		var created int64
+		if err := rows.Scan(&op.Id, &op.Op, &op.Name, &created); err != nil {
+			return nil, fmt.Errorf("SelectFileOps failed to scan operation: %w", err)
+		}
+		op.Created = time.Unix(created, 0)
+		result = append(result, op)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectFileOps failed to select operations: %w", err)
+	}
+
+	return result, nil
+}
+
+func (r *imageRefRepo) DeleteFileOp(id int) error {
+	_, err := r.db.Exec("DELETE FROM file_op WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("DeleteFileOp failed to delete operation: %w", err)
+	}
+
+	return nil
+}
+
+// Reports whether an image is referenced by any row, or is being created by an operation
+// other than ignoreOpId. References are counted from the rows themselves rather than
+// image.refs, which does not know about images stored before it existed.
+func (r *imageRefRepo) SelectImageInUse(name string, ignoreOpId int) (bool, error) {
+	var count int
+
+	row := r.db.QueryRow("SELECT (SELECT COUNT(*) FROM recipe WHERE imagename = ?) + (SELECT COUNT(*) FROM recipe_image WHERE imagename = ?) + (SELECT COUNT(*) FROM profile WHERE avatarname = ?) + (SELECT COUNT(*) FROM file_op WHERE name = ? AND op = 'create' AND id <> ?)",
+		name, name, name, name, ignoreOpId)
+	if err := row.Scan(&count); err != nil {
+		return false, fmt.Errorf("SelectImageInUse failed to count references: %w", err)
+	}
+
+	return count > 0, nil
+}
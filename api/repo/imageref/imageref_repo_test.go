@@ -0,0 +1,230 @@
+package imageref
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_InsertImageRef(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	rr := NewRepo(db)
+	created := time.Unix(1700000000, 0)
+	placeholder := Placeholder{Blurhash: "LEHV6nWB2yk8pyo0adR*.7kCMdnj", Color: "#a0522d", Width: 1600, Height: 1200}
+	query := "INSERT INTO image(name, refs, created, blurhash, color, width, height) VALUES (?, 0, ?, ?, ?, ?, ?) ON CONFLICT(name) DO UPDATE SET created = excluded.created, blurhash = excluded.blurhash, color = excluded.color, width = excluded.width, height = excluded.height"
+
+	mock.ExpectExec(query).
+		WithArgs("abc.jpg", created.Unix(), placeholder.Blurhash, placeholder.Color, 1600, 1200).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err := rr.InsertImageRef("abc.jpg", created, placeholder)
+	assert.NoError(t, err)
+
+	mock.ExpectExec(query).
+		WithArgs("abc.jpg", created.Unix(), placeholder.Blurhash, placeholder.Color, 1600, 1200).
+		WillReturnError(errors.New("failed"))
+
+	err = rr.InsertImageRef("abc.jpg", created, placeholder)
+	assert.Error(t, err)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectPlaceholders(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	rr := NewRepo(db)
+
+	mock.ExpectQuery("SELECT name, blurhash, color, width, height FROM image WHERE blurhash <> '' AND name IN (?, ?)").
+		WithArgs("abc.jpg", "old.jpg").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "blurhash", "color", "width", "height"}).
+			AddRow("abc.jpg", "LEHV6nWB2yk8pyo0adR*.7kCMdnj", "#a0522d", 1600, 1200))
+
+	result, err := rr.SelectPlaceholders([]string{"abc.jpg", "old.jpg"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]Placeholder{
+		"abc.jpg": {Blurhash: "LEHV6nWB2yk8pyo0adR*.7kCMdnj", Color: "#a0522d", Width: 1600, Height: 1200},
+	}, result)
+
+	// nothing to select
+	result, err = rr.SelectPlaceholders(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, result)
+
+	mock.ExpectQuery("SELECT name, blurhash, color, width, height FROM image WHERE blurhash <> '' AND name IN (?)").
+		WithArgs("abc.jpg").
+		WillReturnError(errors.New("failed"))
+
+	_, err = rr.SelectPlaceholders([]string{"abc.jpg"})
+	assert.Error(t, err)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectImageRefs(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	rr := NewRepo(db)
+
+	mock.ExpectQuery("SELECT name, refs, created FROM image").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "refs", "created"}).
+			AddRow("abc.jpg", 2, 1700000000).
+			AddRow("def.jpg", 0, 1700000100))
+
+	result, err := rr.SelectImageRefs()
+	assert.NoError(t, err)
+	assert.Equal(t, []ImageRef{
+		{Name: "abc.jpg", Refs: 2, Created: time.Unix(1700000000, 0)},
+		{Name: "def.jpg", Refs: 0, Created: time.Unix(1700000100, 0)},
+	}, result)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateImageRefCounts(t *testing.T) {
+	data := []struct {
+		Name        string
+		ExpectedSQL func(sqlmock.Sqlmock)
+		Assert      func(error)
+	}{
+		{
+			Name: "recount images",
+			ExpectedSQL: func(m sqlmock.Sqlmock) {
+				m.ExpectBegin()
+				m.ExpectExec("INSERT INTO image(name, refs, created) SELECT imagename, 0, ? FROM (SELECT imagename FROM recipe WHERE imagename <> '' UNION SELECT imagename FROM recipe_image UNION SELECT avatarname FROM profile WHERE avatarname <> '') WHERE true ON CONFLICT(name) DO NOTHING").
+					WithArgs(sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("UPDATE image SET refs = (SELECT COUNT(*) FROM recipe WHERE imagename = image.name) + (SELECT COUNT(*) FROM recipe_image WHERE imagename = image.name) + (SELECT COUNT(*) FROM profile WHERE avatarname = image.name)").
+					WillReturnResult(sqlmock.NewResult(0, 3))
+				m.ExpectCommit()
+			},
+			Assert: func(err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			Name: "recount images error",
+			ExpectedSQL: func(m sqlmock.Sqlmock) {
+				m.ExpectBegin()
+				m.ExpectExec("INSERT INTO image(name, refs, created) SELECT imagename, 0, ? FROM (SELECT imagename FROM recipe WHERE imagename <> '' UNION SELECT imagename FROM recipe_image UNION SELECT avatarname FROM profile WHERE avatarname <> '') WHERE true ON CONFLICT(name) DO NOTHING").
+					WithArgs(sqlmock.AnyArg()).
+					WillReturnError(errors.New("failed"))
+				m.ExpectRollback()
+			},
+			Assert: func(err error) {
+				assert.Error(t, err)
+			},
+		},
+	}
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+
+	for _, d := range data {
+		t.Log("TEST: ", d.Name)
+		d.ExpectedSQL(mock)
+		rr := NewRepo(db)
+		err := rr.UpdateImageRefCounts()
+		d.Assert(err)
+	}
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_DeleteUnreferencedImageRef(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	rr := NewRepo(db)
+	before := time.Unix(1700000000, 0)
+
+	mock.ExpectExec("DELETE FROM image WHERE name = ? AND refs = 0 AND created < ?").
+		WithArgs("abc.jpg", before.Unix()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	deleted, err := rr.DeleteUnreferencedImageRef("abc.jpg", before)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+
+	mock.ExpectExec("DELETE FROM image WHERE name = ? AND refs = 0 AND created < ?").
+		WithArgs("abc.jpg", before.Unix()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	deleted, err = rr.DeleteUnreferencedImageRef("abc.jpg", before)
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_InsertFileOp(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	rr := NewRepo(db)
+	op := FileOp{Op: FileOpCreate, Name: "abc.jpg", Created: time.Unix(1700000000, 0)}
+
+	mock.ExpectExec("INSERT INTO file_op(op, name, created) VALUES (?, ?, ?)").
+		WithArgs(op.Op, op.Name, op.Created.Unix()).
+		WillReturnResult(sqlmock.NewResult(7, 1))
+
+	result, err := rr.InsertFileOp(op)
+	assert.NoError(t, err)
+	op.Id = 7
+	assert.Equal(t, op, result)
+
+	mock.ExpectExec("INSERT INTO file_op(op, name, created) VALUES (?, ?, ?)").
+		WithArgs(op.Op, op.Name, op.Created.Unix()).
+		WillReturnError(errors.New("failed"))
+
+	_, err = rr.InsertFileOp(op)
+	assert.Error(t, err)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectFileOps(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	rr := NewRepo(db)
+	before := time.Unix(1700000600, 0)
+
+	mock.ExpectQuery("SELECT id, op, name, created FROM file_op WHERE created < ? ORDER BY id").
+		WithArgs(before.Unix()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "op", "name", "created"}).
+			AddRow(1, "create", "abc.jpg", 1700000000).
+			AddRow(2, "delete", "def.jpg", 1700000100))
+
+	result, err := rr.SelectFileOps(before)
+	assert.NoError(t, err)
+	assert.Equal(t, []FileOp{
+		{Id: 1, Op: FileOpCreate, Name: "abc.jpg", Created: time.Unix(1700000000, 0)},
+		{Id: 2, Op: FileOpDelete, Name: "def.jpg", Created: time.Unix(1700000100, 0)},
+	}, result)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_DeleteFileOp(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	rr := NewRepo(db)
+
+	mock.ExpectExec("DELETE FROM file_op WHERE id = ?").
+		WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(t, rr.DeleteFileOp(7))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectImageInUse(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	rr := NewRepo(db)
+
+	for _, count := range []int{0, 2} {
+		mock.ExpectQuery("SELECT (SELECT COUNT(*) FROM recipe WHERE imagename = ?) + (SELECT COUNT(*) FROM recipe_image WHERE imagename = ?) + (SELECT COUNT(*) FROM profile WHERE avatarname = ?) + (SELECT COUNT(*) FROM file_op WHERE name = ? AND op = 'create' AND id <> ?)").
+			WithArgs("abc.jpg", "abc.jpg", "abc.jpg", "abc.jpg", 7).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+
+		inUse, err := rr.SelectImageInUse("abc.jpg", 7)
+		assert.NoError(t, err)
+		assert.Equal(t, count > 0, inUse)
+	}
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,25 @@
+package notification
+
+import "time"
+
+// Notification tells a profile what others did, like following it. Actors is how many profiles
+// did it and Actor is the one that did it last.
+type Notification struct {
+	Id        int       `json:"id"`
+	ProfileId string    `json:"-"`
+	Type      string    `json:"type"`
+	Subject   string    `json:"subject,omitempty"`
+	Actors    int       `json:"actors"`
+	Actor     Actor     `json:"actor"`
+	Message   string    `json:"message"`
+	Read      bool      `json:"read"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+}
+
+type Actor struct {
+	Username    string            `json:"username"`
+	DisplayName string            `json:"display_name,omitempty"`
+	AvatarName  string            `json:"-"`
+	AvatarURLs  map[string]string `json:"avatar_urls,omitempty"`
+}
@@ -0,0 +1,192 @@
+package notification
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/eciccone/rh/api/repo"
+)
+
+type NotificationRepository interface {
+	InsertNotification(n Notification, actorId string, coalesceAfter time.Time) error
+	SelectNotifications(profileId string, unreadOnly bool, offset int, limit int) ([]Notification, error)
+	SelectNotificationCounts(profileId string) (int, int, error)
+	UpdateNotificationRead(profileId string, id int) (bool, error)
+	UpdateNotificationsRead(profileId string) error
+	SelectNotificationPreferences(profileId string) (map[string]bool, error)
+	UpdateNotificationPreferences(profileId string, preferences map[string]bool) error
+}
+
+type notificationRepo struct {
+	db *sql.DB
+}
+
+func NewRepo(db *sql.DB) NotificationRepository {
+	return &notificationRepo{db}
+}
+
+// Records that actorId did something a profile is notified about. If the profile has an unread
+// notification of the same type about the same subject updated since coalesceAfter, the actor
+// is added to it instead of inserting another one.
+func (r *notificationRepo) InsertNotification(n Notification, actorId string, coalesceAfter time.Time) error {
+	return repo.Tx(r.db, func(tx *sql.Tx) error {
+		var id int64
+		err := tx.QueryRow("SELECT id FROM notification WHERE profileid = ? AND type = ? AND subject = ? AND read = 0 AND updated >= ? ORDER BY updated DESC LIMIT 1",
+			n.ProfileId, n.Type, n.Subject, coalesceAfter.Unix()).Scan(&id)
+
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			result, err := tx.Exec("INSERT INTO notification(profileid, type, subject, created, updated) VALUES (?, ?, ?, ?, ?)",
+				n.ProfileId, n.Type, n.Subject, n.Updated.Unix(), n.Updated.Unix())
+			if err != nil {
+				return fmt.Errorf("InsertNotification failed to insert notification: %w", err)
+			}
+
+			if id, err = result.LastInsertId(); err != nil {
+				return fmt.Errorf("InsertNotification failed to get notification id: %w", err)
+			}
+		case err != nil:
+			return fmt.Errorf("InsertNotification failed to select notification: %w", err)
+		default:
+			if _, err := tx.Exec("UPDATE notification SET updated = ? WHERE id = ?", n.Updated.Unix(), id); err != nil {
+				return fmt.Errorf("InsertNotification failed to update notification: %w", err)
+			}
+		}
+
+		if _, err := tx.Exec("INSERT INTO notification_actor(notificationid, actorid, created) VALUES (?, ?, ?) ON CONFLICT(notificationid, actorid) DO UPDATE SET created = excluded.created",
+			id, actorId, n.Updated.Unix()); err != nil {
+			return fmt.Errorf("InsertNotification failed to insert actor: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// Selects a page of the notifications of a profile, most recently updated first. Notifications
+// whose actors have all been deleted are left out.
+func (r *notificationRepo) SelectNotifications(profileId string, unreadOnly bool, offset int, limit int) ([]Notification, error) {
+	query := `SELECT notification.id, notification.type, notification.subject, notification.read, notification.created, notification.updated,
+		(SELECT COUNT(*) FROM notification_actor WHERE notification_actor.notificationid = notification.id),
+		profile.username, profile.displayname, profile.avatarname
+		FROM notification JOIN profile ON profile.id = (SELECT notification_actor.actorid FROM notification_actor WHERE notification_actor.notificationid = notification.id ORDER BY notification_actor.created DESC, notification_actor.rowid DESC LIMIT 1)
+		WHERE notification.profileid = ?`
+
+	if unreadOnly {
+		query += " AND notification.read = 0"
+	}
+
+	query += " ORDER BY notification.updated DESC, notification.id DESC LIMIT ?, ?"
+
+	rows, err := r.db.Query(query, profileId, offset, limit)
+	if err != nil {
+		return nil, fmt.Errorf("SelectNotifications failed to select notifications: %w", err)
+	}
+	defer rows.Close()
+
+	result := []Notification{}
+	for rows.Next() {
+		n := Notification{ProfileId: profileId}
+		var created, updated int64
+		if err := rows.Scan(&n.Id, &n.Type, &n.Subject, &n.Read, &created, &updated, &n.Actors, &n.Actor.Username, &n.Actor.DisplayName, &n.Actor.AvatarName); err != nil {
+			return nil, fmt.Errorf("SelectNotifications failed to scan notification: %w", err)
+		}
+		n.Created = time.Unix(created, 0)
+		n.Updated = time.Unix(updated, 0)
+		result = append(result, n)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectNotifications failed to iterate notifications: %w", err)
+	}
+
+	return result, nil
+}
+
+// Counts the notifications of a profile and how many of them are unread, leaving out
+// notifications whose actors have all been deleted.
+func (r *notificationRepo) SelectNotificationCounts(profileId string) (int, int, error) {
+	var total, unread int
+
+	err := r.db.QueryRow("SELECT COUNT(*), COALESCE(SUM(notification.read = 0), 0) FROM notification WHERE notification.profileid = ? AND EXISTS (SELECT 1 FROM notification_actor WHERE notification_actor.notificationid = notification.id)",
+		profileId).Scan(&total, &unread)
+	if err != nil {
+		return 0, 0, fmt.Errorf("SelectNotificationCounts failed to count notifications: %w", err)
+	}
+
+	return total, unread, nil
+}
+
+// Marks a notification of a profile as read. Returns false if the profile has no notification
+// with the id.
+func (r *notificationRepo) UpdateNotificationRead(profileId string, id int) (bool, error) {
+	result, err := r.db.Exec("UPDATE notification SET read = 1 WHERE id = ? AND profileid = ?", id, profileId)
+	if err != nil {
+		return false, fmt.Errorf("UpdateNotificationRead failed to update notification: %w", err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("UpdateNotificationRead failed to get rows affected: %w", err)
+	}
+
+	return updated > 0, nil
+}
+
+func (r *notificationRepo) UpdateNotificationsRead(profileId string) error {
+	_, err := r.db.Exec("UPDATE notification SET read = 1 WHERE profileid = ? AND read = 0", profileId)
+	if err != nil {
+		return fmt.Errorf("UpdateNotificationsRead failed to update notifications: %w", err)
+	}
+
+	return nil
+}
+
+// Selects the notification types a profile turned on or off, types it never changed are not
+// included.
+func (r *notificationRepo) SelectNotificationPreferences(profileId string) (map[string]bool, error) {
+	rows, err := r.db.Query("SELECT type, enabled FROM notification_preference WHERE profileid = ?", profileId)
+	if err != nil {
+		return nil, fmt.Errorf("SelectNotificationPreferences failed to select preferences: %w", err)
+	}
+	defer rows.Close()
+
+	result := map[string]bool{}
+	for rows.Next() {
+		var notificationType string
+		var enabled bool
+		if err := rows.Scan(&notificationType, &enabled); err != nil {
+			return nil, fmt.Errorf("SelectNotificationPreferences failed to scan preference: %w", err)
+		}
+		result[notificationType] = enabled
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectNotificationPreferences failed to iterate preferences: %w", err)
+	}
+
+	return result, nil
+}
+
+// Turns notification types on or off for a profile, types not in preferences are left as they
+// are.
+func (r *notificationRepo) UpdateNotificationPreferences(profileId string, preferences map[string]bool) error {
+	types := make([]string, 0, len(preferences))
+	for notificationType := range preferences {
+		types = append(types, notificationType)
+	}
+	sort.Strings(types)
+
+	return repo.Tx(r.db, func(tx *sql.Tx) error {
+		for _, notificationType := range types {
+			if _, err := tx.Exec("INSERT INTO notification_preference(profileid, type, enabled) VALUES (?, ?, ?) ON CONFLICT(profileid, type) DO UPDATE SET enabled = excluded.enabled",
+				profileId, notificationType, preferences[notificationType]); err != nil {
+				return fmt.Errorf("UpdateNotificationPreferences failed to update preference: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,186 @@
+package notification
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+const selectCoalesced = "SELECT id FROM notification WHERE profileid = ? AND type = ? AND subject = ? AND read = 0 AND updated >= ? ORDER BY updated DESC LIMIT 1"
+const insertActor = "INSERT INTO notification_actor(notificationid, actorid, created) VALUES (?, ?, ?) ON CONFLICT(notificationid, actorid) DO UPDATE SET created = excluded.created"
+
+func Test_InsertNotification(t *testing.T) {
+	updated := time.Unix(1700000000, 0)
+	coalesceAfter := updated.Add(-time.Hour)
+	n := Notification{ProfileId: "test-id", Type: "follow", Updated: updated}
+
+	td := []struct {
+		Mock   func(mock sqlmock.Sqlmock)
+		Assert func(err error)
+	}{
+		{
+			Mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(selectCoalesced).
+					WithArgs("test-id", "follow", "", coalesceAfter.Unix()).
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectExec("INSERT INTO notification(profileid, type, subject, created, updated) VALUES (?, ?, ?, ?, ?)").
+					WithArgs("test-id", "follow", "", updated.Unix(), updated.Unix()).
+					WillReturnResult(sqlmock.NewResult(7, 1))
+				mock.ExpectExec(insertActor).
+					WithArgs(7, "actor-id", updated.Unix()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			Assert: func(err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			// an unread notification of the same type about the same subject takes the actor
+			Mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(selectCoalesced).
+					WithArgs("test-id", "follow", "", coalesceAfter.Unix()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+				mock.ExpectExec("UPDATE notification SET updated = ? WHERE id = ?").
+					WithArgs(updated.Unix(), 3).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(insertActor).
+					WithArgs(3, "actor-id", updated.Unix()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			Assert: func(err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			Mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(selectCoalesced).
+					WithArgs("test-id", "follow", "", coalesceAfter.Unix()).
+					WillReturnError(errors.New("failed"))
+				mock.ExpectRollback()
+			},
+			Assert: func(err error) {
+				assert.Error(t, err)
+			},
+		},
+	}
+
+	for _, tr := range td {
+		db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		nr := NewRepo(db)
+		tr.Mock(mock)
+		tr.Assert(nr.InsertNotification(n, "actor-id", coalesceAfter))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	}
+}
+
+func Test_SelectNotifications(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	nr := NewRepo(db)
+	columns := []string{"id", "type", "subject", "read", "created", "updated", "actors", "username", "displayname", "avatarname"}
+	query := `SELECT notification.id, notification.type, notification.subject, notification.read, notification.created, notification.updated,
+		(SELECT COUNT(*) FROM notification_actor WHERE notification_actor.notificationid = notification.id),
+		profile.username, profile.displayname, profile.avatarname
+		FROM notification JOIN profile ON profile.id = (SELECT notification_actor.actorid FROM notification_actor WHERE notification_actor.notificationid = notification.id ORDER BY notification_actor.created DESC, notification_actor.rowid DESC LIMIT 1)
+		WHERE notification.profileid = ?`
+
+	mock.ExpectQuery(query+" ORDER BY notification.updated DESC, notification.id DESC LIMIT ?, ?").
+		WithArgs("test-id", 0, 10).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, "follow", "", false, 1700000000, 1700000100, 12, "actor", "Actor", "avatar.jpg"))
+
+	result, err := nr.SelectNotifications("test-id", false, 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []Notification{{
+		Id:        1,
+		ProfileId: "test-id",
+		Type:      "follow",
+		Actors:    12,
+		Actor:     Actor{Username: "actor", DisplayName: "Actor", AvatarName: "avatar.jpg"},
+		Created:   time.Unix(1700000000, 0),
+		Updated:   time.Unix(1700000100, 0),
+	}}, result)
+
+	mock.ExpectQuery(query+" AND notification.read = 0 ORDER BY notification.updated DESC, notification.id DESC LIMIT ?, ?").
+		WithArgs("test-id", 10, 10).
+		WillReturnRows(sqlmock.NewRows(columns))
+
+	result, err = nr.SelectNotifications("test-id", true, 10, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []Notification{}, result)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectNotificationCounts(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	nr := NewRepo(db)
+
+	mock.ExpectQuery("SELECT COUNT(*), COALESCE(SUM(notification.read = 0), 0) FROM notification WHERE notification.profileid = ? AND EXISTS (SELECT 1 FROM notification_actor WHERE notification_actor.notificationid = notification.id)").
+		WithArgs("test-id").
+		WillReturnRows(sqlmock.NewRows([]string{"total", "unread"}).AddRow(5, 2))
+
+	total, unread, err := nr.SelectNotificationCounts("test-id")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, total)
+	assert.Equal(t, 2, unread)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateNotificationRead(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	nr := NewRepo(db)
+
+	mock.ExpectExec("UPDATE notification SET read = 1 WHERE id = ? AND profileid = ?").
+		WithArgs(1, "test-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE notification SET read = 1 WHERE id = ? AND profileid = ?").
+		WithArgs(2, "test-id").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE notification SET read = 1 WHERE profileid = ? AND read = 0").
+		WithArgs("test-id").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	found, err := nr.UpdateNotificationRead("test-id", 1)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	found, err = nr.UpdateNotificationRead("test-id", 2)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	assert.NoError(t, nr.UpdateNotificationsRead("test-id"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_NotificationPreferences(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	nr := NewRepo(db)
+
+	mock.ExpectQuery("SELECT type, enabled FROM notification_preference WHERE profileid = ?").
+		WithArgs("test-id").
+		WillReturnRows(sqlmock.NewRows([]string{"type", "enabled"}).AddRow("follow", false))
+
+	result, err := nr.SelectNotificationPreferences("test-id")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"follow": false}, result)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO notification_preference(profileid, type, enabled) VALUES (?, ?, ?) ON CONFLICT(profileid, type) DO UPDATE SET enabled = excluded.enabled").
+		WithArgs("test-id", "a", true).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO notification_preference(profileid, type, enabled) VALUES (?, ?, ?) ON CONFLICT(profileid, type) DO UPDATE SET enabled = excluded.enabled").
+		WithArgs("test-id", "b", false).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, nr.UpdateNotificationPreferences("test-id", map[string]bool{"b": false, "a": true}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,88 @@
+package profile
+
+import (
+	"fmt"
+	"time"
+)
+
+// profileColumns for queries joining profile with other tables
+const joinedProfileColumns = "profile.id, profile.username, profile.displayname, profile.bio, profile.website, profile.units, profile.avatarname, profile.usernamechanged, profile.deleteafter, profile.role, profile.suspended"
+
+// Makes one profile follow another, following a profile again changes nothing. Returns true if
+// the profile was not already following the other.
+func (r *profileRepo) InsertFollow(followerId string, followeeId string, created time.Time) (bool, error) {
+	result, err := r.db.Exec("INSERT INTO follow(followerid, followeeid, created) VALUES (?, ?, ?) ON CONFLICT(followerid, followeeid) DO NOTHING",
+		followerId, followeeId, created.Unix())
+	if err != nil {
+		return false, fmt.Errorf("InsertFollow failed to insert follow: %w", err)
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("InsertFollow failed to get rows affected: %w", err)
+	}
+
+	return inserted > 0, nil
+}
+
+func (r *profileRepo) DeleteFollow(followerId string, followeeId string) error {
+	_, err := r.db.Exec("DELETE FROM follow WHERE followerid = ? AND followeeid = ?", followerId, followeeId)
+	if err != nil {
+		return fmt.Errorf("DeleteFollow failed to delete follow: %w", err)
+	}
+
+	return nil
+}
+
+// Selects a page of the profiles following a profile, most recent first. Profiles scheduled
+// for deletion are left out.
+func (r *profileRepo) SelectFollowers(id string, offset int, limit int) ([]Profile, error) {
+	return r.selectFollows("SELECT "+joinedProfileColumns+" FROM follow JOIN profile ON profile.id = follow.followerid WHERE follow.followeeid = ? AND profile.deleteafter = 0 ORDER BY follow.created DESC, profile.id LIMIT ?, ?",
+		id, offset, limit)
+}
+
+// Selects a page of the profiles a profile follows, most recent first. Profiles scheduled for
+// deletion are left out.
+func (r *profileRepo) SelectFollowing(id string, offset int, limit int) ([]Profile, error) {
+	return r.selectFollows("SELECT "+joinedProfileColumns+" FROM follow JOIN profile ON profile.id = follow.followeeid WHERE follow.followerid = ? AND profile.deleteafter = 0 ORDER BY follow.created DESC, profile.id LIMIT ?, ?",
+		id, offset, limit)
+}
+
+func (r *profileRepo) selectFollows(query string, id string, offset int, limit int) ([]Profile, error) {
+	rows, err := r.db.Query(query, id, offset, limit)
+	if err != nil {
+		return nil, fmt.Errorf("selectFollows failed to select profiles: %w", err)
+	}
+	defer rows.Close()
+
+	result := []Profile{}
+	for rows.Next() {
+		var p Profile
+		if err := scanProfile(rows, &p); err != nil {
+			return nil, fmt.Errorf("selectFollows failed to scan profile: %w", err)
+		}
+		result = append(result, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("selectFollows failed to iterate profiles: %w", err)
+	}
+
+	return result, nil
+}
+
+// Counts the profiles following a profile and the profiles it follows, leaving out profiles
+// scheduled for deletion.
+func (r *profileRepo) SelectFollowCounts(id string) (int, int, error) {
+	var followers, following int
+
+	err := r.db.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM follow JOIN profile ON profile.id = follow.followerid WHERE follow.followeeid = ? AND profile.deleteafter = 0),
+		(SELECT COUNT(*) FROM follow JOIN profile ON profile.id = follow.followeeid WHERE follow.followerid = ? AND profile.deleteafter = 0)`,
+		id, id).Scan(&followers, &following)
+	if err != nil {
+		return 0, 0, fmt.Errorf("SelectFollowCounts failed to count follows: %w", err)
+	}
+
+	return followers, following, nil
+}
@@ -0,0 +1,91 @@
+package profile
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_InsertFollow(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	pr := NewRepo(db)
+	created := time.Unix(1700000000, 0)
+
+	mock.ExpectExec("INSERT INTO follow(followerid, followeeid, created) VALUES (?, ?, ?) ON CONFLICT(followerid, followeeid) DO NOTHING").
+		WithArgs("follower-id", "followee-id", created.Unix()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO follow(followerid, followeeid, created) VALUES (?, ?, ?) ON CONFLICT(followerid, followeeid) DO NOTHING").
+		WithArgs("follower-id", "followee-id", created.Unix()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO follow(followerid, followeeid, created) VALUES (?, ?, ?) ON CONFLICT(followerid, followeeid) DO NOTHING").
+		WithArgs("follower-id", "followee-id", created.Unix()).
+		WillReturnError(errors.New("failed"))
+
+	inserted, err := pr.InsertFollow("follower-id", "followee-id", created)
+	assert.NoError(t, err)
+	assert.True(t, inserted)
+
+	inserted, err = pr.InsertFollow("follower-id", "followee-id", created)
+	assert.NoError(t, err)
+	assert.False(t, inserted)
+
+	_, err = pr.InsertFollow("follower-id", "followee-id", created)
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_DeleteFollow(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	pr := NewRepo(db)
+
+	mock.ExpectExec("DELETE FROM follow WHERE followerid = ? AND followeeid = ?").
+		WithArgs("follower-id", "followee-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(t, pr.DeleteFollow("follower-id", "followee-id"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectFollows(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	pr := NewRepo(db)
+	columns := []string{"id", "username", "displayname", "bio", "website", "units", "avatarname", "usernamechanged", "deleteafter", "role", "suspended"}
+
+	mock.ExpectQuery("SELECT profile.id, profile.username, profile.displayname, profile.bio, profile.website, profile.units, profile.avatarname, profile.usernamechanged, profile.deleteafter, profile.role, profile.suspended FROM follow JOIN profile ON profile.id = follow.followerid WHERE follow.followeeid = ? AND profile.deleteafter = 0 ORDER BY follow.created DESC, profile.id LIMIT ?, ?").
+		WithArgs("test-id", 0, 10).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("follower-id", "follower", "Follower", "", "", "metric", "avatar.jpg", 0, 0, "user", 0))
+
+	result, err := pr.SelectFollowers("test-id", 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []Profile{{Id: "follower-id", Username: "follower", DisplayName: "Follower", Units: "metric", AvatarName: "avatar.jpg", Role: "user"}}, result)
+
+	mock.ExpectQuery("SELECT profile.id, profile.username, profile.displayname, profile.bio, profile.website, profile.units, profile.avatarname, profile.usernamechanged, profile.deleteafter, profile.role, profile.suspended FROM follow JOIN profile ON profile.id = follow.followeeid WHERE follow.followerid = ? AND profile.deleteafter = 0 ORDER BY follow.created DESC, profile.id LIMIT ?, ?").
+		WithArgs("test-id", 10, 10).
+		WillReturnRows(sqlmock.NewRows(columns))
+
+	result, err = pr.SelectFollowing("test-id", 10, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []Profile{}, result)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectFollowCounts(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	pr := NewRepo(db)
+
+	mock.ExpectQuery(`SELECT
+		(SELECT COUNT(*) FROM follow JOIN profile ON profile.id = follow.followerid WHERE follow.followeeid = ? AND profile.deleteafter = 0),
+		(SELECT COUNT(*) FROM follow JOIN profile ON profile.id = follow.followeeid WHERE follow.followerid = ? AND profile.deleteafter = 0)`).
+		WithArgs("test-id", "test-id").
+		WillReturnRows(sqlmock.NewRows([]string{"followers", "following"}).AddRow(3, 5))
+
+	followers, following, err := pr.SelectFollowCounts("test-id")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, followers)
+	assert.Equal(t, 5, following)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,54 @@
+package profile
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Builds the where clause and its arguments for the profiles whose username or display name
+// contains query. An empty query matches every profile.
+func searchClause(query string) (string, []interface{}) {
+	if query == "" {
+		return "1 = 1", nil
+	}
+
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+	return `(username LIKE ? ESCAPE '\' OR displayname LIKE ? ESCAPE '\')`, []interface{}{pattern, pattern}
+}
+
+// Selects a page of the profiles whose username or display name contains query, by username.
+// Profiles scheduled for deletion are included.
+func (r *profileRepo) SearchProfiles(query string, offset int, limit int) ([]Profile, error) {
+	where, args := searchClause(query)
+	rows, err := r.db.Query("SELECT "+profileColumns+" FROM profile WHERE "+where+" ORDER BY username LIMIT ?, ?", append(args, offset, limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("SearchProfiles failed to select profiles: %w", err)
+	}
+	defer rows.Close()
+
+	result := []Profile{}
+	for rows.Next() {
+		var p Profile
+		if err := scanProfile(rows, &p); err != nil {
+			return nil, fmt.Errorf("SearchProfiles failed to scan profile: %w", err)
+		}
+		result = append(result, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SearchProfiles failed to iterate profiles: %w", err)
+	}
+
+	return result, nil
+}
+
+func (r *profileRepo) SelectProfileSearchCount(query string) (int, error) {
+	where, args := searchClause(query)
+
+	var count int
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM profile WHERE "+where, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("SelectProfileSearchCount failed to count profiles: %w", err)
+	}
+
+	return count, nil
+}
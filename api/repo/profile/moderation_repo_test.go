@@ -0,0 +1,30 @@
+package profile
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SearchProfiles(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	pr := NewRepo(db)
+	columns := []string{"id", "username", "displayname", "bio", "website", "units", "avatarname", "usernamechanged", "deleteafter", "role", "suspended"}
+
+	mock.ExpectQuery(`SELECT id, username, displayname, bio, website, units, avatarname, usernamechanged, deleteafter, role, suspended FROM profile WHERE (username LIKE ? ESCAPE '\' OR displayname LIKE ? ESCAPE '\') ORDER BY username LIMIT ?, ?`).
+		WithArgs(`%100\%%`, `%100\%%`, 0, 10).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("test-id", "baker100", "", "", "", "metric", "", 0, 0, "moderator", 1))
+	mock.ExpectQuery(`SELECT COUNT(*) FROM profile WHERE 1 = 1`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(12))
+
+	result, err := pr.SearchProfiles("100%", 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []Profile{{Id: "test-id", Username: "baker100", Units: "metric", Role: "moderator", Suspended: true}}, result)
+
+	count, err := pr.SelectProfileSearchCount("")
+	assert.NoError(t, err)
+	assert.Equal(t, 12, count)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -1,6 +1,58 @@
 package profile
 
+import (
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
 type Profile struct {
-	Id       string `json:"id"`
-	Username string `json:"username"`
+	Id              string            `json:"id"`
+	Username        string            `json:"username"`
+	DisplayName     string            `json:"display_name,omitempty"`
+	Bio             string            `json:"bio,omitempty"`
+	Website         string            `json:"website,omitempty"`
+	Units           string            `json:"units"`
+	AvatarName      string            `json:"avatar"`
+	AvatarURLs      map[string]string `json:"avatar_urls,omitempty"`
+	UsernameKey     string            `json:"-"`
+	UsernameChanged time.Time         `json:"-"`
+	DeleteAfter     *time.Time        `json:"delete_after,omitempty"`
+	Role            string            `json:"role"`
+	Suspended       bool              `json:"suspended,omitempty"`
+}
+
+// lower case characters mapped to the character they are most often mistaken for. Usernames
+// are compared regardless of case, so i is mapped too since I looks like l.
+var confusables = map[rune]rune{
+	'0': 'o', '1': 'l', '|': 'l', 'i': 'l',
+	// Cyrillic
+	'а': 'a', 'е': 'e', 'о': 'o', 'р': 'p', 'с': 'c', 'у': 'y', 'х': 'x', 'і': 'l', 'ј': 'j',
+	'ѕ': 's', 'һ': 'h', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w',
+	// Greek
+	'α': 'a', 'ε': 'e', 'η': 'n', 'ι': 'l', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't',
+	'υ': 'u', 'χ': 'x',
+}
+
+// sequences of characters that look like a single one
+var confusableSequences = strings.NewReplacer("rn", "m", "vv", "w")
+
+// Returns the key two usernames that look alike share: the username in lower case, without
+// accents and with confusable characters replaced.
+func UsernameKey(username string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(username) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		r = unicode.ToLower(r)
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		b.WriteRune(r)
+	}
+
+	return confusableSequences.Replace(b.String())
 }
@@ -4,12 +4,57 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"time"
+
+	"github.com/eciccone/rh/api/repo"
 )
 
 type ProfileRepository interface {
 	SelectProfileById(id string) (Profile, error)
 	SelectProfileByUsername(username string) (Profile, error)
-	InsertProfile(profile Profile) error
+	SelectProfileByUsernameKey(key string) (Profile, error)
+	InsertProfile(profile Profile) (bool, error)
+	UpdateProfile(profile Profile) error
+	UpdateProfileAvatarName(id string, avatarName string) error
+	UpdateProfileUsername(id string, username string, key string, changed time.Time) error
+	SelectProfileByRedirect(username string) (Profile, error)
+	UpdateProfileDeleteAfter(id string, deleteAfter *time.Time) error
+	SelectProfilesToDelete(before time.Time) ([]Profile, error)
+	SelectProfileImageNames(id string) ([]string, error)
+	DeleteProfile(id string, deleted time.Time) error
+	SelectProfileTombstone(id string) (time.Time, error)
+	InsertFollow(followerId string, followeeId string, created time.Time) (bool, error)
+	DeleteFollow(followerId string, followeeId string) error
+	SelectFollowers(id string, offset int, limit int) ([]Profile, error)
+	SelectFollowing(id string, offset int, limit int) ([]Profile, error)
+	SelectFollowCounts(id string) (int, int, error)
+	SearchProfiles(query string, offset int, limit int) ([]Profile, error)
+	SelectProfileSearchCount(query string) (int, error)
+}
+
+// columns selected for a profile, in the order scanProfile expects them
+const profileColumns = "id, username, displayname, bio, website, units, avatarname, usernamechanged, deleteafter, role, suspended"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanProfile(row scanner, p *Profile) error {
+	var changed, deleteAfter int64
+	if err := row.Scan(&p.Id, &p.Username, &p.DisplayName, &p.Bio, &p.Website, &p.Units, &p.AvatarName, &changed, &deleteAfter, &p.Role, &p.Suspended); err != nil {
+		return err
+	}
+
+	if changed != 0 {
+		p.UsernameChanged = time.Unix(changed, 0)
+	}
+
+	if deleteAfter != 0 {
+		t := time.Unix(deleteAfter, 0)
+		p.DeleteAfter = &t
+	}
+
+	return nil
 }
 
 type profileRepo struct {
@@ -23,8 +68,8 @@ func NewRepo(db *sql.DB) ProfileRepository {
 func (r *profileRepo) SelectProfileById(id string) (Profile, error) {
 	var result Profile
 
-	row := r.db.QueryRow("SELECT id, username FROM profile WHERE id = ?", id)
-	if err := row.Scan(&result.Id, &result.Username); err != nil {
+	row := r.db.QueryRow("SELECT "+profileColumns+" FROM profile WHERE id = ?", id)
+	if err := scanProfile(row, &result); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Profile{}, err
 		}
@@ -38,8 +83,8 @@ func (r *profileRepo) SelectProfileById(id string) (Profile, error) {
 func (r *profileRepo) SelectProfileByUsername(username string) (Profile, error) {
 	var result Profile
 
-	row := r.db.QueryRow("SELECT id, username FROM profile WHERE username = ?", username)
-	if err := row.Scan(&result.Id, &result.Username); err != nil {
+	row := r.db.QueryRow("SELECT "+profileColumns+" FROM profile WHERE username = ?", username)
+	if err := scanProfile(row, &result); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Profile{}, err
 		}
@@ -50,11 +95,241 @@ func (r *profileRepo) SelectProfileByUsername(username string) (Profile, error)
 	return result, nil
 }
 
-func (r *profileRepo) InsertProfile(profile Profile) error {
-	_, err := r.db.Exec("INSERT INTO profile(id, username) VALUES (?, ?)", profile.Id, profile.Username)
+// Selects the profile whose username looks like the one key was made from.
+func (r *profileRepo) SelectProfileByUsernameKey(key string) (Profile, error) {
+	var result Profile
+
+	row := r.db.QueryRow("SELECT "+profileColumns+" FROM profile WHERE usernamekey = ?", key)
+	if err := scanProfile(row, &result); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Profile{}, err
+		}
+
+		return Profile{}, fmt.Errorf("SelectProfileByUsernameKey failed to select profile: %w", err)
+	}
+
+	return result, nil
+}
+
+// Inserts a profile, clearing the tombstone of a previous profile with the same id.
+// Returns false if the id, the username or the username key is already in use.
+func (r *profileRepo) InsertProfile(profile Profile) (bool, error) {
+	inserted := false
+
+	err := repo.Tx(r.db, func(tx *sql.Tx) error {
+		result, err := tx.Exec("INSERT INTO profile(id, username, usernamekey) VALUES (?, ?, ?) ON CONFLICT DO NOTHING", profile.Id, profile.Username, profile.UsernameKey)
+		if err != nil {
+			return fmt.Errorf("InsertProfile failed to insert profile: %w", err)
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("InsertProfile failed to get rows affected: %w", err)
+		}
+		if n == 0 {
+			return nil
+		}
+		inserted = true
+
+		if _, err := tx.Exec("DELETE FROM profile_tombstone WHERE id = ?", profile.Id); err != nil {
+			return fmt.Errorf("InsertProfile failed to delete tombstone: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return inserted, nil
+}
+
+// Updates the details of a profile a user can edit, its username and avatar are left as they are.
+func (r *profileRepo) UpdateProfile(profile Profile) error {
+	_, err := r.db.Exec("UPDATE profile SET displayname = ?, bio = ?, website = ?, units = ? WHERE id = ?",
+		profile.DisplayName, profile.Bio, profile.Website, profile.Units, profile.Id)
 	if err != nil {
-		return fmt.Errorf("InsertProfile failed to insert profile: %w", err)
+		return fmt.Errorf("UpdateProfile failed to update profile: %w", err)
 	}
 
 	return nil
 }
+
+func (r *profileRepo) UpdateProfileAvatarName(id string, avatarName string) error {
+	_, err := r.db.Exec("UPDATE profile SET avatarname = ? WHERE id = ?", avatarName, id)
+	if err != nil {
+		return fmt.Errorf("UpdateProfileAvatarName failed to update avatar: %w", err)
+	}
+
+	return nil
+}
+
+// Renames a profile along with the recipes it owns, and redirects its previous username to it.
+// Recipes reference profiles by username, so checking foreign keys is deferred until both are
+// renamed.
+func (r *profileRepo) UpdateProfileUsername(id string, username string, key string, changed time.Time) error {
+	return repo.Tx(r.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("PRAGMA defer_foreign_keys = ON"); err != nil {
+			return fmt.Errorf("UpdateProfileUsername failed to defer foreign keys: %w", err)
+		}
+
+		var previous string
+		if err := tx.QueryRow("SELECT username FROM profile WHERE id = ?", id).Scan(&previous); err != nil {
+			return fmt.Errorf("UpdateProfileUsername failed to select profile: %w", err)
+		}
+
+		if _, err := tx.Exec("UPDATE profile SET username = ?, usernamekey = ?, usernamechanged = ? WHERE id = ?", username, key, changed.Unix(), id); err != nil {
+			return fmt.Errorf("UpdateProfileUsername failed to update profile: %w", err)
+		}
+
+		if _, err := tx.Exec("UPDATE recipe SET username = ? WHERE username = ?", username, previous); err != nil {
+			return fmt.Errorf("UpdateProfileUsername failed to update recipes: %w", err)
+		}
+
+		// taking back a previous username
+		if _, err := tx.Exec("DELETE FROM username_redirect WHERE username = ? AND profileid = ?", username, id); err != nil {
+			return fmt.Errorf("UpdateProfileUsername failed to delete redirect: %w", err)
+		}
+
+		if _, err := tx.Exec("INSERT INTO username_redirect(username, profileid, created) VALUES (?, ?, ?)", previous, id, changed.Unix()); err != nil {
+			return fmt.Errorf("UpdateProfileUsername failed to insert redirect: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// Selects the profile a previous username redirects to.
+func (r *profileRepo) SelectProfileByRedirect(username string) (Profile, error) {
+	var result Profile
+
+	row := r.db.QueryRow("SELECT "+profileColumns+" FROM profile WHERE id = (SELECT profileid FROM username_redirect WHERE username = ?)", username)
+	if err := scanProfile(row, &result); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Profile{}, err
+		}
+
+		return Profile{}, fmt.Errorf("SelectProfileByRedirect failed to select profile: %w", err)
+	}
+
+	return result, nil
+}
+
+// Schedules a profile to be deleted after deleteAfter, or cancels its deletion if deleteAfter is
+// nil.
+func (r *profileRepo) UpdateProfileDeleteAfter(id string, deleteAfter *time.Time) error {
+	var unix int64
+	if deleteAfter != nil {
+		unix = deleteAfter.Unix()
+	}
+
+	_, err := r.db.Exec("UPDATE profile SET deleteafter = ? WHERE id = ?", unix, id)
+	if err != nil {
+		return fmt.Errorf("UpdateProfileDeleteAfter failed to update profile: %w", err)
+	}
+
+	return nil
+}
+
+// Selects the profiles scheduled to be deleted at or before before.
+func (r *profileRepo) SelectProfilesToDelete(before time.Time) ([]Profile, error) {
+	rows, err := r.db.Query("SELECT "+profileColumns+" FROM profile WHERE deleteafter <> 0 AND deleteafter <= ?", before.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("SelectProfilesToDelete failed to select profiles: %w", err)
+	}
+	defer rows.Close()
+
+	var result []Profile
+	for rows.Next() {
+		var p Profile
+		if err := scanProfile(rows, &p); err != nil {
+			return nil, fmt.Errorf("SelectProfilesToDelete failed to scan profile: %w", err)
+		}
+		result = append(result, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectProfilesToDelete failed to iterate profiles: %w", err)
+	}
+
+	return result, nil
+}
+
+// Selects the names of every image a profile references: its avatar and the images of its
+// recipes.
+func (r *profileRepo) SelectProfileImageNames(id string) ([]string, error) {
+	rows, err := r.db.Query(`SELECT avatarname FROM profile WHERE id = ? AND avatarname <> ''
+		UNION SELECT recipe.imagename FROM recipe JOIN profile ON recipe.username = profile.username WHERE profile.id = ? AND recipe.imagename <> ''
+		UNION SELECT recipe_image.imagename FROM recipe_image JOIN recipe ON recipe_image.recipeid = recipe.id JOIN profile ON recipe.username = profile.username WHERE profile.id = ?`,
+		id, id, id)
+	if err != nil {
+		return nil, fmt.Errorf("SelectProfileImageNames failed to select images: %w", err)
+	}
+	defer rows.Close()
+
+	var result []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("SelectProfileImageNames failed to scan image: %w", err)
+		}
+		result = append(result, name)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectProfileImageNames failed to iterate images: %w", err)
+	}
+
+	return result, nil
+}
+
+// Deletes a profile and leaves a tombstone in its place. Its recipes, their ingredients, steps,
+// equipment and images, its username redirects and its group memberships are deleted with it by
+// foreign keys. Groups it was the only owner of go to their longest standing member, and groups
+// it was the only member of are deleted, so no group is left without an owner.
+func (r *profileRepo) DeleteProfile(id string, deleted time.Time) error {
+	return repo.Tx(r.db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE group_member SET role = 'owner'
+			WHERE groupid IN (SELECT groupid FROM group_member WHERE profileid = ? AND role = 'owner')
+			AND NOT EXISTS (SELECT 1 FROM group_member owner WHERE owner.groupid = group_member.groupid AND owner.role = 'owner' AND owner.profileid <> ?)
+			AND profileid = (SELECT member.profileid FROM group_member member WHERE member.groupid = group_member.groupid AND member.profileid <> ? ORDER BY member.joined, member.profileid LIMIT 1)`,
+			id, id, id)
+		if err != nil {
+			return fmt.Errorf("DeleteProfile failed to hand over groups: %w", err)
+		}
+
+		_, err = tx.Exec(`DELETE FROM profile_group
+			WHERE id IN (SELECT groupid FROM group_member WHERE profileid = ?)
+			AND NOT EXISTS (SELECT 1 FROM group_member WHERE groupid = profile_group.id AND profileid <> ?)`,
+			id, id)
+		if err != nil {
+			return fmt.Errorf("DeleteProfile failed to delete groups: %w", err)
+		}
+
+		if _, err := tx.Exec("DELETE FROM profile WHERE id = ?", id); err != nil {
+			return fmt.Errorf("DeleteProfile failed to delete profile: %w", err)
+		}
+
+		if _, err := tx.Exec("INSERT OR REPLACE INTO profile_tombstone(id, deleted) VALUES (?, ?)", id, deleted.Unix()); err != nil {
+			return fmt.Errorf("DeleteProfile failed to insert tombstone: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// Selects when the profile with id was deleted, if it was and no profile took its place since.
+func (r *profileRepo) SelectProfileTombstone(id string) (time.Time, error) {
+	var deleted int64
+
+	err := r.db.QueryRow("SELECT deleted FROM profile_tombstone WHERE id = ?", id).Scan(&deleted)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return time.Time{}, err
+		}
+
+		return time.Time{}, fmt.Errorf("SelectProfileTombstone failed to select tombstone: %w", err)
+	}
+
+	return time.Unix(deleted, 0), nil
+}
@@ -1,8 +1,10 @@
 package profile
 
 import (
+	"database/sql"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
@@ -18,11 +20,12 @@ func Test_SelectProfileById(t *testing.T) {
 	}{
 		{
 			Id: "test-id",
-			P:  Profile{Id: "test-id", Username: "Test User"},
+			P:  Profile{Id: "test-id", Username: "Test User", DisplayName: "Test", Bio: "Cooks things", Website: "https://example.com", Units: "metric", AvatarName: "avatar.jpg"},
 			ExpectedSQL: func(mock sqlmock.Sqlmock, profile Profile) {
-				mock.ExpectQuery("SELECT id, username FROM profile WHERE id = ?").
+				mock.ExpectQuery("SELECT id, username, displayname, bio, website, units, avatarname, usernamechanged, deleteafter, role, suspended FROM profile WHERE id = ?").
 					WithArgs(profile.Id).
-					WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(profile.Id, profile.Username))
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "displayname", "bio", "website", "units", "avatarname", "usernamechanged", "deleteafter", "role", "suspended"}).
+						AddRow(profile.Id, profile.Username, profile.DisplayName, profile.Bio, profile.Website, profile.Units, profile.AvatarName, 0, 0, profile.Role, profile.Suspended))
 			},
 			Pass: true,
 			Assert: func(mock sqlmock.Sqlmock, expected, actual Profile, err error) {
@@ -34,7 +37,7 @@ func Test_SelectProfileById(t *testing.T) {
 			Id: "test-id",
 			P:  Profile{},
 			ExpectedSQL: func(mock sqlmock.Sqlmock, profile Profile) {
-				mock.ExpectQuery("SELECT id, username FROM profile WHERE id = ?").
+				mock.ExpectQuery("SELECT id, username, displayname, bio, website, units, avatarname, usernamechanged, deleteafter, role, suspended FROM profile WHERE id = ?").
 					WillReturnError(errors.New("failed"))
 			},
 			Pass: false,
@@ -65,11 +68,12 @@ func Test_SelectProfileByUsername(t *testing.T) {
 	}{
 		{
 			Username: "Test User",
-			P:        Profile{Id: "test-id", Username: "Test User"},
+			P:        Profile{Id: "test-id", Username: "Test User", Units: "imperial"},
 			ExpectedSQL: func(mock sqlmock.Sqlmock, profile Profile) {
-				mock.ExpectQuery("SELECT id, username FROM profile WHERE username = ?").
+				mock.ExpectQuery("SELECT id, username, displayname, bio, website, units, avatarname, usernamechanged, deleteafter, role, suspended FROM profile WHERE username = ?").
 					WithArgs(profile.Username).
-					WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(profile.Id, profile.Username))
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "displayname", "bio", "website", "units", "avatarname", "usernamechanged", "deleteafter", "role", "suspended"}).
+						AddRow(profile.Id, profile.Username, profile.DisplayName, profile.Bio, profile.Website, profile.Units, profile.AvatarName, 0, 0, profile.Role, profile.Suspended))
 			},
 			Pass: true,
 			Assert: func(mock sqlmock.Sqlmock, expected, actual Profile, err error) {
@@ -81,7 +85,7 @@ func Test_SelectProfileByUsername(t *testing.T) {
 			Username: "Test User",
 			P:        Profile{},
 			ExpectedSQL: func(mock sqlmock.Sqlmock, profile Profile) {
-				mock.ExpectQuery("SELECT id, username FROM profile WHERE username = ?").
+				mock.ExpectQuery("SELECT id, username, displayname, bio, website, units, avatarname, usernamechanged, deleteafter, role, suspended FROM profile WHERE username = ?").
 					WillReturnError(errors.New("failed"))
 			},
 			Pass: false,
@@ -102,35 +106,81 @@ func Test_SelectProfileByUsername(t *testing.T) {
 	}
 }
 
+func Test_SelectProfileByUsernameKey(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	pr := NewRepo(db)
+
+	mock.ExpectQuery("SELECT id, username, displayname, bio, website, units, avatarname, usernamechanged, deleteafter, role, suspended FROM profile WHERE usernamekey = ?").
+		WithArgs("bob").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "displayname", "bio", "website", "units", "avatarname", "usernamechanged", "deleteafter", "role", "suspended"}).
+			AddRow("test-id", "B0b", "", "", "", "metric", "", 0, 0, "user", 0))
+
+	result, err := pr.SelectProfileByUsernameKey("bob")
+	assert.NoError(t, err)
+	assert.Equal(t, Profile{Id: "test-id", Username: "B0b", Units: "metric", Role: "user"}, result)
+
+	mock.ExpectQuery("SELECT id, username, displayname, bio, website, units, avatarname, usernamechanged, deleteafter, role, suspended FROM profile WHERE usernamekey = ?").
+		WithArgs("alice").
+		WillReturnError(sql.ErrNoRows)
+
+	_, err = pr.SelectProfileByUsernameKey("alice")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func Test_InsertProfile(t *testing.T) {
 	data := []struct {
 		P           Profile
 		ExpectedSQL func(mock sqlmock.Sqlmock, profile Profile)
 		Pass        bool
-		Assert      func(mock sqlmock.Sqlmock, err error)
+		Assert      func(mock sqlmock.Sqlmock, inserted bool, err error)
 	}{
 		{
-			P: Profile{Id: "test-id", Username: "Test User"},
+			P: Profile{Id: "test-id", Username: "Test-User", UsernameKey: "test-user"},
 			ExpectedSQL: func(mock sqlmock.Sqlmock, profile Profile) {
-				mock.ExpectExec("INSERT INTO profile(id, username) VALUES (?, ?)").
-					WithArgs(profile.Id, profile.Username).
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO profile(id, username, usernamekey) VALUES (?, ?, ?) ON CONFLICT DO NOTHING").
+					WithArgs(profile.Id, profile.Username, profile.UsernameKey).
 					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("DELETE FROM profile_tombstone WHERE id = ?").
+					WithArgs(profile.Id).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
 			},
 			Pass: true,
-			Assert: func(mock sqlmock.Sqlmock, err error) {
+			Assert: func(mock sqlmock.Sqlmock, inserted bool, err error) {
 				assert.NoError(t, err)
+				assert.True(t, inserted)
 			},
 		},
 		{
-			P: Profile{Id: "test-id", Username: "Test User"},
+			P: Profile{Id: "test-id", Username: "Test-User", UsernameKey: "test-user"},
 			ExpectedSQL: func(mock sqlmock.Sqlmock, profile Profile) {
-				mock.ExpectExec("INSERT INTO profile(id, username) VALUES (?, ?)").
-					WithArgs(profile.Id, profile.Username).
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO profile(id, username, usernamekey) VALUES (?, ?, ?) ON CONFLICT DO NOTHING").
+					WithArgs(profile.Id, profile.Username, profile.UsernameKey).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectCommit()
+			},
+			Pass: true,
+			Assert: func(mock sqlmock.Sqlmock, inserted bool, err error) {
+				assert.NoError(t, err)
+				assert.False(t, inserted)
+			},
+		},
+		{
+			P: Profile{Id: "test-id", Username: "Test-User", UsernameKey: "test-user"},
+			ExpectedSQL: func(mock sqlmock.Sqlmock, profile Profile) {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO profile(id, username, usernamekey) VALUES (?, ?, ?) ON CONFLICT DO NOTHING").
+					WithArgs(profile.Id, profile.Username, profile.UsernameKey).
 					WillReturnError(errors.New("failed"))
+				mock.ExpectRollback()
 			},
 			Pass: true,
-			Assert: func(mock sqlmock.Sqlmock, err error) {
+			Assert: func(mock sqlmock.Sqlmock, inserted bool, err error) {
 				assert.Error(t, err)
+				assert.False(t, inserted)
 			},
 		},
 	}
@@ -140,7 +190,238 @@ func Test_InsertProfile(t *testing.T) {
 	for _, d := range data {
 		d.ExpectedSQL(mock, d.P)
 		pr := NewRepo(db)
-		err := pr.InsertProfile(d.P)
-		d.Assert(mock, err)
+		inserted, err := pr.InsertProfile(d.P)
+		d.Assert(mock, inserted, err)
 	}
 }
+
+func Test_UpdateProfile(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	pr := NewRepo(db)
+	p := Profile{Id: "test-id", Username: "Test User", DisplayName: "Test", Bio: "Cooks things", Website: "https://example.com", Units: "imperial"}
+
+	mock.ExpectExec("UPDATE profile SET displayname = ?, bio = ?, website = ?, units = ? WHERE id = ?").
+		WithArgs(p.DisplayName, p.Bio, p.Website, p.Units, p.Id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(t, pr.UpdateProfile(p))
+
+	mock.ExpectExec("UPDATE profile SET displayname = ?, bio = ?, website = ?, units = ? WHERE id = ?").
+		WithArgs(p.DisplayName, p.Bio, p.Website, p.Units, p.Id).
+		WillReturnError(errors.New("failed"))
+
+	assert.Error(t, pr.UpdateProfile(p))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateProfileAvatarName(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	pr := NewRepo(db)
+
+	mock.ExpectExec("UPDATE profile SET avatarname = ? WHERE id = ?").
+		WithArgs("avatar.jpg", "test-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(t, pr.UpdateProfileAvatarName("test-id", "avatar.jpg"))
+
+	mock.ExpectExec("UPDATE profile SET avatarname = ? WHERE id = ?").
+		WithArgs("avatar.jpg", "test-id").
+		WillReturnError(errors.New("failed"))
+
+	assert.Error(t, pr.UpdateProfileAvatarName("test-id", "avatar.jpg"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateProfileUsername(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	pr := NewRepo(db)
+	changed := time.Unix(1700000000, 0)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("PRAGMA defer_foreign_keys = ON").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT username FROM profile WHERE id = ?").
+		WithArgs("test-id").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("old name"))
+	mock.ExpectExec("UPDATE profile SET username = ?, usernamekey = ?, usernamechanged = ? WHERE id = ?").
+		WithArgs("new name", "new name", changed.Unix(), "test-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE recipe SET username = ? WHERE username = ?").
+		WithArgs("new name", "old name").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("DELETE FROM username_redirect WHERE username = ? AND profileid = ?").
+		WithArgs("new name", "test-id").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO username_redirect(username, profileid, created) VALUES (?, ?, ?)").
+		WithArgs("old name", "test-id", changed.Unix()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, pr.UpdateProfileUsername("test-id", "new name", "new name", changed))
+
+	// nothing is renamed when any of it fails
+	mock.ExpectBegin()
+	mock.ExpectExec("PRAGMA defer_foreign_keys = ON").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT username FROM profile WHERE id = ?").
+		WithArgs("test-id").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("old name"))
+	mock.ExpectExec("UPDATE profile SET username = ?, usernamekey = ?, usernamechanged = ? WHERE id = ?").
+		WithArgs("new name", "new name", changed.Unix(), "test-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE recipe SET username = ? WHERE username = ?").
+		WithArgs("new name", "old name").
+		WillReturnError(errors.New("failed"))
+	mock.ExpectRollback()
+
+	assert.Error(t, pr.UpdateProfileUsername("test-id", "new name", "new name", changed))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectProfileByRedirect(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	pr := NewRepo(db)
+
+	mock.ExpectQuery("SELECT id, username, displayname, bio, website, units, avatarname, usernamechanged, deleteafter, role, suspended FROM profile WHERE id = (SELECT profileid FROM username_redirect WHERE username = ?)").
+		WithArgs("old name").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "displayname", "bio", "website", "units", "avatarname", "usernamechanged", "deleteafter", "role", "suspended"}).
+			AddRow("test-id", "new name", "", "", "", "metric", "", 1700000000, 0, "user", 0))
+
+	result, err := pr.SelectProfileByRedirect("old name")
+	assert.NoError(t, err)
+	assert.Equal(t, Profile{Id: "test-id", Username: "new name", Units: "metric", UsernameChanged: time.Unix(1700000000, 0), Role: "user"}, result)
+
+	mock.ExpectQuery("SELECT id, username, displayname, bio, website, units, avatarname, usernamechanged, deleteafter, role, suspended FROM profile WHERE id = (SELECT profileid FROM username_redirect WHERE username = ?)").
+		WithArgs("unknown").
+		WillReturnError(sql.ErrNoRows)
+
+	_, err = pr.SelectProfileByRedirect("unknown")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateProfileDeleteAfter(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	pr := NewRepo(db)
+	deleteAfter := time.Unix(1700000000, 0)
+
+	mock.ExpectExec("UPDATE profile SET deleteafter = ? WHERE id = ?").
+		WithArgs(deleteAfter.Unix(), "test-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE profile SET deleteafter = ? WHERE id = ?").
+		WithArgs(0, "test-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(t, pr.UpdateProfileDeleteAfter("test-id", &deleteAfter))
+	assert.NoError(t, pr.UpdateProfileDeleteAfter("test-id", nil))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectProfilesToDelete(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	pr := NewRepo(db)
+	before := time.Unix(1700000000, 0)
+	deleteAfter := time.Unix(1690000000, 0)
+
+	mock.ExpectQuery("SELECT id, username, displayname, bio, website, units, avatarname, usernamechanged, deleteafter, role, suspended FROM profile WHERE deleteafter <> 0 AND deleteafter <= ?").
+		WithArgs(before.Unix()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "displayname", "bio", "website", "units", "avatarname", "usernamechanged", "deleteafter", "role", "suspended"}).
+			AddRow("test-id", "Test User", "", "", "", "metric", "", 0, deleteAfter.Unix(), "user", 0))
+
+	result, err := pr.SelectProfilesToDelete(before)
+	assert.NoError(t, err)
+	assert.Equal(t, []Profile{{Id: "test-id", Username: "Test User", Units: "metric", DeleteAfter: &deleteAfter, Role: "user"}}, result)
+
+	mock.ExpectQuery("SELECT id, username, displayname, bio, website, units, avatarname, usernamechanged, deleteafter, role, suspended FROM profile WHERE deleteafter <> 0 AND deleteafter <= ?").
+		WithArgs(before.Unix()).
+		WillReturnError(errors.New("failed"))
+
+	_, err = pr.SelectProfilesToDelete(before)
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectProfileImageNames(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	pr := NewRepo(db)
+
+	mock.ExpectQuery(`SELECT avatarname FROM profile WHERE id = ? AND avatarname <> ''
+		UNION SELECT recipe.imagename FROM recipe JOIN profile ON recipe.username = profile.username WHERE profile.id = ? AND recipe.imagename <> ''
+		UNION SELECT recipe_image.imagename FROM recipe_image JOIN recipe ON recipe_image.recipeid = recipe.id JOIN profile ON recipe.username = profile.username WHERE profile.id = ?`).
+		WithArgs("test-id", "test-id", "test-id").
+		WillReturnRows(sqlmock.NewRows([]string{"avatarname"}).AddRow("avatar.jpg").AddRow("cover.jpg").AddRow("step.jpg"))
+
+	result, err := pr.SelectProfileImageNames("test-id")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"avatar.jpg", "cover.jpg", "step.jpg"}, result)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_DeleteProfile(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	pr := NewRepo(db)
+	deleted := time.Unix(1700000000, 0)
+	handOverQuery := `UPDATE group_member SET role = 'owner'
+			WHERE groupid IN (SELECT groupid FROM group_member WHERE profileid = ? AND role = 'owner')
+			AND NOT EXISTS (SELECT 1 FROM group_member owner WHERE owner.groupid = group_member.groupid AND owner.role = 'owner' AND owner.profileid <> ?)
+			AND profileid = (SELECT member.profileid FROM group_member member WHERE member.groupid = group_member.groupid AND member.profileid <> ? ORDER BY member.joined, member.profileid LIMIT 1)`
+	deleteGroupsQuery := `DELETE FROM profile_group
+			WHERE id IN (SELECT groupid FROM group_member WHERE profileid = ?)
+			AND NOT EXISTS (SELECT 1 FROM group_member WHERE groupid = profile_group.id AND profileid <> ?)`
+
+	// groups the profile owned alone are handed over or deleted before its memberships go
+	mock.ExpectBegin()
+	mock.ExpectExec(handOverQuery).
+		WithArgs("test-id", "test-id", "test-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(deleteGroupsQuery).
+		WithArgs("test-id", "test-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM profile WHERE id = ?").
+		WithArgs("test-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT OR REPLACE INTO profile_tombstone(id, deleted) VALUES (?, ?)").
+		WithArgs("test-id", deleted.Unix()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, pr.DeleteProfile("test-id", deleted))
+
+	// the profile and its groups stay when its tombstone can't be recorded
+	mock.ExpectBegin()
+	mock.ExpectExec(handOverQuery).
+		WithArgs("test-id", "test-id", "test-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(deleteGroupsQuery).
+		WithArgs("test-id", "test-id").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM profile WHERE id = ?").
+		WithArgs("test-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT OR REPLACE INTO profile_tombstone(id, deleted) VALUES (?, ?)").
+		WithArgs("test-id", deleted.Unix()).
+		WillReturnError(errors.New("failed"))
+	mock.ExpectRollback()
+
+	assert.Error(t, pr.DeleteProfile("test-id", deleted))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectProfileTombstone(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	pr := NewRepo(db)
+
+	mock.ExpectQuery("SELECT deleted FROM profile_tombstone WHERE id = ?").
+		WithArgs("test-id").
+		WillReturnRows(sqlmock.NewRows([]string{"deleted"}).AddRow(1700000000))
+
+	deleted, err := pr.SelectProfileTombstone("test-id")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Unix(1700000000, 0), deleted)
+
+	mock.ExpectQuery("SELECT deleted FROM profile_tombstone WHERE id = ?").
+		WithArgs("other-id").
+		WillReturnRows(sqlmock.NewRows([]string{"deleted"}))
+
+	_, err = pr.SelectProfileTombstone("other-id")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,29 @@
+package profile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UsernameKey(t *testing.T) {
+	td := []struct {
+		A, B  string
+		Equal bool
+	}{
+		{A: "bob", B: "BOB", Equal: true},
+		{A: "bob", B: "b0b", Equal: true},
+		{A: "bill", B: "bi11", Equal: true},
+		{A: "modern", B: "modem", Equal: true},
+		// Cyrillic а and о
+		{A: "anna", B: "аnnа", Equal: true},
+		{A: "jose", B: "josé", Equal: true},
+		{A: "bob", B: "rob", Equal: false},
+		{A: "Ian", B: "lan", Equal: true},
+		{A: "ann", B: "arm", Equal: false},
+	}
+
+	for _, tr := range td {
+		assert.Equal(t, tr.Equal, UsernameKey(tr.A) == UsernameKey(tr.B), "%s %s", tr.A, tr.B)
+	}
+}
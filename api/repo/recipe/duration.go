@@ -0,0 +1,92 @@
+package recipe
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrDurationFormat  = errors.New("duration must be in ISO 8601 format, e.g. PT1H30M")
+	ErrDurationTooLong = errors.New("duration can be at most a year")
+)
+
+// longest duration a recipe or step can take, well within what time.Duration holds
+const maxDuration = 365 * 24 * time.Hour
+
+// weeks, days, hours, minutes and seconds; years and months are rejected since their length varies
+var durationPattern = regexp.MustCompile(`^P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// Parses an ISO 8601 duration such as PT45M or P1DT2H.
+// Returns ErrDurationFormat if s is not a duration.
+// Returns ErrDurationTooLong if it is longer than a year.
+func ParseDuration(s string) (time.Duration, error) {
+	m := durationPattern.FindStringSubmatch(s)
+	if m == nil || s == "P" || strings.HasSuffix(s, "T") {
+		return 0, ErrDurationFormat
+	}
+
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+
+	var result time.Duration
+	for i, unit := range units {
+		if m[i+1] == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(m[i+1])
+		if err != nil {
+			return 0, ErrDurationFormat
+		}
+
+		// checked before multiplying, which could overflow
+		if time.Duration(n) > maxDuration/unit {
+			return 0, ErrDurationTooLong
+		}
+		result += time.Duration(n) * unit
+	}
+
+	if result > maxDuration {
+		return 0, ErrDurationTooLong
+	}
+
+	return result, nil
+}
+
+// Formats a duration as ISO 8601, the inverse of ParseDuration.
+func FormatDuration(d time.Duration) string {
+	if d <= 0 {
+		return "PT0S"
+	}
+
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	hours := d / time.Hour
+	d -= hours * time.Hour
+	minutes := d / time.Minute
+	d -= minutes * time.Minute
+	seconds := d / time.Second
+
+	var b strings.Builder
+	b.WriteString("P")
+	if days > 0 {
+		fmt.Fprintf(&b, "%dD", days)
+	}
+	if hours > 0 || minutes > 0 || seconds > 0 {
+		b.WriteString("T")
+	}
+	if hours > 0 {
+		fmt.Fprintf(&b, "%dH", hours)
+	}
+	if minutes > 0 {
+		fmt.Fprintf(&b, "%dM", minutes)
+	}
+	if seconds > 0 {
+		fmt.Fprintf(&b, "%dS", seconds)
+	}
+
+	return b.String()
+}
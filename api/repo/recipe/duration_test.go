@@ -0,0 +1,56 @@
+package recipe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseDuration(t *testing.T) {
+	data := []struct {
+		Input    string
+		Expected time.Duration
+		Pass     bool
+	}{
+		{Input: "PT30M", Expected: 30 * time.Minute, Pass: true},
+		{Input: "PT1H30M", Expected: 90 * time.Minute, Pass: true},
+		{Input: "P1DT2H", Expected: 26 * time.Hour, Pass: true},
+		{Input: "P1W", Expected: 7 * 24 * time.Hour, Pass: true},
+		{Input: "PT45S", Expected: 45 * time.Second, Pass: true},
+		{Input: "P", Pass: false},
+		{Input: "PT", Pass: false},
+		{Input: "P1DT", Pass: false},
+		{Input: "P1M", Pass: false},
+		{Input: "30 minutes", Pass: false},
+		{Input: "", Pass: false},
+	}
+
+	for _, input := range []string{"P53W", "P365DT1S", "PT9999999999999999H", "P99999999999999999999D"} {
+		t.Log("TEST: ", input)
+		_, err := ParseDuration(input)
+		assert.Error(t, err)
+	}
+	_, err := ParseDuration("P365D")
+	assert.NoError(t, err)
+	_, err = ParseDuration("PT9999999999999999H")
+	assert.ErrorIs(t, err, ErrDurationTooLong)
+
+	for _, d := range data {
+		t.Log("TEST: ", d.Input)
+		result, err := ParseDuration(d.Input)
+		if d.Pass {
+			assert.NoError(t, err)
+			assert.Equal(t, d.Expected, result)
+		} else {
+			assert.ErrorIs(t, err, ErrDurationFormat)
+		}
+	}
+}
+
+func Test_FormatDuration(t *testing.T) {
+	assert.Equal(t, "PT1H30M", FormatDuration(90*time.Minute))
+	assert.Equal(t, "P1DT2H", FormatDuration(26*time.Hour))
+	assert.Equal(t, "PT45S", FormatDuration(45*time.Second))
+	assert.Equal(t, "PT0S", FormatDuration(0))
+}
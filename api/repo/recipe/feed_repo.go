@@ -0,0 +1,57 @@
+package recipe
+
+import (
+	"fmt"
+	"time"
+)
+
+// Where a page of a feed starts: after the recipe with Id published at Published. The zero
+// cursor starts at the most recent recipe.
+type FeedCursor struct {
+	Published time.Time
+	Id        int
+}
+
+// recipeColumns for queries joining recipe with other tables, followed by when it was published
+const feedColumns = "recipe.id, recipe.name, recipe.username, recipe.imagename, recipe.preptime, recipe.cooktime, recipe.totaltime, recipe.difficulty, recipe.cuisine, recipe.course, recipe.visibility, recipe.published"
+
+// Selects a page of the public recipes of the profiles a profile follows, most recently
+// published first. Does not include ingredients with recipes. Recipes of profiles scheduled for
+// deletion or suspended, and recipes hidden by moderators, are left out.
+func (r *recipeRepo) SelectFeedRecipes(profileId string, after FeedCursor, limit int) ([]Recipe, error) {
+	query := "SELECT " + feedColumns + " FROM follow JOIN profile ON profile.id = follow.followeeid JOIN recipe ON recipe.username = profile.username WHERE follow.followerid = ? AND profile.deleteafter = 0 AND profile.suspended = 0 AND recipe.visibility = 'public' AND recipe.hidden = 0"
+	args := []interface{}{profileId}
+
+	if after != (FeedCursor{}) {
+		query += " AND (recipe.published, recipe.id) < (?, ?)"
+		args = append(args, after.Published.Unix(), after.Id)
+	}
+
+	query += " ORDER BY recipe.published DESC, recipe.id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("SelectFeedRecipes failed to select recipes: %w", err)
+	}
+	defer rows.Close()
+
+	result := []Recipe{}
+	for rows.Next() {
+		var rec Recipe
+		var published int64
+		if err := rows.Scan(&rec.Id, &rec.Name, &rec.Username, &rec.ImageName, &rec.PrepTime, &rec.CookTime, &rec.TotalTime, &rec.Difficulty, &rec.Cuisine, &rec.Course, &rec.Visibility, &published); err != nil {
+			return nil, fmt.Errorf("SelectFeedRecipes failed to scan recipe: %w", err)
+		}
+
+		t := time.Unix(published, 0)
+		rec.Published = &t
+		result = append(result, rec)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectFeedRecipes failed to iterate recipes: %w", err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,35 @@
+package recipe
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SelectFeedRecipes(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	rr := NewRepo(db)
+	published := time.Unix(1700000000, 0)
+	columns := []string{"id", "name", "username", "imagename", "preptime", "cooktime", "totaltime", "difficulty", "cuisine", "course", "visibility", "published"}
+
+	mock.ExpectQuery("SELECT recipe.id, recipe.name, recipe.username, recipe.imagename, recipe.preptime, recipe.cooktime, recipe.totaltime, recipe.difficulty, recipe.cuisine, recipe.course, recipe.visibility, recipe.published FROM follow JOIN profile ON profile.id = follow.followeeid JOIN recipe ON recipe.username = profile.username WHERE follow.followerid = ? AND profile.deleteafter = 0 AND profile.suspended = 0 AND recipe.visibility = 'public' AND recipe.hidden = 0 ORDER BY recipe.published DESC, recipe.id DESC LIMIT ?").
+		WithArgs("test-id", 11).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(2, "Soup", "cook", "", "", "", "", "", "", "", "public", published.Unix()))
+
+	result, err := rr.SelectFeedRecipes("test-id", FeedCursor{}, 11)
+	assert.NoError(t, err)
+	assert.Equal(t, []Recipe{{Id: 2, Name: "Soup", Username: "cook", Visibility: "public", Published: &published}}, result)
+
+	// later pages start after the cursor
+	mock.ExpectQuery("SELECT recipe.id, recipe.name, recipe.username, recipe.imagename, recipe.preptime, recipe.cooktime, recipe.totaltime, recipe.difficulty, recipe.cuisine, recipe.course, recipe.visibility, recipe.published FROM follow JOIN profile ON profile.id = follow.followeeid JOIN recipe ON recipe.username = profile.username WHERE follow.followerid = ? AND profile.deleteafter = 0 AND profile.suspended = 0 AND recipe.visibility = 'public' AND recipe.hidden = 0 AND (recipe.published, recipe.id) < (?, ?) ORDER BY recipe.published DESC, recipe.id DESC LIMIT ?").
+		WithArgs("test-id", published.Unix(), 2, 11).
+		WillReturnError(errors.New("failed"))
+
+	_, err = rr.SelectFeedRecipes("test-id", FeedCursor{Published: published, Id: 2}, 11)
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,145 @@
+package recipe
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eciccone/rh/api/repo"
+)
+
+// Selects the role a recipe is shared with a profile as, or an empty role if it isn't.
+func (r *recipeRepo) SelectRecipeGrantRole(recipeId int, username string) (string, error) {
+	var role string
+	err := r.db.QueryRow("SELECT recipe_grant.role FROM recipe_grant JOIN profile ON profile.id = recipe_grant.profileid WHERE recipe_grant.recipeid = ? AND profile.username = ?", recipeId, username).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("SelectRecipeGrantRole failed to select grant: %w", err)
+	}
+
+	return role, nil
+}
+
+// Selects the role a profile has in a group, or an empty role if it isn't a member.
+func (r *recipeRepo) SelectGroupRole(groupId int, username string) (string, error) {
+	var role string
+	err := r.db.QueryRow("SELECT group_member.role FROM group_member JOIN profile ON profile.id = group_member.profileid WHERE group_member.groupid = ? AND profile.username = ?", groupId, username).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("SelectGroupRole failed to select member: %w", err)
+	}
+
+	return role, nil
+}
+
+// Selects the profiles a recipe is shared with, in the order it was shared with them.
+func (r *recipeRepo) SelectRecipeGrants(recipeId int) ([]Collaborator, error) {
+	rows, err := r.db.Query("SELECT profile.id, profile.username, profile.displayname, profile.avatarname, recipe_grant.role, recipe_grant.created FROM recipe_grant JOIN profile ON profile.id = recipe_grant.profileid WHERE recipe_grant.recipeid = ? ORDER BY recipe_grant.created, profile.username", recipeId)
+	if err != nil {
+		return nil, fmt.Errorf("SelectRecipeGrants failed to select grants: %w", err)
+	}
+	defer rows.Close()
+
+	result := []Collaborator{}
+	for rows.Next() {
+		var c Collaborator
+		var created int64
+		if err := rows.Scan(&c.ProfileId, &c.Username, &c.DisplayName, &c.AvatarName, &c.Role, &created); err != nil {
+			return nil, fmt.Errorf("SelectRecipeGrants failed to scan grant: %w", err)
+		}
+		c.Created = time.Unix(created, 0)
+		result = append(result, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectRecipeGrants failed to iterate grants: %w", err)
+	}
+
+	return result, nil
+}
+
+// Shares a recipe with the profile with username as role, or changes the role it is shared with
+// them as. Returns false if no profile has the username.
+func (r *recipeRepo) UpsertRecipeGrant(recipeId int, username string, role string, created time.Time) (bool, error) {
+	result, err := r.db.Exec(`INSERT INTO recipe_grant(recipeid, profileid, role, created) SELECT ?, id, ?, ? FROM profile WHERE username = ?
+		ON CONFLICT(recipeid, profileid) DO UPDATE SET role = excluded.role`, recipeId, role, created.Unix(), username)
+	if err != nil {
+		return false, fmt.Errorf("UpsertRecipeGrant failed to upsert grant: %w", err)
+	}
+
+	upserted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("UpsertRecipeGrant failed to get rows affected: %w", err)
+	}
+
+	return upserted > 0, nil
+}
+
+// Stops sharing a recipe with the profile with username. Returns false if it wasn't shared with
+// them.
+func (r *recipeRepo) DeleteRecipeGrant(recipeId int, username string) (bool, error) {
+	result, err := r.db.Exec("DELETE FROM recipe_grant WHERE recipeid = ? AND profileid = (SELECT id FROM profile WHERE username = ?)", recipeId, username)
+	if err != nil {
+		return false, fmt.Errorf("DeleteRecipeGrant failed to delete grant: %w", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("DeleteRecipeGrant failed to get rows affected: %w", err)
+	}
+
+	return deleted > 0, nil
+}
+
+// Makes the profile with username the owner of a recipe in place of its current owner, who keeps
+// it shared with them as previousRole unless previousRole is empty. The new owner no longer needs
+// a grant of their own. Returns false if no profile has the username.
+func (r *recipeRepo) UpdateRecipeOwner(recipeId int, username string, previousRole string, created time.Time) (bool, error) {
+	found := false
+
+	err := repo.Tx(r.db, func(tx *sql.Tx) error {
+		var previous string
+		if err := tx.QueryRow("SELECT username FROM recipe WHERE id = ?", recipeId).Scan(&previous); err != nil {
+			return fmt.Errorf("UpdateRecipeOwner failed to select recipe: %w", err)
+		}
+
+		// recipes reference profiles by the username as the profile spells it
+		var ownerId, owner string
+		err := tx.QueryRow("SELECT id, username FROM profile WHERE username = ?", username).Scan(&ownerId, &owner)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("UpdateRecipeOwner failed to select profile: %w", err)
+		}
+		found = true
+
+		if _, err := tx.Exec("UPDATE recipe SET username = ? WHERE id = ?", owner, recipeId); err != nil {
+			return fmt.Errorf("UpdateRecipeOwner failed to update recipe: %w", err)
+		}
+
+		if _, err := tx.Exec("DELETE FROM recipe_grant WHERE recipeid = ? AND profileid = ?", recipeId, ownerId); err != nil {
+			return fmt.Errorf("UpdateRecipeOwner failed to delete grant: %w", err)
+		}
+
+		if previousRole == "" {
+			return nil
+		}
+
+		if _, err := tx.Exec("INSERT OR REPLACE INTO recipe_grant(recipeid, profileid, role, created) SELECT ?, id, ?, ? FROM profile WHERE username = ?", recipeId, previousRole, created.Unix(), previous); err != nil {
+			return fmt.Errorf("UpdateRecipeOwner failed to insert grant: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return found, nil
+}
@@ -0,0 +1,141 @@
+package recipe
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SelectRecipeGrantRole(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	rr := NewRepo(db)
+	query := "SELECT recipe_grant.role FROM recipe_grant JOIN profile ON profile.id = recipe_grant.profileid WHERE recipe_grant.recipeid = ? AND profile.username = ?"
+
+	mock.ExpectQuery(query).WithArgs(1, "editor").
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("editor"))
+	mock.ExpectQuery(query).WithArgs(1, "stranger").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(query).WithArgs(1, "broken").
+		WillReturnError(errors.New("failed"))
+
+	role, err := rr.SelectRecipeGrantRole(1, "editor")
+	assert.NoError(t, err)
+	assert.Equal(t, "editor", role)
+
+	role, err = rr.SelectRecipeGrantRole(1, "stranger")
+	assert.NoError(t, err)
+	assert.Equal(t, "", role)
+
+	_, err = rr.SelectRecipeGrantRole(1, "broken")
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectGroupRole(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	rr := NewRepo(db)
+	query := "SELECT group_member.role FROM group_member JOIN profile ON profile.id = group_member.profileid WHERE group_member.groupid = ? AND profile.username = ?"
+
+	mock.ExpectQuery(query).WithArgs(3, "owner").
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("owner"))
+	mock.ExpectQuery(query).WithArgs(3, "stranger").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(query).WithArgs(3, "broken").
+		WillReturnError(errors.New("failed"))
+
+	role, err := rr.SelectGroupRole(3, "owner")
+	assert.NoError(t, err)
+	assert.Equal(t, "owner", role)
+
+	role, err = rr.SelectGroupRole(3, "stranger")
+	assert.NoError(t, err)
+	assert.Equal(t, "", role)
+
+	_, err = rr.SelectGroupRole(3, "broken")
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectRecipeGrants(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	rr := NewRepo(db)
+
+	mock.ExpectQuery("SELECT profile.id, profile.username, profile.displayname, profile.avatarname, recipe_grant.role, recipe_grant.created FROM recipe_grant JOIN profile ON profile.id = recipe_grant.profileid WHERE recipe_grant.recipeid = ? ORDER BY recipe_grant.created, profile.username").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "displayname", "avatarname", "role", "created"}).
+			AddRow("editor-id", "editor", "Ed", "ed.jpg", "editor", 1700000000))
+
+	result, err := rr.SelectRecipeGrants(1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Collaborator{{ProfileId: "editor-id", Username: "editor", DisplayName: "Ed", AvatarName: "ed.jpg", Role: "editor", Created: time.Unix(1700000000, 0)}}, result)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpsertAndDeleteRecipeGrant(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	rr := NewRepo(db)
+	created := time.Unix(1700000000, 0)
+	upsert := `INSERT INTO recipe_grant(recipeid, profileid, role, created) SELECT ?, id, ?, ? FROM profile WHERE username = ?
+		ON CONFLICT(recipeid, profileid) DO UPDATE SET role = excluded.role`
+
+	mock.ExpectExec(upsert).WithArgs(1, "viewer", created.Unix(), "cook").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(upsert).WithArgs(1, "viewer", created.Unix(), "nobody").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM recipe_grant WHERE recipeid = ? AND profileid = (SELECT id FROM profile WHERE username = ?)").
+		WithArgs(1, "cook").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	upserted, err := rr.UpsertRecipeGrant(1, "cook", "viewer", created)
+	assert.NoError(t, err)
+	assert.True(t, upserted)
+
+	upserted, err = rr.UpsertRecipeGrant(1, "nobody", "viewer", created)
+	assert.NoError(t, err)
+	assert.False(t, upserted)
+
+	deleted, err := rr.DeleteRecipeGrant(1, "cook")
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateRecipeOwner(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	rr := NewRepo(db)
+	created := time.Unix(1700000000, 0)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT username FROM recipe WHERE id = ?").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("owner"))
+	mock.ExpectQuery("SELECT id, username FROM profile WHERE username = ?").WithArgs("COOK").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow("cook-id", "cook"))
+	mock.ExpectExec("UPDATE recipe SET username = ? WHERE id = ?").WithArgs("cook", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM recipe_grant WHERE recipeid = ? AND profileid = ?").WithArgs(1, "cook-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT OR REPLACE INTO recipe_grant(recipeid, profileid, role, created) SELECT ?, id, ?, ? FROM profile WHERE username = ?").
+		WithArgs(1, "editor", created.Unix(), "owner").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT username FROM recipe WHERE id = ?").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("cook"))
+	mock.ExpectQuery("SELECT id, username FROM profile WHERE username = ?").WithArgs("nobody").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectCommit()
+
+	found, err := rr.UpdateRecipeOwner(1, "COOK", "editor", created)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	found, err = rr.UpdateRecipeOwner(1, "nobody", "editor", created)
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
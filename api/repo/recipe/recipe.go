@@ -1,24 +1,92 @@
 package recipe
 
+import (
+	"time"
+
+	"github.com/eciccone/rh/api/repo/imageref"
+)
+
 type Recipe struct {
-	Id          int          `json:"id"`
-	Name        string       `json:"name"`
-	Username    string       `json:"username"`
-	ImageName   string       `json:"image"`
-	Ingredients []Ingredient `json:"ingredients,omitempty"`
-	Steps       []Step       `json:"steps,omitempty"`
+	Id               int                   `json:"id"`
+	Name             string                `json:"name"`
+	Username         string                `json:"username"`
+	ImageName        string                `json:"image"`
+	ImageURLs        map[string]string     `json:"image_urls,omitempty"`
+	ImagePlaceholder *imageref.Placeholder `json:"image_placeholder,omitempty"`
+	PrepTime         string                `json:"prep_time,omitempty"`
+	CookTime         string                `json:"cook_time,omitempty"`
+	TotalTime        string                `json:"total_time,omitempty"`
+	Difficulty       string                `json:"difficulty,omitempty"`
+	Cuisine          string                `json:"cuisine,omitempty"`
+	Course           string                `json:"course,omitempty"`
+	Visibility       string                `json:"visibility"`
+	Hidden           bool                  `json:"hidden,omitempty"`
+	GroupId          *int                  `json:"group_id,omitempty"`
+	OwnerInactive    bool                  `json:"-"`
+	Published        *time.Time            `json:"published,omitempty"`
+	Equipment        []string              `json:"equipment,omitempty"`
+	Ingredients      []Ingredient          `json:"ingredients,omitempty"`
+	Steps            []Step                `json:"steps,omitempty"`
+	Images           []Image               `json:"images,omitempty"`
 }
 
 type Ingredient struct {
-	Id       int    `json:"id"`
-	Name     string `json:"name"`
-	Amount   string `json:"amount"`
-	Unit     string `json:"unit"`
-	RecipeId int    `json:"-"`
+	Id          int     `json:"id"`
+	Name        string  `json:"name"`
+	Amount      string  `json:"amount"`
+	Unit        string  `json:"unit"`
+	Group       string  `json:"group,omitempty"`
+	Position    int     `json:"position"`
+	SubrecipeId *int    `json:"subrecipe_id,omitempty"`
+	Subrecipe   *Recipe `json:"subrecipe,omitempty"`
+	RecipeId    int     `json:"-"`
 }
 
 type Step struct {
-	StepNumber  int    `json:"step_number"`
-	Description string `json:"description"`
-	RecipeId    int    `json:"-"`
+	Id              int     `json:"id"`
+	StepNumber      int     `json:"step_number"`
+	Description     string  `json:"description"`
+	Section         string  `json:"section,omitempty"`
+	Duration        string  `json:"duration,omitempty"`
+	Temperature     int     `json:"temperature,omitempty"`
+	TemperatureUnit string  `json:"temperature_unit,omitempty"`
+	Images          []Image `json:"images,omitempty"`
+	RecipeId        int     `json:"-"`
+}
+
+// An image in a recipe's gallery, or attached to one of its steps when StepId is set. StepNumber
+// is the number that step has.
+type Image struct {
+	Id          int                   `json:"id"`
+	Name        string                `json:"image"`
+	URLs        map[string]string     `json:"urls,omitempty"`
+	Placeholder *imageref.Placeholder `json:"placeholder,omitempty"`
+	Caption     string                `json:"caption,omitempty"`
+	Position    int                   `json:"position"`
+	Cover       bool                  `json:"cover"`
+	StepNumber  *int                  `json:"step_number,omitempty"`
+	StepId      *int                  `json:"-"`
+	RecipeId    int                   `json:"-"`
+}
+
+// A profile a recipe is shared with, as a viewer or editor.
+type Collaborator struct {
+	ProfileId   string            `json:"-"`
+	Username    string            `json:"username"`
+	DisplayName string            `json:"display_name,omitempty"`
+	AvatarName  string            `json:"-"`
+	AvatarURLs  map[string]string `json:"avatar_urls,omitempty"`
+	Role        string            `json:"role"`
+	Created     time.Time         `json:"created"`
+}
+
+// Narrows a listing of recipes, zero values are ignored.
+type Filter struct {
+	MaxTotalTime time.Duration
+	Difficulty   string
+	Cuisine      string
+	Course       string
+
+	// lists the recipes of a group instead of the user's
+	Group int
 }
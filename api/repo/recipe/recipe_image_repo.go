@@ -0,0 +1,136 @@
+package recipe
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/eciccone/rh/api/repo"
+)
+
+// columns selected for a recipe image, along with the number of the step it is attached to
+const recipeImageColumns = "recipe_image.id, recipe_image.imagename, recipe_image.caption, recipe_image.position, recipe_image.cover, recipe_image.stepid, step.stepnumber, recipe_image.recipeid"
+
+const recipeImageFrom = "FROM recipe_image LEFT JOIN step ON step.id = recipe_image.stepid"
+
+func scanRecipeImage(row scanner, i *Image) error {
+	return row.Scan(&i.Id, &i.Name, &i.Caption, &i.Position, &i.Cover, &i.StepId, &i.StepNumber, &i.RecipeId)
+}
+
+// Inserts an image for a recipe after the recipe's existing images.
+func (r *recipeRepo) InsertRecipeImage(image Image) (Image, error) {
+	res, err := r.db.Exec("INSERT INTO recipe_image(imagename, caption, position, cover, stepid, recipeid) VALUES (?, ?, (SELECT COALESCE(MAX(position), 0) + 1 FROM recipe_image WHERE recipeid = ?), ?, ?, ?)",
+		image.Name, image.Caption, image.RecipeId, image.Cover, image.StepId, image.RecipeId)
+	if err != nil {
+		return Image{}, fmt.Errorf("InsertRecipeImage failed to insert image: %w", err)
+	}
+
+	id, _ := res.LastInsertId()
+	if id == 0 {
+		return Image{}, errors.New("InsertRecipeImage no id was generated for image")
+	}
+
+	return r.SelectRecipeImage(int(id))
+}
+
+// Selects a single recipe image.
+func (r *recipeRepo) SelectRecipeImage(id int) (Image, error) {
+	var result Image
+
+	row := r.db.QueryRow("SELECT "+recipeImageColumns+" "+recipeImageFrom+" WHERE recipe_image.id = ?", id)
+	if err := scanRecipeImage(row, &result); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Image{}, err
+		}
+
+		return Image{}, fmt.Errorf("SelectRecipeImage failed to select image: %w", err)
+	}
+
+	return result, nil
+}
+
+// Selects the gallery and step images of a recipe in order.
+func (r *recipeRepo) SelectRecipeImages(recipeId int) ([]Image, error) {
+	var result []Image
+
+	rows, err := r.db.Query("SELECT "+recipeImageColumns+" "+recipeImageFrom+" WHERE recipe_image.recipeid = ? ORDER BY recipe_image.position", recipeId)
+	if err != nil {
+		return nil, fmt.Errorf("SelectRecipeImages failed to select images: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i Image
+		if err := scanRecipeImage(rows, &i); err != nil {
+			return nil, fmt.Errorf("SelectRecipeImages failed to scan row: %w", err)
+		}
+		result = append(result, i)
+	}
+
+	return result, nil
+}
+
+// Updates the caption of a recipe image.
+func (r *recipeRepo) UpdateRecipeImageCaption(id int, caption string) error {
+	_, err := r.db.Exec("UPDATE recipe_image SET caption = ? WHERE id = ?", caption, id)
+	if err != nil {
+		return fmt.Errorf("UpdateRecipeImageCaption failed to update caption: %w", err)
+	}
+
+	return nil
+}
+
+// Makes the image the only cover image of its recipe.
+func (r *recipeRepo) UpdateRecipeCoverImage(recipeId int, imageId int) error {
+	return repo.Tx(r.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE recipe_image SET cover = 0 WHERE recipeid = ?", recipeId); err != nil {
+			return fmt.Errorf("UpdateRecipeCoverImage failed to clear cover: %w", err)
+		}
+
+		if _, err := tx.Exec("UPDATE recipe_image SET cover = 1 WHERE id = ? AND recipeid = ?", imageId, recipeId); err != nil {
+			return fmt.Errorf("UpdateRecipeCoverImage failed to set cover: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// Orders the images of a recipe to match the order of the given image ids.
+func (r *recipeRepo) UpdateRecipeImagePositions(recipeId int, imageIds []int) error {
+	return repo.Tx(r.db, func(tx *sql.Tx) error {
+		for i, id := range imageIds {
+			if _, err := tx.Exec("UPDATE recipe_image SET position = ? WHERE id = ? AND recipeid = ?", i+1, id, recipeId); err != nil {
+				return fmt.Errorf("UpdateRecipeImagePositions failed to update position: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// Selects the id of the recipe an image file belongs to, either as its image or as one of its
+// gallery or step images.
+func (r *recipeRepo) SelectRecipeIdByImageName(imageName string) (int, error) {
+	var result int
+
+	row := r.db.QueryRow("SELECT id FROM recipe WHERE imagename = ? UNION ALL SELECT recipeid FROM recipe_image WHERE imagename = ? LIMIT 1", imageName, imageName)
+	if err := row.Scan(&result); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, err
+		}
+
+		return 0, fmt.Errorf("SelectRecipeIdByImageName failed to select recipe: %w", err)
+	}
+
+	return result, nil
+}
+
+// Deletes a recipe image.
+func (r *recipeRepo) DeleteRecipeImage(id int) error {
+	_, err := r.db.Exec("DELETE FROM recipe_image WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("DeleteRecipeImage failed to delete image: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package recipe
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_InsertRecipeImage(t *testing.T) {
+	stepId := 5
+	stepNumber := 2
+
+	data := []struct {
+		Name        string
+		I           Image
+		ExpectedSQL func(sqlmock.Sqlmock, Image)
+		Assert      func(Image, Image, error)
+	}{
+		{
+			Name: "insert recipe image",
+			I:    Image{Id: 3, Name: "test-img.png", Caption: "Kneading", Position: 4, StepId: &stepId, StepNumber: &stepNumber, RecipeId: 1},
+			ExpectedSQL: func(m sqlmock.Sqlmock, i Image) {
+				m.ExpectExec("INSERT INTO recipe_image(imagename, caption, position, cover, stepid, recipeid) VALUES (?, ?, (SELECT COALESCE(MAX(position), 0) + 1 FROM recipe_image WHERE recipeid = ?), ?, ?, ?)").
+					WithArgs(i.Name, i.Caption, i.RecipeId, i.Cover, i.StepId, i.RecipeId).
+					WillReturnResult(sqlmock.NewResult(int64(i.Id), 1))
+				m.ExpectQuery("SELECT recipe_image.id, recipe_image.imagename, recipe_image.caption, recipe_image.position, recipe_image.cover, recipe_image.stepid, step.stepnumber, recipe_image.recipeid FROM recipe_image LEFT JOIN step ON step.id = recipe_image.stepid WHERE recipe_image.id = ?").
+					WithArgs(i.Id).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "imagename", "caption", "position", "cover", "stepid", "stepnumber", "recipeid"}).
+						AddRow(i.Id, i.Name, i.Caption, i.Position, i.Cover, i.StepId, i.StepNumber, i.RecipeId))
+			},
+			Assert: func(expected, actual Image, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, expected, actual)
+			},
+		},
+		{
+			Name: "insert recipe image error",
+			I:    Image{Name: "test-img.png", RecipeId: 1},
+			ExpectedSQL: func(m sqlmock.Sqlmock, i Image) {
+				m.ExpectExec("INSERT INTO recipe_image(imagename, caption, position, cover, stepid, recipeid) VALUES (?, ?, (SELECT COALESCE(MAX(position), 0) + 1 FROM recipe_image WHERE recipeid = ?), ?, ?, ?)").
+					WithArgs(i.Name, i.Caption, i.RecipeId, i.Cover, i.StepId, i.RecipeId).
+					WillReturnError(errors.New("failed"))
+			},
+			Assert: func(expected, actual Image, err error) {
+				assert.Error(t, err)
+				assert.Equal(t, Image{}, actual)
+			},
+		},
+	}
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+
+	for _, d := range data {
+		t.Log("TEST: ", d.Name)
+		d.ExpectedSQL(mock, d.I)
+		rr := NewRepo(db)
+		result, err := rr.InsertRecipeImage(d.I)
+		d.Assert(d.I, result, err)
+	}
+}
+
+func Test_UpdateRecipeCoverImage(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE recipe_image SET cover = 0 WHERE recipeid = ?").
+		WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("UPDATE recipe_image SET cover = 1 WHERE id = ? AND recipeid = ?").
+		WithArgs(3, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	rr := NewRepo(db)
+	err := rr.UpdateRecipeCoverImage(1, 3)
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateRecipeImagePositions(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE recipe_image SET position = ? WHERE id = ? AND recipeid = ?").
+		WithArgs(1, 5, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE recipe_image SET position = ? WHERE id = ? AND recipeid = ?").
+		WithArgs(2, 4, 1).WillReturnError(errors.New("failed"))
+	mock.ExpectRollback()
+
+	rr := NewRepo(db)
+	err := rr.UpdateRecipeImagePositions(1, []int{5, 4})
+
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectRecipeIdByImageName(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	rr := NewRepo(db)
+
+	mock.ExpectQuery("SELECT id FROM recipe WHERE imagename = ? UNION ALL SELECT recipeid FROM recipe_image WHERE imagename = ? LIMIT 1").
+		WithArgs("test-img.jpg", "test-img.jpg").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+
+	result, err := rr.SelectRecipeIdByImageName("test-img.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, result)
+
+	mock.ExpectQuery("SELECT id FROM recipe WHERE imagename = ? UNION ALL SELECT recipeid FROM recipe_image WHERE imagename = ? LIMIT 1").
+		WithArgs("missing.jpg", "missing.jpg").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	_, err = rr.SelectRecipeIdByImageName("missing.jpg")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_DeleteRecipeImage(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+
+	mock.ExpectExec("DELETE FROM recipe_image WHERE id = ?").
+		WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rr := NewRepo(db)
+	err := rr.DeleteRecipeImage(3)
+
+	assert.NoError(t, err)
+}
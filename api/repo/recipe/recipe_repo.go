@@ -4,7 +4,9 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/eciccone/rh/api/repo"
 )
@@ -12,11 +14,54 @@ import (
 type RecipeRepository interface {
 	InsertRecipe(recipe Recipe) (Recipe, error)
 	SelectRecipeById(id int) (Recipe, error)
-	SelectRecipesByUsername(username string, orderBy string, offset int, limit int) ([]Recipe, error)
-	SelectRecipeCountByUsername(username string) (int, error)
+	SelectRecipesByUsername(username string, filter Filter, orderBy string, offset int, limit int) ([]Recipe, error)
+	SelectRecipeCountByUsername(username string, filter Filter) (int, error)
 	UpdateRecipe(recipe Recipe) (Recipe, error)
 	UpdateRecipeImageName(id int, imageName string) error
 	DeleteRecipe(id int) error
+
+	InsertRecipeImage(image Image) (Image, error)
+	SelectRecipeImage(id int) (Image, error)
+	SelectRecipeImages(recipeId int) ([]Image, error)
+	UpdateRecipeImageCaption(id int, caption string) error
+	UpdateRecipeCoverImage(recipeId int, imageId int) error
+	UpdateRecipeImagePositions(recipeId int, imageIds []int) error
+	SelectRecipeIdByImageName(imageName string) (int, error)
+	DeleteRecipeImage(id int) error
+
+	SelectFeedRecipes(profileId string, after FeedCursor, limit int) ([]Recipe, error)
+
+	SelectRecipeGrantRole(recipeId int, username string) (string, error)
+	SelectRecipeGrants(recipeId int) ([]Collaborator, error)
+	UpsertRecipeGrant(recipeId int, username string, role string, created time.Time) (bool, error)
+	DeleteRecipeGrant(recipeId int, username string) (bool, error)
+	UpdateRecipeOwner(recipeId int, username string, previousRole string, created time.Time) (bool, error)
+	SelectGroupRole(groupId int, username string) (string, error)
+}
+
+// columns selected for a recipe, in the order scanRecipe expects them
+// Whether the owner of a recipe is suspended or scheduled for deletion, which hides their
+// recipes from everyone else.
+const ownerInactive = "EXISTS (SELECT 1 FROM profile WHERE profile.username = recipe.username AND (profile.deleteafter <> 0 OR profile.suspended <> 0))"
+
+const recipeColumns = "id, name, username, imagename, preptime, cooktime, totaltime, difficulty, cuisine, course, visibility, hidden, groupid, " + ownerInactive
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRecipe(row scanner, r *Recipe) error {
+	return row.Scan(&r.Id, &r.Name, &r.Username, &r.ImageName, &r.PrepTime, &r.CookTime, &r.TotalTime, &r.Difficulty, &r.Cuisine, &r.Course, &r.Visibility, &r.Hidden, &r.GroupId, &r.OwnerInactive)
+}
+
+// Converts a validated ISO 8601 duration to seconds so recipes can be sorted and filtered by it.
+func durationSeconds(s string) int {
+	d, err := ParseDuration(s)
+	if err != nil {
+		return 0
+	}
+
+	return int(d.Seconds())
 }
 
 type recipeRepo struct {
@@ -47,7 +92,15 @@ func (r *recipeRepo) InsertRecipe(recipe Recipe) (Recipe, error) {
 			return err
 		}
 
-		result = Recipe{recipe.Id, recipe.Name, recipe.Username, recipe.ImageName, ingredients, steps}
+		equipment, err := r.insertEquipment(tx, recipe.Equipment, recipe.Id)
+		if err != nil {
+			return err
+		}
+
+		recipe.Ingredients = ingredients
+		recipe.Steps = steps
+		recipe.Equipment = equipment
+		result = recipe
 		return nil
 	}
 
@@ -56,7 +109,8 @@ func (r *recipeRepo) InsertRecipe(recipe Recipe) (Recipe, error) {
 
 // Inserts a recipe into the recipe table.
 func (r *recipeRepo) insertRecipe(tx *sql.Tx, recipe Recipe) (Recipe, error) {
-	result, err := tx.Exec("INSERT INTO RECIPE(name, username) VALUES (?, ?)", recipe.Name, recipe.Username)
+	result, err := tx.Exec("INSERT INTO RECIPE(name, username, preptime, cooktime, totaltime, totalseconds, difficulty, cuisine, course, visibility, groupid) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		recipe.Name, recipe.Username, recipe.PrepTime, recipe.CookTime, recipe.TotalTime, durationSeconds(recipe.TotalTime), recipe.Difficulty, recipe.Cuisine, recipe.Course, recipe.Visibility, recipe.GroupId)
 	if err != nil {
 		return Recipe{}, fmt.Errorf("recipe.InsertRecipe() failed to insert recipe: %v", err)
 	}
@@ -76,7 +130,7 @@ func (r *recipeRepo) insertIngredients(tx *sql.Tx, ingredients []Ingredient, rec
 	var result []Ingredient
 
 	for _, ing := range ingredients {
-		res, err := tx.Exec("INSERT INTO INGREDIENT(name, amount, unit, recipeid) VALUES(?, ?, ?, ?)", ing.Name, ing.Amount, ing.Unit, recipeId)
+		res, err := tx.Exec("INSERT INTO INGREDIENT(name, amount, unit, groupname, position, subrecipeid, recipeid) VALUES(?, ?, ?, ?, ?, ?, ?)", ing.Name, ing.Amount, ing.Unit, ing.Group, ing.Position, ing.SubrecipeId, recipeId)
 		if err != nil {
 			return nil, fmt.Errorf("insertIngredients() failed to insert ingredient: %v", err)
 		}
@@ -99,23 +153,55 @@ func (r *recipeRepo) insertSteps(tx *sql.Tx, steps []Step, recipeId int) ([]Step
 	var result []Step
 
 	for _, s := range steps {
-		_, err := tx.Exec("INSERT INTO STEP(stepnumber, description, recipeid) VALUES(?, ?, ?)", s.StepNumber, s.Description, recipeId)
+		s, err := r.insertStep(tx, s, recipeId)
 		if err != nil {
-			return nil, fmt.Errorf("insertSteps failed to insert step: %v", err)
+			return nil, err
 		}
-		s.RecipeId = recipeId
 		result = append(result, s)
 	}
 
 	return result, nil
 }
 
+func (r *recipeRepo) insertStep(tx *sql.Tx, s Step, recipeId int) (Step, error) {
+	res, err := tx.Exec("INSERT INTO STEP(stepnumber, description, section, duration, temperature, temperatureunit, recipeid) VALUES(?, ?, ?, ?, ?, ?, ?)",
+		s.StepNumber, s.Description, s.Section, s.Duration, s.Temperature, s.TemperatureUnit, recipeId)
+	if err != nil {
+		return Step{}, fmt.Errorf("insertSteps failed to insert step: %v", err)
+	}
+
+	stepId, _ := res.LastInsertId()
+	if stepId == 0 {
+		return Step{}, errors.New("insertSteps no id was generated for step")
+	}
+
+	s.Id = int(stepId)
+	s.RecipeId = recipeId
+
+	return s, nil
+}
+
+// Inserts the equipment list into the equipment table, keeping its order.
+func (r *recipeRepo) insertEquipment(tx *sql.Tx, equipment []string, recipeId int) ([]string, error) {
+	var result []string
+
+	for i, e := range equipment {
+		_, err := tx.Exec("INSERT INTO EQUIPMENT(name, position, recipeid) VALUES(?, ?, ?)", e, i+1, recipeId)
+		if err != nil {
+			return nil, fmt.Errorf("insertEquipment failed to insert equipment: %v", err)
+		}
+		result = append(result, e)
+	}
+
+	return result, nil
+}
+
 // Selects a recipe from the database
 func (r *recipeRepo) SelectRecipeById(id int) (Recipe, error) {
 	var result Recipe
 
-	row := r.db.QueryRow("SELECT id, name, username, imagename FROM recipe WHERE id = ?", id)
-	if err := row.Scan(&result.Id, &result.Name, &result.Username, &result.ImageName); err != nil {
+	row := r.db.QueryRow("SELECT "+recipeColumns+" FROM recipe WHERE id = ?", id)
+	if err := scanRecipe(row, &result); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Recipe{}, err
 		}
@@ -133,8 +219,33 @@ func (r *recipeRepo) SelectRecipeById(id int) (Recipe, error) {
 		return Recipe{}, err
 	}
 
+	equipment, err := r.selectEquipment(id)
+	if err != nil {
+		return Recipe{}, err
+	}
+
+	images, err := r.SelectRecipeImages(id)
+	if err != nil {
+		return Recipe{}, err
+	}
+
+	// step images go with their step, the rest make up the gallery
+	for _, i := range images {
+		if i.StepId == nil {
+			result.Images = append(result.Images, i)
+			continue
+		}
+
+		for s := range steps {
+			if steps[s].Id == *i.StepId {
+				steps[s].Images = append(steps[s].Images, i)
+			}
+		}
+	}
+
 	result.Ingredients = ingredients
 	result.Steps = steps
+	result.Equipment = equipment
 
 	return result, nil
 }
@@ -143,7 +254,7 @@ func (r *recipeRepo) SelectRecipeById(id int) (Recipe, error) {
 func (r *recipeRepo) selectIngredients(recipeId int) ([]Ingredient, error) {
 	var result []Ingredient
 
-	rows, err := r.db.Query("SELECT id, name, amount, unit, recipeid FROM ingredient WHERE recipeid = ?", recipeId)
+	rows, err := r.db.Query("SELECT id, name, amount, unit, groupname, position, subrecipeid, recipeid FROM ingredient WHERE recipeid = ? ORDER BY position, id", recipeId)
 	if err != nil {
 		return []Ingredient{}, fmt.Errorf("selectIngredients() failed to select ingredients: %v", err)
 	}
@@ -151,7 +262,7 @@ func (r *recipeRepo) selectIngredients(recipeId int) ([]Ingredient, error) {
 
 	for rows.Next() {
 		var i Ingredient
-		if err := rows.Scan(&i.Id, &i.Name, &i.Amount, &i.Unit, &i.RecipeId); err != nil {
+		if err := rows.Scan(&i.Id, &i.Name, &i.Amount, &i.Unit, &i.Group, &i.Position, &i.SubrecipeId, &i.RecipeId); err != nil {
 			return []Ingredient{}, fmt.Errorf("selectIngredients() failed to scan row: %v", err)
 		}
 		result = append(result, i)
@@ -163,7 +274,7 @@ func (r *recipeRepo) selectIngredients(recipeId int) ([]Ingredient, error) {
 func (r *recipeRepo) selectSteps(recipeId int) ([]Step, error) {
 	result := []Step{}
 
-	rows, err := r.db.Query("SELECT stepnumber, description, recipeid FROM step WHERE recipeid = ?", recipeId)
+	rows, err := r.db.Query("SELECT id, stepnumber, description, section, duration, temperature, temperatureunit, recipeid FROM step WHERE recipeid = ? ORDER BY stepnumber", recipeId)
 	if err != nil {
 		return []Step{}, fmt.Errorf("selectSteps failed to select steps: %v", err)
 	}
@@ -171,7 +282,7 @@ func (r *recipeRepo) selectSteps(recipeId int) ([]Step, error) {
 
 	for rows.Next() {
 		var s Step
-		if err := rows.Scan(&s.StepNumber, &s.Description, &s.RecipeId); err != nil {
+		if err := rows.Scan(&s.Id, &s.StepNumber, &s.Description, &s.Section, &s.Duration, &s.Temperature, &s.TemperatureUnit, &s.RecipeId); err != nil {
 			return []Step{}, fmt.Errorf("selectSteps failed to scan row: %v", err)
 		}
 		result = append(result, s)
@@ -180,12 +291,69 @@ func (r *recipeRepo) selectSteps(recipeId int) ([]Step, error) {
 	return result, nil
 }
 
+func (r *recipeRepo) selectEquipment(recipeId int) ([]string, error) {
+	var result []string
+
+	rows, err := r.db.Query("SELECT name FROM equipment WHERE recipeid = ? ORDER BY position", recipeId)
+	if err != nil {
+		return nil, fmt.Errorf("selectEquipment failed to select equipment: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e string
+		if err := rows.Scan(&e); err != nil {
+			return nil, fmt.Errorf("selectEquipment failed to scan row: %v", err)
+		}
+		result = append(result, e)
+	}
+
+	return result, nil
+}
+
+// Builds the where clause and its arguments for the recipes of a user narrowed by filter. When
+// filter has a group the recipes of the group are used instead, leaving out those hidden from
+// the user and those of members who are suspended or scheduled for deletion.
+func filterClause(username string, filter Filter) (string, []interface{}) {
+	where := "username = ?"
+	args := []interface{}{username}
+
+	if filter.Group > 0 {
+		where = "groupid = ? AND ((hidden = 0 AND NOT " + ownerInactive + ") OR username = ?)"
+		args = []interface{}{filter.Group, username}
+	}
+
+	if filter.MaxTotalTime > 0 {
+		where += " AND totalseconds > 0 AND totalseconds <= ?"
+		args = append(args, int(filter.MaxTotalTime.Seconds()))
+	}
+
+	if filter.Difficulty != "" {
+		where += " AND difficulty = ?"
+		args = append(args, filter.Difficulty)
+	}
+
+	if filter.Cuisine != "" {
+		where += " AND cuisine = ? COLLATE NOCASE"
+		args = append(args, filter.Cuisine)
+	}
+
+	if filter.Course != "" {
+		where += " AND course = ? COLLATE NOCASE"
+		args = append(args, filter.Course)
+	}
+
+	return where, args
+}
+
 // Selects a page of recipes for a user. Does not include ingredients with recipes.
-func (r *recipeRepo) SelectRecipesByUsername(username string, orderBy string, offset int, limit int) ([]Recipe, error) {
+// orderBy is placed into the query as is and must come from a trusted list of orderings.
+func (r *recipeRepo) SelectRecipesByUsername(username string, filter Filter, orderBy string, offset int, limit int) ([]Recipe, error) {
 	var result []Recipe
 
-	sql := "SELECT id, name, username, imagename FROM recipe WHERE username = ? ORDER BY ? LIMIT ?, ?"
-	rows, err := r.db.Query(sql, username, orderBy, offset, limit)
+	where, args := filterClause(username, filter)
+	sql := fmt.Sprintf("SELECT %s FROM recipe WHERE %s ORDER BY %s LIMIT ?, ?", recipeColumns, where, orderBy)
+	rows, err := r.db.Query(sql, append(args, offset, limit)...)
 	if err != nil {
 		return []Recipe{}, fmt.Errorf("SelectRecipesByUsername() failed to select recipes: %v", err)
 	}
@@ -193,7 +361,7 @@ func (r *recipeRepo) SelectRecipesByUsername(username string, orderBy string, of
 
 	for rows.Next() {
 		var r Recipe
-		if err := rows.Scan(&r.Id, &r.Name, &r.Username, &r.ImageName); err != nil {
+		if err := scanRecipe(rows, &r); err != nil {
 			return []Recipe{}, fmt.Errorf("SelectRecipesByUsername() failed to scan row: %v", err)
 		}
 		result = append(result, r)
@@ -202,8 +370,9 @@ func (r *recipeRepo) SelectRecipesByUsername(username string, orderBy string, of
 	return result, nil
 }
 
-func (r *recipeRepo) SelectRecipeCountByUsername(username string) (int, error) {
-	rows, err := r.db.Query("SELECT COUNT(*) FROM recipe WHERE username = ?", username)
+func (r *recipeRepo) SelectRecipeCountByUsername(username string, filter Filter) (int, error) {
+	where, args := filterClause(username, filter)
+	rows, err := r.db.Query("SELECT COUNT(*) FROM recipe WHERE "+where, args...)
 	if err != nil {
 		return 0, fmt.Errorf("SelectRecipeCountByUsername failed to select count: %w", err)
 	}
@@ -224,7 +393,8 @@ func (r *recipeRepo) UpdateRecipe(recipe Recipe) (Recipe, error) {
 	var result Recipe
 
 	err := repo.Tx(r.db, func(tx *sql.Tx) error {
-		_, err := tx.Exec("UPDATE recipe SET name = ?, imagename = ? WHERE id = ?", recipe.Name, recipe.ImageName, recipe.Id)
+		_, err := tx.Exec("UPDATE recipe SET name = ?, imagename = ?, preptime = ?, cooktime = ?, totaltime = ?, totalseconds = ?, difficulty = ?, cuisine = ?, course = ?, visibility = ?, groupid = ? WHERE id = ?",
+			recipe.Name, recipe.ImageName, recipe.PrepTime, recipe.CookTime, recipe.TotalTime, durationSeconds(recipe.TotalTime), recipe.Difficulty, recipe.Cuisine, recipe.Course, recipe.Visibility, recipe.GroupId, recipe.Id)
 		if err != nil {
 			return err
 		}
@@ -239,7 +409,19 @@ func (r *recipeRepo) UpdateRecipe(recipe Recipe) (Recipe, error) {
 			return fmt.Errorf("UpdateRecipe failed to update steps: %w", err)
 		}
 
-		result = Recipe{recipe.Id, recipe.Name, recipe.Username, recipe.ImageName, ingredients, steps}
+		if _, err := tx.Exec("DELETE FROM equipment WHERE recipeid = ?", recipe.Id); err != nil {
+			return fmt.Errorf("UpdateRecipe failed to delete equipment: %w", err)
+		}
+
+		equipment, err := r.insertEquipment(tx, recipe.Equipment, recipe.Id)
+		if err != nil {
+			return fmt.Errorf("UpdateRecipe failed to update equipment: %w", err)
+		}
+
+		recipe.Ingredients = ingredients
+		recipe.Steps = steps
+		recipe.Equipment = equipment
+		result = recipe
 
 		return nil
 	})
@@ -277,7 +459,7 @@ func (r *recipeRepo) updateIngredients(tx *sql.Tx, ingredients []Ingredient, rec
 		}
 		// update the kept ingredients
 		for _, i := range existingIngredients {
-			_, err := tx.Exec("UPDATE ingredient SET name = ?, amount = ?, unit = ? WHERE id = ?", i.Name, i.Amount, i.Unit, i.Id)
+			_, err := tx.Exec("UPDATE ingredient SET name = ?, amount = ?, unit = ?, groupname = ?, position = ?, subrecipeid = ? WHERE id = ?", i.Name, i.Amount, i.Unit, i.Group, i.Position, i.SubrecipeId, i.Id)
 			if err != nil {
 				return []Ingredient{}, fmt.Errorf("updateIngredients() error updating ingredient: %v", err)
 			}
@@ -292,48 +474,77 @@ func (r *recipeRepo) updateIngredients(tx *sql.Tx, ingredients []Ingredient, rec
 	}
 	result = append(result, i...)
 
+	// kept and new ingredients were handled separately, restore the requested order
+	sort.SliceStable(result, func(a, b int) bool {
+		return result[a].Position < result[b].Position
+	})
+
 	return result, nil
 }
 
+// Updates the steps of a recipe. Steps with the id of one of its steps are kept, possibly under
+// a new number, steps without one are inserted and the steps left out are deleted along with
+// their images. Step images refer to their step by id, so they stay with it when it moves.
 func (r *recipeRepo) upsertStep(tx *sql.Tx, steps []Step, recipeId int) ([]Step, error) {
-	if len(steps) == 0 {
-		_, err := tx.Exec("DELETE FROM step WHERE recipeid = ?", recipeId)
-		if err != nil {
-			return []Step{}, fmt.Errorf("upsertStep failed to delete steps: %w", err)
+	rows, err := tx.Query("SELECT id FROM step WHERE recipeid = ?", recipeId)
+	if err != nil {
+		return []Step{}, fmt.Errorf("upsertStep failed to select steps: %w", err)
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return []Step{}, fmt.Errorf("upsertStep failed to scan row: %w", err)
 		}
-		return []Step{}, nil
+		ids = append(ids, id)
 	}
+	rows.Close()
 
-	var stepNumbers []interface{}
+	current := map[int]bool{}
+	for _, id := range ids {
+		current[id] = true
+	}
 
+	kept := map[int]bool{}
 	for _, s := range steps {
-		stepNumbers = append(stepNumbers, s.StepNumber)
+		if current[s.Id] {
+			kept[s.Id] = true
+		}
+	}
 
-		res, err := tx.Exec("UPDATE step SET description = ? WHERE stepnumber = ? AND recipeid = ?", s.Description, s.StepNumber, recipeId)
-		if err != nil {
-			return []Step{}, fmt.Errorf("upsertStep failed to update step: %w", err)
+	for _, id := range ids {
+		if kept[id] {
+			continue
 		}
 
-		rowsAffected, err := res.RowsAffected()
-		if err != nil {
-			return []Step{}, fmt.Errorf("upsertStep failed to get rows affected; %w", err)
+		if _, err := tx.Exec("DELETE FROM step WHERE id = ?", id); err != nil {
+			return []Step{}, fmt.Errorf("upsertStep failed to delete step: %w", err)
 		}
-		if rowsAffected == 0 {
-			_, err = tx.Exec("INSERT INTO STEP(stepnumber, description, recipeid) VALUES(?, ?, ?)", s.StepNumber, s.Description, recipeId)
+	}
+
+	result := []Step{}
+	for _, s := range steps {
+		if !kept[s.Id] {
+			s, err := r.insertStep(tx, s, recipeId)
 			if err != nil {
 				return []Step{}, fmt.Errorf("upsertStep failed to insert step: %w", err)
 			}
+			result = append(result, s)
+			continue
 		}
-	}
 
-	questionMarks := "?" + strings.Repeat(", ?", len(stepNumbers)-1)
-	sql := fmt.Sprintf("DELETE FROM step WHERE recipeid = %d AND stepnumber NOT IN (%s)", recipeId, questionMarks)
-	_, err := tx.Exec(sql, stepNumbers...)
-	if err != nil {
-		return []Step{}, fmt.Errorf("upsertStep failed to delete old steps: %w", err)
+		_, err := tx.Exec("UPDATE step SET stepnumber = ?, description = ?, section = ?, duration = ?, temperature = ?, temperatureunit = ? WHERE id = ?",
+			s.StepNumber, s.Description, s.Section, s.Duration, s.Temperature, s.TemperatureUnit, s.Id)
+		if err != nil {
+			return []Step{}, fmt.Errorf("upsertStep failed to update step: %w", err)
+		}
+		s.RecipeId = recipeId
+		result = append(result, s)
 	}
 
-	return steps, nil
+	return result, nil
 }
 
 // Deletes all ingredients associated with a recipe
@@ -3,6 +3,7 @@ package recipe
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
@@ -50,7 +51,7 @@ func Test_SelectRecipeCountByUsername(t *testing.T) {
 		t.Log("TEST: ", d.Name)
 		d.ExpectedSQL(mock, d.Username)
 		rr := NewRepo(db)
-		count, err := rr.SelectRecipeCountByUsername(d.Username)
+		count, err := rr.SelectRecipeCountByUsername(d.Username, Filter{})
 		d.Assert(mock, count, err)
 	}
 }
@@ -176,21 +177,24 @@ func Test_UpdateRecipe(t *testing.T) {
 			},
 			ExpectedSQL: func(m sqlmock.Sqlmock, recipe Recipe) {
 				m.ExpectBegin()
-				m.ExpectExec("UPDATE recipe SET name = ?, imagename = ? WHERE id = ?").
-					WithArgs(recipe.Name, recipe.ImageName, recipe.Id).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("UPDATE recipe SET name = ?, imagename = ?, preptime = ?, cooktime = ?, totaltime = ?, totalseconds = ?, difficulty = ?, cuisine = ?, course = ?, visibility = ?, groupid = ? WHERE id = ?").
+					WithArgs(recipe.Name, recipe.ImageName, recipe.PrepTime, recipe.CookTime, recipe.TotalTime, 0, recipe.Difficulty, recipe.Cuisine, recipe.Course, recipe.Visibility, recipe.GroupId, recipe.Id).WillReturnResult(sqlmock.NewResult(0, 1))
 
 				m.ExpectExec("DELETE FROM ingredient WHERE recipeid = 1 AND id NOT IN (?)").
 					WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 0))
 
-				m.ExpectExec("UPDATE ingredient SET name = ?, amount = ?, unit = ? WHERE id = ?").
-					WithArgs(recipe.Ingredients[0].Name, recipe.Ingredients[0].Amount, recipe.Ingredients[0].Unit, recipe.Ingredients[0].Id).
+				m.ExpectExec("UPDATE ingredient SET name = ?, amount = ?, unit = ?, groupname = ?, position = ?, subrecipeid = ? WHERE id = ?").
+					WithArgs(recipe.Ingredients[0].Name, recipe.Ingredients[0].Amount, recipe.Ingredients[0].Unit, recipe.Ingredients[0].Group, recipe.Ingredients[0].Position, recipe.Ingredients[0].SubrecipeId, recipe.Ingredients[0].Id).
 					WillReturnResult(sqlmock.NewResult(0, 1))
 
-				m.ExpectExec("INSERT INTO INGREDIENT(name, amount, unit, recipeid) VALUES(?, ?, ?, ?)").
-					WithArgs(recipe.Ingredients[1].Name, recipe.Ingredients[1].Amount, recipe.Ingredients[1].Unit, recipe.Ingredients[1].RecipeId).
+				m.ExpectExec("INSERT INTO INGREDIENT(name, amount, unit, groupname, position, subrecipeid, recipeid) VALUES(?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(recipe.Ingredients[1].Name, recipe.Ingredients[1].Amount, recipe.Ingredients[1].Unit, recipe.Ingredients[1].Group, recipe.Ingredients[1].Position, recipe.Ingredients[1].SubrecipeId, recipe.Ingredients[1].RecipeId).
 					WillReturnResult(sqlmock.NewResult(2, 1))
 
-				m.ExpectExec("DELETE FROM step WHERE recipeid = ?").
+				m.ExpectQuery("SELECT id FROM step WHERE recipeid = ?").
+					WithArgs(recipe.Id).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				m.ExpectExec("DELETE FROM equipment WHERE recipeid = ?").
 					WithArgs(recipe.Id).
 					WillReturnResult(sqlmock.NewResult(0, 0))
 				m.ExpectCommit()
@@ -221,21 +225,24 @@ func Test_UpdateRecipe(t *testing.T) {
 			},
 			ExpectedSQL: func(m sqlmock.Sqlmock, recipe Recipe) {
 				m.ExpectBegin()
-				m.ExpectExec("UPDATE recipe SET name = ?, imagename = ? WHERE id = ?").
-					WithArgs(recipe.Name, recipe.ImageName, recipe.Id).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("UPDATE recipe SET name = ?, imagename = ?, preptime = ?, cooktime = ?, totaltime = ?, totalseconds = ?, difficulty = ?, cuisine = ?, course = ?, visibility = ?, groupid = ? WHERE id = ?").
+					WithArgs(recipe.Name, recipe.ImageName, recipe.PrepTime, recipe.CookTime, recipe.TotalTime, 0, recipe.Difficulty, recipe.Cuisine, recipe.Course, recipe.Visibility, recipe.GroupId, recipe.Id).WillReturnResult(sqlmock.NewResult(0, 1))
 
 				m.ExpectExec("DELETE FROM ingredient WHERE recipeid = ?").
 					WithArgs(recipe.Id).WillReturnResult(sqlmock.NewResult(0, 0))
 
-				m.ExpectExec("INSERT INTO INGREDIENT(name, amount, unit, recipeid) VALUES(?, ?, ?, ?)").
-					WithArgs(recipe.Ingredients[0].Name, recipe.Ingredients[0].Amount, recipe.Ingredients[0].Unit, recipe.Ingredients[0].RecipeId).
+				m.ExpectExec("INSERT INTO INGREDIENT(name, amount, unit, groupname, position, subrecipeid, recipeid) VALUES(?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(recipe.Ingredients[0].Name, recipe.Ingredients[0].Amount, recipe.Ingredients[0].Unit, recipe.Ingredients[0].Group, recipe.Ingredients[0].Position, recipe.Ingredients[0].SubrecipeId, recipe.Ingredients[0].RecipeId).
 					WillReturnResult(sqlmock.NewResult(1, 1))
 
-				m.ExpectExec("INSERT INTO INGREDIENT(name, amount, unit, recipeid) VALUES(?, ?, ?, ?)").
-					WithArgs(recipe.Ingredients[1].Name, recipe.Ingredients[1].Amount, recipe.Ingredients[1].Unit, recipe.Ingredients[1].RecipeId).
+				m.ExpectExec("INSERT INTO INGREDIENT(name, amount, unit, groupname, position, subrecipeid, recipeid) VALUES(?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(recipe.Ingredients[1].Name, recipe.Ingredients[1].Amount, recipe.Ingredients[1].Unit, recipe.Ingredients[1].Group, recipe.Ingredients[1].Position, recipe.Ingredients[1].SubrecipeId, recipe.Ingredients[1].RecipeId).
 					WillReturnResult(sqlmock.NewResult(2, 1))
 
-				m.ExpectExec("DELETE FROM step WHERE recipeid = ?").
+				m.ExpectQuery("SELECT id FROM step WHERE recipeid = ?").
+					WithArgs(recipe.Id).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				m.ExpectExec("DELETE FROM equipment WHERE recipeid = ?").
 					WithArgs(recipe.Id).
 					WillReturnResult(sqlmock.NewResult(0, 0))
 				m.ExpectCommit()
@@ -266,21 +273,25 @@ func Test_UpdateRecipe(t *testing.T) {
 			},
 			ExpectedSQL: func(m sqlmock.Sqlmock, recipe Recipe) {
 				m.ExpectBegin()
-				m.ExpectExec("UPDATE recipe SET name = ?, imagename = ? WHERE id = ?").
-					WithArgs(recipe.Name, recipe.ImageName, recipe.Id).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("UPDATE recipe SET name = ?, imagename = ?, preptime = ?, cooktime = ?, totaltime = ?, totalseconds = ?, difficulty = ?, cuisine = ?, course = ?, visibility = ?, groupid = ? WHERE id = ?").
+					WithArgs(recipe.Name, recipe.ImageName, recipe.PrepTime, recipe.CookTime, recipe.TotalTime, 0, recipe.Difficulty, recipe.Cuisine, recipe.Course, recipe.Visibility, recipe.GroupId, recipe.Id).WillReturnResult(sqlmock.NewResult(0, 1))
 
 				m.ExpectExec("DELETE FROM ingredient WHERE recipeid = 1 AND id NOT IN (?, ?)").
 					WithArgs(1, 2).WillReturnResult(sqlmock.NewResult(0, 0))
 
-				m.ExpectExec("UPDATE ingredient SET name = ?, amount = ?, unit = ? WHERE id = ?").
-					WithArgs(recipe.Ingredients[0].Name, recipe.Ingredients[0].Amount, recipe.Ingredients[0].Unit, recipe.Ingredients[0].Id).
+				m.ExpectExec("UPDATE ingredient SET name = ?, amount = ?, unit = ?, groupname = ?, position = ?, subrecipeid = ? WHERE id = ?").
+					WithArgs(recipe.Ingredients[0].Name, recipe.Ingredients[0].Amount, recipe.Ingredients[0].Unit, recipe.Ingredients[0].Group, recipe.Ingredients[0].Position, recipe.Ingredients[0].SubrecipeId, recipe.Ingredients[0].Id).
 					WillReturnResult(sqlmock.NewResult(0, 1))
 
-				m.ExpectExec("UPDATE ingredient SET name = ?, amount = ?, unit = ? WHERE id = ?").
-					WithArgs(recipe.Ingredients[1].Name, recipe.Ingredients[1].Amount, recipe.Ingredients[1].Unit, recipe.Ingredients[1].Id).
+				m.ExpectExec("UPDATE ingredient SET name = ?, amount = ?, unit = ?, groupname = ?, position = ?, subrecipeid = ? WHERE id = ?").
+					WithArgs(recipe.Ingredients[1].Name, recipe.Ingredients[1].Amount, recipe.Ingredients[1].Unit, recipe.Ingredients[1].Group, recipe.Ingredients[1].Position, recipe.Ingredients[1].SubrecipeId, recipe.Ingredients[1].Id).
 					WillReturnResult(sqlmock.NewResult(0, 1))
 
-				m.ExpectExec("DELETE FROM step WHERE recipeid = ?").
+				m.ExpectQuery("SELECT id FROM step WHERE recipeid = ?").
+					WithArgs(recipe.Id).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+				m.ExpectExec("DELETE FROM equipment WHERE recipeid = ?").
 					WithArgs(recipe.Id).
 					WillReturnResult(sqlmock.NewResult(0, 0))
 
@@ -293,6 +304,74 @@ func Test_UpdateRecipe(t *testing.T) {
 				assert.Equal(t, expected, actual)
 			},
 		},
+		{
+			Name: "update recipe keeps ingredient and step order across groups",
+			R: Recipe{
+				Id:        1,
+				Name:      "Test Recipe",
+				Username:  "Test User",
+				ImageName: "test-img.png",
+				Ingredients: []Ingredient{
+					{Id: 0, Name: "Flour", Amount: "2", Unit: "cups", Group: "For the dough", Position: 1, RecipeId: 1},
+					{Id: 3, Name: "Cheese", Amount: "1", Unit: "cups", Group: "For the filling", Position: 2, RecipeId: 1},
+				},
+				Steps: []Step{
+					{Id: 5, StepNumber: 1, Description: "Knead the dough", Section: "Dough"},
+					{StepNumber: 2, Description: "Fill the dough", Section: "Filling"},
+				},
+			},
+			ExpectedIngredients: []Ingredient{
+				{Id: 4, Name: "Flour", Amount: "2", Unit: "cups", Group: "For the dough", Position: 1, RecipeId: 1},
+				{Id: 3, Name: "Cheese", Amount: "1", Unit: "cups", Group: "For the filling", Position: 2, RecipeId: 1},
+			},
+			ExpectedSQL: func(m sqlmock.Sqlmock, recipe Recipe) {
+				m.ExpectBegin()
+				m.ExpectExec("UPDATE recipe SET name = ?, imagename = ?, preptime = ?, cooktime = ?, totaltime = ?, totalseconds = ?, difficulty = ?, cuisine = ?, course = ?, visibility = ?, groupid = ? WHERE id = ?").
+					WithArgs(recipe.Name, recipe.ImageName, recipe.PrepTime, recipe.CookTime, recipe.TotalTime, 0, recipe.Difficulty, recipe.Cuisine, recipe.Course, recipe.Visibility, recipe.GroupId, recipe.Id).WillReturnResult(sqlmock.NewResult(0, 1))
+
+				m.ExpectExec("DELETE FROM ingredient WHERE recipeid = 1 AND id NOT IN (?)").
+					WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 0))
+
+				m.ExpectExec("UPDATE ingredient SET name = ?, amount = ?, unit = ?, groupname = ?, position = ?, subrecipeid = ? WHERE id = ?").
+					WithArgs(recipe.Ingredients[1].Name, recipe.Ingredients[1].Amount, recipe.Ingredients[1].Unit, recipe.Ingredients[1].Group, recipe.Ingredients[1].Position, recipe.Ingredients[1].SubrecipeId, recipe.Ingredients[1].Id).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+
+				m.ExpectExec("INSERT INTO INGREDIENT(name, amount, unit, groupname, position, subrecipeid, recipeid) VALUES(?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(recipe.Ingredients[0].Name, recipe.Ingredients[0].Amount, recipe.Ingredients[0].Unit, recipe.Ingredients[0].Group, recipe.Ingredients[0].Position, recipe.Ingredients[0].SubrecipeId, recipe.Id).
+					WillReturnResult(sqlmock.NewResult(4, 1))
+
+				// step 5 moves up in place of step 6, which is removed
+				m.ExpectQuery("SELECT id FROM step WHERE recipeid = ?").
+					WithArgs(recipe.Id).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(6).AddRow(5))
+
+				m.ExpectExec("DELETE FROM step WHERE id = ?").
+					WithArgs(6).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+
+				m.ExpectExec("UPDATE step SET stepnumber = ?, description = ?, section = ?, duration = ?, temperature = ?, temperatureunit = ? WHERE id = ?").
+					WithArgs(1, recipe.Steps[0].Description, recipe.Steps[0].Section, recipe.Steps[0].Duration, recipe.Steps[0].Temperature, recipe.Steps[0].TemperatureUnit, 5).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("INSERT INTO STEP(stepnumber, description, section, duration, temperature, temperatureunit, recipeid) VALUES(?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(2, recipe.Steps[1].Description, recipe.Steps[1].Section, recipe.Steps[1].Duration, recipe.Steps[1].Temperature, recipe.Steps[1].TemperatureUnit, recipe.Id).
+					WillReturnResult(sqlmock.NewResult(7, 1))
+
+				m.ExpectExec("DELETE FROM equipment WHERE recipeid = ?").
+					WithArgs(recipe.Id).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				m.ExpectCommit()
+			},
+			Pass: true,
+			Assert: func(m sqlmock.Sqlmock, expected, actual Recipe, expectedI []Ingredient, err error) {
+				assert.NoError(t, err)
+				expected.Ingredients = expectedI
+				expected.Steps = []Step{
+					{Id: 5, StepNumber: 1, Description: "Knead the dough", Section: "Dough", RecipeId: 1},
+					{Id: 7, StepNumber: 2, Description: "Fill the dough", Section: "Filling", RecipeId: 1},
+				}
+				assert.Equal(t, expected, actual)
+			},
+		},
 		{
 			Name: "update recipe error",
 			R: Recipe{
@@ -309,8 +388,8 @@ func Test_UpdateRecipe(t *testing.T) {
 			ExpectedIngredients: []Ingredient{},
 			ExpectedSQL: func(m sqlmock.Sqlmock, recipe Recipe) {
 				m.ExpectBegin()
-				m.ExpectExec("UPDATE recipe SET name = ?, imagename = ? WHERE id = ?").
-					WithArgs(recipe.Name, recipe.ImageName, recipe.Id).
+				m.ExpectExec("UPDATE recipe SET name = ?, imagename = ?, preptime = ?, cooktime = ?, totaltime = ?, totalseconds = ?, difficulty = ?, cuisine = ?, course = ?, visibility = ?, groupid = ? WHERE id = ?").
+					WithArgs(recipe.Name, recipe.ImageName, recipe.PrepTime, recipe.CookTime, recipe.TotalTime, 0, recipe.Difficulty, recipe.Cuisine, recipe.Course, recipe.Visibility, recipe.GroupId, recipe.Id).
 					WillReturnError(errors.New("error updating recipe"))
 				m.ExpectRollback()
 			},
@@ -346,19 +425,19 @@ func Test_SelectRecipesByUsername(t *testing.T) {
 		{
 			Name: "select recipes by username",
 			R: []Recipe{
-				{1, "Test Name 1", "Test User", "test-img.png", nil, nil},
-				{2, "Test Name 2", "Test User", "test-img.jpg", nil, nil},
-				{3, "Test Name 3", "Test User", "test-img.png", nil, nil},
+				{Id: 1, Name: "Test Name 1", Username: "Test User", ImageName: "test-img.png"},
+				{Id: 2, Name: "Test Name 2", Username: "Test User", ImageName: "test-img.jpg"},
+				{Id: 3, Name: "Test Name 3", Username: "Test User", ImageName: "test-img.png"},
 			},
 			Username: "Test User",
 			ExpectedSQL: func(m sqlmock.Sqlmock, r []Recipe, username string) {
-				recipeRow := sqlmock.NewRows([]string{"id", "name", "username", "imagename"})
+				recipeRow := sqlmock.NewRows([]string{"id", "name", "username", "imagename", "preptime", "cooktime", "totaltime", "difficulty", "cuisine", "course", "visibility", "hidden", "groupid", "ownerinactive"})
 				for _, rr := range r {
-					recipeRow.AddRow(rr.Id, rr.Name, rr.Username, rr.ImageName)
+					recipeRow.AddRow(rr.Id, rr.Name, rr.Username, rr.ImageName, rr.PrepTime, rr.CookTime, rr.TotalTime, rr.Difficulty, rr.Cuisine, rr.Course, rr.Visibility, rr.Hidden, rr.GroupId, rr.OwnerInactive)
 				}
 
-				m.ExpectQuery("SELECT id, name, username, imagename FROM recipe WHERE username = ? ORDER BY ? LIMIT ?, ?").
-					WithArgs(username, "id desc", 0, 10).WillReturnRows(recipeRow)
+				m.ExpectQuery("SELECT id, name, username, imagename, preptime, cooktime, totaltime, difficulty, cuisine, course, visibility, hidden, groupid, "+ownerInactive+" FROM recipe WHERE username = ? ORDER BY id desc LIMIT ?, ?").
+					WithArgs(username, 0, 10).WillReturnRows(recipeRow)
 			},
 			Pass: true,
 			Assert: func(m sqlmock.Sqlmock, expected, actual []Recipe, err error) {
@@ -369,14 +448,14 @@ func Test_SelectRecipesByUsername(t *testing.T) {
 		{
 			Name: "select recipes by username error",
 			R: []Recipe{
-				{1, "Test Name 1", "Test User", "test-img.png", nil, nil},
-				{2, "Test Name 2", "Test User", "test-img.jpg", nil, nil},
-				{3, "Test Name 3", "Test User", "test-img.png", nil, nil},
+				{Id: 1, Name: "Test Name 1", Username: "Test User", ImageName: "test-img.png"},
+				{Id: 2, Name: "Test Name 2", Username: "Test User", ImageName: "test-img.jpg"},
+				{Id: 3, Name: "Test Name 3", Username: "Test User", ImageName: "test-img.png"},
 			},
 			Username: "Test User",
 			ExpectedSQL: func(m sqlmock.Sqlmock, r []Recipe, username string) {
-				m.ExpectQuery("SELECT id, name, username, imagename FROM recipe WHERE username = ? ORDER BY ? LIMIT ?, ?").
-					WithArgs(username, "id desc", 0, 10).WillReturnError(errors.New("error selecting recipes by username"))
+				m.ExpectQuery("SELECT id, name, username, imagename, preptime, cooktime, totaltime, difficulty, cuisine, course, visibility, hidden, groupid, "+ownerInactive+" FROM recipe WHERE username = ? ORDER BY id desc LIMIT ?, ?").
+					WithArgs(username, 0, 10).WillReturnError(errors.New("error selecting recipes by username"))
 			},
 			Pass: false,
 			Assert: func(m sqlmock.Sqlmock, expected, actual []Recipe, err error) {
@@ -393,12 +472,69 @@ func Test_SelectRecipesByUsername(t *testing.T) {
 
 		d.ExpectedSQL(mock, d.R, d.Username)
 		rr := NewRepo(db)
-		result, err := rr.SelectRecipesByUsername(d.Username, "id desc", 0, 10)
+		result, err := rr.SelectRecipesByUsername(d.Username, Filter{}, "id desc", 0, 10)
 		d.Assert(mock, d.R, result, err)
 	}
 }
 
+func Test_SelectRecipesByUsernameFiltered(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+
+	filter := Filter{MaxTotalTime: 30 * time.Minute, Difficulty: "easy", Cuisine: "Italian", Course: "main"}
+	where := "username = ? AND totalseconds > 0 AND totalseconds <= ? AND difficulty = ? AND cuisine = ? COLLATE NOCASE AND course = ? COLLATE NOCASE"
+
+	mock.ExpectQuery("SELECT id, name, username, imagename, preptime, cooktime, totaltime, difficulty, cuisine, course, visibility, hidden, groupid, "+ownerInactive+" FROM recipe WHERE "+where+" ORDER BY totalseconds asc, id desc LIMIT ?, ?").
+		WithArgs("Test User", 1800, "easy", "Italian", "main", 0, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "username", "imagename", "preptime", "cooktime", "totaltime", "difficulty", "cuisine", "course", "visibility", "hidden", "groupid", "ownerinactive"}).
+			AddRow(1, "Test Name 1", "Test User", "", "PT10M", "PT15M", "PT25M", "easy", "italian", "main", "private", false, nil, false))
+
+	mock.ExpectQuery("SELECT COUNT(*) FROM recipe WHERE "+where).
+		WithArgs("Test User", 1800, "easy", "Italian", "main").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	rr := NewRepo(db)
+
+	result, err := rr.SelectRecipesByUsername("Test User", filter, "totalseconds asc, id desc", 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []Recipe{{Id: 1, Name: "Test Name 1", Username: "Test User", PrepTime: "PT10M", CookTime: "PT15M", TotalTime: "PT25M", Difficulty: "easy", Cuisine: "italian", Course: "main", Visibility: "private"}}, result)
+
+	count, err := rr.SelectRecipeCountByUsername("Test User", filter)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func Test_SelectRecipesByUsernameInGroup(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+
+	groupId := 3
+	filter := Filter{Difficulty: "easy", Group: groupId}
+	where := "groupid = ? AND ((hidden = 0 AND NOT " + ownerInactive + ") OR username = ?) AND difficulty = ?"
+
+	mock.ExpectQuery("SELECT id, name, username, imagename, preptime, cooktime, totaltime, difficulty, cuisine, course, visibility, hidden, groupid, "+ownerInactive+" FROM recipe WHERE "+where+" ORDER BY id desc LIMIT ?, ?").
+		WithArgs(groupId, "Test User", "easy", 0, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "username", "imagename", "preptime", "cooktime", "totaltime", "difficulty", "cuisine", "course", "visibility", "hidden", "groupid", "ownerinactive"}).
+			AddRow(1, "Test Name 1", "Other User", "", "", "", "", "easy", "", "", "private", false, groupId, false))
+
+	mock.ExpectQuery("SELECT COUNT(*) FROM recipe WHERE "+where).
+		WithArgs(groupId, "Test User", "easy").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	rr := NewRepo(db)
+
+	result, err := rr.SelectRecipesByUsername("Test User", filter, "id desc", 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []Recipe{{Id: 1, Name: "Test Name 1", Username: "Other User", Difficulty: "easy", Visibility: "private", GroupId: &groupId}}, result)
+
+	count, err := rr.SelectRecipeCountByUsername("Test User", filter)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
 func Test_SelectRecipeById(t *testing.T) {
+	subrecipeId := 2
+	stepId := 1
+	stepNumber := 1
+
 	data := []struct {
 		Name        string
 		R           Recipe
@@ -415,27 +551,59 @@ func Test_SelectRecipeById(t *testing.T) {
 				ImageName: "test-img.png",
 				Ingredients: []Ingredient{
 					{Id: 1, Name: "Ingredient 1", Amount: "1", Unit: "tbsp", RecipeId: 1},
-					{Id: 2, Name: "Ingredient 2", Amount: "1", Unit: "cups", RecipeId: 1},
+					{Id: 2, Name: "Ingredient 2", Amount: "1", Unit: "batch", SubrecipeId: &subrecipeId, RecipeId: 1},
+				},
+				Steps: []Step{
+					{Id: 1, StepNumber: 1, Description: "Step 1", RecipeId: 1, Images: []Image{
+						{Id: 2, Name: "step.png", Position: 2, StepId: &stepId, StepNumber: &stepNumber, RecipeId: 1},
+					}},
+				},
+				Images: []Image{
+					{Id: 1, Name: "gallery.png", Caption: "Plated", Position: 1, Cover: true, RecipeId: 1},
 				},
-				Steps: []Step{},
 			},
 			ExpectedSQL: func(mock sqlmock.Sqlmock, recipe Recipe) {
-				recipeRow := sqlmock.NewRows([]string{"id", "name", "username", "imagename"}).
-					AddRow(recipe.Id, recipe.Name, recipe.Username, recipe.ImageName)
-				mock.ExpectQuery("SELECT id, name, username, imagename FROM recipe WHERE id = ?").
+				recipeRow := sqlmock.NewRows([]string{"id", "name", "username", "imagename", "preptime", "cooktime", "totaltime", "difficulty", "cuisine", "course", "visibility", "hidden", "groupid", "ownerinactive"}).
+					AddRow(recipe.Id, recipe.Name, recipe.Username, recipe.ImageName, recipe.PrepTime, recipe.CookTime, recipe.TotalTime, recipe.Difficulty, recipe.Cuisine, recipe.Course, recipe.Visibility, recipe.Hidden, recipe.GroupId, recipe.OwnerInactive)
+				mock.ExpectQuery("SELECT id, name, username, imagename, preptime, cooktime, totaltime, difficulty, cuisine, course, visibility, hidden, groupid, " + ownerInactive + " FROM recipe WHERE id = ?").
 					WithArgs(recipe.Id).WillReturnRows(recipeRow)
 
-				ingredientRows := sqlmock.NewRows([]string{"id", "name", "amount", "unit", "recipeid"})
+				ingredientRows := sqlmock.NewRows([]string{"id", "name", "amount", "unit", "groupname", "position", "subrecipeid", "recipeid"})
 				for _, i := range recipe.Ingredients {
-					ingredientRows.AddRow(i.Id, i.Name, i.Amount, i.Unit, i.RecipeId)
+					ingredientRows.AddRow(i.Id, i.Name, i.Amount, i.Unit, i.Group, i.Position, i.SubrecipeId, i.RecipeId)
 				}
-				mock.ExpectQuery("SELECT id, name, amount, unit, recipeid FROM ingredient WHERE recipeid = ?").
+				mock.ExpectQuery("SELECT id, name, amount, unit, groupname, position, subrecipeid, recipeid FROM ingredient WHERE recipeid = ? ORDER BY position, id").
 					WithArgs(recipe.Id).
 					WillReturnRows(ingredientRows)
 
-				mock.ExpectQuery("SELECT stepnumber, description, recipeid FROM step WHERE recipeid = ?").
+				stepRows := sqlmock.NewRows([]string{"id", "stepnumber", "description", "section", "duration", "temperature", "temperatureunit", "recipeid"})
+				for _, s := range recipe.Steps {
+					stepRows.AddRow(s.Id, s.StepNumber, s.Description, s.Section, s.Duration, s.Temperature, s.TemperatureUnit, s.RecipeId)
+				}
+				mock.ExpectQuery("SELECT id, stepnumber, description, section, duration, temperature, temperatureunit, recipeid FROM step WHERE recipeid = ? ORDER BY stepnumber").
 					WithArgs(recipe.Id).
-					WillReturnRows(sqlmock.NewRows([]string{"stepnumber", "description", "recipeid"}))
+					WillReturnRows(stepRows)
+
+				equipmentRows := sqlmock.NewRows([]string{"name"})
+				for _, e := range recipe.Equipment {
+					equipmentRows.AddRow(e)
+				}
+				mock.ExpectQuery("SELECT name FROM equipment WHERE recipeid = ? ORDER BY position").
+					WithArgs(recipe.Id).
+					WillReturnRows(equipmentRows)
+
+				imageRows := sqlmock.NewRows([]string{"id", "imagename", "caption", "position", "cover", "stepid", "stepnumber", "recipeid"})
+				for _, i := range recipe.Images {
+					imageRows.AddRow(i.Id, i.Name, i.Caption, i.Position, i.Cover, i.StepId, i.StepNumber, i.RecipeId)
+				}
+				for _, s := range recipe.Steps {
+					for _, i := range s.Images {
+						imageRows.AddRow(i.Id, i.Name, i.Caption, i.Position, i.Cover, i.StepId, i.StepNumber, i.RecipeId)
+					}
+				}
+				mock.ExpectQuery("SELECT recipe_image.id, recipe_image.imagename, recipe_image.caption, recipe_image.position, recipe_image.cover, recipe_image.stepid, step.stepnumber, recipe_image.recipeid FROM recipe_image LEFT JOIN step ON step.id = recipe_image.stepid WHERE recipe_image.recipeid = ? ORDER BY recipe_image.position").
+					WithArgs(recipe.Id).
+					WillReturnRows(imageRows)
 			},
 			Pass: true,
 			Assert: func(mock sqlmock.Sqlmock, expected, result Recipe, err error) {
@@ -451,7 +619,7 @@ func Test_SelectRecipeById(t *testing.T) {
 				Steps:       []Step{},
 			},
 			ExpectedSQL: func(mock sqlmock.Sqlmock, recipe Recipe) {
-				mock.ExpectQuery("SELECT id, name, username, imagename FROM recipe WHERE id = ?").
+				mock.ExpectQuery("SELECT id, name, username, imagename, preptime, cooktime, totaltime, difficulty, cuisine, course, visibility, hidden, groupid, " + ownerInactive + " FROM recipe WHERE id = ?").
 					WithArgs(recipe.Id).WillReturnError(errors.New("error selecting recipe"))
 			},
 			Pass: false,
@@ -474,12 +642,12 @@ func Test_SelectRecipeById(t *testing.T) {
 				Steps: []Step{},
 			},
 			ExpectedSQL: func(mock sqlmock.Sqlmock, recipe Recipe) {
-				recipeRow := sqlmock.NewRows([]string{"id", "name", "username", "imagename"}).
-					AddRow(recipe.Id, recipe.Name, recipe.Username, recipe.ImageName)
-				mock.ExpectQuery("SELECT id, name, username, imagename FROM recipe WHERE id = ?").
+				recipeRow := sqlmock.NewRows([]string{"id", "name", "username", "imagename", "preptime", "cooktime", "totaltime", "difficulty", "cuisine", "course", "visibility", "hidden", "groupid", "ownerinactive"}).
+					AddRow(recipe.Id, recipe.Name, recipe.Username, recipe.ImageName, recipe.PrepTime, recipe.CookTime, recipe.TotalTime, recipe.Difficulty, recipe.Cuisine, recipe.Course, recipe.Visibility, recipe.Hidden, recipe.GroupId, recipe.OwnerInactive)
+				mock.ExpectQuery("SELECT id, name, username, imagename, preptime, cooktime, totaltime, difficulty, cuisine, course, visibility, hidden, groupid, " + ownerInactive + " FROM recipe WHERE id = ?").
 					WithArgs(recipe.Id).WillReturnRows(recipeRow)
 
-				mock.ExpectQuery("SELECT id, name, amount, unit, recipeid FROM ingredient WHERE recipeid = ?").
+				mock.ExpectQuery("SELECT id, name, amount, unit, groupname, position, subrecipeid, recipeid FROM ingredient WHERE recipeid = ? ORDER BY position, id").
 					WithArgs(recipe.Id).WillReturnError(errors.New("error selecting ingredients"))
 			},
 			Pass: false,
@@ -521,25 +689,64 @@ func Test_InsertRecipe(t *testing.T) {
 					{Id: 2, Name: "Ingredient 2", Amount: "1", Unit: "cups", RecipeId: 1},
 				},
 				Steps: []Step{
-					{StepNumber: 1, Description: "test step 1", RecipeId: 1},
-					{StepNumber: 2, Description: "test step 2", RecipeId: 1},
+					{Id: 1, StepNumber: 1, Description: "test step 1", RecipeId: 1},
+					{Id: 2, StepNumber: 2, Description: "test step 2", RecipeId: 1},
 				},
 			},
 			ExpectedSQL: func(mock sqlmock.Sqlmock, recipe Recipe) {
-				mock.ExpectExec("INSERT INTO RECIPE(name, username) VALUES (?, ?)").
-					WithArgs(recipe.Name, recipe.Username).
+				mock.ExpectExec("INSERT INTO RECIPE(name, username, preptime, cooktime, totaltime, totalseconds, difficulty, cuisine, course, visibility, groupid) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(recipe.Name, recipe.Username, recipe.PrepTime, recipe.CookTime, recipe.TotalTime, 0, recipe.Difficulty, recipe.Cuisine, recipe.Course, recipe.Visibility, recipe.GroupId).
 					WillReturnResult(sqlmock.NewResult(int64(recipe.Id), 1))
 
 				for _, in := range recipe.Ingredients {
-					mock.ExpectExec("INSERT INTO INGREDIENT(name, amount, unit, recipeid) VALUES(?, ?, ?, ?)").
-						WithArgs(in.Name, in.Amount, in.Unit, recipe.Id).
+					mock.ExpectExec("INSERT INTO INGREDIENT(name, amount, unit, groupname, position, subrecipeid, recipeid) VALUES(?, ?, ?, ?, ?, ?, ?)").
+						WithArgs(in.Name, in.Amount, in.Unit, in.Group, in.Position, in.SubrecipeId, recipe.Id).
 						WillReturnResult(sqlmock.NewResult(int64(in.Id), 1))
 				}
 
 				for _, s := range recipe.Steps {
-					mock.ExpectExec("INSERT INTO STEP(stepnumber, description, recipeid) VALUES(?, ?, ?)").
-						WithArgs(s.StepNumber, s.Description, recipe.Id).
-						WillReturnResult(sqlmock.NewResult(0, 1))
+					mock.ExpectExec("INSERT INTO STEP(stepnumber, description, section, duration, temperature, temperatureunit, recipeid) VALUES(?, ?, ?, ?, ?, ?, ?)").
+						WithArgs(s.StepNumber, s.Description, s.Section, s.Duration, s.Temperature, s.TemperatureUnit, recipe.Id).
+						WillReturnResult(sqlmock.NewResult(int64(s.Id), 1))
+				}
+			},
+			Pass: true,
+			Assert: func(mock sqlmock.Sqlmock, expected, result Recipe, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, expected, result)
+			},
+		},
+		{
+			Name: "insert recipe with metadata",
+			R: Recipe{
+				Id:         1,
+				Name:       "Test Recipe",
+				Username:   "Test User",
+				PrepTime:   "PT10M",
+				CookTime:   "PT20M",
+				TotalTime:  "PT30M",
+				Difficulty: "easy",
+				Cuisine:    "italian",
+				Course:     "main",
+				Equipment:  []string{"Dutch oven", "Wooden spoon"},
+				Steps: []Step{
+					{Id: 1, StepNumber: 1, Description: "Bake", Duration: "PT20M", Temperature: 200, TemperatureUnit: "C", RecipeId: 1},
+				},
+			},
+			ExpectedSQL: func(mock sqlmock.Sqlmock, recipe Recipe) {
+				mock.ExpectExec("INSERT INTO RECIPE(name, username, preptime, cooktime, totaltime, totalseconds, difficulty, cuisine, course, visibility, groupid) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(recipe.Name, recipe.Username, recipe.PrepTime, recipe.CookTime, recipe.TotalTime, 1800, recipe.Difficulty, recipe.Cuisine, recipe.Course, recipe.Visibility, recipe.GroupId).
+					WillReturnResult(sqlmock.NewResult(int64(recipe.Id), 1))
+
+				s := recipe.Steps[0]
+				mock.ExpectExec("INSERT INTO STEP(stepnumber, description, section, duration, temperature, temperatureunit, recipeid) VALUES(?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(s.StepNumber, s.Description, s.Section, s.Duration, s.Temperature, s.TemperatureUnit, recipe.Id).
+					WillReturnResult(sqlmock.NewResult(int64(s.Id), 1))
+
+				for i, e := range recipe.Equipment {
+					mock.ExpectExec("INSERT INTO EQUIPMENT(name, position, recipeid) VALUES(?, ?, ?)").
+						WithArgs(e, i+1, recipe.Id).
+						WillReturnResult(sqlmock.NewResult(int64(i+1), 1))
 				}
 			},
 			Pass: true,
@@ -552,8 +759,8 @@ func Test_InsertRecipe(t *testing.T) {
 			Name: "insert recipe no generated id",
 			R:    Recipe{},
 			ExpectedSQL: func(mock sqlmock.Sqlmock, recipe Recipe) {
-				mock.ExpectExec("INSERT INTO RECIPE(name, username) VALUES (?, ?)").
-					WithArgs(recipe.Name, recipe.Username).
+				mock.ExpectExec("INSERT INTO RECIPE(name, username, preptime, cooktime, totaltime, totalseconds, difficulty, cuisine, course, visibility, groupid) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(recipe.Name, recipe.Username, recipe.PrepTime, recipe.CookTime, recipe.TotalTime, 0, recipe.Difficulty, recipe.Cuisine, recipe.Course, recipe.Visibility, recipe.GroupId).
 					WillReturnResult(sqlmock.NewResult(0, 1))
 			},
 			Pass: false,
@@ -566,8 +773,8 @@ func Test_InsertRecipe(t *testing.T) {
 			Name: "insert recipe error",
 			R:    Recipe{},
 			ExpectedSQL: func(mock sqlmock.Sqlmock, recipe Recipe) {
-				mock.ExpectExec("INSERT INTO RECIPE(name, username) VALUES (?, ?)").
-					WithArgs(recipe.Name, recipe.Username).
+				mock.ExpectExec("INSERT INTO RECIPE(name, username, preptime, cooktime, totaltime, totalseconds, difficulty, cuisine, course, visibility, groupid) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(recipe.Name, recipe.Username, recipe.PrepTime, recipe.CookTime, recipe.TotalTime, 0, recipe.Difficulty, recipe.Cuisine, recipe.Course, recipe.Visibility, recipe.GroupId).
 					WillReturnError(errors.New("error inserting recipe"))
 			},
 			Pass: false,
@@ -587,11 +794,11 @@ func Test_InsertRecipe(t *testing.T) {
 				},
 			},
 			ExpectedSQL: func(mock sqlmock.Sqlmock, recipe Recipe) {
-				mock.ExpectExec("INSERT INTO RECIPE(name, username) VALUES (?, ?)").
-					WithArgs(recipe.Name, recipe.Username).
+				mock.ExpectExec("INSERT INTO RECIPE(name, username, preptime, cooktime, totaltime, totalseconds, difficulty, cuisine, course, visibility, groupid) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(recipe.Name, recipe.Username, recipe.PrepTime, recipe.CookTime, recipe.TotalTime, 0, recipe.Difficulty, recipe.Cuisine, recipe.Course, recipe.Visibility, recipe.GroupId).
 					WillReturnResult(sqlmock.NewResult(int64(recipe.Id), 1))
-				mock.ExpectExec("INSERT INTO INGREDIENT(name, amount, unit, recipeid) VALUES(?, ?, ?, ?)").
-					WithArgs(recipe.Ingredients[0].Name, recipe.Ingredients[0].Amount, recipe.Ingredients[0].Unit, recipe.Id).
+				mock.ExpectExec("INSERT INTO INGREDIENT(name, amount, unit, groupname, position, subrecipeid, recipeid) VALUES(?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(recipe.Ingredients[0].Name, recipe.Ingredients[0].Amount, recipe.Ingredients[0].Unit, recipe.Ingredients[0].Group, recipe.Ingredients[0].Position, recipe.Ingredients[0].SubrecipeId, recipe.Id).
 					WillReturnError(errors.New("error inserting ingredient"))
 			},
 			Pass: false,
@@ -611,11 +818,11 @@ func Test_InsertRecipe(t *testing.T) {
 				},
 			},
 			ExpectedSQL: func(mock sqlmock.Sqlmock, recipe Recipe) {
-				mock.ExpectExec("INSERT INTO RECIPE(name, username) VALUES (?, ?)").
-					WithArgs(recipe.Name, recipe.Username).
+				mock.ExpectExec("INSERT INTO RECIPE(name, username, preptime, cooktime, totaltime, totalseconds, difficulty, cuisine, course, visibility, groupid) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(recipe.Name, recipe.Username, recipe.PrepTime, recipe.CookTime, recipe.TotalTime, 0, recipe.Difficulty, recipe.Cuisine, recipe.Course, recipe.Visibility, recipe.GroupId).
 					WillReturnResult(sqlmock.NewResult(int64(recipe.Id), 1))
-				mock.ExpectExec("INSERT INTO INGREDIENT(name, amount, unit, recipeid) VALUES(?, ?, ?, ?)").
-					WithArgs(recipe.Ingredients[0].Name, recipe.Ingredients[0].Amount, recipe.Ingredients[0].Unit, recipe.Id).
+				mock.ExpectExec("INSERT INTO INGREDIENT(name, amount, unit, groupname, position, subrecipeid, recipeid) VALUES(?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(recipe.Ingredients[0].Name, recipe.Ingredients[0].Amount, recipe.Ingredients[0].Unit, recipe.Ingredients[0].Group, recipe.Ingredients[0].Position, recipe.Ingredients[0].SubrecipeId, recipe.Id).
 					WillReturnResult(sqlmock.NewResult(0, 1))
 			},
 			Pass: false,
@@ -638,14 +845,14 @@ func Test_InsertRecipe(t *testing.T) {
 				},
 			},
 			ExpectedSQL: func(mock sqlmock.Sqlmock, recipe Recipe) {
-				mock.ExpectExec("INSERT INTO RECIPE(name, username) VALUES (?, ?)").
-					WithArgs(recipe.Name, recipe.Username).
+				mock.ExpectExec("INSERT INTO RECIPE(name, username, preptime, cooktime, totaltime, totalseconds, difficulty, cuisine, course, visibility, groupid) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(recipe.Name, recipe.Username, recipe.PrepTime, recipe.CookTime, recipe.TotalTime, 0, recipe.Difficulty, recipe.Cuisine, recipe.Course, recipe.Visibility, recipe.GroupId).
 					WillReturnResult(sqlmock.NewResult(int64(recipe.Id), 1))
-				mock.ExpectExec("INSERT INTO INGREDIENT(name, amount, unit, recipeid) VALUES(?, ?, ?, ?)").
-					WithArgs(recipe.Ingredients[0].Name, recipe.Ingredients[0].Amount, recipe.Ingredients[0].Unit, recipe.Id).
+				mock.ExpectExec("INSERT INTO INGREDIENT(name, amount, unit, groupname, position, subrecipeid, recipeid) VALUES(?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(recipe.Ingredients[0].Name, recipe.Ingredients[0].Amount, recipe.Ingredients[0].Unit, recipe.Ingredients[0].Group, recipe.Ingredients[0].Position, recipe.Ingredients[0].SubrecipeId, recipe.Id).
 					WillReturnResult(sqlmock.NewResult(1, 1))
-				mock.ExpectExec("INSERT INTO STEP(stepnumber, description, recipeid) VALUES(?, ?, ?)").
-					WithArgs(recipe.Steps[0].StepNumber, recipe.Steps[0].Description, recipe.Id).
+				mock.ExpectExec("INSERT INTO STEP(stepnumber, description, section, duration, temperature, temperatureunit, recipeid) VALUES(?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(recipe.Steps[0].StepNumber, recipe.Steps[0].Description, recipe.Steps[0].Section, recipe.Steps[0].Duration, recipe.Steps[0].Temperature, recipe.Steps[0].TemperatureUnit, recipe.Id).
 					WillReturnError(errors.New("failed"))
 			},
 			Pass: false,
@@ -0,0 +1,16 @@
+package token
+
+import "time"
+
+// PersonalToken lets scripts use the api on behalf of a profile, limited to its scopes. Only
+// the hash of the token itself is kept.
+type PersonalToken struct {
+	Id        int        `json:"id"`
+	ProfileId string     `json:"-"`
+	Name      string     `json:"name"`
+	TokenHash string     `json:"-"`
+	Scopes    []string   `json:"scopes"`
+	Created   time.Time  `json:"created"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+	Expires   *time.Time `json:"expires_at,omitempty"`
+}
@@ -0,0 +1,141 @@
+package token
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type TokenRepository interface {
+	InsertToken(t PersonalToken) (PersonalToken, error)
+	SelectTokens(profileId string) ([]PersonalToken, error)
+	SelectTokenByHash(hash string) (PersonalToken, error)
+	UpdateTokenLastUsed(id int, used time.Time, before time.Time) error
+	DeleteToken(profileId string, id int) (bool, error)
+}
+
+// columns selected for a token, in the order scanToken expects them
+const tokenColumns = "id, profileid, name, tokenhash, scopes, created, lastused, expires"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanToken(row scanner, t *PersonalToken) error {
+	var scopes string
+	var created, lastUsed, expires int64
+	if err := row.Scan(&t.Id, &t.ProfileId, &t.Name, &t.TokenHash, &scopes, &created, &lastUsed, &expires); err != nil {
+		return err
+	}
+
+	t.Scopes = strings.Fields(scopes)
+	t.Created = time.Unix(created, 0)
+
+	if lastUsed != 0 {
+		used := time.Unix(lastUsed, 0)
+		t.LastUsed = &used
+	}
+
+	if expires != 0 {
+		e := time.Unix(expires, 0)
+		t.Expires = &e
+	}
+
+	return nil
+}
+
+type tokenRepo struct {
+	db *sql.DB
+}
+
+func NewRepo(db *sql.DB) TokenRepository {
+	return &tokenRepo{db}
+}
+
+func (r *tokenRepo) InsertToken(t PersonalToken) (PersonalToken, error) {
+	var expires int64
+	if t.Expires != nil {
+		expires = t.Expires.Unix()
+	}
+
+	result, err := r.db.Exec("INSERT INTO personal_token(profileid, name, tokenhash, scopes, created, expires) VALUES (?, ?, ?, ?, ?, ?)",
+		t.ProfileId, t.Name, t.TokenHash, strings.Join(t.Scopes, " "), t.Created.Unix(), expires)
+	if err != nil {
+		return PersonalToken{}, fmt.Errorf("InsertToken failed to insert token: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return PersonalToken{}, fmt.Errorf("InsertToken failed to get token id: %w", err)
+	}
+	t.Id = int(id)
+
+	return t, nil
+}
+
+// Selects the tokens of a profile, most recently created first.
+func (r *tokenRepo) SelectTokens(profileId string) ([]PersonalToken, error) {
+	rows, err := r.db.Query("SELECT "+tokenColumns+" FROM personal_token WHERE profileid = ? ORDER BY id DESC", profileId)
+	if err != nil {
+		return nil, fmt.Errorf("SelectTokens failed to select tokens: %w", err)
+	}
+	defer rows.Close()
+
+	result := []PersonalToken{}
+	for rows.Next() {
+		var t PersonalToken
+		if err := scanToken(rows, &t); err != nil {
+			return nil, fmt.Errorf("SelectTokens failed to scan token: %w", err)
+		}
+		result = append(result, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectTokens failed to iterate tokens: %w", err)
+	}
+
+	return result, nil
+}
+
+func (r *tokenRepo) SelectTokenByHash(hash string) (PersonalToken, error) {
+	var result PersonalToken
+
+	row := r.db.QueryRow("SELECT "+tokenColumns+" FROM personal_token WHERE tokenhash = ?", hash)
+	if err := scanToken(row, &result); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return PersonalToken{}, err
+		}
+
+		return PersonalToken{}, fmt.Errorf("SelectTokenByHash failed to select token: %w", err)
+	}
+
+	return result, nil
+}
+
+// Records when a token was used, unless it was already used since before. This keeps tokens
+// used by every request of a script from writing on every request.
+func (r *tokenRepo) UpdateTokenLastUsed(id int, used time.Time, before time.Time) error {
+	_, err := r.db.Exec("UPDATE personal_token SET lastused = ? WHERE id = ? AND lastused < ?", used.Unix(), id, before.Unix())
+	if err != nil {
+		return fmt.Errorf("UpdateTokenLastUsed failed to update token: %w", err)
+	}
+
+	return nil
+}
+
+// Deletes a token of a profile. Returns false if the profile has no token with the id.
+func (r *tokenRepo) DeleteToken(profileId string, id int) (bool, error) {
+	result, err := r.db.Exec("DELETE FROM personal_token WHERE id = ? AND profileid = ?", id, profileId)
+	if err != nil {
+		return false, fmt.Errorf("DeleteToken failed to delete token: %w", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("DeleteToken failed to get rows affected: %w", err)
+	}
+
+	return deleted > 0, nil
+}
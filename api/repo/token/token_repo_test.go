@@ -0,0 +1,83 @@
+package token
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var columns = []string{"id", "profileid", "name", "tokenhash", "scopes", "created", "lastused", "expires"}
+
+func Test_InsertToken(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	tr := NewRepo(db)
+	created, expires := time.Unix(1700000000, 0), time.Unix(1710000000, 0)
+
+	mock.ExpectExec("INSERT INTO personal_token(profileid, name, tokenhash, scopes, created, expires) VALUES (?, ?, ?, ?, ?, ?)").
+		WithArgs("test-id", "backup", "hash", "recipes:read images:write", created.Unix(), expires.Unix()).
+		WillReturnResult(sqlmock.NewResult(4, 1))
+	mock.ExpectExec("INSERT INTO personal_token(profileid, name, tokenhash, scopes, created, expires) VALUES (?, ?, ?, ?, ?, ?)").
+		WithArgs("test-id", "backup", "hash", "recipes:read", created.Unix(), 0).
+		WillReturnError(errors.New("failed"))
+
+	result, err := tr.InsertToken(PersonalToken{ProfileId: "test-id", Name: "backup", TokenHash: "hash", Scopes: []string{"recipes:read", "images:write"}, Created: created, Expires: &expires})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, result.Id)
+
+	_, err = tr.InsertToken(PersonalToken{ProfileId: "test-id", Name: "backup", TokenHash: "hash", Scopes: []string{"recipes:read"}, Created: created})
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SelectTokens(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	tr := NewRepo(db)
+	used := time.Unix(1700000500, 0)
+
+	mock.ExpectQuery("SELECT id, profileid, name, tokenhash, scopes, created, lastused, expires FROM personal_token WHERE profileid = ? ORDER BY id DESC").
+		WithArgs("test-id").
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(2, "test-id", "backup", "hash", "recipes:read", 1700000000, 1700000500, 0))
+	mock.ExpectQuery("SELECT id, profileid, name, tokenhash, scopes, created, lastused, expires FROM personal_token WHERE tokenhash = ?").
+		WithArgs("missing").
+		WillReturnError(sql.ErrNoRows)
+
+	result, err := tr.SelectTokens("test-id")
+	assert.NoError(t, err)
+	assert.Equal(t, []PersonalToken{{Id: 2, ProfileId: "test-id", Name: "backup", TokenHash: "hash", Scopes: []string{"recipes:read"}, Created: time.Unix(1700000000, 0), LastUsed: &used}}, result)
+
+	_, err = tr.SelectTokenByHash("missing")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateAndDeleteToken(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	tr := NewRepo(db)
+	used := time.Unix(1700000500, 0)
+
+	mock.ExpectExec("UPDATE personal_token SET lastused = ? WHERE id = ? AND lastused < ?").
+		WithArgs(used.Unix(), 2, used.Add(-time.Minute).Unix()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM personal_token WHERE id = ? AND profileid = ?").
+		WithArgs(2, "test-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM personal_token WHERE id = ? AND profileid = ?").
+		WithArgs(2, "other-id").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(t, tr.UpdateTokenLastUsed(2, used, used.Add(-time.Minute)))
+
+	deleted, err := tr.DeleteToken("test-id", 2)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+
+	deleted, err = tr.DeleteToken("other-id", 2)
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,343 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/eciccone/rh/api/repo/admin"
+	"github.com/eciccone/rh/api/repo/profile"
+	"github.com/eciccone/rh/api/repo/recipe"
+)
+
+var (
+	ErrRoleData      = errors.New("role must be user, moderator or admin")
+	ErrRoleForbidden = errors.New("not allowed to moderate this profile")
+)
+
+// roles of profiles, each can do everything the roles before it can
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var roleRanks = map[string]int{RoleUser: 1, RoleModerator: 2, RoleAdmin: 3}
+
+// actions written to the audit log
+const (
+	AuditProfileSuspend   = "profile.suspend"
+	AuditProfileUnsuspend = "profile.unsuspend"
+	AuditProfileRole      = "profile.role"
+	AuditRecipeHide       = "recipe.hide"
+	AuditRecipeUnhide     = "recipe.unhide"
+	AuditRecipeDelete     = "recipe.delete"
+)
+
+// the actor of audit entries for what the api did on its own, like granting the admins it was
+// configured with
+const auditSystemActor = "system"
+
+// Reports whether actor can moderate profile p. Moderators can't moderate themselves, each other
+// or admins.
+func canModerate(actor profile.Profile, p profile.Profile) bool {
+	return p.Id != actor.Id && roleRanks[p.Role] < roleRanks[actor.Role]
+}
+
+// HasRole reports whether a profile with role can do what required allows.
+func HasRole(role string, required string) bool {
+	rank, ok := roleRanks[required]
+	return ok && roleRanks[role] >= rank
+}
+
+type AdminService interface {
+	// Gets a page of the profiles whose username or display name contains query, by username.
+	SearchProfiles(query string, offset int, limit int) (AdminProfilePage, error)
+
+	// Suspends a profile, or lifts its suspension. Suspended profiles can't use the api.
+	// Returns ErrNoProfile if either profile does not exist.
+	// Returns ErrRoleForbidden if the profile is the actor's or its role is not below theirs.
+	SuspendProfile(actorId string, username string, suspended bool, reason string) (profile.Profile, error)
+
+	// Changes the role of a profile.
+	// Returns ErrRoleData if role is unknown.
+	// Returns ErrNoProfile if the profile does not exist.
+	// Returns ErrRoleForbidden if the profile is the actor's.
+	SetRole(actorId string, username string, role string) (profile.Profile, error)
+
+	// Hides a recipe from everyone but its owner, or shows it again.
+	// Returns ErrNoRecipe if recipe does not exist.
+	HideRecipe(actorId string, id int, hidden bool, reason string) (recipe.Recipe, error)
+
+	// Removes a recipe whoever owns it.
+	// Returns ErrNoRecipe if recipe does not exist.
+	RemoveRecipe(actorId string, id int, reason string) error
+
+	GetStats() (admin.Stats, error)
+
+	// Gets a page of the audit log, most recent first.
+	GetAuditLog(offset int, limit int) (AuditPage, error)
+
+	// Makes the profiles with usernames admins, skipping those that don't exist yet.
+	GrantAdmins(usernames []string) error
+}
+
+type AdminProfilePage struct {
+	Profiles []profile.Profile `json:"profiles"`
+	Offset   int               `json:"offset"`
+	Limit    int               `json:"limit"`
+	Total    int               `json:"total"`
+}
+
+type AuditPage struct {
+	Entries []admin.AuditEntry `json:"entries"`
+	Offset  int                `json:"offset"`
+	Limit   int                `json:"limit"`
+	Total   int                `json:"total"`
+}
+
+type adminService struct {
+	adminRepo     admin.AdminRepository
+	profileRepo   profile.ProfileRepository
+	recipeService RecipeService
+	imageService  ImageService
+	now           func() time.Time
+}
+
+func NewAdminService(adminRepo admin.AdminRepository, profileRepo profile.ProfileRepository, recipeService RecipeService, imageService ImageService) AdminService {
+	return &adminService{adminRepo, profileRepo, recipeService, imageService, time.Now}
+}
+
+// Gets a page of the profiles whose username or display name contains query, by username.
+func (s *adminService) SearchProfiles(query string, offset int, limit int) (AdminProfilePage, error) {
+	if offset < 0 {
+		offset = 0
+	}
+
+	if limit <= 0 {
+		limit = 10
+	}
+
+	profiles, err := s.profileRepo.SearchProfiles(query, offset, limit)
+	if err != nil {
+		return AdminProfilePage{}, fmt.Errorf("SearchProfiles failed to get profiles: %w", err)
+	}
+
+	total, err := s.profileRepo.SelectProfileSearchCount(query)
+	if err != nil {
+		return AdminProfilePage{}, fmt.Errorf("SearchProfiles failed to count profiles: %w", err)
+	}
+
+	return AdminProfilePage{
+		Profiles: profiles,
+		Offset:   offset,
+		Limit:    limit,
+		Total:    total,
+	}, nil
+}
+
+// Suspends a profile, or lifts its suspension. Suspended profiles can't use the api.
+// Returns ErrNoProfile if either profile does not exist.
+// Returns ErrRoleForbidden if the profile is the actor's or its role is not below theirs.
+func (s *adminService) SuspendProfile(actorId string, username string, suspended bool, reason string) (profile.Profile, error) {
+	actor, err := s.profileById(actorId)
+	if err != nil {
+		return profile.Profile{}, err
+	}
+
+	p, err := s.profileByUsername(username)
+	if err != nil {
+		return profile.Profile{}, err
+	}
+
+	if !canModerate(actor, p) {
+		return profile.Profile{}, ErrRoleForbidden
+	}
+
+	action := AuditProfileSuspend
+	if !suspended {
+		action = AuditProfileUnsuspend
+	}
+
+	if err := s.adminRepo.UpdateProfileSuspended(p.Id, suspended, s.auditEntry(actorId, action, "profile", p.Id, reason)); err != nil {
+		return profile.Profile{}, fmt.Errorf("SuspendProfile failed to update profile: %w", err)
+	}
+	p.Suspended = suspended
+
+	return p, nil
+}
+
+// Changes the role of a profile.
+// Returns ErrRoleData if role is unknown.
+// Returns ErrNoProfile if the profile does not exist.
+// Returns ErrRoleForbidden if the profile is the actor's.
+func (s *adminService) SetRole(actorId string, username string, role string) (profile.Profile, error) {
+	if _, ok := roleRanks[role]; !ok {
+		return profile.Profile{}, ErrRoleData
+	}
+
+	p, err := s.profileByUsername(username)
+	if err != nil {
+		return profile.Profile{}, err
+	}
+
+	// so the last admin can't leave the api without one
+	if p.Id == actorId {
+		return profile.Profile{}, ErrRoleForbidden
+	}
+
+	if err := s.adminRepo.UpdateProfileRole(p.Id, role, s.auditEntry(actorId, AuditProfileRole, "profile", p.Id, p.Role+" to "+role)); err != nil {
+		return profile.Profile{}, fmt.Errorf("SetRole failed to update profile: %w", err)
+	}
+	p.Role = role
+
+	return p, nil
+}
+
+// Hides a recipe from everyone but its owner, or shows it again.
+// Returns ErrNoRecipe if recipe does not exist.
+func (s *adminService) HideRecipe(actorId string, id int, hidden bool, reason string) (recipe.Recipe, error) {
+	r, err := s.recipeService.GetRecipe(id)
+	if err != nil {
+		return recipe.Recipe{}, err
+	}
+
+	action := AuditRecipeHide
+	if !hidden {
+		action = AuditRecipeUnhide
+	}
+
+	if err := s.adminRepo.UpdateRecipeHidden(id, hidden, s.auditEntry(actorId, action, "recipe", strconv.Itoa(id), reason)); err != nil {
+		return recipe.Recipe{}, fmt.Errorf("HideRecipe failed to update recipe: %w", err)
+	}
+	r.Hidden = hidden
+
+	return r, nil
+}
+
+// Removes a recipe whoever owns it, along with the images no other recipe shares.
+// Returns ErrNoRecipe if recipe does not exist.
+func (s *adminService) RemoveRecipe(actorId string, id int, reason string) error {
+	r, err := s.recipeService.GetRecipe(id)
+	if err != nil {
+		return err
+	}
+
+	// the recipe will be gone, so the entry says whose it was and what it was called
+	details := fmt.Sprintf("%q by %s", r.Name, r.Username)
+	if reason != "" {
+		details += ": " + reason
+	}
+
+	return withImages(s.imageService, func(images ImageUnit) error {
+		if err := deleteRecipeImages(images, r); err != nil {
+			return err
+		}
+
+		if err := s.adminRepo.DeleteRecipe(id, s.auditEntry(actorId, AuditRecipeDelete, "recipe", strconv.Itoa(id), details)); err != nil {
+			return fmt.Errorf("RemoveRecipe failed to delete recipe: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func (s *adminService) GetStats() (admin.Stats, error) {
+	stats, err := s.adminRepo.SelectStats()
+	if err != nil {
+		return admin.Stats{}, fmt.Errorf("GetStats failed to get stats: %w", err)
+	}
+
+	return stats, nil
+}
+
+// Gets a page of the audit log, most recent first.
+func (s *adminService) GetAuditLog(offset int, limit int) (AuditPage, error) {
+	if offset < 0 {
+		offset = 0
+	}
+
+	if limit <= 0 {
+		limit = 10
+	}
+
+	entries, err := s.adminRepo.SelectAuditEntries(offset, limit)
+	if err != nil {
+		return AuditPage{}, fmt.Errorf("GetAuditLog failed to get entries: %w", err)
+	}
+
+	total, err := s.adminRepo.SelectAuditEntryCount()
+	if err != nil {
+		return AuditPage{}, fmt.Errorf("GetAuditLog failed to count entries: %w", err)
+	}
+
+	return AuditPage{
+		Entries: entries,
+		Offset:  offset,
+		Limit:   limit,
+		Total:   total,
+	}, nil
+}
+
+// Makes the profiles with usernames admins, skipping those that don't exist yet.
+func (s *adminService) GrantAdmins(usernames []string) error {
+	for _, username := range usernames {
+		p, err := s.profileByUsername(username)
+		if errors.Is(err, ErrNoProfile) {
+			log.Printf("admin %q has no profile yet, it is made an admin on the next start after it is created", username)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if p.Role == RoleAdmin {
+			continue
+		}
+
+		if err := s.adminRepo.UpdateProfileRole(p.Id, RoleAdmin, s.auditEntry(auditSystemActor, AuditProfileRole, "profile", p.Id, p.Role+" to "+RoleAdmin)); err != nil {
+			return fmt.Errorf("GrantAdmins failed to update profile: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// The audit log entry of what an actor did, written along with the change itself.
+func (s *adminService) auditEntry(actorId string, action string, targetType string, targetId string, details string) admin.AuditEntry {
+	return admin.AuditEntry{
+		ActorId:    actorId,
+		Action:     action,
+		TargetType: targetType,
+		TargetId:   targetId,
+		Details:    details,
+		Created:    s.now(),
+	}
+}
+
+func (s *adminService) profileById(id string) (profile.Profile, error) {
+	p, err := s.profileRepo.SelectProfileById(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return profile.Profile{}, ErrNoProfile
+	}
+	if err != nil {
+		return profile.Profile{}, fmt.Errorf("failed to get profile: %w", err)
+	}
+
+	return p, nil
+}
+
+func (s *adminService) profileByUsername(username string) (profile.Profile, error) {
+	p, err := s.profileRepo.SelectProfileByUsername(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return profile.Profile{}, ErrNoProfile
+	}
+	if err != nil {
+		return profile.Profile{}, fmt.Errorf("failed to get profile: %w", err)
+	}
+
+	return p, nil
+}
@@ -0,0 +1,256 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eciccone/rh/api/repo/admin"
+	"github.com/eciccone/rh/api/repo/profile"
+	"github.com/eciccone/rh/api/repo/recipe"
+	"github.com/stretchr/testify/assert"
+)
+
+type AdminRepoMocker struct {
+	InsertAuditEntryMock      func(entry admin.AuditEntry) error
+	SelectAuditEntriesMock    func(offset int, limit int) ([]admin.AuditEntry, error)
+	SelectAuditEntryCountMock func() (int, error)
+	SelectStatsMock           func() (admin.Stats, error)
+
+	UpdateProfileSuspendedMock func(id string, suspended bool, entry admin.AuditEntry) error
+	UpdateProfileRoleMock      func(id string, role string, entry admin.AuditEntry) error
+	UpdateRecipeHiddenMock     func(id int, hidden bool, entry admin.AuditEntry) error
+	DeleteRecipeMock           func(id int, entry admin.AuditEntry) error
+
+	InsertReportMock             func(report admin.Report) (admin.Report, bool, error)
+	SelectReportsMock            func(statuses []string, offset int, limit int) ([]admin.Report, error)
+	SelectReportCountMock        func(statuses []string) (int, error)
+	SelectReportsByOwnerMock     func(ownerId string, offset int, limit int) ([]admin.Report, error)
+	SelectReportCountByOwnerMock func(ownerId string) (int, error)
+	SelectReportMock             func(id int) (admin.Report, error)
+	TriageReportMock             func(report admin.Report, moderation admin.Moderation, entries []admin.AuditEntry) error
+}
+
+func (r *AdminRepoMocker) InsertAuditEntry(entry admin.AuditEntry) error {
+	return r.InsertAuditEntryMock(entry)
+}
+
+func (r *AdminRepoMocker) SelectAuditEntries(offset int, limit int) ([]admin.AuditEntry, error) {
+	return r.SelectAuditEntriesMock(offset, limit)
+}
+
+func (r *AdminRepoMocker) SelectAuditEntryCount() (int, error) {
+	return r.SelectAuditEntryCountMock()
+}
+
+func (r *AdminRepoMocker) SelectStats() (admin.Stats, error) {
+	return r.SelectStatsMock()
+}
+
+func (r *AdminRepoMocker) UpdateProfileSuspended(id string, suspended bool, entry admin.AuditEntry) error {
+	return r.UpdateProfileSuspendedMock(id, suspended, entry)
+}
+
+func (r *AdminRepoMocker) UpdateProfileRole(id string, role string, entry admin.AuditEntry) error {
+	return r.UpdateProfileRoleMock(id, role, entry)
+}
+
+func (r *AdminRepoMocker) UpdateRecipeHidden(id int, hidden bool, entry admin.AuditEntry) error {
+	return r.UpdateRecipeHiddenMock(id, hidden, entry)
+}
+
+func (r *AdminRepoMocker) DeleteRecipe(id int, entry admin.AuditEntry) error {
+	return r.DeleteRecipeMock(id, entry)
+}
+
+func (r *AdminRepoMocker) InsertReport(report admin.Report) (admin.Report, bool, error) {
+	return r.InsertReportMock(report)
+}
+
+func (r *AdminRepoMocker) SelectReports(statuses []string, offset int, limit int) ([]admin.Report, error) {
+	return r.SelectReportsMock(statuses, offset, limit)
+}
+
+func (r *AdminRepoMocker) SelectReportCount(statuses []string) (int, error) {
+	return r.SelectReportCountMock(statuses)
+}
+
+func (r *AdminRepoMocker) SelectReportsByOwner(ownerId string, offset int, limit int) ([]admin.Report, error) {
+	return r.SelectReportsByOwnerMock(ownerId, offset, limit)
+}
+
+func (r *AdminRepoMocker) SelectReportCountByOwner(ownerId string) (int, error) {
+	return r.SelectReportCountByOwnerMock(ownerId)
+}
+
+func (r *AdminRepoMocker) SelectReport(id int) (admin.Report, error) {
+	return r.SelectReportMock(id)
+}
+
+func (r *AdminRepoMocker) TriageReport(report admin.Report, moderation admin.Moderation, entries []admin.AuditEntry) error {
+	return r.TriageReportMock(report, moderation, entries)
+}
+
+// an admin repo recording the audit log in memory, along with the changes moderators make
+func newAuditRepo() (*AdminRepoMocker, *[]admin.AuditEntry) {
+	entries := &[]admin.AuditEntry{}
+	audit := func(entry admin.AuditEntry) error {
+		*entries = append(*entries, entry)
+		return nil
+	}
+
+	return &AdminRepoMocker{
+		InsertAuditEntryMock: audit,
+		UpdateProfileSuspendedMock: func(id string, suspended bool, entry admin.AuditEntry) error {
+			return audit(entry)
+		},
+		UpdateProfileRoleMock: func(id string, role string, entry admin.AuditEntry) error {
+			return audit(entry)
+		},
+		UpdateRecipeHiddenMock: func(id int, hidden bool, entry admin.AuditEntry) error {
+			return audit(entry)
+		},
+		DeleteRecipeMock: func(id int, entry admin.AuditEntry) error {
+			return audit(entry)
+		},
+	}, entries
+}
+
+// a profile repo with an admin, a moderator and a cook
+func newModerationProfileRepo() *ProfileRepoMocker {
+	profiles := map[string]profile.Profile{
+		"admin":     {Id: "admin-id", Username: "admin", Role: RoleAdmin},
+		"moderator": {Id: "moderator-id", Username: "moderator", Role: RoleModerator},
+		"cook":      {Id: "cook-id", Username: "cook", Role: RoleUser},
+	}
+
+	return &ProfileRepoMocker{
+		SelectProfileByIdMock: func(id string) (profile.Profile, error) {
+			for _, p := range profiles {
+				if p.Id == id {
+					return p, nil
+				}
+			}
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		SelectProfileByUsernameMock: func(username string) (profile.Profile, error) {
+			if p, ok := profiles[username]; ok {
+				return p, nil
+			}
+			return profile.Profile{}, sql.ErrNoRows
+		},
+	}
+}
+
+func Test_HasRole(t *testing.T) {
+	assert.True(t, HasRole(RoleAdmin, RoleModerator))
+	assert.True(t, HasRole(RoleModerator, RoleModerator))
+	assert.False(t, HasRole(RoleUser, RoleModerator))
+	assert.False(t, HasRole("", RoleUser))
+	assert.False(t, HasRole(RoleAdmin, "owner"))
+}
+
+func Test_SuspendProfile(t *testing.T) {
+	now := time.Date(2022, 3, 2, 12, 0, 0, 0, time.UTC)
+	ar, entries := newAuditRepo()
+	as := &adminService{ar, newModerationProfileRepo(), nil, nil, func() time.Time { return now }}
+
+	result, err := as.SuspendProfile("moderator-id", "cook", true, "spam")
+	assert.NoError(t, err)
+	assert.True(t, result.Suspended)
+
+	_, err = as.SuspendProfile("admin-id", "cook", false, "")
+	assert.NoError(t, err)
+
+	// moderators can't suspend themselves, each other or admins
+	_, err = as.SuspendProfile("moderator-id", "moderator", true, "")
+	assert.ErrorIs(t, err, ErrRoleForbidden)
+	_, err = as.SuspendProfile("moderator-id", "admin", true, "")
+	assert.ErrorIs(t, err, ErrRoleForbidden)
+	_, err = as.SuspendProfile("moderator-id", "nobody", true, "")
+	assert.ErrorIs(t, err, ErrNoProfile)
+
+	assert.Equal(t, []admin.AuditEntry{
+		{ActorId: "moderator-id", Action: AuditProfileSuspend, TargetType: "profile", TargetId: "cook-id", Details: "spam", Created: now},
+		{ActorId: "admin-id", Action: AuditProfileUnsuspend, TargetType: "profile", TargetId: "cook-id", Created: now},
+	}, *entries)
+}
+
+func Test_SetRole(t *testing.T) {
+	ar, entries := newAuditRepo()
+	as := &adminService{ar, newModerationProfileRepo(), nil, nil, time.Now}
+
+	result, err := as.SetRole("admin-id", "cook", RoleModerator)
+	assert.NoError(t, err)
+	assert.Equal(t, RoleModerator, result.Role)
+
+	_, err = as.SetRole("admin-id", "admin", RoleUser)
+	assert.ErrorIs(t, err, ErrRoleForbidden)
+	_, err = as.SetRole("admin-id", "cook", "owner")
+	assert.ErrorIs(t, err, ErrRoleData)
+
+	assert.Len(t, *entries, 1)
+	assert.Equal(t, "user to moderator", (*entries)[0].Details)
+
+	// the role and the audit log are written together, failing either fails the action
+	as.adminRepo = &AdminRepoMocker{UpdateProfileRoleMock: func(id string, role string, entry admin.AuditEntry) error {
+		return errors.New("failed")
+	}}
+	_, err = as.SetRole("admin-id", "cook", RoleModerator)
+	assert.Error(t, err)
+}
+
+func Test_ModerateRecipe(t *testing.T) {
+	var hidden []bool
+	deleted := 0
+	rr := &RecipeRepoMocker{
+		SelectRecipeByIdMock: func(id int) (recipe.Recipe, error) {
+			if id != 4 {
+				return recipe.Recipe{}, sql.ErrNoRows
+			}
+			return recipe.Recipe{Id: 4, Name: "Soup", Username: "cook", ImageName: "cover.jpg", Visibility: VisibilityPublic}, nil
+		},
+	}
+	ar, entries := newAuditRepo()
+	ar.UpdateRecipeHiddenMock = func(id int, h bool, entry admin.AuditEntry) error {
+		hidden = append(hidden, h)
+		return ar.InsertAuditEntryMock(entry)
+	}
+	ar.DeleteRecipeMock = func(id int, entry admin.AuditEntry) error {
+		deleted++
+		return ar.InsertAuditEntryMock(entry)
+	}
+	is := &ImageServiceMocker{}
+	as := NewAdminService(ar, &ProfileRepoMocker{}, NewRecipeService(rr, is), is)
+
+	result, err := as.HideRecipe("moderator-id", 4, true, "spam")
+	assert.NoError(t, err)
+	assert.True(t, result.Hidden)
+	assert.NoError(t, as.RemoveRecipe("admin-id", 4, "spam"))
+	assert.ErrorIs(t, as.RemoveRecipe("admin-id", 5, ""), ErrNoRecipe)
+
+	assert.Equal(t, []bool{true}, hidden)
+	assert.Equal(t, 1, deleted)
+	assert.Len(t, *entries, 2)
+	assert.Equal(t, AuditRecipeHide, (*entries)[0].Action)
+	assert.Equal(t, AuditRecipeDelete, (*entries)[1].Action)
+	assert.Equal(t, `"Soup" by cook: spam`, (*entries)[1].Details)
+	assert.Equal(t, []string{"cover.jpg"}, is.Deleted)
+}
+
+func Test_GrantAdmins(t *testing.T) {
+	var granted []string
+	ar, entries := newAuditRepo()
+	ar.UpdateProfileRoleMock = func(id string, role string, entry admin.AuditEntry) error {
+		assert.Equal(t, RoleAdmin, role)
+		granted = append(granted, id)
+		return ar.InsertAuditEntryMock(entry)
+	}
+	as := NewAdminService(ar, newModerationProfileRepo(), nil, nil)
+
+	assert.NoError(t, as.GrantAdmins([]string{"admin", "cook", "nobody"}))
+	assert.Equal(t, []string{"cook-id"}, granted)
+	assert.Len(t, *entries, 1)
+	assert.Equal(t, auditSystemActor, (*entries)[0].ActorId)
+}
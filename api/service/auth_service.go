@@ -0,0 +1,464 @@
+package service
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/eciccone/rh/api/repo/account"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrAccountData         = errors.New("invalid account details")
+	ErrAccountExists       = errors.New("username already registered")
+	ErrNoAccount           = errors.New("account not found")
+	ErrInvalidCredentials  = errors.New("invalid username or password")
+	ErrAccountLocked       = errors.New("too many failed logins, try again later")
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+)
+
+const (
+	// failed logins in a row that lock an account, and for how long
+	maxFailedLogins = 5
+	loginLockout    = 15 * time.Minute
+
+	minPasswordLength = 8
+	// bcrypt ignores the rest of longer passwords
+	maxPasswordLength = 72
+
+	maxAccountUsernameLength = 100
+)
+
+// LocalAuthConfig configures the accounts of users who sign in with a username and password.
+// Their access tokens are signed with Key and issued by Issuer, so a provider of Issuer with
+// the public key verifies them like any other.
+type LocalAuthConfig struct {
+	Issuer          string
+	Audience        string
+	Key             jwk.Key
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+}
+
+// Gets the local auth configuration from LOCAL_AUTH_KEY_FILE, a PEM encoded private key, along
+// with LOCAL_AUTH_ISSUER, LOCAL_AUTH_AUDIENCE, LOCAL_AUTH_ACCESS_TTL and LOCAL_AUTH_REFRESH_TTL.
+// Returns nil if LOCAL_AUTH_KEY_FILE is not set, local auth is off then.
+func LocalAuthFromEnv() (*LocalAuthConfig, error) {
+	path := os.Getenv("LOCAL_AUTH_KEY_FILE")
+	if path == "" {
+		return nil, nil
+	}
+
+	set, err := jwk.ReadFile(path, jwk.WithPEM(true))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LOCAL_AUTH_KEY_FILE: %w", err)
+	}
+
+	key, ok := set.Get(0)
+	if !ok || set.Len() != 1 {
+		return nil, errors.New("LOCAL_AUTH_KEY_FILE must have exactly one key")
+	}
+
+	if _, err := signingAlgorithm(key); err != nil {
+		return nil, fmt.Errorf("invalid LOCAL_AUTH_KEY_FILE: %w", err)
+	}
+
+	// the key id lets the key be rotated later without invalidating every token at once
+	if key.KeyID() == "" {
+		thumbprint, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LOCAL_AUTH_KEY_FILE: %w", err)
+		}
+		key.Set(jwk.KeyIDKey, base64.RawURLEncoding.EncodeToString(thumbprint))
+	}
+
+	config := &LocalAuthConfig{
+		Issuer:          os.Getenv("LOCAL_AUTH_ISSUER"),
+		Audience:        os.Getenv("LOCAL_AUTH_AUDIENCE"),
+		Key:             key,
+		AccessTokenTTL:  15 * time.Minute,
+		RefreshTokenTTL: 30 * 24 * time.Hour,
+	}
+	if config.Issuer == "" {
+		config.Issuer = "local"
+	}
+
+	for env, ttl := range map[string]*time.Duration{"LOCAL_AUTH_ACCESS_TTL": &config.AccessTokenTTL, "LOCAL_AUTH_REFRESH_TTL": &config.RefreshTokenTTL} {
+		if value := os.Getenv(env); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid %s %q", env, value)
+			}
+			*ttl = d
+		}
+	}
+
+	return config, nil
+}
+
+// The public keys access tokens are verified with.
+func (c *LocalAuthConfig) PublicKeys() (jwk.Set, error) {
+	key, err := jwk.PublicKeyOf(c.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	alg, err := signingAlgorithm(c.Key)
+	if err != nil {
+		return nil, err
+	}
+	key.Set(jwk.AlgorithmKey, alg)
+
+	set := jwk.NewSet()
+	set.Add(key)
+
+	return set, nil
+}
+
+func signingAlgorithm(key jwk.Key) (jwa.SignatureAlgorithm, error) {
+	switch key.KeyType() {
+	case jwa.RSA:
+		return jwa.RS256, nil
+	case jwa.EC:
+		return jwa.ES256, nil
+	case jwa.OKP:
+		return jwa.EdDSA, nil
+	}
+
+	return "", fmt.Errorf("unsupported key type %s", key.KeyType())
+}
+
+type AuthService interface {
+	// Creates an account and logs it in.
+	// Returns ErrAccountData if the username or password is invalid.
+	// Returns ErrAccountExists if the username is registered.
+	Register(username string, password string) (Tokens, error)
+
+	// Returns ErrInvalidCredentials if no account has the username and password.
+	// Returns ErrAccountLocked if the account is locked after too many failed logins.
+	Login(username string, password string) (Tokens, error)
+
+	// Exchanges a refresh token for new tokens, it can't be used again after. Using it again
+	// revokes every token rotated from the same login, as it may have been stolen.
+	// Returns ErrInvalidRefreshToken if the token is unknown, used or expired.
+	Refresh(refreshToken string) (Tokens, error)
+
+	// Revokes a refresh token along with every token rotated from the same login.
+	Logout(refreshToken string) error
+
+	// Changes the password of the account a token identifies and revokes its refresh tokens.
+	// Returns ErrNoAccount if the token is not for a local account.
+	// Returns ErrInvalidCredentials if current is not the password.
+	// Returns ErrAccountLocked if the account is locked after too many failed logins.
+	// Returns ErrAccountData if password is invalid.
+	ChangePassword(issuer string, subject string, current string, password string) error
+}
+
+type Tokens struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type authService struct {
+	accountRepo account.AccountRepository
+	config      LocalAuthConfig
+	now         func() time.Time
+}
+
+func NewAuthService(accountRepo account.AccountRepository, config LocalAuthConfig) AuthService {
+	return &authService{accountRepo, config, time.Now}
+}
+
+// Creates an account and logs it in.
+// Returns ErrAccountData if the username or password is invalid.
+// Returns ErrAccountExists if the username is registered.
+func (s *authService) Register(username string, password string) (Tokens, error) {
+	username = strings.TrimSpace(username)
+
+	if username == "" {
+		return Tokens{}, fieldError(ErrAccountData, "username", "is required")
+	}
+
+	if utf8.RuneCountInString(username) > maxAccountUsernameLength {
+		return Tokens{}, fieldError(ErrAccountData, "username", fmt.Sprintf("must be at most %d characters", maxAccountUsernameLength))
+	}
+
+	if err := validatePassword(password); err != nil {
+		return Tokens{}, err
+	}
+
+	if _, err := s.accountRepo.SelectAccountByUsername(username); err == nil {
+		return Tokens{}, ErrAccountExists
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return Tokens{}, fmt.Errorf("Register failed to select account: %w", err)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return Tokens{}, fmt.Errorf("Register failed to hash password: %w", err)
+	}
+
+	id, err := randomToken()
+	if err != nil {
+		return Tokens{}, fmt.Errorf("Register failed to generate account id: %w", err)
+	}
+
+	// the username can be registered by someone else while the password is hashed
+	a := account.Account{Id: id, Username: username, PasswordHash: string(hash), Created: s.now()}
+	inserted, err := s.accountRepo.InsertAccount(a)
+	if err != nil {
+		return Tokens{}, fmt.Errorf("Register failed to insert account: %w", err)
+	}
+
+	if !inserted {
+		return Tokens{}, ErrAccountExists
+	}
+
+	return s.issueTokens(a.Id, "")
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fieldError(ErrAccountData, "password", fmt.Sprintf("must be at least %d characters", minPasswordLength))
+	}
+
+	if len(password) > maxPasswordLength {
+		return fieldError(ErrAccountData, "password", fmt.Sprintf("must be at most %d bytes", maxPasswordLength))
+	}
+
+	return nil
+}
+
+// compared with passwords of unknown usernames, so logging in takes as long whether or not the
+// username is registered
+var (
+	unknownAccountHash []byte
+	unknownAccountOnce sync.Once
+)
+
+// Returns ErrInvalidCredentials if no account has the username and password.
+// Returns ErrAccountLocked if the account is locked after too many failed logins.
+func (s *authService) Login(username string, password string) (Tokens, error) {
+	a, err := s.accountRepo.SelectAccountByUsername(strings.TrimSpace(username))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			unknownAccountOnce.Do(func() {
+				unknownAccountHash, _ = bcrypt.GenerateFromPassword([]byte("unknown account"), bcrypt.DefaultCost)
+			})
+			bcrypt.CompareHashAndPassword(unknownAccountHash, []byte(password))
+			return Tokens{}, ErrInvalidCredentials
+		}
+
+		return Tokens{}, fmt.Errorf("Login failed to select account: %w", err)
+	}
+
+	if err := s.checkPassword(a, password); err != nil {
+		return Tokens{}, err
+	}
+
+	return s.issueTokens(a.Id, "")
+}
+
+// Exchanges a refresh token for new tokens, it can't be used again after. Using it again revokes
+// every token rotated from the same login, as it may have been stolen.
+// Returns ErrInvalidRefreshToken if the token is unknown, used or expired.
+func (s *authService) Refresh(refreshToken string) (Tokens, error) {
+	t, err := s.accountRepo.SelectRefreshToken(hashToken(refreshToken))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Tokens{}, ErrInvalidRefreshToken
+		}
+
+		return Tokens{}, fmt.Errorf("Refresh failed to select refresh token: %w", err)
+	}
+
+	if !s.now().Before(t.Expires) {
+		return Tokens{}, ErrInvalidRefreshToken
+	}
+
+	unused := !t.Used
+	if unused {
+		if unused, err = s.accountRepo.UpdateRefreshTokenUsed(t.Id); err != nil {
+			return Tokens{}, fmt.Errorf("Refresh failed to use refresh token: %w", err)
+		}
+	}
+
+	if !unused {
+		if err := s.accountRepo.DeleteRefreshTokenFamily(t.Family); err != nil {
+			return Tokens{}, fmt.Errorf("Refresh failed to revoke refresh tokens: %w", err)
+		}
+
+		return Tokens{}, ErrInvalidRefreshToken
+	}
+
+	return s.issueTokens(t.AccountId, t.Family)
+}
+
+// Revokes a refresh token along with every token rotated from the same login.
+func (s *authService) Logout(refreshToken string) error {
+	t, err := s.accountRepo.SelectRefreshToken(hashToken(refreshToken))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+
+		return fmt.Errorf("Logout failed to select refresh token: %w", err)
+	}
+
+	if err := s.accountRepo.DeleteRefreshTokenFamily(t.Family); err != nil {
+		return fmt.Errorf("Logout failed to revoke refresh tokens: %w", err)
+	}
+
+	return nil
+}
+
+// Changes the password of the account a token identifies and revokes its refresh tokens.
+// Returns ErrNoAccount if the token is not for a local account.
+// Returns ErrInvalidCredentials if current is not the password.
+// Returns ErrAccountLocked if the account is locked after too many failed logins.
+// Returns ErrAccountData if password is invalid.
+func (s *authService) ChangePassword(issuer string, subject string, current string, password string) error {
+	if issuer != s.config.Issuer {
+		return ErrNoAccount
+	}
+
+	a, err := s.accountRepo.SelectAccountById(subject)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoAccount
+		}
+
+		return fmt.Errorf("ChangePassword failed to select account: %w", err)
+	}
+
+	if err := s.checkPassword(a, current); err != nil {
+		return err
+	}
+
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("ChangePassword failed to hash password: %w", err)
+	}
+
+	if err := s.accountRepo.UpdateAccountPassword(a.Id, string(hash)); err != nil {
+		return fmt.Errorf("ChangePassword failed to update password: %w", err)
+	}
+
+	return nil
+}
+
+// Issues an access token and a refresh token for an account. The refresh token starts a new
+// family unless it is rotated from one of family.
+// Checks password against an account, counting a wrong one as a failed login so passwords can't
+// be guessed without limit, and resetting the count on the right one.
+// Returns ErrAccountLocked if the account is locked after too many failed logins.
+// Returns ErrInvalidCredentials if password is wrong.
+func (s *authService) checkPassword(a account.Account, password string) error {
+	now := s.now()
+	if now.Before(a.LockedUntil) {
+		return ErrAccountLocked
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(a.PasswordHash), []byte(password)) != nil {
+		if err := s.accountRepo.UpdateAccountFailedLogin(a.Id, maxFailedLogins, now.Add(loginLockout)); err != nil {
+			return fmt.Errorf("failed to count failed login: %w", err)
+		}
+
+		return ErrInvalidCredentials
+	}
+
+	if a.FailedLogins > 0 {
+		if err := s.accountRepo.UpdateAccountLoggedIn(a.Id); err != nil {
+			return fmt.Errorf("failed to reset failed logins: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *authService) issueTokens(accountId string, family string) (Tokens, error) {
+	now := s.now()
+
+	token := jwt.New()
+	token.Set(jwt.IssuerKey, s.config.Issuer)
+	token.Set(jwt.SubjectKey, accountId)
+	token.Set(jwt.IssuedAtKey, now)
+	token.Set(jwt.ExpirationKey, now.Add(s.config.AccessTokenTTL))
+	if s.config.Audience != "" {
+		token.Set(jwt.AudienceKey, s.config.Audience)
+	}
+
+	alg, err := signingAlgorithm(s.config.Key)
+	if err != nil {
+		return Tokens{}, fmt.Errorf("issueTokens failed to sign access token: %w", err)
+	}
+
+	signed, err := jwt.Sign(token, alg, s.config.Key)
+	if err != nil {
+		return Tokens{}, fmt.Errorf("issueTokens failed to sign access token: %w", err)
+	}
+
+	refreshToken, err := randomToken()
+	if err != nil {
+		return Tokens{}, fmt.Errorf("issueTokens failed to generate refresh token: %w", err)
+	}
+
+	if family == "" {
+		if family, err = randomToken(); err != nil {
+			return Tokens{}, fmt.Errorf("issueTokens failed to generate refresh token family: %w", err)
+		}
+	}
+
+	t := account.RefreshToken{
+		Id:        hashToken(refreshToken),
+		AccountId: accountId,
+		Family:    family,
+		Expires:   now.Add(s.config.RefreshTokenTTL),
+		Created:   now,
+	}
+	if err := s.accountRepo.InsertRefreshToken(t); err != nil {
+		return Tokens{}, fmt.Errorf("issueTokens failed to insert refresh token: %w", err)
+	}
+
+	return Tokens{
+		AccessToken:  string(signed),
+		TokenType:    "Bearer",
+		ExpiresIn:    int(s.config.AccessTokenTTL.Seconds()),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// refresh tokens are stored hashed, so a copy of the database can't be used to log in
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
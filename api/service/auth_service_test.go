@@ -0,0 +1,282 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/eciccone/rh/api/repo/account"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type AccountRepoMocker struct {
+	InsertAccountMock            func(a account.Account) (bool, error)
+	SelectAccountByIdMock        func(id string) (account.Account, error)
+	SelectAccountByUsernameMock  func(username string) (account.Account, error)
+	UpdateAccountFailedLoginMock func(id string, maxFailed int, lockedUntil time.Time) error
+	UpdateAccountLoggedInMock    func(id string) error
+	UpdateAccountPasswordMock    func(id string, passwordHash string) error
+	InsertRefreshTokenMock       func(t account.RefreshToken) error
+	SelectRefreshTokenMock       func(id string) (account.RefreshToken, error)
+	UpdateRefreshTokenUsedMock   func(id string) (bool, error)
+	DeleteRefreshTokenFamilyMock func(family string) error
+}
+
+func (r *AccountRepoMocker) InsertAccount(a account.Account) (bool, error) {
+	return r.InsertAccountMock(a)
+}
+
+func (r *AccountRepoMocker) SelectAccountById(id string) (account.Account, error) {
+	return r.SelectAccountByIdMock(id)
+}
+
+func (r *AccountRepoMocker) SelectAccountByUsername(username string) (account.Account, error) {
+	return r.SelectAccountByUsernameMock(username)
+}
+
+func (r *AccountRepoMocker) UpdateAccountFailedLogin(id string, maxFailed int, lockedUntil time.Time) error {
+	return r.UpdateAccountFailedLoginMock(id, maxFailed, lockedUntil)
+}
+
+func (r *AccountRepoMocker) UpdateAccountLoggedIn(id string) error {
+	return r.UpdateAccountLoggedInMock(id)
+}
+
+func (r *AccountRepoMocker) UpdateAccountPassword(id string, passwordHash string) error {
+	return r.UpdateAccountPasswordMock(id, passwordHash)
+}
+
+func (r *AccountRepoMocker) InsertRefreshToken(t account.RefreshToken) error {
+	return r.InsertRefreshTokenMock(t)
+}
+
+func (r *AccountRepoMocker) SelectRefreshToken(id string) (account.RefreshToken, error) {
+	return r.SelectRefreshTokenMock(id)
+}
+
+func (r *AccountRepoMocker) UpdateRefreshTokenUsed(id string) (bool, error) {
+	return r.UpdateRefreshTokenUsedMock(id)
+}
+
+func (r *AccountRepoMocker) DeleteRefreshTokenFamily(family string) error {
+	return r.DeleteRefreshTokenFamilyMock(family)
+}
+
+// An account repo keeping one account and its refresh tokens in memory.
+func newAccountRepo(a *account.Account, tokens map[string]account.RefreshToken) *AccountRepoMocker {
+	selectAccount := func(matches bool) (account.Account, error) {
+		if a == nil || !matches {
+			return account.Account{}, sql.ErrNoRows
+		}
+		return *a, nil
+	}
+
+	return &AccountRepoMocker{
+		InsertAccountMock: func(inserted account.Account) (bool, error) {
+			*a = inserted
+			return true, nil
+		},
+		SelectAccountByIdMock: func(id string) (account.Account, error) {
+			return selectAccount(a != nil && a.Id == id)
+		},
+		SelectAccountByUsernameMock: func(username string) (account.Account, error) {
+			return selectAccount(a != nil && a.Username == username)
+		},
+		UpdateAccountFailedLoginMock: func(id string, maxFailed int, lockedUntil time.Time) error {
+			a.FailedLogins++
+			if a.FailedLogins >= maxFailed {
+				a.FailedLogins = 0
+				a.LockedUntil = lockedUntil
+			}
+			return nil
+		},
+		UpdateAccountLoggedInMock: func(id string) error {
+			a.FailedLogins = 0
+			a.LockedUntil = time.Time{}
+			return nil
+		},
+		UpdateAccountPasswordMock: func(id string, passwordHash string) error {
+			a.PasswordHash = passwordHash
+			for k := range tokens {
+				delete(tokens, k)
+			}
+			return nil
+		},
+		InsertRefreshTokenMock: func(t account.RefreshToken) error {
+			tokens[t.Id] = t
+			return nil
+		},
+		SelectRefreshTokenMock: func(id string) (account.RefreshToken, error) {
+			t, ok := tokens[id]
+			if !ok {
+				return account.RefreshToken{}, sql.ErrNoRows
+			}
+			return t, nil
+		},
+		UpdateRefreshTokenUsedMock: func(id string) (bool, error) {
+			t := tokens[id]
+			if t.Used {
+				return false, nil
+			}
+			t.Used = true
+			tokens[id] = t
+			return true, nil
+		},
+		DeleteRefreshTokenFamilyMock: func(family string) error {
+			for k, t := range tokens {
+				if t.Family == family {
+					delete(tokens, k)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func newLocalAuthConfig(t *testing.T) LocalAuthConfig {
+	_, raw, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	key, err := jwk.New(raw)
+	assert.NoError(t, err)
+	key.Set(jwk.KeyIDKey, "test-key")
+
+	return LocalAuthConfig{Issuer: "local", Audience: "rh", Key: key, AccessTokenTTL: 15 * time.Minute, RefreshTokenTTL: time.Hour}
+}
+
+func Test_Register(t *testing.T) {
+	config := newLocalAuthConfig(t)
+	a := &account.Account{}
+	tokens := map[string]account.RefreshToken{}
+	as := NewAuthService(newAccountRepo(a, tokens), config)
+
+	_, err := as.Register(" ", "password")
+	assert.ErrorIs(t, err, ErrAccountData)
+
+	_, err = as.Register("cook", "short")
+	assert.ErrorIs(t, err, ErrAccountData)
+
+	result, err := as.Register(" cook ", "correct horse")
+	assert.NoError(t, err)
+	assert.Equal(t, "cook", a.Username)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(a.PasswordHash), []byte("correct horse")))
+	assert.Len(t, tokens, 1)
+
+	// the access token is verified with the public keys
+	keys, err := config.PublicKeys()
+	assert.NoError(t, err)
+	token, err := jwt.Parse([]byte(result.AccessToken), jwt.WithKeySet(keys), jwt.WithValidate(true), jwt.WithIssuer("local"), jwt.WithAudience("rh"))
+	assert.NoError(t, err)
+	assert.Equal(t, a.Id, token.Subject())
+	assert.Equal(t, 900, result.ExpiresIn)
+
+	_, err = as.Register("cook", "correct horse")
+	assert.ErrorIs(t, err, ErrAccountExists)
+
+	// registered by someone else after the username was checked
+	repo := newAccountRepo(&account.Account{}, tokens)
+	repo.InsertAccountMock = func(inserted account.Account) (bool, error) {
+		return false, nil
+	}
+	_, err = NewAuthService(repo, config).Register("baker", "correct horse")
+	assert.ErrorIs(t, err, ErrAccountExists)
+}
+
+func Test_Login(t *testing.T) {
+	now := time.Date(2022, 3, 2, 12, 0, 0, 0, time.UTC)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	a := &account.Account{Id: "test-id", Username: "cook", PasswordHash: string(hash), FailedLogins: 1}
+	tokens := map[string]account.RefreshToken{}
+	as := &authService{newAccountRepo(a, tokens), newLocalAuthConfig(t), func() time.Time { return now }}
+
+	_, err := as.Login("unknown", "correct horse")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	_, err = as.Login("cook", "correct horse")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, a.FailedLogins)
+
+	// the account is locked after too many failed logins in a row
+	for i := 0; i < maxFailedLogins; i++ {
+		_, err = as.Login("cook", "wrong")
+		assert.ErrorIs(t, err, ErrInvalidCredentials)
+	}
+	_, err = as.Login("cook", "correct horse")
+	assert.ErrorIs(t, err, ErrAccountLocked)
+
+	now = now.Add(loginLockout)
+	_, err = as.Login("cook", "correct horse")
+	assert.NoError(t, err)
+}
+
+func Test_RefreshTokens(t *testing.T) {
+	now := time.Date(2022, 3, 2, 12, 0, 0, 0, time.UTC)
+	a := &account.Account{Id: "test-id", Username: "cook"}
+	tokens := map[string]account.RefreshToken{}
+	as := &authService{newAccountRepo(a, tokens), newLocalAuthConfig(t), func() time.Time { return now }}
+
+	first, err := as.issueTokens("test-id", "")
+	assert.NoError(t, err)
+
+	second, err := as.Refresh(first.RefreshToken)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	assert.Equal(t, tokens[hashToken(first.RefreshToken)].Family, tokens[hashToken(second.RefreshToken)].Family)
+
+	// reusing a rotated token revokes the tokens rotated from it
+	_, err = as.Refresh(first.RefreshToken)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	_, err = as.Refresh(second.RefreshToken)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	third, err := as.issueTokens("test-id", "")
+	assert.NoError(t, err)
+	now = now.Add(2 * time.Hour)
+	_, err = as.Refresh(third.RefreshToken)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	assert.NoError(t, as.Logout(third.RefreshToken))
+	assert.Empty(t, tokens)
+	assert.NoError(t, as.Logout("unknown"))
+}
+
+func Test_ChangePassword(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	a := &account.Account{Id: "test-id", Username: "cook", PasswordHash: string(hash)}
+	tokens := map[string]account.RefreshToken{"hash": {Id: "hash", AccountId: "test-id"}}
+	as := NewAuthService(newAccountRepo(a, tokens), newLocalAuthConfig(t))
+
+	assert.ErrorIs(t, as.ChangePassword("https://other.example.com/", "test-id", "correct horse", "battery staple"), ErrNoAccount)
+	assert.ErrorIs(t, as.ChangePassword("local", "test-id", "wrong", "battery staple"), ErrInvalidCredentials)
+	assert.ErrorIs(t, as.ChangePassword("local", "test-id", "correct horse", "short"), ErrAccountData)
+
+	assert.NoError(t, as.ChangePassword("local", "test-id", "correct horse", "battery staple"))
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(a.PasswordHash), []byte("battery staple")))
+	assert.Empty(t, tokens)
+}
+
+func Test_ChangePasswordLockout(t *testing.T) {
+	now := time.Date(2022, 3, 2, 12, 0, 0, 0, time.UTC)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	a := &account.Account{Id: "test-id", Username: "cook", PasswordHash: string(hash)}
+	as := &authService{newAccountRepo(a, map[string]account.RefreshToken{}), newLocalAuthConfig(t), func() time.Time { return now }}
+
+	// a stolen access token can't be used to guess the password without limit
+	for i := 0; i < maxFailedLogins; i++ {
+		assert.ErrorIs(t, as.ChangePassword("local", "test-id", "wrong", "battery staple"), ErrInvalidCredentials)
+	}
+	assert.ErrorIs(t, as.ChangePassword("local", "test-id", "correct horse", "battery staple"), ErrAccountLocked)
+	_, err := as.Login("cook", "correct horse")
+	assert.ErrorIs(t, err, ErrAccountLocked)
+
+	now = now.Add(loginLockout)
+	assert.ErrorIs(t, as.ChangePassword("local", "test-id", "wrong", "battery staple"), ErrInvalidCredentials)
+	assert.Equal(t, 1, a.FailedLogins)
+	assert.NoError(t, as.ChangePassword("local", "test-id", "correct horse", "battery staple"))
+	assert.Equal(t, 0, a.FailedLogins)
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eciccone/rh/api/repo/recipe"
+)
+
+const maxFeedLimit = 50
+
+type FeedPage struct {
+	Recipes []recipe.Recipe `json:"recipes"`
+	// where the next page starts, empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Gets a page of the public recipes of the profiles a profile follows, most recently published
+// first. The page starts after cursor, a cursor returned with the previous page, or at the most
+// recent recipe when it is empty.
+// Returns ErrRecipeQuery if the cursor is invalid.
+func (s *recipeService) GetFeed(profileId string, cursor string, limit int) (FeedPage, error) {
+	after, err := decodeFeedCursor(cursor)
+	if err != nil {
+		return FeedPage{}, err
+	}
+
+	if limit <= 0 {
+		limit = 10
+	}
+
+	if limit > maxFeedLimit {
+		limit = maxFeedLimit
+	}
+
+	// one more than asked for tells whether there is a next page
+	recipes, err := s.recipeRepo.SelectFeedRecipes(profileId, after, limit+1)
+	if err != nil {
+		return FeedPage{}, fmt.Errorf("GetFeed failed to get recipes: %w", err)
+	}
+
+	var page FeedPage
+	if len(recipes) > limit {
+		recipes = recipes[:limit]
+		last := recipes[limit-1]
+		page.NextCursor = encodeFeedCursor(recipe.FeedCursor{Published: *last.Published, Id: last.Id})
+	}
+
+	details := make([]*recipe.Recipe, len(recipes))
+	for i := range recipes {
+		details[i] = &recipes[i]
+	}
+
+	if err := s.withImageDetails(details...); err != nil {
+		return FeedPage{}, fmt.Errorf("GetFeed failed to get image details: %w", err)
+	}
+
+	page.Recipes = recipes
+
+	return page, nil
+}
+
+// Cursors are opaque to clients, so how pages are keyed can change without breaking them.
+func encodeFeedCursor(c recipe.FeedCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d", c.Published.Unix(), c.Id)))
+}
+
+// Returns ErrRecipeQuery if the cursor was not returned by encodeFeedCursor.
+func decodeFeedCursor(cursor string) (recipe.FeedCursor, error) {
+	if cursor == "" {
+		return recipe.FeedCursor{}, nil
+	}
+
+	invalid := fmt.Errorf("%w: invalid cursor", ErrRecipeQuery)
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return recipe.FeedCursor{}, invalid
+	}
+
+	parts := strings.Split(string(b), ".")
+	if len(parts) != 2 {
+		return recipe.FeedCursor{}, invalid
+	}
+
+	published, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return recipe.FeedCursor{}, invalid
+	}
+
+	id, err := strconv.Atoi(parts[1])
+	if err != nil || id <= 0 {
+		return recipe.FeedCursor{}, invalid
+	}
+
+	return recipe.FeedCursor{Published: time.Unix(published, 0), Id: id}, nil
+}
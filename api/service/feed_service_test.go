@@ -0,0 +1,64 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eciccone/rh/api/repo/recipe"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_GetFeed(t *testing.T) {
+	newer := time.Unix(1700000100, 0)
+	older := time.Unix(1700000000, 0)
+	feed := []recipe.Recipe{
+		{Id: 3, Name: "Soup", Username: "cook", Visibility: "public", ImageName: "soup.jpg", Published: &newer},
+		{Id: 2, Name: "Bread", Username: "cook", Visibility: "public", Published: &older},
+		{Id: 1, Name: "Salad", Username: "baker", Visibility: "public", Published: &older},
+	}
+
+	rr := &RecipeRepoMocker{
+		SelectFeedRecipesMock: func(profileId string, after recipe.FeedCursor, limit int) ([]recipe.Recipe, error) {
+			assert.Equal(t, "test-id", profileId)
+
+			var result []recipe.Recipe
+			for _, r := range feed {
+				if after == (recipe.FeedCursor{}) || r.Published.Before(after.Published) || (r.Published.Equal(after.Published) && r.Id < after.Id) {
+					result = append(result, r)
+				}
+			}
+			if len(result) > limit {
+				result = result[:limit]
+			}
+			return result, nil
+		},
+	}
+	rs := NewRecipeService(rr, &ImageServiceMocker{})
+
+	page, err := rs.GetFeed("test-id", "", 2)
+	assert.NoError(t, err)
+	assert.Len(t, page.Recipes, 2)
+	assert.Equal(t, 3, page.Recipes[0].Id)
+	assert.Equal(t, map[string]string{"full": "/images/soup.jpg"}, page.Recipes[0].ImageURLs)
+	assert.NotEmpty(t, page.NextCursor)
+
+	// recipes published in the same second are paged by id
+	page, err = rs.GetFeed("test-id", page.NextCursor, 2)
+	assert.NoError(t, err)
+	assert.Len(t, page.Recipes, 1)
+	assert.Equal(t, 1, page.Recipes[0].Id)
+	assert.Empty(t, page.NextCursor)
+
+	for _, cursor := range []string{"not base64!", "MTIz", "YS5i"} {
+		_, err = rs.GetFeed("test-id", cursor, 2)
+		assert.ErrorIs(t, err, ErrRecipeQuery, cursor)
+	}
+
+	rr.SelectFeedRecipesMock = func(profileId string, after recipe.FeedCursor, limit int) ([]recipe.Recipe, error) {
+		assert.Equal(t, maxFeedLimit+1, limit)
+		return nil, errors.New("failed")
+	}
+	_, err = rs.GetFeed("test-id", "", 1000)
+	assert.Error(t, err)
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/eciccone/rh/api/repo/profile"
+)
+
+var ErrFollowSelf = errors.New("can not follow yourself")
+
+// A profile in a list of profiles.
+type ProfileSummary struct {
+	Username    string            `json:"username"`
+	DisplayName string            `json:"display_name,omitempty"`
+	AvatarURLs  map[string]string `json:"avatar_urls,omitempty"`
+}
+
+type ProfilePage struct {
+	Profiles []ProfileSummary `json:"profiles"`
+	Offset   int              `json:"offset"`
+	Limit    int              `json:"limit"`
+	Total    int              `json:"total"`
+}
+
+// Makes a profile follow the profile with username, following it again changes nothing.
+// Returns ErrNoProfile if no profile has or had the username.
+// Returns ErrFollowSelf if it is the profile's own username.
+func (s *profileService) Follow(id string, username string) error {
+	followee, err := s.findProfile(username)
+	if err != nil {
+		return err
+	}
+
+	if followee.Id == id {
+		return ErrFollowSelf
+	}
+
+	followed, err := s.profileRepo.InsertFollow(id, followee.Id, s.now())
+	if err != nil {
+		return fmt.Errorf("Follow failed to follow profile: %w", err)
+	}
+
+	// the follow is made even if the followed profile can't be notified of it
+	if followed {
+		if err := s.notificationService.Notify(followee.Id, id, NotificationFollow, ""); err != nil {
+			log.Printf("failed to notify of follow: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Makes a profile stop following the profile with username.
+// Returns ErrNoProfile if no profile has or had the username.
+func (s *profileService) Unfollow(id string, username string) error {
+	followee, err := s.findProfile(username)
+	if err != nil {
+		return err
+	}
+
+	if err := s.profileRepo.DeleteFollow(id, followee.Id); err != nil {
+		return fmt.Errorf("Unfollow failed to unfollow profile: %w", err)
+	}
+
+	return nil
+}
+
+// Gets a page of the profiles following the profile with username, most recent first.
+// Returns ErrNoProfile if no profile has or had the username.
+func (s *profileService) GetFollowers(username string, offset int, limit int) (ProfilePage, error) {
+	return s.getFollows(username, offset, limit, true)
+}
+
+// Gets a page of the profiles the profile with username follows, most recent first.
+// Returns ErrNoProfile if no profile has or had the username.
+func (s *profileService) GetFollowing(username string, offset int, limit int) (ProfilePage, error) {
+	return s.getFollows(username, offset, limit, false)
+}
+
+func (s *profileService) getFollows(username string, offset int, limit int, followers bool) (ProfilePage, error) {
+	p, err := s.findProfile(username)
+	if err != nil {
+		return ProfilePage{}, err
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	if limit <= 0 {
+		limit = 10
+	}
+
+	selectFollows := s.profileRepo.SelectFollowing
+	if followers {
+		selectFollows = s.profileRepo.SelectFollowers
+	}
+
+	profiles, err := selectFollows(p.Id, offset, limit)
+	if err != nil {
+		return ProfilePage{}, fmt.Errorf("getFollows failed to get profiles: %w", err)
+	}
+
+	followerCount, followingCount, err := s.profileRepo.SelectFollowCounts(p.Id)
+	if err != nil {
+		return ProfilePage{}, fmt.Errorf("getFollows failed to count profiles: %w", err)
+	}
+
+	total := followingCount
+	if followers {
+		total = followerCount
+	}
+
+	return ProfilePage{
+		Profiles: s.profileSummaries(profiles),
+		Offset:   offset,
+		Limit:    limit,
+		Total:    total,
+	}, nil
+}
+
+func (s *profileService) profileSummaries(profiles []profile.Profile) []ProfileSummary {
+	result := make([]ProfileSummary, len(profiles))
+	for i, p := range profiles {
+		result[i] = ProfileSummary{
+			Username:    p.Username,
+			DisplayName: p.DisplayName,
+			AvatarURLs:  s.imageService.ImageURLs(p.AvatarName),
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/eciccone/rh/api/repo/profile"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Follow(t *testing.T) {
+	now := time.Date(2022, 3, 2, 12, 0, 0, 0, time.UTC)
+	var followed, unfollowed, notified []string
+
+	rr := &ProfileRepoMocker{
+		SelectProfileByUsernameMock: func(username string) (profile.Profile, error) {
+			switch username {
+			case "cook":
+				return profile.Profile{Id: "cook-id", Username: "cook"}, nil
+			case "me":
+				return profile.Profile{Id: "test-id", Username: "me"}, nil
+			case "leaving":
+				deleteAfter := now.Add(time.Hour)
+				return profile.Profile{Id: "leaving-id", Username: "leaving", DeleteAfter: &deleteAfter}, nil
+			}
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		SelectProfileByRedirectMock: func(username string) (profile.Profile, error) {
+			if username == "old-cook" {
+				return profile.Profile{Id: "cook-id", Username: "cook"}, nil
+			}
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		InsertFollowMock: func(followerId string, followeeId string, created time.Time) (bool, error) {
+			assert.Equal(t, "test-id", followerId)
+			assert.Equal(t, now, created)
+			followed = append(followed, followeeId)
+			// only the first follow is new
+			return len(followed) == 1, nil
+		},
+		DeleteFollowMock: func(followerId string, followeeId string) error {
+			unfollowed = append(unfollowed, followeeId)
+			return nil
+		},
+	}
+	ns := &NotificationServiceMocker{
+		NotifyMock: func(profileId string, actorId string, notificationType string, subject string) error {
+			assert.Equal(t, "test-id", actorId)
+			assert.Equal(t, NotificationFollow, notificationType)
+			notified = append(notified, profileId)
+			return nil
+		},
+	}
+	ps := &profileService{rr, &ImageServiceMocker{}, ns, DefaultUsernamePolicy(), func() time.Time { return now }}
+
+	assert.NoError(t, ps.Follow("test-id", "cook"))
+	// previous usernames lead to the profile
+	assert.NoError(t, ps.Follow("test-id", "old-cook"))
+	assert.ErrorIs(t, ps.Follow("test-id", "me"), ErrFollowSelf)
+	assert.ErrorIs(t, ps.Follow("test-id", "leaving"), ErrNoProfile)
+	assert.ErrorIs(t, ps.Follow("test-id", "unknown"), ErrNoProfile)
+	assert.Equal(t, []string{"cook-id", "cook-id"}, followed)
+	// following again does not notify again
+	assert.Equal(t, []string{"cook-id"}, notified)
+
+	assert.NoError(t, ps.Unfollow("test-id", "cook"))
+	assert.ErrorIs(t, ps.Unfollow("test-id", "unknown"), ErrNoProfile)
+	assert.Equal(t, []string{"cook-id"}, unfollowed)
+}
+
+func Test_GetFollows(t *testing.T) {
+	rr := &ProfileRepoMocker{
+		SelectProfileByUsernameMock: func(username string) (profile.Profile, error) {
+			return profile.Profile{Id: "cook-id", Username: "cook"}, nil
+		},
+		SelectFollowersMock: func(id string, offset int, limit int) ([]profile.Profile, error) {
+			assert.Equal(t, "cook-id", id)
+			assert.Equal(t, 0, offset)
+			assert.Equal(t, 10, limit)
+			return []profile.Profile{{Id: "fan-id", Username: "fan", DisplayName: "Fan", AvatarName: "fan.jpg"}}, nil
+		},
+		SelectFollowingMock: func(id string, offset int, limit int) ([]profile.Profile, error) {
+			assert.Equal(t, 5, offset)
+			assert.Equal(t, 5, limit)
+			return []profile.Profile{}, nil
+		},
+		SelectFollowCountsMock: func(id string) (int, int, error) {
+			return 1, 7, nil
+		},
+	}
+	ps := NewProfileService(rr, &ImageServiceMocker{}, &NotificationServiceMocker{}, DefaultUsernamePolicy())
+
+	page, err := ps.GetFollowers("cook", -1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, ProfilePage{
+		Profiles: []ProfileSummary{{Username: "fan", DisplayName: "Fan", AvatarURLs: map[string]string{"full": "/images/fan.jpg"}}},
+		Offset:   0,
+		Limit:    10,
+		Total:    1,
+	}, page)
+
+	page, err = ps.GetFollowing("cook", 5, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, ProfilePage{Profiles: []ProfileSummary{}, Offset: 5, Limit: 5, Total: 7}, page)
+}
@@ -0,0 +1,447 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/eciccone/rh/api/repo/group"
+)
+
+var (
+	ErrGroupData      = errors.New("invalid group")
+	ErrNoGroup        = errors.New("group not found")
+	ErrGroupForbidden = errors.New("only group owners can do that")
+	ErrNoMember       = errors.New("group member not found")
+	ErrInvalidInvite  = errors.New("invalid or expired invite")
+)
+
+// roles profiles have in a group, owners manage the group and members
+const (
+	GroupOwner  = "owner"
+	GroupMember = "member"
+)
+
+var groupRoles = map[string]bool{GroupOwner: true, GroupMember: true}
+
+const (
+	maxGroupNameLength = 100
+	maxGroups          = 20
+	maxGroupMembers    = 50
+
+	defaultInviteExpiry = 7 * 24 * time.Hour
+	maxInviteExpiry     = 30 * 24 * time.Hour
+)
+
+type GroupService interface {
+	// Creates a group with the profile creating it as its owner.
+	// Returns ErrGroupData if the name is invalid or the profile is in too many groups.
+	CreateGroup(profileId string, name string) (group.Group, error)
+
+	// Gets the groups a profile is in, by name.
+	GetGroups(profileId string) ([]group.Group, error)
+
+	// Gets a group along with its members.
+	// Returns ErrNoGroup if the group does not exist or the profile is not in it.
+	GetGroup(id int, profileId string) (group.Group, error)
+
+	// Returns ErrGroupData if the name is invalid.
+	// Returns ErrNoGroup if the group does not exist or the profile is not in it.
+	// Returns ErrGroupForbidden if the profile is not an owner of the group.
+	RenameGroup(id int, profileId string, name string) (group.Group, error)
+
+	// Deletes a group. Its recipes go back to being only their owners'.
+	// Returns ErrNoGroup if the group does not exist or the profile is not in it.
+	// Returns ErrGroupForbidden if the profile is not an owner of the group.
+	DeleteGroup(id int, profileId string) error
+
+	// Creates an invite anyone can join the group with until it expires, in a week when expires
+	// is nil. The code is only ever returned here.
+	// Returns ErrGroupData if the expiry is not in the next 30 days.
+	// Returns ErrNoGroup if the group does not exist or the profile is not in it.
+	// Returns ErrGroupForbidden if the profile is not an owner of the group.
+	CreateInvite(id int, profileId string, expires *time.Time) (GroupInvite, error)
+
+	// Revokes every invite of a group.
+	// Returns ErrNoGroup if the group does not exist or the profile is not in it.
+	// Returns ErrGroupForbidden if the profile is not an owner of the group.
+	RevokeInvites(id int, profileId string) error
+
+	// Adds a profile to the group of an invite as a member. Joining a group the profile is
+	// already in leaves its role as it was.
+	// Returns ErrInvalidInvite if there is no such invite or it expired.
+	// Returns ErrGroupData if the profile is in too many groups or the group is full.
+	JoinGroup(profileId string, code string) (group.Group, error)
+
+	// Changes the role of a member. Returns every member.
+	// Returns ErrGroupData if role is unknown or the group would be left without an owner.
+	// Returns ErrNoGroup if the group does not exist or the profile is not in it.
+	// Returns ErrGroupForbidden if the profile is not an owner of the group.
+	// Returns ErrNoMember if no member has the username.
+	SetMemberRole(id int, profileId string, username string, role string) ([]group.Member, error)
+
+	// Removes a member from a group. Owners can remove anyone, members only themselves.
+	// Returns ErrGroupData if the group would be left without an owner.
+	// Returns ErrNoGroup if the group does not exist or the profile is not in it.
+	// Returns ErrGroupForbidden if a member removes someone else.
+	// Returns ErrNoMember if no member has the username.
+	RemoveMember(id int, profileId string, username string) error
+}
+
+// GroupInvite is the code of an invite, which is not stored, along with when it expires.
+type GroupInvite struct {
+	Code    string    `json:"code"`
+	Expires time.Time `json:"expires_at"`
+}
+
+type groupService struct {
+	groupRepo    group.GroupRepository
+	imageService ImageService
+	now          func() time.Time
+}
+
+func NewGroupService(groupRepo group.GroupRepository, imageService ImageService) GroupService {
+	return &groupService{groupRepo, imageService, time.Now}
+}
+
+// Creates a group with the profile creating it as its owner.
+// Returns ErrGroupData if the name is invalid or the profile is in too many groups.
+func (s *groupService) CreateGroup(profileId string, name string) (group.Group, error) {
+	name, err := normalizeGroupName(name)
+	if err != nil {
+		return group.Group{}, err
+	}
+
+	if err := s.checkGroupCount(profileId); err != nil {
+		return group.Group{}, err
+	}
+
+	result, err := s.groupRepo.InsertGroup(group.Group{Name: name, Created: s.now()}, profileId)
+	if err != nil {
+		return group.Group{}, fmt.Errorf("CreateGroup failed to insert group: %w", err)
+	}
+
+	return result, nil
+}
+
+// Gets the groups a profile is in, by name.
+func (s *groupService) GetGroups(profileId string) ([]group.Group, error) {
+	groups, err := s.groupRepo.SelectGroups(profileId)
+	if err != nil {
+		return nil, fmt.Errorf("GetGroups failed to select groups: %w", err)
+	}
+
+	return groups, nil
+}
+
+// Gets a group along with its members.
+// Returns ErrNoGroup if the group does not exist or the profile is not in it.
+func (s *groupService) GetGroup(id int, profileId string) (group.Group, error) {
+	g, err := s.getGroup(id, profileId)
+	if err != nil {
+		return group.Group{}, err
+	}
+
+	g.Members, err = s.members(id)
+	if err != nil {
+		return group.Group{}, err
+	}
+
+	return g, nil
+}
+
+// Returns ErrGroupData if the name is invalid.
+// Returns ErrNoGroup if the group does not exist or the profile is not in it.
+// Returns ErrGroupForbidden if the profile is not an owner of the group.
+func (s *groupService) RenameGroup(id int, profileId string, name string) (group.Group, error) {
+	name, err := normalizeGroupName(name)
+	if err != nil {
+		return group.Group{}, err
+	}
+
+	g, err := s.getOwnedGroup(id, profileId)
+	if err != nil {
+		return group.Group{}, err
+	}
+
+	if err := s.groupRepo.UpdateGroupName(id, name); err != nil {
+		return group.Group{}, fmt.Errorf("RenameGroup failed to update group: %w", err)
+	}
+	g.Name = name
+
+	return g, nil
+}
+
+// Deletes a group. Its recipes go back to being only their owners'.
+// Returns ErrNoGroup if the group does not exist or the profile is not in it.
+// Returns ErrGroupForbidden if the profile is not an owner of the group.
+func (s *groupService) DeleteGroup(id int, profileId string) error {
+	if _, err := s.getOwnedGroup(id, profileId); err != nil {
+		return err
+	}
+
+	if err := s.groupRepo.DeleteGroup(id); err != nil {
+		return fmt.Errorf("DeleteGroup failed to delete group: %w", err)
+	}
+
+	return nil
+}
+
+// Creates an invite anyone can join the group with until it expires, in a week when expires is
+// nil. The code is only ever returned here.
+// Returns ErrGroupData if the expiry is not in the next 30 days.
+// Returns ErrNoGroup if the group does not exist or the profile is not in it.
+// Returns ErrGroupForbidden if the profile is not an owner of the group.
+func (s *groupService) CreateInvite(id int, profileId string, expires *time.Time) (GroupInvite, error) {
+	now := s.now()
+
+	expiry := now.Add(defaultInviteExpiry)
+	if expires != nil {
+		expiry = *expires
+	}
+
+	if !expiry.After(now) || expiry.After(now.Add(maxInviteExpiry)) {
+		return GroupInvite{}, fmt.Errorf("%w: invites must expire in the next %d days", ErrGroupData, maxInviteExpiry/(24*time.Hour))
+	}
+
+	if _, err := s.getOwnedGroup(id, profileId); err != nil {
+		return GroupInvite{}, err
+	}
+
+	code, err := randomToken()
+	if err != nil {
+		return GroupInvite{}, fmt.Errorf("CreateInvite failed to generate code: %w", err)
+	}
+
+	err = s.groupRepo.InsertInvite(group.Invite{CodeHash: hashToken(code), GroupId: id, Created: now, Expires: expiry})
+	if err != nil {
+		return GroupInvite{}, fmt.Errorf("CreateInvite failed to insert invite: %w", err)
+	}
+
+	return GroupInvite{code, expiry}, nil
+}
+
+// Revokes every invite of a group.
+// Returns ErrNoGroup if the group does not exist or the profile is not in it.
+// Returns ErrGroupForbidden if the profile is not an owner of the group.
+func (s *groupService) RevokeInvites(id int, profileId string) error {
+	if _, err := s.getOwnedGroup(id, profileId); err != nil {
+		return err
+	}
+
+	if err := s.groupRepo.DeleteInvites(id); err != nil {
+		return fmt.Errorf("RevokeInvites failed to delete invites: %w", err)
+	}
+
+	return nil
+}
+
+// Adds a profile to the group of an invite as a member. Joining a group the profile is already
+// in leaves its role as it was.
+// Returns ErrInvalidInvite if there is no such invite or it expired.
+// Returns ErrGroupData if the profile is in too many groups or the group is full.
+func (s *groupService) JoinGroup(profileId string, code string) (group.Group, error) {
+	invite, err := s.groupRepo.SelectInvite(hashToken(strings.TrimSpace(code)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return group.Group{}, ErrInvalidInvite
+	}
+	if err != nil {
+		return group.Group{}, fmt.Errorf("JoinGroup failed to select invite: %w", err)
+	}
+
+	now := s.now()
+	if !invite.Expires.After(now) {
+		return group.Group{}, ErrInvalidInvite
+	}
+
+	// already a member
+	if g, err := s.GetGroup(invite.GroupId, profileId); !errors.Is(err, ErrNoGroup) {
+		return g, err
+	}
+
+	if err := s.checkGroupCount(profileId); err != nil {
+		return group.Group{}, err
+	}
+
+	members, err := s.groupRepo.SelectMembers(invite.GroupId)
+	if err != nil {
+		return group.Group{}, fmt.Errorf("JoinGroup failed to select members: %w", err)
+	}
+
+	if len(members) >= maxGroupMembers {
+		return group.Group{}, fmt.Errorf("%w: groups have at most %d members", ErrGroupData, maxGroupMembers)
+	}
+
+	if _, err := s.groupRepo.InsertMember(invite.GroupId, profileId, GroupMember, now); err != nil {
+		return group.Group{}, fmt.Errorf("JoinGroup failed to insert member: %w", err)
+	}
+
+	return s.GetGroup(invite.GroupId, profileId)
+}
+
+// Changes the role of a member. Returns every member.
+// Returns ErrGroupData if role is unknown or the group would be left without an owner.
+// Returns ErrNoGroup if the group does not exist or the profile is not in it.
+// Returns ErrGroupForbidden if the profile is not an owner of the group.
+// Returns ErrNoMember if no member has the username.
+func (s *groupService) SetMemberRole(id int, profileId string, username string, role string) ([]group.Member, error) {
+	if !groupRoles[role] {
+		return nil, fmt.Errorf("%w: role must be owner or member", ErrGroupData)
+	}
+
+	if _, err := s.getOwnedGroup(id, profileId); err != nil {
+		return nil, err
+	}
+
+	members, err := s.members(id)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := findMember(members, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Role == GroupOwner && role != GroupOwner && countOwners(members) == 1 {
+		return nil, fmt.Errorf("%w: a group must keep an owner", ErrGroupData)
+	}
+
+	if _, err := s.groupRepo.UpdateMemberRole(id, m.Username, role); err != nil {
+		return nil, fmt.Errorf("SetMemberRole failed to update member: %w", err)
+	}
+
+	return s.members(id)
+}
+
+// Removes a member from a group. Owners can remove anyone, members only themselves.
+// Returns ErrGroupData if the group would be left without an owner.
+// Returns ErrNoGroup if the group does not exist or the profile is not in it.
+// Returns ErrGroupForbidden if a member removes someone else.
+// Returns ErrNoMember if no member has the username.
+func (s *groupService) RemoveMember(id int, profileId string, username string) error {
+	g, err := s.getGroup(id, profileId)
+	if err != nil {
+		return err
+	}
+
+	members, err := s.members(id)
+	if err != nil {
+		return err
+	}
+
+	m, err := findMember(members, username)
+	if err != nil {
+		return err
+	}
+
+	if m.ProfileId != profileId && g.Role != GroupOwner {
+		return ErrGroupForbidden
+	}
+
+	if m.Role == GroupOwner && countOwners(members) == 1 {
+		return fmt.Errorf("%w: a group must keep an owner, delete it instead", ErrGroupData)
+	}
+
+	if _, err := s.groupRepo.DeleteMember(id, m.Username); err != nil {
+		return fmt.Errorf("RemoveMember failed to delete member: %w", err)
+	}
+
+	return nil
+}
+
+// Gets a group along with the role of the profile in it.
+// Returns ErrNoGroup if the group does not exist or the profile is not in it.
+func (s *groupService) getGroup(id int, profileId string) (group.Group, error) {
+	g, err := s.groupRepo.SelectGroup(id, profileId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return group.Group{}, ErrNoGroup
+	}
+	if err != nil {
+		return group.Group{}, fmt.Errorf("failed to select group: %w", err)
+	}
+
+	return g, nil
+}
+
+// Gets a group the profile owns, for what only owners can do.
+// Returns ErrNoGroup if the group does not exist or the profile is not in it.
+// Returns ErrGroupForbidden if the profile is not an owner of the group.
+func (s *groupService) getOwnedGroup(id int, profileId string) (group.Group, error) {
+	g, err := s.getGroup(id, profileId)
+	if err != nil {
+		return group.Group{}, err
+	}
+
+	if g.Role != GroupOwner {
+		return group.Group{}, ErrGroupForbidden
+	}
+
+	return g, nil
+}
+
+// Gets the members of a group with the urls of their avatars.
+func (s *groupService) members(id int) ([]group.Member, error) {
+	members, err := s.groupRepo.SelectMembers(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select members: %w", err)
+	}
+
+	for i := range members {
+		if members[i].AvatarName != "" {
+			members[i].AvatarURLs = s.imageService.ImageURLs(members[i].AvatarName)
+		}
+	}
+
+	return members, nil
+}
+
+// Returns ErrGroupData if the profile can't be in any more groups.
+func (s *groupService) checkGroupCount(profileId string) error {
+	groups, err := s.groupRepo.SelectGroups(profileId)
+	if err != nil {
+		return fmt.Errorf("failed to select groups: %w", err)
+	}
+
+	if len(groups) >= maxGroups {
+		return fmt.Errorf("%w: profiles can be in at most %d groups", ErrGroupData, maxGroups)
+	}
+
+	return nil
+}
+
+// Returns ErrGroupData if the name is empty or too long once trimmed.
+func normalizeGroupName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxGroupNameLength {
+		return "", fmt.Errorf("%w: name must be 1 to %d characters", ErrGroupData, maxGroupNameLength)
+	}
+
+	return name, nil
+}
+
+// Finds the member with the username, usernames are unique regardless of case.
+// Returns ErrNoMember if there is none.
+func findMember(members []group.Member, username string) (group.Member, error) {
+	for _, m := range members {
+		if strings.EqualFold(m.Username, username) {
+			return m, nil
+		}
+	}
+
+	return group.Member{}, ErrNoMember
+}
+
+func countOwners(members []group.Member) int {
+	owners := 0
+	for _, m := range members {
+		if m.Role == GroupOwner {
+			owners++
+		}
+	}
+
+	return owners
+}
@@ -0,0 +1,324 @@
+package service
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/eciccone/rh/api/repo/group"
+	"github.com/eciccone/rh/api/repo/recipe"
+	"github.com/stretchr/testify/assert"
+)
+
+type GroupRepoMocker struct {
+	InsertGroupMock      func(g group.Group, ownerId string) (group.Group, error)
+	SelectGroupsMock     func(profileId string) ([]group.Group, error)
+	SelectGroupMock      func(id int, profileId string) (group.Group, error)
+	UpdateGroupNameMock  func(id int, name string) error
+	DeleteGroupMock      func(id int) error
+	SelectMembersMock    func(groupId int) ([]group.Member, error)
+	InsertMemberMock     func(groupId int, profileId string, role string, joined time.Time) (bool, error)
+	UpdateMemberRoleMock func(groupId int, username string, role string) (bool, error)
+	DeleteMemberMock     func(groupId int, username string) (bool, error)
+	InsertInviteMock     func(i group.Invite) error
+	SelectInviteMock     func(codeHash string) (group.Invite, error)
+	DeleteInvitesMock    func(groupId int) error
+}
+
+func (r *GroupRepoMocker) InsertGroup(g group.Group, ownerId string) (group.Group, error) {
+	return r.InsertGroupMock(g, ownerId)
+}
+
+func (r *GroupRepoMocker) SelectGroups(profileId string) ([]group.Group, error) {
+	return r.SelectGroupsMock(profileId)
+}
+
+func (r *GroupRepoMocker) SelectGroup(id int, profileId string) (group.Group, error) {
+	return r.SelectGroupMock(id, profileId)
+}
+
+func (r *GroupRepoMocker) UpdateGroupName(id int, name string) error {
+	return r.UpdateGroupNameMock(id, name)
+}
+
+func (r *GroupRepoMocker) DeleteGroup(id int) error {
+	return r.DeleteGroupMock(id)
+}
+
+func (r *GroupRepoMocker) SelectMembers(groupId int) ([]group.Member, error) {
+	return r.SelectMembersMock(groupId)
+}
+
+func (r *GroupRepoMocker) InsertMember(groupId int, profileId string, role string, joined time.Time) (bool, error) {
+	return r.InsertMemberMock(groupId, profileId, role, joined)
+}
+
+func (r *GroupRepoMocker) UpdateMemberRole(groupId int, username string, role string) (bool, error) {
+	return r.UpdateMemberRoleMock(groupId, username, role)
+}
+
+func (r *GroupRepoMocker) DeleteMember(groupId int, username string) (bool, error) {
+	return r.DeleteMemberMock(groupId, username)
+}
+
+func (r *GroupRepoMocker) InsertInvite(i group.Invite) error {
+	return r.InsertInviteMock(i)
+}
+
+func (r *GroupRepoMocker) SelectInvite(codeHash string) (group.Invite, error) {
+	return r.SelectInviteMock(codeHash)
+}
+
+func (r *GroupRepoMocker) DeleteInvites(groupId int) error {
+	return r.DeleteInvitesMock(groupId)
+}
+
+// A group repository with group 3 owned by owner-id and with member-id as a member.
+func householdRepo() *GroupRepoMocker {
+	members := []group.Member{
+		{ProfileId: "owner-id", Username: "owner", Role: GroupOwner},
+		{ProfileId: "member-id", Username: "member", Role: GroupMember},
+	}
+	invites := map[string]group.Invite{}
+
+	return &GroupRepoMocker{
+		SelectGroupsMock: func(profileId string) ([]group.Group, error) {
+			return []group.Group{}, nil
+		},
+		SelectGroupMock: func(id int, profileId string) (group.Group, error) {
+			for _, m := range members {
+				if id == 3 && m.ProfileId == profileId {
+					return group.Group{Id: 3, Name: "Home", Role: m.Role}, nil
+				}
+			}
+			return group.Group{}, sql.ErrNoRows
+		},
+		SelectMembersMock: func(groupId int) ([]group.Member, error) {
+			return append([]group.Member{}, members...), nil
+		},
+		InsertMemberMock: func(groupId int, profileId string, role string, joined time.Time) (bool, error) {
+			members = append(members, group.Member{ProfileId: profileId, Username: profileId, Role: role})
+			return true, nil
+		},
+		UpdateMemberRoleMock: func(groupId int, username string, role string) (bool, error) {
+			for i := range members {
+				if members[i].Username == username {
+					members[i].Role = role
+				}
+			}
+			return true, nil
+		},
+		DeleteMemberMock: func(groupId int, username string) (bool, error) {
+			return true, nil
+		},
+		InsertInviteMock: func(i group.Invite) error {
+			invites[i.CodeHash] = i
+			return nil
+		},
+		SelectInviteMock: func(codeHash string) (group.Invite, error) {
+			i, ok := invites[codeHash]
+			if !ok {
+				return group.Invite{}, sql.ErrNoRows
+			}
+			return i, nil
+		},
+	}
+}
+
+func Test_CreateGroup(t *testing.T) {
+	now := time.Date(2022, 3, 2, 12, 0, 0, 0, time.UTC)
+
+	gr := householdRepo()
+	gr.InsertGroupMock = func(g group.Group, ownerId string) (group.Group, error) {
+		assert.Equal(t, "test-id", ownerId)
+		g.Id = 4
+		g.Role = GroupOwner
+		return g, nil
+	}
+	gs := &groupService{gr, &ImageServiceMocker{}, func() time.Time { return now }}
+
+	result, err := gs.CreateGroup("test-id", "  Home ")
+	assert.NoError(t, err)
+	assert.Equal(t, group.Group{Id: 4, Name: "Home", Role: GroupOwner, Created: now}, result)
+
+	_, err = gs.CreateGroup("test-id", " ")
+	assert.ErrorIs(t, err, ErrGroupData)
+
+	gr.SelectGroupsMock = func(profileId string) ([]group.Group, error) {
+		return make([]group.Group, maxGroups), nil
+	}
+	_, err = gs.CreateGroup("test-id", "One too many")
+	assert.ErrorIs(t, err, ErrGroupData)
+}
+
+func Test_GroupOwnerOnly(t *testing.T) {
+	gs := NewGroupService(householdRepo(), &ImageServiceMocker{})
+
+	_, err := gs.RenameGroup(3, "member-id", "Ours")
+	assert.ErrorIs(t, err, ErrGroupForbidden)
+
+	_, err = gs.CreateInvite(3, "member-id", nil)
+	assert.ErrorIs(t, err, ErrGroupForbidden)
+
+	assert.ErrorIs(t, gs.DeleteGroup(3, "member-id"), ErrGroupForbidden)
+	assert.ErrorIs(t, gs.DeleteGroup(3, "stranger-id"), ErrNoGroup)
+
+	_, err = gs.GetGroup(3, "stranger-id")
+	assert.ErrorIs(t, err, ErrNoGroup)
+}
+
+func Test_InviteAndJoinGroup(t *testing.T) {
+	now := time.Date(2022, 3, 2, 12, 0, 0, 0, time.UTC)
+	gs := &groupService{householdRepo(), &ImageServiceMocker{}, func() time.Time { return now }}
+
+	tooLate := now.Add(60 * 24 * time.Hour)
+	_, err := gs.CreateInvite(3, "owner-id", &tooLate)
+	assert.ErrorIs(t, err, ErrGroupData)
+
+	invite, err := gs.CreateInvite(3, "owner-id", nil)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, invite.Code)
+	assert.Equal(t, now.Add(defaultInviteExpiry), invite.Expires)
+
+	_, err = gs.JoinGroup("new-id", "not-a-code")
+	assert.ErrorIs(t, err, ErrInvalidInvite)
+
+	g, err := gs.JoinGroup("new-id", invite.Code)
+	assert.NoError(t, err)
+	assert.Equal(t, GroupMember, g.Role)
+	assert.Len(t, g.Members, 3)
+
+	// joining again changes nothing
+	g, err = gs.JoinGroup("owner-id", invite.Code)
+	assert.NoError(t, err)
+	assert.Equal(t, GroupOwner, g.Role)
+	assert.Len(t, g.Members, 3)
+
+	gs.now = func() time.Time { return invite.Expires }
+	_, err = gs.JoinGroup("late-id", invite.Code)
+	assert.ErrorIs(t, err, ErrInvalidInvite)
+}
+
+func Test_SetMemberRole(t *testing.T) {
+	td := []struct {
+		ProfileId string
+		Username  string
+		Role      string
+		Expected  error
+	}{
+		{"owner-id", "Member", GroupOwner, nil},
+		{"owner-id", "member", "admin", ErrGroupData},
+		{"owner-id", "owner", GroupMember, ErrGroupData},
+		{"owner-id", "stranger", GroupMember, ErrNoMember},
+		{"member-id", "member", GroupOwner, ErrGroupForbidden},
+	}
+
+	for _, tr := range td {
+		gs := NewGroupService(householdRepo(), &ImageServiceMocker{})
+		members, err := gs.SetMemberRole(3, tr.ProfileId, tr.Username, tr.Role)
+		if tr.Expected != nil {
+			assert.ErrorIs(t, err, tr.Expected)
+			continue
+		}
+
+		assert.NoError(t, err)
+		assert.Equal(t, GroupOwner, members[1].Role)
+	}
+}
+
+func Test_RemoveMember(t *testing.T) {
+	td := []struct {
+		ProfileId string
+		Username  string
+		Expected  error
+	}{
+		{"owner-id", "member", nil},
+		{"member-id", "member", nil},
+		{"member-id", "owner", ErrGroupForbidden},
+		{"owner-id", "owner", ErrGroupData},
+		{"owner-id", "stranger", ErrNoMember},
+		{"stranger-id", "member", ErrNoGroup},
+	}
+
+	for _, tr := range td {
+		gs := NewGroupService(householdRepo(), &ImageServiceMocker{})
+		err := gs.RemoveMember(3, tr.ProfileId, tr.Username)
+		if tr.Expected != nil {
+			assert.ErrorIs(t, err, tr.Expected)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func Test_GroupRecipeAccess(t *testing.T) {
+	groupId := 3
+	roles := map[string]string{"owner": GroupOwner, "member": GroupMember}
+	var updated recipe.Recipe
+
+	rr := &RecipeRepoMocker{
+		SelectRecipeByIdMock: func(id int) (recipe.Recipe, error) {
+			return recipe.Recipe{Id: 1, Name: "Soup", Username: "member", Visibility: "private", GroupId: &groupId}, nil
+		},
+		SelectRecipeGrantRoleMock: noGrants,
+		SelectGroupRoleMock: func(id int, username string) (string, error) {
+			if id != groupId {
+				return "", nil
+			}
+			return roles[username], nil
+		},
+		UpdateRecipeMock: func(r recipe.Recipe) (recipe.Recipe, error) {
+			updated = r
+			return r, nil
+		},
+	}
+	rs := NewRecipeService(rr, &ImageServiceMocker{})
+
+	td := []struct {
+		Username  string
+		CanView   bool
+		CanRemove bool
+	}{
+		{"member", true, true},
+		{"owner", true, true},
+		{"stranger", false, false},
+	}
+
+	for _, tr := range td {
+		_, err := rs.GetRecipeForUsername(1, tr.Username)
+		assert.Equal(t, tr.CanView, err == nil, tr.Username)
+
+		// changes by anyone keep the recipe in its group unless it is sent
+		noGroup := 0
+		_, err = rs.UpdateRecipe(recipe.Recipe{Id: 1, Name: "Soup", Username: tr.Username, GroupId: &noGroup})
+		assert.Equal(t, tr.CanView, err == nil, tr.Username)
+		if err == nil && tr.Username != "member" {
+			assert.Equal(t, &groupId, updated.GroupId, tr.Username)
+		}
+
+		ok, err := rs.(*recipeService).canRemove(recipe.Recipe{Id: 1, Username: "member", GroupId: &groupId}, tr.Username)
+		assert.NoError(t, err)
+		assert.Equal(t, tr.CanRemove, ok, tr.Username)
+	}
+
+	// other members can't remove a member's recipe
+	roles["other"] = GroupMember
+	ok, err := rs.(*recipeService).canRemove(recipe.Recipe{Id: 1, Username: "member", GroupId: &groupId}, "other")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// only the owner takes the recipe out of the group
+	noGroup, otherGroup := 0, 5
+	_, err = rs.UpdateRecipe(recipe.Recipe{Id: 1, Name: "Soup", Username: "member", GroupId: &noGroup})
+	assert.NoError(t, err)
+	assert.Nil(t, updated.GroupId)
+
+	_, err = rs.UpdateRecipe(recipe.Recipe{Id: 1, Name: "Soup", Username: "member", GroupId: &otherGroup})
+	assert.ErrorIs(t, err, ErrNoGroup)
+
+	_, err = rs.CreateRecipe(recipe.Recipe{Name: "Stew", Username: "stranger", GroupId: &groupId})
+	assert.ErrorIs(t, err, ErrNoGroup)
+
+	_, err = rs.GetRecipesForUsername("stranger", recipe.Filter{Group: groupId}, "", 0, 10)
+	assert.ErrorIs(t, err, ErrNoGroup)
+}
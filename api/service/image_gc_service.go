@@ -0,0 +1,110 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/eciccone/rh/api/repo/imageref"
+)
+
+type ImageGCReport struct {
+	Removed []string `json:"removed"`
+	Kept    int      `json:"kept"`
+}
+
+type ImageGCService interface {
+	// Reconciles stored images against the rows referencing them and removes every image
+	// nothing references. Images stored or recorded within the grace period are kept, so
+	// uploads that are not referenced yet are never removed. Units of work begun before the
+	// grace period that never finished are recovered first.
+	CollectImages(grace time.Duration) (ImageGCReport, error)
+}
+
+type imageGCService struct {
+	imageRefRepo imageref.ImageRefRepository
+	imageService ImageService
+	now          func() time.Time
+}
+
+func NewImageGCService(imageRefRepo imageref.ImageRefRepository, imageService ImageService) ImageGCService {
+	return &imageGCService{imageRefRepo, imageService, time.Now}
+}
+
+// Reconciles stored images against the rows referencing them and removes every image nothing
+// references. Images stored or recorded within the grace period are kept, so uploads that are
+// not referenced yet are never removed. Units of work begun before the grace period that
+// never finished are recovered first.
+func (s *imageGCService) CollectImages(grace time.Duration) (ImageGCReport, error) {
+	var report ImageGCReport
+
+	if err := s.imageService.RecoverImages(s.now().Add(-grace)); err != nil {
+		return report, fmt.Errorf("CollectImages failed to recover images: %w", err)
+	}
+
+	// the counts kept by the database are only trusted after recounting them
+	if err := s.imageRefRepo.UpdateImageRefCounts(); err != nil {
+		return report, fmt.Errorf("CollectImages failed to count references: %w", err)
+	}
+
+	refs, err := s.imageRefRepo.SelectImageRefs()
+	if err != nil {
+		return report, fmt.Errorf("CollectImages failed to get references: %w", err)
+	}
+
+	recorded := map[string]imageref.ImageRef{}
+	for _, r := range refs {
+		recorded[r.Name] = r
+	}
+
+	stored, err := s.imageService.ListImages()
+	if err != nil {
+		return report, fmt.Errorf("CollectImages failed to list images: %w", err)
+	}
+
+	cutoff := s.now().Add(-grace)
+
+	for _, i := range stored {
+		ref, ok := recorded[i.Name]
+		delete(recorded, i.Name)
+
+		if i.Modified.After(cutoff) || (ok && (ref.Refs > 0 || ref.Created.After(cutoff))) {
+			report.Kept++
+			continue
+		}
+
+		// deleting the record first means an upload of the same image that races with the
+		// collection keeps its record, and the files it writes again
+		if ok {
+			deleted, err := s.imageRefRepo.DeleteUnreferencedImageRef(i.Name, cutoff)
+			if err != nil {
+				return report, fmt.Errorf("CollectImages failed to delete reference: %w", err)
+			}
+			if !deleted {
+				report.Kept++
+				continue
+			}
+		}
+
+		err := s.imageService.DeleteImage(i.Name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return report, fmt.Errorf("CollectImages failed to delete image: %w", err)
+		}
+
+		report.Removed = append(report.Removed, i.Name)
+	}
+
+	// records of images whose files are already gone
+	for _, ref := range recorded {
+		if ref.Refs > 0 || ref.Created.After(cutoff) {
+			continue
+		}
+
+		if _, err := s.imageRefRepo.DeleteUnreferencedImageRef(ref.Name, cutoff); err != nil {
+			return report, fmt.Errorf("CollectImages failed to delete reference: %w", err)
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eciccone/rh/api/repo/imageref"
+	"github.com/stretchr/testify/assert"
+)
+
+type ImageRefRepoMocker struct {
+	InsertImageRefMock             func(name string, created time.Time, placeholder imageref.Placeholder) error
+	SelectPlaceholdersMock         func(names []string) (map[string]imageref.Placeholder, error)
+	SelectImageRefsMock            func() ([]imageref.ImageRef, error)
+	UpdateImageRefCountsMock       func() error
+	DeleteUnreferencedImageRefMock func(name string, createdBefore time.Time) (bool, error)
+	InsertFileOpMock               func(op imageref.FileOp) (imageref.FileOp, error)
+	SelectFileOpsMock              func(createdBefore time.Time) ([]imageref.FileOp, error)
+	DeleteFileOpMock               func(id int) error
+	SelectImageInUseMock           func(name string, ignoreOpId int) (bool, error)
+}
+
+func (r *ImageRefRepoMocker) InsertImageRef(name string, created time.Time, placeholder imageref.Placeholder) error {
+	return r.InsertImageRefMock(name, created, placeholder)
+}
+
+func (r *ImageRefRepoMocker) SelectPlaceholders(names []string) (map[string]imageref.Placeholder, error) {
+	return r.SelectPlaceholdersMock(names)
+}
+
+func (r *ImageRefRepoMocker) SelectImageRefs() ([]imageref.ImageRef, error) {
+	return r.SelectImageRefsMock()
+}
+
+func (r *ImageRefRepoMocker) UpdateImageRefCounts() error {
+	return r.UpdateImageRefCountsMock()
+}
+
+func (r *ImageRefRepoMocker) DeleteUnreferencedImageRef(name string, createdBefore time.Time) (bool, error) {
+	return r.DeleteUnreferencedImageRefMock(name, createdBefore)
+}
+
+func (r *ImageRefRepoMocker) InsertFileOp(op imageref.FileOp) (imageref.FileOp, error) {
+	return r.InsertFileOpMock(op)
+}
+
+func (r *ImageRefRepoMocker) SelectFileOps(createdBefore time.Time) ([]imageref.FileOp, error) {
+	return r.SelectFileOpsMock(createdBefore)
+}
+
+func (r *ImageRefRepoMocker) DeleteFileOp(id int) error {
+	return r.DeleteFileOpMock(id)
+}
+
+func (r *ImageRefRepoMocker) SelectImageInUse(name string, ignoreOpId int) (bool, error) {
+	return r.SelectImageInUseMock(name, ignoreOpId)
+}
+
+func Test_CollectImages(t *testing.T) {
+	now := time.Date(2022, 3, 2, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-48 * time.Hour)
+	recent := now.Add(-time.Hour)
+
+	var deletedRefs, deletedImages []string
+
+	rr := &ImageRefRepoMocker{
+		UpdateImageRefCountsMock: func() error {
+			return nil
+		},
+		SelectImageRefsMock: func() ([]imageref.ImageRef, error) {
+			return []imageref.ImageRef{
+				{Name: "referenced.jpg", Refs: 2, Created: old},
+				{Name: "unreferenced.jpg", Refs: 0, Created: old},
+				{Name: "uploading.jpg", Refs: 0, Created: recent},
+				{Name: "reuploaded.jpg", Refs: 0, Created: old},
+				{Name: "missing.jpg", Refs: 0, Created: old},
+			}, nil
+		},
+		DeleteUnreferencedImageRefMock: func(name string, createdBefore time.Time) (bool, error) {
+			assert.Equal(t, now.Add(-24*time.Hour), createdBefore)
+			deletedRefs = append(deletedRefs, name)
+			// stored again after the references were selected
+			return name != "reuploaded.jpg", nil
+		},
+	}
+	is := &ImageServiceMocker{
+		RecoverImagesMock: func(createdBefore time.Time) error {
+			assert.Equal(t, now.Add(-24*time.Hour), createdBefore)
+			return nil
+		},
+		ListImagesMock: func() ([]StoredImage, error) {
+			return []StoredImage{
+				{Name: "referenced.jpg", Modified: old},
+				{Name: "unreferenced.jpg", Modified: old},
+				{Name: "uploading.jpg", Modified: recent},
+				{Name: "reuploaded.jpg", Modified: old},
+				{Name: "stray.jpg", Modified: old},
+				{Name: "stray-recent.jpg", Modified: recent},
+			}, nil
+		},
+		DeleteImageMock: func(filename string) error {
+			deletedImages = append(deletedImages, filename)
+			return nil
+		},
+	}
+
+	gc := &imageGCService{rr, is, func() time.Time { return now }}
+
+	report, err := gc.CollectImages(24 * time.Hour)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"unreferenced.jpg", "stray.jpg"}, report.Removed)
+	assert.Equal(t, 4, report.Kept)
+	assert.Equal(t, []string{"unreferenced.jpg", "stray.jpg"}, deletedImages)
+	assert.ElementsMatch(t, []string{"unreferenced.jpg", "reuploaded.jpg", "missing.jpg"}, deletedRefs)
+}
+
+func Test_CollectImagesError(t *testing.T) {
+	rr := &ImageRefRepoMocker{
+		UpdateImageRefCountsMock: func() error {
+			return errors.New("failed")
+		},
+	}
+
+	is := &ImageServiceMocker{
+		RecoverImagesMock: func(createdBefore time.Time) error {
+			return nil
+		},
+	}
+
+	gc := NewImageGCService(rr, is)
+
+	_, err := gc.CollectImages(time.Hour)
+	assert.Error(t, err)
+
+	is.RecoverImagesMock = func(createdBefore time.Time) error {
+		return errors.New("failed")
+	}
+
+	_, err = gc.CollectImages(time.Hour)
+	assert.Error(t, err)
+}
@@ -1,70 +1,455 @@
 package service
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"image"
 	"io"
 	"mime/multipart"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/eciccone/rh/api/imaging"
+	"github.com/eciccone/rh/api/repo/imageref"
+	"github.com/eciccone/rh/api/storage"
+)
+
+var (
+	ErrImageType     = errors.New("file must be a jpeg, png or gif image")
+	ErrImageTooLarge = errors.New("image is too large")
+	ErrImageURL      = errors.New("image url is invalid or has expired")
+	ErrNoImage       = errors.New("image not found")
 )
 
+// largest upload accepted by default
+const maxImageSize = 10 << 20
+
+// Image urls stay valid for at least this long and at most twice as long. They are signed
+// for the same expiry throughout a window of this length, so clients can cache the images.
+const imageURLLifetime = time.Hour
+
+type Rendition struct {
+	Name string
+	Size int
+}
+
+// Every uploaded image is stored as these renditions side by side, "full" keeps the filename
+// it was saved under and the others add their name as a suffix, e.g. abc_thumb.jpg.
+var Renditions = []Rendition{
+	{Name: "thumb", Size: 200},
+	{Name: "card", Size: 640},
+	{Name: "full", Size: 1600},
+}
+
+// Extension of every image written by SaveImage.
+const ImageExtension = ".jpg"
+
+// Returns the filename a rendition of an image is stored under.
+func RenditionName(filename string, rendition string) string {
+	if rendition == "full" {
+		return filename
+	}
+
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "_" + rendition + ext
+}
+
+// Returns the filename of the image a rendition belongs to, the inverse of RenditionName.
+func OriginalName(rendition string) string {
+	ext := filepath.Ext(rendition)
+	base := strings.TrimSuffix(rendition, ext)
+
+	for _, r := range Renditions {
+		if r.Name != "full" && strings.HasSuffix(base, "_"+r.Name) {
+			return strings.TrimSuffix(base, "_"+r.Name) + ext
+		}
+	}
+
+	return rendition
+}
+
+// Reports whether key is a rendition of an image SaveImage stored, named after the sha-256 of the
+// image.
+func isImageKey(key string) bool {
+	name := OriginalName(key)
+	hash := strings.TrimSuffix(name, ImageExtension)
+	if len(hash) != 2*sha256.Size || hash+ImageExtension != name || strings.ToLower(hash) != hash {
+		return false
+	}
+
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
 type FileProcessor struct {
 	OpenFile   func(file *multipart.FileHeader) (multipart.File, error)
-	CreateFile func(path string, filename string) (*os.File, error)
-	CopyFile   func(w io.Writer, r io.Reader) (int64, error)
-	RemoveFile func(path string, filename string) error
+	RecordFile func(filename string, created time.Time, placeholder imageref.Placeholder) error
+	CreateFile func(filename string, r io.Reader) error
+	ReadFile   func(filename string) (io.ReadCloser, error)
+	ListFiles  func() ([]storage.Object, error)
+	RemoveFile func(filename string) error
+	FileURL    func(filename string, expires time.Time) string
+	PrivateURL func(filename string, expires time.Time) string
+	VerifyURL  func(filename string, expires string, signature string) error
+	Now        func() time.Time
+	MaxSize    int64
+
+	// outbox of file operations, see ImageUnit
+	StageFileOp    func(op imageref.FileOp) (imageref.FileOp, error)
+	ClearFileOp    func(id int) error
+	PendingFileOps func(createdBefore time.Time) ([]imageref.FileOp, error)
+	FileInUse      func(filename string, ignoreOpId int) (bool, error)
+
+	FilePlaceholders func(filenames []string) (map[string]imageref.Placeholder, error)
+}
+
+// A stored image along with its renditions.
+type StoredImage struct {
+	Name     string
+	Modified time.Time
 }
 
 type ImageService interface {
-	SaveImage(file *multipart.FileHeader, path string, filename string) error
-	DeleteImage(path string, filename string) error
+	// Begins a unit of work saving and deleting images alongside a database change.
+	Begin() ImageUnit
+
+	// Finishes units of work begun before createdBefore that were neither committed nor
+	// rolled back, e.g. because the server stopped in between. Images nothing references
+	// are deleted.
+	RecoverImages(createdBefore time.Time) error
+
+	// Deletes an image along with its renditions.
+	DeleteImage(filename string) error
+
+	// Lists every stored image by the filename SaveImage returned for it, leaving out files it
+	// did not store.
+	ListImages() ([]StoredImage, error)
+
+	// Returns urls of every rendition of an image, keyed by rendition name. They are signed and
+	// expire, unless the storage serves images publicly.
+	ImageURLs(filename string) map[string]string
+
+	// Returns signed, expiring urls of every rendition of an image, keyed by rendition name,
+	// for images that must not be served publicly.
+	PrivateImageURLs(filename string) map[string]string
+
+	// Returns the placeholders of images, keyed by filename. Images stored before placeholders
+	// existed are left out.
+	Placeholders(filenames []string) (map[string]imageref.Placeholder, error)
+
+	// Opens a stored image or one of its renditions.
+	// Returns ErrNoImage if it does not exist.
+	OpenImage(filename string) (io.ReadCloser, error)
+
+	// Checks the expiry and signature of a url returned by ImageURLs.
+	// Returns ErrImageURL if they are not valid for filename.
+	VerifyImageURL(filename string, expires string, signature string) error
 }
 
-func NewFileProcessor() ImageService {
-	return &FileProcessor{
+// Returns an ImageService storing images in store and recording them in imageRefRepo.
+func NewFileProcessor(store storage.Storage, imageRefRepo imageref.ImageRefRepository) ImageService {
+	f := &FileProcessor{
 		OpenFile: func(file *multipart.FileHeader) (multipart.File, error) {
 			return file.Open()
 		},
 
-		CreateFile: func(path, filename string) (*os.File, error) {
-			return os.Create(filepath.Join(path, filename))
-		},
+		RecordFile: imageRefRepo.InsertImageRef,
+		CreateFile: store.Create,
+		ReadFile:   store.Open,
+		ListFiles:  store.List,
+		RemoveFile: store.Remove,
+		FileURL:    store.URL,
+		PrivateURL: store.URL,
+		Now:        time.Now,
+		MaxSize:    maxImageSize,
 
-		CopyFile: func(w io.Writer, r io.Reader) (int64, error) {
-			return io.Copy(w, r)
-		},
+		StageFileOp:    imageRefRepo.InsertFileOp,
+		ClearFileOp:    imageRefRepo.DeleteFileOp,
+		PendingFileOps: imageRefRepo.SelectFileOps,
+		FileInUse:      imageRefRepo.SelectImageInUse,
 
-		RemoveFile: func(path string, filename string) error {
-			return os.Remove(filepath.Join(path, filename))
-		},
+		FilePlaceholders: imageRefRepo.SelectPlaceholders,
+	}
+
+	// backends serving their own urls check them themselves
+	f.VerifyURL = func(filename, expires, signature string) error {
+		return storage.ErrSignature
+	}
+	if v, ok := store.(storage.Verifier); ok {
+		f.VerifyURL = v.Verify
+	}
+	if p, ok := store.(storage.PrivateURLer); ok {
+		f.PrivateURL = p.PrivateURL
+	}
+
+	return f
+}
+
+// Validates an uploaded image, strips its metadata, makes it upright and stores every
+// rendition of it. Returns the filename of the image, which is derived from its content so
+// identical uploads share the same files.
+// Returns ErrImageType if the file is not a supported image.
+// Returns ErrImageTooLarge if the file or its dimensions are too large.
+func (f *FileProcessor) SaveImage(file *multipart.FileHeader) (string, error) {
+	img, filename, err := f.decodeImage(file)
+	if err != nil {
+		return "", err
+	}
+
+	if err := f.recordImage(filename, img); err != nil {
+		return "", err
 	}
+
+	if err := f.storeImage(img, filename); err != nil {
+		return "", err
+	}
+
+	return filename, nil
 }
 
-func (f *FileProcessor) SaveImage(file *multipart.FileHeader, path string, filename string) error {
+// Reads and decodes an uploaded image, returning it with the filename it is stored under.
+func (f *FileProcessor) decodeImage(file *multipart.FileHeader) (image.Image, string, error) {
+	if file.Size > f.MaxSize {
+		return nil, "", ErrImageTooLarge
+	}
+
 	src, err := f.OpenFile(file)
 	if err != nil {
-		return fmt.Errorf("SaveImage failed to open file: %w", err)
+		return nil, "", fmt.Errorf("SaveImage failed to open file: %w", err)
 	}
 	defer src.Close()
 
-	dest, err := f.CreateFile(path, filename)
+	// the header size comes from the client, so never read more than allowed
+	data, err := io.ReadAll(io.LimitReader(src, f.MaxSize+1))
 	if err != nil {
-		return fmt.Errorf("SaveImage failed to create destination file: %w", err)
+		return nil, "", fmt.Errorf("SaveImage failed to read file: %w", err)
+	}
+	if int64(len(data)) > f.MaxSize {
+		return nil, "", ErrImageTooLarge
 	}
-	defer dest.Close()
 
-	_, err = f.CopyFile(dest, src)
+	img, err := imaging.Decode(data)
+	if errors.Is(err, imaging.ErrFormat) {
+		return nil, "", ErrImageType
+	}
+	if errors.Is(err, imaging.ErrTooLarge) {
+		return nil, "", ErrImageTooLarge
+	}
 	if err != nil {
-		return fmt.Errorf("SaveImage failed to copy source to destination: %w", err)
+		return nil, "", fmt.Errorf("SaveImage failed to decode image: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	return img, hex.EncodeToString(sum[:]) + ImageExtension, nil
+}
+
+// Records an image and its placeholder before storing it, garbage collection leaves recently
+// recorded images alone so the files can't be collected before they are referenced.
+func (f *FileProcessor) recordImage(filename string, img image.Image) error {
+	if err := f.RecordFile(filename, f.Now(), placeholder(img)); err != nil {
+		return fmt.Errorf("SaveImage failed to record image: %w", err)
 	}
 
 	return nil
 }
 
-func (f *FileProcessor) DeleteImage(path string, filename string) error {
-	err := f.RemoveFile(path, filename)
+// Stores every rendition of an image. The files are written even when the image is already
+// stored, in case they are being collected right now.
+func (f *FileProcessor) storeImage(img image.Image, filename string) error {
+	var saved []string
+	for _, r := range Renditions {
+		name := RenditionName(filename, r.Name)
+		if err := f.saveRendition(imaging.Fit(img, r.Size), name); err != nil {
+			// don't leave a partial set of renditions behind
+			for _, s := range saved {
+				f.RemoveFile(s)
+			}
+			return err
+		}
+		saved = append(saved, name)
+	}
+
+	return nil
+}
+
+// Describes the full rendition of an image.
+func placeholder(img image.Image) imageref.Placeholder {
+	var size int
+	for _, r := range Renditions {
+		if r.Name == "full" {
+			size = r.Size
+		}
+	}
+
+	b := img.Bounds()
+	w, h := imaging.FitSize(b.Dx(), b.Dy(), size)
+
+	return imageref.Placeholder{
+		Blurhash: imaging.Blurhash(img),
+		Color:    imaging.DominantColor(img),
+		Width:    w,
+		Height:   h,
+	}
+}
+
+func (f *FileProcessor) saveRendition(img image.Image, filename string) error {
+	var buf bytes.Buffer
+	if err := imaging.EncodeJPEG(&buf, img); err != nil {
+		return fmt.Errorf("SaveImage failed to encode image: %w", err)
+	}
+
+	if err := f.CreateFile(filename, &buf); err != nil {
+		return fmt.Errorf("SaveImage failed to store image: %w", err)
+	}
+
+	return nil
+}
+
+// Deletes an image along with its renditions. Images uploaded before renditions existed only
+// have the full image, so missing renditions are ignored. Every file is deleted even when
+// deleting another one fails.
+func (f *FileProcessor) DeleteImage(filename string) error {
+	var errs fileErrors
+
+	if err := f.RemoveFile(filename); err != nil {
+		errs = append(errs, fmt.Errorf("failed to delete image file: %w", err))
+	}
+
+	for _, r := range Renditions {
+		if r.Name == "full" {
+			continue
+		}
+
+		err := f.RemoveFile(RenditionName(filename, r.Name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("failed to delete %s rendition: %w", r.Name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("DeleteImage %w", errs)
+	}
+
+	return nil
+}
+
+// The errors of an operation on several files that carries on past the first failure. They
+// only count as a particular error, like os.ErrNotExist, when every one of them is.
+type fileErrors []error
+
+func (e fileErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+func (e fileErrors) Is(target error) bool {
+	for _, err := range e {
+		if !errors.Is(err, target) {
+			return false
+		}
+	}
+
+	return len(e) > 0
+}
+
+// Lists every stored image by the filename SaveImage returned for it. Modified is the latest
+// modification of any of its renditions. Files SaveImage did not store are left out, the storage
+// may be shared with data that isn't ours to collect.
+func (f *FileProcessor) ListImages() ([]StoredImage, error) {
+	objects, err := f.ListFiles()
+	if err != nil {
+		return nil, fmt.Errorf("ListImages failed to list files: %w", err)
+	}
+
+	var result []StoredImage
+	index := map[string]int{}
+	for _, o := range objects {
+		if !isImageKey(o.Key) {
+			continue
+		}
+		name := OriginalName(o.Key)
+
+		i, ok := index[name]
+		if !ok {
+			index[name] = len(result)
+			result = append(result, StoredImage{Name: name, Modified: o.Modified})
+			continue
+		}
+
+		if o.Modified.After(result[i].Modified) {
+			result[i].Modified = o.Modified
+		}
+	}
+
+	return result, nil
+}
+
+// Returns urls of every rendition of an image, keyed by rendition name. They are signed and
+// expire, unless the storage serves images publicly.
+func (f *FileProcessor) ImageURLs(filename string) map[string]string {
+	return f.imageURLs(filename, f.FileURL)
+}
+
+// Returns signed, expiring urls of every rendition of an image, keyed by rendition name, for
+// images that must not be served publicly.
+func (f *FileProcessor) PrivateImageURLs(filename string) map[string]string {
+	return f.imageURLs(filename, f.PrivateURL)
+}
+
+func (f *FileProcessor) imageURLs(filename string, fileURL func(filename string, expires time.Time) string) map[string]string {
+	if filename == "" {
+		return nil
+	}
+
+	expires := f.Now().Truncate(imageURLLifetime).Add(2 * imageURLLifetime)
+
+	result := map[string]string{}
+	for _, r := range Renditions {
+		result[r.Name] = fileURL(RenditionName(filename, r.Name), expires)
+	}
+
+	return result
+}
+
+// Returns the placeholders of images, keyed by filename. Images stored before placeholders
+// existed are left out.
+func (f *FileProcessor) Placeholders(filenames []string) (map[string]imageref.Placeholder, error) {
+	result, err := f.FilePlaceholders(filenames)
+	if err != nil {
+		return nil, fmt.Errorf("Placeholders failed to get placeholders: %w", err)
+	}
+
+	return result, nil
+}
+
+// Opens a stored image or one of its renditions.
+// Returns ErrNoImage if it does not exist.
+func (f *FileProcessor) OpenImage(filename string) (io.ReadCloser, error) {
+	r, err := f.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoImage
+	}
 	if err != nil {
-		return fmt.Errorf("DeleteImage failed to delete image file: %w", err)
+		return nil, fmt.Errorf("OpenImage failed to open image: %w", err)
+	}
+
+	return r, nil
+}
+
+// Checks the expiry and signature of a url returned by ImageURLs.
+// Returns ErrImageURL if they are not valid for filename.
+func (f *FileProcessor) VerifyImageURL(filename string, expires string, signature string) error {
+	if err := f.VerifyURL(filename, expires, signature); err != nil {
+		return ErrImageURL
 	}
 
 	return nil
@@ -1,22 +1,33 @@
 package service
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"image"
+	"image/png"
 	"io"
 	"mime/multipart"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/eciccone/rh/api/repo/imageref"
+	"github.com/eciccone/rh/api/storage"
 	"github.com/stretchr/testify/assert"
 )
 
 func Test_RemoveImage(t *testing.T) {
 	data := []struct {
-		RemoveFile func(path string, filename string) error
+		RemoveFile func(filename string) error
 		Assert     func(err error)
 	}{
 		{
-			RemoveFile: func(path, filename string) error {
+			RemoveFile: func(filename string) error {
 				return nil
 			},
 			Assert: func(err error) {
@@ -24,7 +35,7 @@ func Test_RemoveImage(t *testing.T) {
 			},
 		},
 		{
-			RemoveFile: func(path, filename string) error {
+			RemoveFile: func(filename string) error {
 				return errors.New("failed")
 			},
 			Assert: func(err error) {
@@ -35,70 +46,320 @@ func Test_RemoveImage(t *testing.T) {
 
 	for _, d := range data {
 		fp := FileProcessor{RemoveFile: d.RemoveFile}
-		err := fp.DeleteImage("mockpath", "mock.file")
+		err := fp.DeleteImage("mock.file")
 		d.Assert(err)
 	}
 }
 
+// Writes a small png to a temporary file and returns its path.
+func testImageFile(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "upload.png")
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, image.NewRGBA(image.Rect(0, 0, 800, 400))); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
 func Test_SaveImage(t *testing.T) {
+	upload := testImageFile(t)
+
+	openUpload := func(file *multipart.FileHeader) (multipart.File, error) {
+		return os.Open(upload)
+	}
+
+	disk, err := storage.NewDisk(t.TempDir(), "/images", []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var removed, recorded []string
+	removeFile := func(filename string) error {
+		removed = append(removed, filename)
+		return nil
+	}
+	recordFile := func(filename string, created time.Time, placeholder imageref.Placeholder) error {
+		recorded = append(recorded, filename)
+		return nil
+	}
+
 	data := []struct {
 		OpenFile   func(file *multipart.FileHeader) (multipart.File, error)
-		CreateFile func(path, filename string) (*os.File, error)
-		CopyFile   func(w io.Writer, r io.Reader) (int64, error)
-		Assert     func(err error)
+		CreateFile func(filename string, r io.Reader) error
+		MaxSize    int64
+		Assert     func(name string, err error)
 	}{
 		{
-			OpenFile: func(file *multipart.FileHeader) (multipart.File, error) {
-				return &os.File{}, nil
-			},
-			CreateFile: func(path, filename string) (*os.File, error) {
-				return &os.File{}, nil
-			},
-			CopyFile: func(w io.Writer, r io.Reader) (int64, error) {
-				return 0, nil
-			},
-			Assert: func(err error) {
+			OpenFile:   openUpload,
+			CreateFile: disk.Create,
+			MaxSize:    maxImageSize,
+			Assert: func(name string, err error) {
 				assert.NoError(t, err)
+
+				// named after the content of the upload
+				data, _ := os.ReadFile(upload)
+				sum := sha256.Sum256(data)
+				assert.Equal(t, hex.EncodeToString(sum[:])+".jpg", name)
+				assert.Equal(t, []string{name}, recorded)
+
+				for _, r := range Renditions {
+					f, err := disk.Open(RenditionName(name, r.Name))
+					assert.NoError(t, err)
+					config, format, err := image.DecodeConfig(f)
+					assert.NoError(t, err)
+					assert.Equal(t, "jpeg", format)
+					assert.LessOrEqual(t, config.Width, r.Size)
+					f.Close()
+				}
 			},
 		},
 		{
 			OpenFile: func(file *multipart.FileHeader) (multipart.File, error) {
 				return &os.File{}, errors.New("failed")
 			},
-			Assert: func(err error) {
+			MaxSize: maxImageSize,
+			Assert: func(name string, err error) {
 				assert.Error(t, err)
 			},
 		},
 		{
-			OpenFile: func(file *multipart.FileHeader) (multipart.File, error) {
-				return &os.File{}, nil
+			OpenFile: openUpload,
+			CreateFile: func(filename string, r io.Reader) error {
+				return errors.New("failed")
 			},
-			CreateFile: func(path, filename string) (*os.File, error) {
-				return &os.File{}, errors.New("failed")
+			MaxSize: maxImageSize,
+			Assert: func(name string, err error) {
+				assert.Error(t, err)
 			},
-			Assert: func(err error) {
+		},
+		{
+			// a failure part way through removes the renditions already stored
+			OpenFile: openUpload,
+			CreateFile: func(filename string, r io.Reader) error {
+				if !strings.Contains(filename, "_") {
+					return errors.New("failed")
+				}
+				return nil
+			},
+			MaxSize: maxImageSize,
+			Assert: func(name string, err error) {
 				assert.Error(t, err)
+				assert.Equal(t, "", name)
+				assert.Len(t, removed, 2)
+				assert.True(t, strings.HasSuffix(removed[0], "_thumb.jpg"))
+				assert.True(t, strings.HasSuffix(removed[1], "_card.jpg"))
 			},
 		},
 		{
 			OpenFile: func(file *multipart.FileHeader) (multipart.File, error) {
-				return &os.File{}, nil
-			},
-			CreateFile: func(path, filename string) (*os.File, error) {
-				return &os.File{}, nil
+				path := filepath.Join(t.TempDir(), "upload.png")
+				os.WriteFile(path, []byte("<html><script>alert(1)</script></html>"), 0644)
+				return os.Open(path)
 			},
-			CopyFile: func(w io.Writer, r io.Reader) (int64, error) {
-				return 0, errors.New("failed")
+			MaxSize: maxImageSize,
+			Assert: func(name string, err error) {
+				assert.ErrorIs(t, err, ErrImageType)
 			},
-			Assert: func(err error) {
-				assert.Error(t, err)
+		},
+		{
+			OpenFile: openUpload,
+			MaxSize:  10,
+			Assert: func(name string, err error) {
+				assert.ErrorIs(t, err, ErrImageTooLarge)
 			},
 		},
 	}
 
 	for _, d := range data {
-		fp := FileProcessor{OpenFile: d.OpenFile, CreateFile: d.CreateFile, CopyFile: d.CopyFile}
-		err := fp.SaveImage(&multipart.FileHeader{}, "mockpath", "mock.file")
-		d.Assert(err)
+		removed, recorded = nil, nil
+		fp := FileProcessor{OpenFile: d.OpenFile, RecordFile: recordFile, CreateFile: d.CreateFile, RemoveFile: removeFile, Now: time.Now, MaxSize: d.MaxSize}
+		name, err := fp.SaveImage(&multipart.FileHeader{})
+		d.Assert(name, err)
+	}
+}
+
+func Test_SaveImagePlaceholder(t *testing.T) {
+	upload := testImageFile(t)
+
+	disk, err := storage.NewDisk(t.TempDir(), "/images", []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var recorded imageref.Placeholder
+	fp := NewFileProcessor(disk, &ImageRefRepoMocker{
+		InsertImageRefMock: func(name string, created time.Time, placeholder imageref.Placeholder) error {
+			recorded = placeholder
+			return nil
+		},
+	}).(*FileProcessor)
+	fp.OpenFile = func(file *multipart.FileHeader) (multipart.File, error) {
+		return os.Open(upload)
+	}
+
+	_, err = fp.SaveImage(&multipart.FileHeader{})
+	assert.NoError(t, err)
+
+	// the upload is a transparent 800x400 png, which is stored on white
+	assert.Equal(t, 800, recorded.Width)
+	assert.Equal(t, 400, recorded.Height)
+	assert.Equal(t, "#ffffff", recorded.Color)
+	assert.Len(t, recorded.Blurhash, 28)
+}
+
+func Test_SaveImageDedupes(t *testing.T) {
+	upload := testImageFile(t)
+
+	disk, err := storage.NewDisk(t.TempDir(), "/images", []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fp := NewFileProcessor(disk, &ImageRefRepoMocker{
+		InsertImageRefMock: func(name string, created time.Time, placeholder imageref.Placeholder) error {
+			return nil
+		},
+	}).(*FileProcessor)
+	fp.OpenFile = func(file *multipart.FileHeader) (multipart.File, error) {
+		return os.Open(upload)
 	}
+
+	first, err := fp.SaveImage(&multipart.FileHeader{})
+	assert.NoError(t, err)
+
+	second, err := fp.SaveImage(&multipart.FileHeader{})
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	images, err := fp.ListImages()
+	assert.NoError(t, err)
+	assert.Len(t, images, 1)
+	assert.Equal(t, first, images[0].Name)
+}
+
+func Test_ListImagesSkipsOtherFiles(t *testing.T) {
+	hash := strings.Repeat("ab", sha256.Size)
+	modified := time.Unix(1700000000, 0)
+
+	fp := FileProcessor{ListFiles: func() ([]storage.Object, error) {
+		return []storage.Object{
+			{Key: hash + ".jpg", Modified: modified},
+			{Key: hash + "_thumb.jpg", Modified: modified.Add(time.Minute)},
+			{Key: "backup.tar", Modified: modified},
+			{Key: "avatar.jpg", Modified: modified},
+			{Key: hash + "_large.jpg", Modified: modified},
+			{Key: strings.ToUpper(hash) + ".jpg", Modified: modified},
+			{Key: hash + ".png", Modified: modified},
+		}, nil
+	}}
+
+	// files of others sharing the storage are never offered to garbage collection
+	images, err := fp.ListImages()
+	assert.NoError(t, err)
+	assert.Equal(t, []StoredImage{{Name: hash + ".jpg", Modified: modified.Add(time.Minute)}}, images)
+}
+
+func Test_SaveImageTooLargeHeader(t *testing.T) {
+	fp := FileProcessor{MaxSize: 10}
+	_, err := fp.SaveImage(&multipart.FileHeader{Size: 11})
+	assert.ErrorIs(t, err, ErrImageTooLarge)
+}
+
+func Test_DeleteImageRenditions(t *testing.T) {
+	var removed []string
+	fp := FileProcessor{RemoveFile: func(filename string) error {
+		removed = append(removed, filename)
+		if filename != "mock.jpg" {
+			return os.ErrNotExist
+		}
+		return nil
+	}}
+
+	err := fp.DeleteImage("mock.jpg")
+
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"mock.jpg", "mock_thumb.jpg", "mock_card.jpg"}, removed)
+}
+
+// A file that can't be deleted doesn't keep the others from being deleted.
+func Test_DeleteImageFailures(t *testing.T) {
+	var removed []string
+	fp := FileProcessor{RemoveFile: func(filename string) error {
+		removed = append(removed, filename)
+		switch filename {
+		case "mock.jpg":
+			return os.ErrNotExist
+		case "mock_thumb.jpg":
+			return errors.New("unreachable")
+		}
+		return nil
+	}}
+
+	err := fp.DeleteImage("mock.jpg")
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "thumb rendition")
+	assert.False(t, errors.Is(err, os.ErrNotExist))
+	assert.ElementsMatch(t, []string{"mock.jpg", "mock_thumb.jpg", "mock_card.jpg"}, removed)
+
+	// a missing image is only reported as missing
+	removed = nil
+	fp.RemoveFile = func(filename string) error {
+		removed = append(removed, filename)
+		return os.ErrNotExist
+	}
+
+	err = fp.DeleteImage("mock.jpg")
+
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Len(t, removed, 3)
+}
+
+func Test_RenditionName(t *testing.T) {
+	assert.Equal(t, "abc.jpg", RenditionName("abc.jpg", "full"))
+	assert.Equal(t, "abc_thumb.jpg", RenditionName("abc.jpg", "thumb"))
+}
+
+func Test_ImageURLs(t *testing.T) {
+	disk, err := storage.NewDisk(t.TempDir(), "/images", []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2022, 3, 1, 10, 20, 0, 0, time.UTC)
+
+	fp := NewFileProcessor(disk, &ImageRefRepoMocker{}).(*FileProcessor)
+	fp.Now = func() time.Time { return now }
+
+	result := fp.ImageURLs("abc.jpg")
+	assert.Len(t, result, len(Renditions))
+	assert.Nil(t, fp.ImageURLs(""))
+
+	u, err := url.Parse(result["thumb"])
+	assert.NoError(t, err)
+	assert.Equal(t, "/images/abc_thumb.jpg", u.Path)
+
+	// urls are valid for at least an hour and stay the same within the hour
+	expires := u.Query().Get("expires")
+	assert.Equal(t, fmt.Sprint(time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC).Unix()), expires)
+
+	now = now.Add(30 * time.Minute)
+	assert.Equal(t, result, fp.ImageURLs("abc.jpg"))
+
+	assert.ErrorIs(t, fp.VerifyImageURL("abc_thumb.jpg", expires, "wrong"), ErrImageURL)
+	assert.ErrorIs(t, fp.VerifyImageURL("abc_card.jpg", expires, u.Query().Get("signature")), ErrImageURL)
+}
+
+func Test_OriginalName(t *testing.T) {
+	assert.Equal(t, "abc.jpg", OriginalName("abc.jpg"))
+	assert.Equal(t, "abc.jpg", OriginalName("abc_thumb.jpg"))
+	assert.Equal(t, "abc.jpg", OriginalName("abc_card.jpg"))
+	assert.Equal(t, "abc_other.jpg", OriginalName("abc_other.jpg"))
 }
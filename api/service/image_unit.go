@@ -0,0 +1,205 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"os"
+	"time"
+
+	"github.com/eciccone/rh/api/repo/imageref"
+)
+
+// ImageUnit keeps image files consistent with the database change they belong to. Every
+// operation is recorded in an outbox before it touches a file or the database:
+//
+//	images := imageService.Begin()
+//	name, err := images.Save(file)   // written now, removed again by Rollback
+//	err = images.Delete(oldName)     // deleted by Commit
+//	err = repo.Update(...)           // the database change
+//	images.Commit() or images.Rollback()
+//
+// Whichever way a unit ends, and also when it never ends because the server stopped, an
+// image is deleted exactly when nothing references it once the database change is done or
+// undone, so RecoverImages can finish any unit the same way.
+type ImageUnit interface {
+	// Saves an uploaded image like SaveImage does, it is removed again by Rollback unless
+	// something else references it.
+	// Returns ErrImageType if the file is not a supported image.
+	// Returns ErrImageTooLarge if the file or its dimensions are too large.
+	Save(file *multipart.FileHeader) (string, error)
+
+	// Deletes an image once the unit is committed, unless something still references it.
+	Delete(filename string) error
+
+	// Finishes the unit after its database change succeeded.
+	Commit() error
+
+	// Undoes the unit after its database change failed.
+	Rollback() error
+}
+
+type fileUnit struct {
+	f       *FileProcessor
+	created []imageref.FileOp
+	deleted []imageref.FileOp
+}
+
+// Begins a unit of work saving and deleting images alongside a database change.
+func (f *FileProcessor) Begin() ImageUnit {
+	return &fileUnit{f: f}
+}
+
+func (u *fileUnit) Save(file *multipart.FileHeader) (string, error) {
+	img, filename, err := u.f.decodeImage(file)
+	if err != nil {
+		return "", err
+	}
+
+	if err := u.f.recordImage(filename, img); err != nil {
+		return "", err
+	}
+
+	op, err := u.stage(imageref.FileOpCreate, filename)
+	if err != nil {
+		return "", err
+	}
+	u.created = append(u.created, op)
+
+	if err := u.f.storeImage(img, filename); err != nil {
+		return "", err
+	}
+
+	return filename, nil
+}
+
+func (u *fileUnit) Delete(filename string) error {
+	if filename == "" {
+		return nil
+	}
+
+	op, err := u.stage(imageref.FileOpDelete, filename)
+	if err != nil {
+		return err
+	}
+	u.deleted = append(u.deleted, op)
+
+	return nil
+}
+
+func (u *fileUnit) stage(op string, filename string) (imageref.FileOp, error) {
+	result, err := u.f.StageFileOp(imageref.FileOp{Op: op, Name: filename, Created: u.f.Now()})
+	if err != nil {
+		return imageref.FileOp{}, fmt.Errorf("ImageUnit failed to stage %s of %s: %w", op, filename, err)
+	}
+
+	return result, nil
+}
+
+// Created images are referenced now, so only the deleted ones need resolving. Operations
+// that fail are left in the outbox for RecoverImages.
+func (u *fileUnit) Commit() error {
+	var result error
+
+	for _, op := range u.created {
+		if err := u.f.clearFileOp(op); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	for _, op := range u.deleted {
+		if err := u.f.resolveFileOp(op); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	u.created, u.deleted = nil, nil
+
+	return result
+}
+
+// Deleted images were never deleted, so only the created ones need resolving. Operations
+// that fail are left in the outbox for RecoverImages.
+func (u *fileUnit) Rollback() error {
+	var result error
+
+	for _, op := range u.created {
+		if err := u.f.resolveFileOp(op); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	for _, op := range u.deleted {
+		if err := u.f.clearFileOp(op); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	u.created, u.deleted = nil, nil
+
+	return result
+}
+
+// Finishes units of work begun before createdBefore that were neither committed nor rolled
+// back, e.g. because the server stopped in between. Images nothing references are deleted.
+func (f *FileProcessor) RecoverImages(createdBefore time.Time) error {
+	ops, err := f.PendingFileOps(createdBefore)
+	if err != nil {
+		return fmt.Errorf("RecoverImages failed to select operations: %w", err)
+	}
+
+	for _, op := range ops {
+		if err := f.resolveFileOp(op); err != nil {
+			return fmt.Errorf("RecoverImages failed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Deletes the image of an operation if nothing but the operation itself references it, then
+// removes the operation.
+func (f *FileProcessor) resolveFileOp(op imageref.FileOp) error {
+	inUse, err := f.FileInUse(op.Name, op.Id)
+	if err != nil {
+		return fmt.Errorf("ImageUnit failed to check references of %s: %w", op.Name, err)
+	}
+
+	if !inUse {
+		err := f.DeleteImage(op.Name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("ImageUnit failed to delete %s: %w", op.Name, err)
+		}
+	}
+
+	return f.clearFileOp(op)
+}
+
+func (f *FileProcessor) clearFileOp(op imageref.FileOp) error {
+	if err := f.ClearFileOp(op.Id); err != nil {
+		return fmt.Errorf("ImageUnit failed to clear %s of %s: %w", op.Op, op.Name, err)
+	}
+
+	return nil
+}
+
+// Runs a database change along with the image files it saves and deletes. The files are
+// committed once fn succeeds and rolled back when it fails. A failed commit is left for
+// RecoverImages, as the database change already happened.
+func withImages(imageService ImageService, fn func(images ImageUnit) error) error {
+	images := imageService.Begin()
+
+	if err := fn(images); err != nil {
+		if rerr := images.Rollback(); rerr != nil {
+			return fmt.Errorf("%w (rolling back images also failed: %v)", err, rerr)
+		}
+		return err
+	}
+
+	if err := images.Commit(); err != nil {
+		log.Printf("failed to commit images, leaving them for recovery: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,260 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eciccone/rh/api/repo/imageref"
+	"github.com/eciccone/rh/api/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// In memory outbox and references standing in for the database.
+type testOutbox struct {
+	ops  map[int]imageref.FileOp
+	next int
+	refs map[string]int
+}
+
+func (o *testOutbox) stage(op imageref.FileOp) (imageref.FileOp, error) {
+	o.next++
+	op.Id = o.next
+	o.ops[op.Id] = op
+	return op, nil
+}
+
+func (o *testOutbox) clear(id int) error {
+	delete(o.ops, id)
+	return nil
+}
+
+func (o *testOutbox) pending(createdBefore time.Time) ([]imageref.FileOp, error) {
+	var result []imageref.FileOp
+	for id := 1; id <= o.next; id++ {
+		if op, ok := o.ops[id]; ok && op.Created.Before(createdBefore) {
+			result = append(result, op)
+		}
+	}
+	return result, nil
+}
+
+func (o *testOutbox) inUse(filename string, ignoreOpId int) (bool, error) {
+	if o.refs[filename] > 0 {
+		return true, nil
+	}
+	for _, op := range o.ops {
+		if op.Name == filename && op.Op == imageref.FileOpCreate && op.Id != ignoreOpId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Returns a FileProcessor storing images on disk with its outbox in memory.
+func testUnitProcessor(t *testing.T) (*FileProcessor, *storage.Disk, *testOutbox) {
+	upload := testImageFile(t)
+
+	disk, err := storage.NewDisk(t.TempDir(), "/images", []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outbox := &testOutbox{ops: map[int]imageref.FileOp{}, refs: map[string]int{}}
+
+	f := &FileProcessor{
+		OpenFile: func(file *multipart.FileHeader) (multipart.File, error) {
+			return os.Open(upload)
+		},
+		RecordFile: func(filename string, created time.Time, placeholder imageref.Placeholder) error {
+			return nil
+		},
+		CreateFile:     disk.Create,
+		ReadFile:       disk.Open,
+		ListFiles:      disk.List,
+		RemoveFile:     disk.Remove,
+		Now:            time.Now,
+		MaxSize:        maxImageSize,
+		StageFileOp:    outbox.stage,
+		ClearFileOp:    outbox.clear,
+		PendingFileOps: outbox.pending,
+		FileInUse:      outbox.inUse,
+	}
+
+	return f, disk, outbox
+}
+
+func testStoreImage(t *testing.T, disk *storage.Disk, filename string) {
+	for _, r := range Renditions {
+		if err := disk.Create(RenditionName(filename, r.Name), strings.NewReader("image")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testImageExists(disk *storage.Disk, filename string) bool {
+	r, err := disk.Open(filename)
+	if err != nil {
+		return false
+	}
+	r.Close()
+	return true
+}
+
+func Test_ImageUnitCommit(t *testing.T) {
+	f, disk, outbox := testUnitProcessor(t)
+	testStoreImage(t, disk, "old.jpg")
+	testStoreImage(t, disk, "shared.jpg")
+	outbox.refs["shared.jpg"] = 1
+
+	images := f.Begin()
+	name, err := images.Save(&multipart.FileHeader{})
+	assert.NoError(t, err)
+	assert.NoError(t, images.Delete("old.jpg"))
+	assert.NoError(t, images.Delete("shared.jpg"))
+	assert.NoError(t, images.Delete(""))
+
+	// nothing is deleted before the database change is done
+	assert.True(t, testImageExists(disk, "old.jpg"))
+	assert.Len(t, outbox.ops, 3)
+
+	outbox.refs[name] = 1
+	assert.NoError(t, images.Commit())
+
+	assert.True(t, testImageExists(disk, name))
+	assert.False(t, testImageExists(disk, "old.jpg"))
+	assert.False(t, testImageExists(disk, RenditionName("old.jpg", "thumb")))
+	assert.True(t, testImageExists(disk, "shared.jpg"))
+	assert.Empty(t, outbox.ops)
+}
+
+func Test_ImageUnitRollback(t *testing.T) {
+	f, disk, outbox := testUnitProcessor(t)
+	testStoreImage(t, disk, "old.jpg")
+
+	images := f.Begin()
+	name, err := images.Save(&multipart.FileHeader{})
+	assert.NoError(t, err)
+	assert.True(t, testImageExists(disk, name))
+	assert.NoError(t, images.Delete("old.jpg"))
+
+	assert.NoError(t, images.Rollback())
+
+	assert.False(t, testImageExists(disk, name))
+	assert.False(t, testImageExists(disk, RenditionName(name, "card")))
+	assert.True(t, testImageExists(disk, "old.jpg"))
+	assert.Empty(t, outbox.ops)
+}
+
+// An identical image referenced by another recipe survives the rollback.
+func Test_ImageUnitRollbackShared(t *testing.T) {
+	f, disk, outbox := testUnitProcessor(t)
+
+	images := f.Begin()
+	name, err := images.Save(&multipart.FileHeader{})
+	assert.NoError(t, err)
+
+	outbox.refs[name] = 1
+	assert.NoError(t, images.Rollback())
+
+	assert.True(t, testImageExists(disk, name))
+	assert.Empty(t, outbox.ops)
+}
+
+func Test_ImageUnitSaveFails(t *testing.T) {
+	f, disk, outbox := testUnitProcessor(t)
+
+	// storing the renditions fails part way through
+	created := 0
+	f.CreateFile = func(filename string, r io.Reader) error {
+		created++
+		if created == 2 {
+			return errors.New("failed")
+		}
+		return disk.Create(filename, r)
+	}
+
+	images := f.Begin()
+	_, err := images.Save(&multipart.FileHeader{})
+	assert.Error(t, err)
+	assert.Len(t, outbox.ops, 1)
+
+	assert.NoError(t, images.Rollback())
+	objects, _ := disk.List()
+	assert.Empty(t, objects)
+	assert.Empty(t, outbox.ops)
+
+	// nothing is written when the operation can't be staged
+	f.CreateFile = disk.Create
+	f.StageFileOp = func(op imageref.FileOp) (imageref.FileOp, error) {
+		return imageref.FileOp{}, errors.New("failed")
+	}
+
+	images = f.Begin()
+	_, err = images.Save(&multipart.FileHeader{})
+	assert.Error(t, err)
+	assert.Error(t, images.Delete("old.jpg"))
+	objects, _ = disk.List()
+	assert.Empty(t, objects)
+}
+
+// Operations that can't be finished stay in the outbox until RecoverImages finishes them.
+func Test_ImageUnitCommitFails(t *testing.T) {
+	f, disk, outbox := testUnitProcessor(t)
+	testStoreImage(t, disk, "old.jpg")
+
+	f.RemoveFile = func(filename string) error {
+		return errors.New("failed")
+	}
+
+	images := f.Begin()
+	assert.NoError(t, images.Delete("old.jpg"))
+	assert.Error(t, images.Commit())
+	assert.True(t, testImageExists(disk, "old.jpg"))
+	assert.Len(t, outbox.ops, 1)
+
+	f.RemoveFile = disk.Remove
+	assert.NoError(t, f.RecoverImages(time.Now().Add(time.Minute)))
+	assert.False(t, testImageExists(disk, "old.jpg"))
+	assert.Empty(t, outbox.ops)
+}
+
+// Units left behind by a crash are finished by deleting the images nothing references.
+func Test_RecoverImages(t *testing.T) {
+	f, disk, outbox := testUnitProcessor(t)
+	now := time.Now()
+
+	testStoreImage(t, disk, "uploaded.jpg")     // the database change never happened
+	testStoreImage(t, disk, "committed.jpg")    // the database change happened
+	testStoreImage(t, disk, "dereferenced.jpg") // deleted after the database change
+	testStoreImage(t, disk, "kept.jpg")         // the deletion's database change never happened
+	testStoreImage(t, disk, "in-flight.jpg")    // a unit that is still running
+	outbox.refs["committed.jpg"] = 1
+	outbox.refs["kept.jpg"] = 1
+
+	old := now.Add(-time.Hour)
+	outbox.stage(imageref.FileOp{Op: imageref.FileOpCreate, Name: "uploaded.jpg", Created: old})
+	outbox.stage(imageref.FileOp{Op: imageref.FileOpCreate, Name: "committed.jpg", Created: old})
+	outbox.stage(imageref.FileOp{Op: imageref.FileOpDelete, Name: "dereferenced.jpg", Created: old})
+	outbox.stage(imageref.FileOp{Op: imageref.FileOpDelete, Name: "kept.jpg", Created: old})
+	outbox.stage(imageref.FileOp{Op: imageref.FileOpCreate, Name: "in-flight.jpg", Created: now})
+
+	assert.NoError(t, f.RecoverImages(now.Add(-time.Minute)))
+
+	assert.False(t, testImageExists(disk, "uploaded.jpg"))
+	assert.True(t, testImageExists(disk, "committed.jpg"))
+	assert.False(t, testImageExists(disk, "dereferenced.jpg"))
+	assert.True(t, testImageExists(disk, "kept.jpg"))
+	assert.True(t, testImageExists(disk, "in-flight.jpg"))
+	assert.Len(t, outbox.ops, 1)
+
+	f.FileInUse = func(filename string, ignoreOpId int) (bool, error) {
+		return false, errors.New("failed")
+	}
+	assert.Error(t, f.RecoverImages(now.Add(time.Minute)))
+	assert.True(t, testImageExists(disk, "in-flight.jpg"))
+}
@@ -0,0 +1,210 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eciccone/rh/api/repo/notification"
+)
+
+var (
+	ErrNoNotification   = errors.New("notification not found")
+	ErrNotificationType = errors.New("unknown notification type")
+)
+
+// how long events of the same type about the same subject keep being merged into one unread
+// notification
+const notificationCoalesceWindow = 24 * time.Hour
+
+// types of notifications
+const (
+	NotificationFollow = "follow"
+)
+
+// what the last actor of a notification did, by type
+var notificationActions = map[string]string{
+	NotificationFollow: "followed you",
+}
+
+type NotificationService interface {
+	// Notifies a profile that actorId did something of notificationType about subject, unless
+	// the profile turned notifications of that type off or is the actor. Bursts of them are
+	// merged into one unread notification.
+	// Returns ErrNotificationType if notificationType is unknown.
+	Notify(profileId string, actorId string, notificationType string, subject string) error
+
+	// Gets a page of the notifications of a profile, most recent first.
+	GetNotifications(profileId string, unreadOnly bool, offset int, limit int) (NotificationPage, error)
+
+	// Returns ErrNoNotification if the profile has no notification with the id.
+	MarkRead(profileId string, id int) error
+
+	MarkAllRead(profileId string) error
+
+	// Gets whether each type of notification is on for a profile, they are on by default.
+	GetPreferences(profileId string) (map[string]bool, error)
+
+	// Turns types of notifications on or off for a profile, returning all of its preferences.
+	// Returns ErrNotificationType if any type is unknown.
+	UpdatePreferences(profileId string, preferences map[string]bool) (map[string]bool, error)
+}
+
+type NotificationPage struct {
+	Notifications []notification.Notification `json:"notifications"`
+	Offset        int                         `json:"offset"`
+	Limit         int                         `json:"limit"`
+	Total         int                         `json:"total"`
+	Unread        int                         `json:"unread"`
+}
+
+type notificationService struct {
+	notificationRepo notification.NotificationRepository
+	imageService     ImageService
+	now              func() time.Time
+}
+
+func NewNotificationService(notificationRepo notification.NotificationRepository, imageService ImageService) NotificationService {
+	return &notificationService{notificationRepo, imageService, time.Now}
+}
+
+// Notifies a profile that actorId did something of notificationType about subject, unless the
+// profile turned notifications of that type off or is the actor. Bursts of them are merged into
+// one unread notification.
+// Returns ErrNotificationType if notificationType is unknown.
+func (s *notificationService) Notify(profileId string, actorId string, notificationType string, subject string) error {
+	if _, ok := notificationActions[notificationType]; !ok {
+		return ErrNotificationType
+	}
+
+	if profileId == actorId {
+		return nil
+	}
+
+	preferences, err := s.GetPreferences(profileId)
+	if err != nil {
+		return err
+	}
+
+	if !preferences[notificationType] {
+		return nil
+	}
+
+	now := s.now()
+	n := notification.Notification{ProfileId: profileId, Type: notificationType, Subject: subject, Updated: now}
+	if err := s.notificationRepo.InsertNotification(n, actorId, now.Add(-notificationCoalesceWindow)); err != nil {
+		return fmt.Errorf("Notify failed to insert notification: %w", err)
+	}
+
+	return nil
+}
+
+// Gets a page of the notifications of a profile, most recent first.
+func (s *notificationService) GetNotifications(profileId string, unreadOnly bool, offset int, limit int) (NotificationPage, error) {
+	if offset < 0 {
+		offset = 0
+	}
+
+	if limit <= 0 {
+		limit = 10
+	}
+
+	notifications, err := s.notificationRepo.SelectNotifications(profileId, unreadOnly, offset, limit)
+	if err != nil {
+		return NotificationPage{}, fmt.Errorf("GetNotifications failed to get notifications: %w", err)
+	}
+
+	total, unread, err := s.notificationRepo.SelectNotificationCounts(profileId)
+	if err != nil {
+		return NotificationPage{}, fmt.Errorf("GetNotifications failed to count notifications: %w", err)
+	}
+
+	if unreadOnly {
+		total = unread
+	}
+
+	for i := range notifications {
+		n := &notifications[i]
+		n.Actor.AvatarURLs = s.imageService.ImageURLs(n.Actor.AvatarName)
+		n.Message = notificationMessage(*n)
+	}
+
+	return NotificationPage{
+		Notifications: notifications,
+		Offset:        offset,
+		Limit:         limit,
+		Total:         total,
+		Unread:        unread,
+	}, nil
+}
+
+// Describes a notification, like "Alice and 11 others followed you".
+func notificationMessage(n notification.Notification) string {
+	name := n.Actor.DisplayName
+	if name == "" {
+		name = n.Actor.Username
+	}
+
+	switch {
+	case n.Actors == 2:
+		name += " and 1 other"
+	case n.Actors > 2:
+		name += fmt.Sprintf(" and %d others", n.Actors-1)
+	}
+
+	return name + " " + notificationActions[n.Type]
+}
+
+// Returns ErrNoNotification if the profile has no notification with the id.
+func (s *notificationService) MarkRead(profileId string, id int) error {
+	found, err := s.notificationRepo.UpdateNotificationRead(profileId, id)
+	if err != nil {
+		return fmt.Errorf("MarkRead failed to update notification: %w", err)
+	}
+
+	if !found {
+		return ErrNoNotification
+	}
+
+	return nil
+}
+
+func (s *notificationService) MarkAllRead(profileId string) error {
+	if err := s.notificationRepo.UpdateNotificationsRead(profileId); err != nil {
+		return fmt.Errorf("MarkAllRead failed to update notifications: %w", err)
+	}
+
+	return nil
+}
+
+// Gets whether each type of notification is on for a profile, they are on by default.
+func (s *notificationService) GetPreferences(profileId string) (map[string]bool, error) {
+	stored, err := s.notificationRepo.SelectNotificationPreferences(profileId)
+	if err != nil {
+		return nil, fmt.Errorf("GetPreferences failed to get preferences: %w", err)
+	}
+
+	result := map[string]bool{}
+	for notificationType := range notificationActions {
+		enabled, ok := stored[notificationType]
+		result[notificationType] = enabled || !ok
+	}
+
+	return result, nil
+}
+
+// Turns types of notifications on or off for a profile, returning all of its preferences.
+// Returns ErrNotificationType if any type is unknown.
+func (s *notificationService) UpdatePreferences(profileId string, preferences map[string]bool) (map[string]bool, error) {
+	for notificationType := range preferences {
+		if _, ok := notificationActions[notificationType]; !ok {
+			return nil, ErrNotificationType
+		}
+	}
+
+	if err := s.notificationRepo.UpdateNotificationPreferences(profileId, preferences); err != nil {
+		return nil, fmt.Errorf("UpdatePreferences failed to update preferences: %w", err)
+	}
+
+	return s.GetPreferences(profileId)
+}
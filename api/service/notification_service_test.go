@@ -0,0 +1,186 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eciccone/rh/api/repo/notification"
+	"github.com/stretchr/testify/assert"
+)
+
+type NotificationServiceMocker struct {
+	NotifyMock            func(profileId string, actorId string, notificationType string, subject string) error
+	GetNotificationsMock  func(profileId string, unreadOnly bool, offset int, limit int) (NotificationPage, error)
+	MarkReadMock          func(profileId string, id int) error
+	MarkAllReadMock       func(profileId string) error
+	GetPreferencesMock    func(profileId string) (map[string]bool, error)
+	UpdatePreferencesMock func(profileId string, preferences map[string]bool) (map[string]bool, error)
+}
+
+func (s *NotificationServiceMocker) Notify(profileId string, actorId string, notificationType string, subject string) error {
+	return s.NotifyMock(profileId, actorId, notificationType, subject)
+}
+
+func (s *NotificationServiceMocker) GetNotifications(profileId string, unreadOnly bool, offset int, limit int) (NotificationPage, error) {
+	return s.GetNotificationsMock(profileId, unreadOnly, offset, limit)
+}
+
+func (s *NotificationServiceMocker) MarkRead(profileId string, id int) error {
+	return s.MarkReadMock(profileId, id)
+}
+
+func (s *NotificationServiceMocker) MarkAllRead(profileId string) error {
+	return s.MarkAllReadMock(profileId)
+}
+
+func (s *NotificationServiceMocker) GetPreferences(profileId string) (map[string]bool, error) {
+	return s.GetPreferencesMock(profileId)
+}
+
+func (s *NotificationServiceMocker) UpdatePreferences(profileId string, preferences map[string]bool) (map[string]bool, error) {
+	return s.UpdatePreferencesMock(profileId, preferences)
+}
+
+type NotificationRepoMocker struct {
+	InsertNotificationMock            func(n notification.Notification, actorId string, coalesceAfter time.Time) error
+	SelectNotificationsMock           func(profileId string, unreadOnly bool, offset int, limit int) ([]notification.Notification, error)
+	SelectNotificationCountsMock      func(profileId string) (int, int, error)
+	UpdateNotificationReadMock        func(profileId string, id int) (bool, error)
+	UpdateNotificationsReadMock       func(profileId string) error
+	SelectNotificationPreferencesMock func(profileId string) (map[string]bool, error)
+	UpdateNotificationPreferencesMock func(profileId string, preferences map[string]bool) error
+}
+
+func (r *NotificationRepoMocker) InsertNotification(n notification.Notification, actorId string, coalesceAfter time.Time) error {
+	return r.InsertNotificationMock(n, actorId, coalesceAfter)
+}
+
+func (r *NotificationRepoMocker) SelectNotifications(profileId string, unreadOnly bool, offset int, limit int) ([]notification.Notification, error) {
+	return r.SelectNotificationsMock(profileId, unreadOnly, offset, limit)
+}
+
+func (r *NotificationRepoMocker) SelectNotificationCounts(profileId string) (int, int, error) {
+	return r.SelectNotificationCountsMock(profileId)
+}
+
+func (r *NotificationRepoMocker) UpdateNotificationRead(profileId string, id int) (bool, error) {
+	return r.UpdateNotificationReadMock(profileId, id)
+}
+
+func (r *NotificationRepoMocker) UpdateNotificationsRead(profileId string) error {
+	return r.UpdateNotificationsReadMock(profileId)
+}
+
+func (r *NotificationRepoMocker) SelectNotificationPreferences(profileId string) (map[string]bool, error) {
+	return r.SelectNotificationPreferencesMock(profileId)
+}
+
+func (r *NotificationRepoMocker) UpdateNotificationPreferences(profileId string, preferences map[string]bool) error {
+	return r.UpdateNotificationPreferencesMock(profileId, preferences)
+}
+
+func Test_Notify(t *testing.T) {
+	now := time.Date(2022, 3, 2, 12, 0, 0, 0, time.UTC)
+	var inserted []notification.Notification
+
+	nr := &NotificationRepoMocker{
+		SelectNotificationPreferencesMock: func(profileId string) (map[string]bool, error) {
+			if profileId == "quiet-id" {
+				return map[string]bool{NotificationFollow: false}, nil
+			}
+			return map[string]bool{}, nil
+		},
+		InsertNotificationMock: func(n notification.Notification, actorId string, coalesceAfter time.Time) error {
+			assert.Equal(t, "actor-id", actorId)
+			assert.Equal(t, now.Add(-notificationCoalesceWindow), coalesceAfter)
+			inserted = append(inserted, n)
+			return nil
+		},
+	}
+	ns := &notificationService{nr, &ImageServiceMocker{}, func() time.Time { return now }}
+
+	assert.NoError(t, ns.Notify("cook-id", "actor-id", NotificationFollow, ""))
+	// turned off
+	assert.NoError(t, ns.Notify("quiet-id", "actor-id", NotificationFollow, ""))
+	// profiles are not notified of what they did themselves
+	assert.NoError(t, ns.Notify("actor-id", "actor-id", NotificationFollow, ""))
+	assert.ErrorIs(t, ns.Notify("cook-id", "actor-id", "unknown", ""), ErrNotificationType)
+
+	assert.Equal(t, []notification.Notification{{ProfileId: "cook-id", Type: NotificationFollow, Updated: now}}, inserted)
+}
+
+func Test_GetNotifications(t *testing.T) {
+	nr := &NotificationRepoMocker{
+		SelectNotificationsMock: func(profileId string, unreadOnly bool, offset int, limit int) ([]notification.Notification, error) {
+			assert.Equal(t, 0, offset)
+			assert.Equal(t, 10, limit)
+			return []notification.Notification{
+				{Id: 1, Type: NotificationFollow, Actors: 12, Actor: notification.Actor{Username: "alice", DisplayName: "Alice", AvatarName: "alice.jpg"}},
+				{Id: 2, Type: NotificationFollow, Actors: 2, Actor: notification.Actor{Username: "bob"}},
+				{Id: 3, Type: NotificationFollow, Actors: 1, Actor: notification.Actor{Username: "carol"}},
+			}, nil
+		},
+		SelectNotificationCountsMock: func(profileId string) (int, int, error) {
+			return 5, 2, nil
+		},
+	}
+	ns := NewNotificationService(nr, &ImageServiceMocker{})
+
+	page, err := ns.GetNotifications("test-id", false, -1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, page.Total)
+	assert.Equal(t, 2, page.Unread)
+	assert.Equal(t, "Alice and 11 others followed you", page.Notifications[0].Message)
+	assert.Equal(t, "bob and 1 other followed you", page.Notifications[1].Message)
+	assert.Equal(t, "carol followed you", page.Notifications[2].Message)
+	assert.NotEmpty(t, page.Notifications[0].Actor.AvatarURLs)
+
+	page, err = ns.GetNotifications("test-id", true, 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, page.Total)
+}
+
+func Test_MarkRead(t *testing.T) {
+	nr := &NotificationRepoMocker{
+		UpdateNotificationReadMock: func(profileId string, id int) (bool, error) {
+			if id == 3 {
+				return false, errors.New("failed")
+			}
+			return id == 1, nil
+		},
+	}
+	ns := NewNotificationService(nr, &ImageServiceMocker{})
+
+	assert.NoError(t, ns.MarkRead("test-id", 1))
+	assert.ErrorIs(t, ns.MarkRead("test-id", 2), ErrNoNotification)
+	assert.Error(t, ns.MarkRead("test-id", 3))
+}
+
+func Test_NotificationPreferences(t *testing.T) {
+	stored := map[string]bool{}
+	nr := &NotificationRepoMocker{
+		SelectNotificationPreferencesMock: func(profileId string) (map[string]bool, error) {
+			return stored, nil
+		},
+		UpdateNotificationPreferencesMock: func(profileId string, preferences map[string]bool) error {
+			for k, v := range preferences {
+				stored[k] = v
+			}
+			return nil
+		},
+	}
+	ns := NewNotificationService(nr, &ImageServiceMocker{})
+
+	// on by default
+	result, err := ns.GetPreferences("test-id")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{NotificationFollow: true}, result)
+
+	result, err = ns.UpdatePreferences("test-id", map[string]bool{NotificationFollow: false})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{NotificationFollow: false}, result)
+
+	_, err = ns.UpdatePreferences("test-id", map[string]bool{"unknown": false})
+	assert.ErrorIs(t, err, ErrNotificationType)
+}
@@ -4,59 +4,473 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"mime/multipart"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/eciccone/rh/api/repo/profile"
 )
 
 var (
 	ErrNoProfile         = errors.New("profile not found")
-	ErrProfileData       = errors.New("must provide username for profile")
+	ErrProfileDeleted    = fmt.Errorf("%w, it was deleted", ErrNoProfile)
+	ErrProfileData       = errors.New("invalid username")
 	ErrUsernameForbidden = errors.New("username not available")
 	ErrProfileExists     = errors.New("profile already created")
+	ErrProfileDetails    = errors.New("invalid profile details")
+	ErrUsernameTooSoon   = errors.New("username was changed too recently")
+)
+
+// how long a user has to wait between changing their username
+const usernameChangeInterval = 30 * 24 * time.Hour
+
+// how long a deleted profile is kept so its deletion can be cancelled
+const profileDeletionGrace = 14 * 24 * time.Hour
+
+const (
+	UnitsMetric   = "metric"
+	UnitsImperial = "imperial"
+)
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 500
+	maxWebsiteLength     = 200
 )
 
 type ProfileService interface {
-	// Returns ErrProfileData if username is empty.
+	// Returns ErrProfileData if the username policy does not allow username.
 	// Returns ErrProfileExists if profile already exists.
-	// Returns ErrUsernameForbidden if username is in use.
+	// Returns ErrUsernameForbidden if username, or one that looks like it, is in use.
 	CreateProfile(args profile.Profile) error
 
 	// Returns ErrNoProfile if profile does not exist.
+	// Returns ErrProfileDeleted, which is also ErrNoProfile, if the profile was deleted and no new
+	// one was created since.
 	FetchProfile(id string) (profile.Profile, error)
+
+	// Updates the display name, bio, website and preferred units of a profile. Units default
+	// to metric.
+	// Returns ErrNoProfile if profile does not exist.
+	// Returns ErrProfileDetails if any of them is invalid.
+	UpdateProfile(id string, args profile.Profile) (profile.Profile, error)
+
+	// Stores an image as the avatar of a profile, replacing its current avatar.
+	// Returns ErrNoProfile if profile does not exist.
+	// Returns ErrImageType if the file is not a supported image.
+	// Returns ErrImageTooLarge if the file or its dimensions are too large.
+	UpdateProfileAvatar(id string, file *multipart.FileHeader) (profile.Profile, error)
+
+	// Renames a profile along with the recipes it owns. The previous username keeps leading to
+	// the profile and can't be taken by anyone else.
+	// Returns ErrProfileData if the username policy does not allow username.
+	// Returns ErrNoProfile if profile does not exist.
+	// Returns ErrUsernameForbidden if username, or one that looks like it, is in use.
+	// Returns ErrUsernameTooSoon if the username was changed within the last 30 days.
+	ChangeUsername(id string, username string) (profile.Profile, error)
+
+	// Finds the public profile of a user by their current or a previous username.
+	// Returns ErrNoProfile if no profile has or had the username.
+	FindProfile(username string) (PublicProfile, error)
+
+	// Schedules a profile to be deleted once the grace period is over. Until then it is hidden
+	// from other users and the deletion can be cancelled.
+	// Returns ErrNoProfile if profile does not exist.
+	DeleteProfile(id string) (profile.Profile, error)
+
+	// Cancels the scheduled deletion of a profile.
+	// Returns ErrNoProfile if profile does not exist.
+	RestoreProfile(id string) (profile.Profile, error)
+
+	// Deletes the profiles whose grace period is over with everything they own, including their
+	// image files, and returns how many were deleted.
+	PurgeProfiles() (int, error)
+
+	// Makes a profile follow the profile with username, following it again changes nothing.
+	// Returns ErrNoProfile if no profile has or had the username.
+	// Returns ErrFollowSelf if it is the profile's own username.
+	Follow(id string, username string) error
+
+	// Makes a profile stop following the profile with username.
+	// Returns ErrNoProfile if no profile has or had the username.
+	Unfollow(id string, username string) error
+
+	// Gets a page of the profiles following the profile with username, most recent first.
+	// Returns ErrNoProfile if no profile has or had the username.
+	GetFollowers(username string, offset int, limit int) (ProfilePage, error)
+
+	// Gets a page of the profiles the profile with username follows, most recent first.
+	// Returns ErrNoProfile if no profile has or had the username.
+	GetFollowing(username string, offset int, limit int) (ProfilePage, error)
+}
+
+// The part of a profile anyone can see.
+type PublicProfile struct {
+	Username    string            `json:"username"`
+	DisplayName string            `json:"display_name,omitempty"`
+	Bio         string            `json:"bio,omitempty"`
+	Website     string            `json:"website,omitempty"`
+	AvatarURLs  map[string]string `json:"avatar_urls,omitempty"`
+	Followers   int               `json:"followers"`
+	Following   int               `json:"following"`
 }
 
 type profileService struct {
-	profileRepo profile.ProfileRepository
+	profileRepo         profile.ProfileRepository
+	imageService        ImageService
+	notificationService NotificationService
+	policy              UsernamePolicy
+	now                 func() time.Time
 }
 
-func NewProfileService(profileRepo profile.ProfileRepository) ProfileService {
-	return &profileService{profileRepo}
+func NewProfileService(profileRepo profile.ProfileRepository, imageService ImageService, notificationService NotificationService, policy UsernamePolicy) ProfileService {
+	return &profileService{profileRepo, imageService, notificationService, policy, time.Now}
 }
 
 // Returns ErrNoProfile if profile does not exist.
+// Returns ErrProfileDeleted, which is also ErrNoProfile, if the profile was deleted and no new
+// one was created since.
 func (s *profileService) FetchProfile(id string) (profile.Profile, error) {
 	result, err := s.profileRepo.SelectProfileById(id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return profile.Profile{}, ErrNoProfile
+			return profile.Profile{}, s.noProfile(id)
 		}
 
 		return profile.Profile{}, err
 	}
 
+	result.AvatarURLs = s.imageService.ImageURLs(result.AvatarName)
+
+	return result, nil
+}
+
+// Returns ErrProfileDeleted if a profile with id was deleted, so the user knows to create a new
+// one, and ErrNoProfile otherwise.
+func (s *profileService) noProfile(id string) error {
+	if _, err := s.profileRepo.SelectProfileTombstone(id); err == nil {
+		return ErrProfileDeleted
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	return ErrNoProfile
+}
+
+// Updates the display name, bio, website and preferred units of a profile. Units default to
+// metric.
+// Returns ErrNoProfile if profile does not exist.
+// Returns ErrProfileDetails if any of them is invalid.
+func (s *profileService) UpdateProfile(id string, args profile.Profile) (profile.Profile, error) {
+	if err := normalizeProfileDetails(&args); err != nil {
+		return profile.Profile{}, err
+	}
+
+	result, err := s.FetchProfile(id)
+	if err != nil {
+		return profile.Profile{}, err
+	}
+
+	result.DisplayName = args.DisplayName
+	result.Bio = args.Bio
+	result.Website = args.Website
+	result.Units = args.Units
+
+	if err := s.profileRepo.UpdateProfile(result); err != nil {
+		return profile.Profile{}, fmt.Errorf("UpdateProfile failed to update profile: %w", err)
+	}
+
+	return result, nil
+}
+
+// Stores an image as the avatar of a profile, replacing its current avatar.
+// Returns ErrNoProfile if profile does not exist.
+// Returns ErrImageType if the file is not a supported image.
+// Returns ErrImageTooLarge if the file or its dimensions are too large.
+func (s *profileService) UpdateProfileAvatar(id string, file *multipart.FileHeader) (profile.Profile, error) {
+	result, err := s.FetchProfile(id)
+	if err != nil {
+		return profile.Profile{}, err
+	}
+
+	var name string
+	err = withImages(s.imageService, func(images ImageUnit) error {
+		name, err = images.Save(file)
+		if err != nil {
+			return err
+		}
+
+		// the previous avatar is deleted unless something else shares it
+		if err := images.Delete(result.AvatarName); err != nil {
+			return err
+		}
+
+		if err := s.profileRepo.UpdateProfileAvatarName(id, name); err != nil {
+			return fmt.Errorf("UpdateProfileAvatar failed to update avatar: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return profile.Profile{}, err
+	}
+
+	result.AvatarName = name
+	result.AvatarURLs = s.imageService.ImageURLs(name)
+
+	return result, nil
+}
+
+// Renames a profile along with the recipes it owns. The previous username keeps leading to the
+// profile and can't be taken by anyone else.
+// Returns ErrProfileData if the username policy does not allow username.
+// Returns ErrNoProfile if profile does not exist.
+// Returns ErrUsernameForbidden if username, or one that looks like it, is in use.
+// Returns ErrUsernameTooSoon if the username was changed within the last 30 days.
+func (s *profileService) ChangeUsername(id string, username string) (profile.Profile, error) {
+	username, key, err := s.policy.Validate(username)
+	if err != nil {
+		return profile.Profile{}, err
+	}
+
+	result, err := s.FetchProfile(id)
+	if err != nil {
+		return profile.Profile{}, err
+	}
+
+	if username == result.Username {
+		return result, nil
+	}
+
+	now := s.now()
+	if next := result.UsernameChanged.Add(usernameChangeInterval); now.Before(next) {
+		return profile.Profile{}, fmt.Errorf("%w, it can be changed again after %s", ErrUsernameTooSoon, next.UTC().Format(time.RFC3339))
+	}
+
+	if err := s.checkUsernameAvailable(username, key, id); err != nil {
+		return profile.Profile{}, err
+	}
+
+	if err := s.profileRepo.UpdateProfileUsername(id, username, key, now); err != nil {
+		return profile.Profile{}, fmt.Errorf("ChangeUsername failed to update username: %w", err)
+	}
+
+	result.Username = username
+	result.UsernameKey = key
+	result.UsernameChanged = now
+
+	return result, nil
+}
+
+// Finds the public profile of a user by their current or a previous username.
+// Returns ErrNoProfile if no profile has or had the username.
+func (s *profileService) FindProfile(username string) (PublicProfile, error) {
+	result, err := s.findProfile(username)
+	if err != nil {
+		return PublicProfile{}, err
+	}
+
+	followers, following, err := s.profileRepo.SelectFollowCounts(result.Id)
+	if err != nil {
+		return PublicProfile{}, fmt.Errorf("FindProfile failed to count follows: %w", err)
+	}
+
+	return PublicProfile{
+		Username:    result.Username,
+		DisplayName: result.DisplayName,
+		Bio:         result.Bio,
+		Website:     result.Website,
+		AvatarURLs:  s.imageService.ImageURLs(result.AvatarName),
+		Followers:   followers,
+		Following:   following,
+	}, nil
+}
+
+// Finds a profile other users can see by its current or a previous username.
+// Returns ErrNoProfile if no profile has or had the username, or it is scheduled for deletion.
+func (s *profileService) findProfile(username string) (profile.Profile, error) {
+	result, err := s.profileRepo.SelectProfileByUsername(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		result, err = s.profileRepo.SelectProfileByRedirect(username)
+	}
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && result.DeleteAfter != nil) {
+		return profile.Profile{}, ErrNoProfile
+	}
+	if err != nil {
+		return profile.Profile{}, fmt.Errorf("findProfile failed to get profile: %w", err)
+	}
+
+	return result, nil
+}
+
+// Schedules a profile to be deleted once the grace period is over. Until then it is hidden from
+// other users and the deletion can be cancelled.
+// Returns ErrNoProfile if profile does not exist.
+func (s *profileService) DeleteProfile(id string) (profile.Profile, error) {
+	result, err := s.FetchProfile(id)
+	if err != nil {
+		return profile.Profile{}, err
+	}
+
+	if result.DeleteAfter != nil {
+		return result, nil
+	}
+
+	deleteAfter := s.now().Add(profileDeletionGrace)
+	if err := s.profileRepo.UpdateProfileDeleteAfter(id, &deleteAfter); err != nil {
+		return profile.Profile{}, fmt.Errorf("DeleteProfile failed to schedule deletion: %w", err)
+	}
+
+	result.DeleteAfter = &deleteAfter
+
+	return result, nil
+}
+
+// Cancels the scheduled deletion of a profile.
+// Returns ErrNoProfile if profile does not exist.
+func (s *profileService) RestoreProfile(id string) (profile.Profile, error) {
+	result, err := s.FetchProfile(id)
+	if err != nil {
+		return profile.Profile{}, err
+	}
+
+	if result.DeleteAfter == nil {
+		return result, nil
+	}
+
+	if err := s.profileRepo.UpdateProfileDeleteAfter(id, nil); err != nil {
+		return profile.Profile{}, fmt.Errorf("RestoreProfile failed to cancel deletion: %w", err)
+	}
+
+	result.DeleteAfter = nil
+
 	return result, nil
 }
 
-// Returns ErrProfileData if username is empty.
+// Deletes the profiles whose grace period is over with everything they own, including their
+// image files, and returns how many were deleted.
+func (s *profileService) PurgeProfiles() (int, error) {
+	now := s.now()
+
+	profiles, err := s.profileRepo.SelectProfilesToDelete(now)
+	if err != nil {
+		return 0, fmt.Errorf("PurgeProfiles failed to get profiles: %w", err)
+	}
+
+	for i, p := range profiles {
+		if err := s.purgeProfile(p.Id, now); err != nil {
+			return i, err
+		}
+	}
+
+	return len(profiles), nil
+}
+
+// Deletes a profile, its recipes by cascading foreign keys, and every image file nothing else
+// shares.
+func (s *profileService) purgeProfile(id string, now time.Time) error {
+	names, err := s.profileRepo.SelectProfileImageNames(id)
+	if err != nil {
+		return fmt.Errorf("PurgeProfiles failed to get images of %s: %w", id, err)
+	}
+
+	return withImages(s.imageService, func(images ImageUnit) error {
+		for _, name := range names {
+			if err := images.Delete(name); err != nil {
+				return err
+			}
+		}
+
+		if err := s.profileRepo.DeleteProfile(id, now); err != nil {
+			return fmt.Errorf("PurgeProfiles failed to delete %s: %w", id, err)
+		}
+
+		return nil
+	})
+}
+
+// Checks that no profile but the one with id has or had username, or has one that looks like
+// it.
+// Returns a ValidationError wrapping ErrUsernameForbidden if another profile does.
+func (s *profileService) checkUsernameAvailable(username string, key string, id string) error {
+	// usernames are compared regardless of case
+	p, err := s.profileRepo.SelectProfileByUsername(username)
+	if err == nil && p.Id != id {
+		return fieldError(ErrUsernameForbidden, "username", "is taken")
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("checkUsernameAvailable failed to get profile by username: %w", err)
+	}
+
+	// previous usernames keep leading to their profile
+	p, err = s.profileRepo.SelectProfileByRedirect(username)
+	if err == nil && p.Id != id {
+		return fieldError(ErrUsernameForbidden, "username", "is taken")
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("checkUsernameAvailable failed to get profile by redirect: %w", err)
+	}
+
+	p, err = s.profileRepo.SelectProfileByUsernameKey(key)
+	if err == nil && p.Id != id {
+		return fieldError(ErrUsernameForbidden, "username", "is too similar to an existing username")
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("checkUsernameAvailable failed to get profile by username key: %w", err)
+	}
+
+	return nil
+}
+
+// Validates the editable details of a profile, normalizing them for storage.
+// Returns ErrProfileDetails if any of them is invalid.
+func normalizeProfileDetails(args *profile.Profile) error {
+	args.DisplayName = strings.TrimSpace(args.DisplayName)
+	if utf8.RuneCountInString(args.DisplayName) > maxDisplayNameLength {
+		return fmt.Errorf("%w: display name must be at most %d characters", ErrProfileDetails, maxDisplayNameLength)
+	}
+
+	args.Bio = strings.TrimSpace(args.Bio)
+	if utf8.RuneCountInString(args.Bio) > maxBioLength {
+		return fmt.Errorf("%w: bio must be at most %d characters", ErrProfileDetails, maxBioLength)
+	}
+
+	args.Website = strings.TrimSpace(args.Website)
+	if args.Website != "" {
+		u, err := url.Parse(args.Website)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%w: website must be an http or https url", ErrProfileDetails)
+		}
+		if len(args.Website) > maxWebsiteLength {
+			return fmt.Errorf("%w: website must be at most %d characters", ErrProfileDetails, maxWebsiteLength)
+		}
+	}
+
+	args.Units = strings.ToLower(strings.TrimSpace(args.Units))
+	if args.Units == "" {
+		args.Units = UnitsMetric
+	}
+	if args.Units != UnitsMetric && args.Units != UnitsImperial {
+		return fmt.Errorf("%w: units must be metric or imperial", ErrProfileDetails)
+	}
+
+	return nil
+}
+
+// Returns ErrProfileData if the username policy does not allow username.
 // Returns ErrProfileExists if profile already exists.
-// Returns ErrUsernameForbidden if username is in use.
+// Returns ErrUsernameForbidden if username, or one that looks like it, is in use.
 func (s *profileService) CreateProfile(args profile.Profile) error {
-	if args.Username == "" {
-		return ErrProfileData
+	username, key, err := s.policy.Validate(args.Username)
+	if err != nil {
+		return err
 	}
+	args.Username, args.UsernameKey = username, key
 
 	// check if profile exists
-	_, err := s.profileRepo.SelectProfileById(args.Id)
+	_, err = s.profileRepo.SelectProfileById(args.Id)
 	if !errors.Is(err, sql.ErrNoRows) {
 		if err != nil {
 			return fmt.Errorf("CreateProfile failed to get profile by id: %w", err)
@@ -66,18 +480,19 @@ func (s *profileService) CreateProfile(args profile.Profile) error {
 	}
 
 	// check if username is in use
-	_, err = s.profileRepo.SelectProfileByUsername(args.Username)
-	if !errors.Is(err, sql.ErrNoRows) {
-		if err != nil {
-			return fmt.Errorf("CreateProfile failed to get profile by username: %w", err)
-		}
-		// username exists
-		return ErrUsernameForbidden
+	if err := s.checkUsernameAvailable(args.Username, args.UsernameKey, args.Id); err != nil {
+		return err
 	}
 
-	if err = s.profileRepo.InsertProfile(args); err != nil {
+	// the username can be taken by someone else between the check and the insert
+	inserted, err := s.profileRepo.InsertProfile(args)
+	if err != nil {
 		return fmt.Errorf("CreateProfile failed to create profile: %w", err)
 	}
 
+	if !inserted {
+		return fieldError(ErrUsernameForbidden, "username", "is taken")
+	}
+
 	return nil
 }
@@ -3,16 +3,36 @@ package service
 import (
 	"database/sql"
 	"errors"
+	"mime/multipart"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/eciccone/rh/api/repo/profile"
 	"github.com/stretchr/testify/assert"
 )
 
 type ProfileRepoMocker struct {
-	SelectProfileByIdMock       func(id string) (profile.Profile, error)
-	SelectProfileByUsernameMock func(username string) (profile.Profile, error)
-	InsertProfileMock           func(profile profile.Profile) error
+	SelectProfileByIdMock          func(id string) (profile.Profile, error)
+	SelectProfileByUsernameMock    func(username string) (profile.Profile, error)
+	SelectProfileByUsernameKeyMock func(key string) (profile.Profile, error)
+	InsertProfileMock              func(profile profile.Profile) (bool, error)
+	UpdateProfileMock              func(profile profile.Profile) error
+	UpdateProfileAvatarNameMock    func(id string, avatarName string) error
+	UpdateProfileUsernameMock      func(id string, username string, key string, changed time.Time) error
+	SelectProfileByRedirectMock    func(username string) (profile.Profile, error)
+	UpdateProfileDeleteAfterMock   func(id string, deleteAfter *time.Time) error
+	SelectProfilesToDeleteMock     func(before time.Time) ([]profile.Profile, error)
+	SelectProfileImageNamesMock    func(id string) ([]string, error)
+	DeleteProfileMock              func(id string, deleted time.Time) error
+	SelectProfileTombstoneMock     func(id string) (time.Time, error)
+	InsertFollowMock               func(followerId string, followeeId string, created time.Time) (bool, error)
+	DeleteFollowMock               func(followerId string, followeeId string) error
+	SelectFollowersMock            func(id string, offset int, limit int) ([]profile.Profile, error)
+	SelectFollowingMock            func(id string, offset int, limit int) ([]profile.Profile, error)
+	SelectFollowCountsMock         func(id string) (int, int, error)
+	SearchProfilesMock             func(query string, offset int, limit int) ([]profile.Profile, error)
+	SelectProfileSearchCountMock   func(query string) (int, error)
 }
 
 func (r *ProfileRepoMocker) SelectProfileById(id string) (profile.Profile, error) {
@@ -23,10 +43,81 @@ func (r *ProfileRepoMocker) SelectProfileByUsername(username string) (profile.Pr
 	return r.SelectProfileByUsernameMock(username)
 }
 
-func (r *ProfileRepoMocker) InsertProfile(profile profile.Profile) error {
+func (r *ProfileRepoMocker) InsertProfile(profile profile.Profile) (bool, error) {
 	return r.InsertProfileMock(profile)
 }
 
+func (r *ProfileRepoMocker) UpdateProfile(profile profile.Profile) error {
+	return r.UpdateProfileMock(profile)
+}
+
+func (r *ProfileRepoMocker) UpdateProfileAvatarName(id string, avatarName string) error {
+	return r.UpdateProfileAvatarNameMock(id, avatarName)
+}
+
+func (r *ProfileRepoMocker) SelectProfileByUsernameKey(key string) (profile.Profile, error) {
+	return r.SelectProfileByUsernameKeyMock(key)
+}
+
+func (r *ProfileRepoMocker) UpdateProfileUsername(id string, username string, key string, changed time.Time) error {
+	return r.UpdateProfileUsernameMock(id, username, key, changed)
+}
+
+func (r *ProfileRepoMocker) SelectProfileByRedirect(username string) (profile.Profile, error) {
+	return r.SelectProfileByRedirectMock(username)
+}
+
+func (r *ProfileRepoMocker) UpdateProfileDeleteAfter(id string, deleteAfter *time.Time) error {
+	return r.UpdateProfileDeleteAfterMock(id, deleteAfter)
+}
+
+func (r *ProfileRepoMocker) SelectProfilesToDelete(before time.Time) ([]profile.Profile, error) {
+	return r.SelectProfilesToDeleteMock(before)
+}
+
+func (r *ProfileRepoMocker) SelectProfileImageNames(id string) ([]string, error) {
+	return r.SelectProfileImageNamesMock(id)
+}
+
+func (r *ProfileRepoMocker) DeleteProfile(id string, deleted time.Time) error {
+	return r.DeleteProfileMock(id, deleted)
+}
+
+func (r *ProfileRepoMocker) SelectProfileTombstone(id string) (time.Time, error) {
+	if r.SelectProfileTombstoneMock == nil {
+		return time.Time{}, sql.ErrNoRows
+	}
+	return r.SelectProfileTombstoneMock(id)
+}
+
+func (r *ProfileRepoMocker) InsertFollow(followerId string, followeeId string, created time.Time) (bool, error) {
+	return r.InsertFollowMock(followerId, followeeId, created)
+}
+
+func (r *ProfileRepoMocker) DeleteFollow(followerId string, followeeId string) error {
+	return r.DeleteFollowMock(followerId, followeeId)
+}
+
+func (r *ProfileRepoMocker) SelectFollowers(id string, offset int, limit int) ([]profile.Profile, error) {
+	return r.SelectFollowersMock(id, offset, limit)
+}
+
+func (r *ProfileRepoMocker) SelectFollowing(id string, offset int, limit int) ([]profile.Profile, error) {
+	return r.SelectFollowingMock(id, offset, limit)
+}
+
+func (r *ProfileRepoMocker) SelectFollowCounts(id string) (int, int, error) {
+	return r.SelectFollowCountsMock(id)
+}
+
+func (r *ProfileRepoMocker) SearchProfiles(query string, offset int, limit int) ([]profile.Profile, error) {
+	return r.SearchProfilesMock(query, offset, limit)
+}
+
+func (r *ProfileRepoMocker) SelectProfileSearchCount(query string) (int, error) {
+	return r.SelectProfileSearchCountMock(query)
+}
+
 func Test_CreateProfile(t *testing.T) {
 	rr := &ProfileRepoMocker{
 		SelectProfileByIdMock: func(id string) (profile.Profile, error) {
@@ -35,14 +126,20 @@ func Test_CreateProfile(t *testing.T) {
 		SelectProfileByUsernameMock: func(username string) (profile.Profile, error) {
 			return profile.Profile{}, sql.ErrNoRows
 		},
-		InsertProfileMock: func(profile profile.Profile) error {
-			return nil
+		SelectProfileByRedirectMock: func(username string) (profile.Profile, error) {
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		SelectProfileByUsernameKeyMock: func(key string) (profile.Profile, error) {
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		InsertProfileMock: func(profile profile.Profile) (bool, error) {
+			return true, nil
 		},
 	}
 
-	rs := NewProfileService(rr)
+	rs := NewProfileService(rr, &ImageServiceMocker{}, &NotificationServiceMocker{}, DefaultUsernamePolicy())
 
-	err := rs.CreateProfile(profile.Profile{"test-id", "test user"})
+	err := rs.CreateProfile(profile.Profile{Id: "test-id", Username: "test_user"})
 
 	assert.NoError(t, err)
 }
@@ -55,14 +152,20 @@ func Test_CreateProfileIdExists(t *testing.T) {
 		SelectProfileByUsernameMock: func(username string) (profile.Profile, error) {
 			return profile.Profile{}, sql.ErrNoRows
 		},
-		InsertProfileMock: func(profile profile.Profile) error {
-			return nil
+		SelectProfileByRedirectMock: func(username string) (profile.Profile, error) {
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		SelectProfileByUsernameKeyMock: func(key string) (profile.Profile, error) {
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		InsertProfileMock: func(profile profile.Profile) (bool, error) {
+			return true, nil
 		},
 	}
 
-	rs := NewProfileService(rr)
+	rs := NewProfileService(rr, &ImageServiceMocker{}, &NotificationServiceMocker{}, DefaultUsernamePolicy())
 
-	err := rs.CreateProfile(profile.Profile{"test-id", "test user"})
+	err := rs.CreateProfile(profile.Profile{Id: "test-id", Username: "test_user"})
 
 	assert.Error(t, err)
 }
@@ -75,18 +178,48 @@ func Test_CreateProfileUsernameExists(t *testing.T) {
 		SelectProfileByUsernameMock: func(username string) (profile.Profile, error) {
 			return profile.Profile{}, nil
 		},
-		InsertProfileMock: func(profile profile.Profile) error {
-			return nil
+		InsertProfileMock: func(profile profile.Profile) (bool, error) {
+			return true, nil
 		},
 	}
 
-	rs := NewProfileService(rr)
+	rs := NewProfileService(rr, &ImageServiceMocker{}, &NotificationServiceMocker{}, DefaultUsernamePolicy())
 
-	err := rs.CreateProfile(profile.Profile{"test-id", "test user"})
+	err := rs.CreateProfile(profile.Profile{Id: "test-id", Username: "test_user"})
 
 	assert.Error(t, err)
 }
 
+func Test_CreateProfileUsernameTakenConcurrently(t *testing.T) {
+	rr := &ProfileRepoMocker{
+		SelectProfileByIdMock: func(id string) (profile.Profile, error) {
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		SelectProfileByUsernameMock: func(username string) (profile.Profile, error) {
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		SelectProfileByRedirectMock: func(username string) (profile.Profile, error) {
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		SelectProfileByUsernameKeyMock: func(key string) (profile.Profile, error) {
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		InsertProfileMock: func(profile profile.Profile) (bool, error) {
+			return false, nil
+		},
+	}
+
+	rs := NewProfileService(rr, &ImageServiceMocker{}, &NotificationServiceMocker{}, DefaultUsernamePolicy())
+
+	err := rs.CreateProfile(profile.Profile{Id: "test-id", Username: "test_user"})
+
+	assert.ErrorIs(t, err, ErrUsernameForbidden)
+	var verr *ValidationError
+	if assert.ErrorAs(t, err, &verr) {
+		assert.Equal(t, map[string]string{"username": "is taken"}, verr.Fields)
+	}
+}
+
 func Test_CreateProfileError(t *testing.T) {
 	rr := &ProfileRepoMocker{
 		SelectProfileByIdMock: func(id string) (profile.Profile, error) {
@@ -95,27 +228,96 @@ func Test_CreateProfileError(t *testing.T) {
 		SelectProfileByUsernameMock: func(username string) (profile.Profile, error) {
 			return profile.Profile{}, sql.ErrNoRows
 		},
-		InsertProfileMock: func(profile profile.Profile) error {
-			return errors.New("failed")
+		SelectProfileByRedirectMock: func(username string) (profile.Profile, error) {
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		SelectProfileByUsernameKeyMock: func(key string) (profile.Profile, error) {
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		InsertProfileMock: func(profile profile.Profile) (bool, error) {
+			return false, errors.New("failed")
 		},
 	}
 
-	rs := NewProfileService(rr)
+	rs := NewProfileService(rr, &ImageServiceMocker{}, &NotificationServiceMocker{}, DefaultUsernamePolicy())
 
-	err := rs.CreateProfile(profile.Profile{"test-id", "test user"})
+	err := rs.CreateProfile(profile.Profile{Id: "test-id", Username: "test_user"})
 
 	assert.Error(t, err)
 }
 
+func Test_CreateProfileUsernameRedirected(t *testing.T) {
+	rr := &ProfileRepoMocker{
+		SelectProfileByIdMock: func(id string) (profile.Profile, error) {
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		SelectProfileByUsernameMock: func(username string) (profile.Profile, error) {
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		SelectProfileByRedirectMock: func(username string) (profile.Profile, error) {
+			return profile.Profile{Id: "other-id", Username: "renamed"}, nil
+		},
+	}
+
+	rs := NewProfileService(rr, &ImageServiceMocker{}, &NotificationServiceMocker{}, DefaultUsernamePolicy())
+
+	err := rs.CreateProfile(profile.Profile{Id: "test-id", Username: "test_user"})
+
+	assert.ErrorIs(t, err, ErrUsernameForbidden)
+}
+
+func Test_CreateProfileUsernamePolicy(t *testing.T) {
+	var inserted profile.Profile
+	rr := &ProfileRepoMocker{
+		SelectProfileByIdMock: func(id string) (profile.Profile, error) {
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		SelectProfileByUsernameMock: func(username string) (profile.Profile, error) {
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		SelectProfileByRedirectMock: func(username string) (profile.Profile, error) {
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		SelectProfileByUsernameKeyMock: func(key string) (profile.Profile, error) {
+			if key == "bob" {
+				return profile.Profile{Id: "other-id", Username: "bob"}, nil
+			}
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		InsertProfileMock: func(p profile.Profile) (bool, error) {
+			inserted = p
+			return true, nil
+		},
+	}
+
+	rs := NewProfileService(rr, &ImageServiceMocker{}, &NotificationServiceMocker{}, DefaultUsernamePolicy())
+
+	err := rs.CreateProfile(profile.Profile{Id: "test-id", Username: " Alice "})
+	assert.NoError(t, err)
+	assert.Equal(t, profile.Profile{Id: "test-id", Username: "Alice", UsernameKey: "allce"}, inserted)
+
+	err = rs.CreateProfile(profile.Profile{Id: "test-id", Username: "Admin"})
+	assert.ErrorIs(t, err, ErrProfileData)
+
+	var validationErr *ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, map[string]string{"username": "is reserved"}, validationErr.Fields)
+
+	err = rs.CreateProfile(profile.Profile{Id: "test-id", Username: "B0B"})
+	assert.ErrorIs(t, err, ErrUsernameForbidden)
+	assert.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, map[string]string{"username": "is too similar to an existing username"}, validationErr.Fields)
+}
+
 func Test_FetchProfile(t *testing.T) {
-	p := profile.Profile{"test-id", "test user"}
+	p := profile.Profile{Id: "test-id", Username: "test user"}
 	rr := &ProfileRepoMocker{
 		SelectProfileByIdMock: func(id string) (profile.Profile, error) {
 			return p, nil
 		},
 	}
 
-	rs := NewProfileService(rr)
+	rs := NewProfileService(rr, &ImageServiceMocker{}, &NotificationServiceMocker{}, DefaultUsernamePolicy())
 
 	result, err := rs.FetchProfile("test-id")
 
@@ -131,10 +333,453 @@ func Test_FetchProfileError(t *testing.T) {
 		},
 	}
 
-	rs := NewProfileService(rr)
+	rs := NewProfileService(rr, &ImageServiceMocker{}, &NotificationServiceMocker{}, DefaultUsernamePolicy())
 
 	result, err := rs.FetchProfile("test-id")
 
 	assert.Error(t, err)
 	assert.Equal(t, p, result)
 }
+
+func Test_FetchProfileDeleted(t *testing.T) {
+	rr := &ProfileRepoMocker{
+		SelectProfileByIdMock: func(id string) (profile.Profile, error) {
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		SelectProfileTombstoneMock: func(id string) (time.Time, error) {
+			if id == "deleted-id" {
+				return time.Unix(1700000000, 0), nil
+			}
+			return time.Time{}, sql.ErrNoRows
+		},
+	}
+
+	rs := NewProfileService(rr, &ImageServiceMocker{}, &NotificationServiceMocker{}, DefaultUsernamePolicy())
+
+	_, err := rs.FetchProfile("deleted-id")
+	assert.ErrorIs(t, err, ErrProfileDeleted)
+	assert.ErrorIs(t, err, ErrNoProfile)
+
+	_, err = rs.FetchProfile("test-id")
+	assert.ErrorIs(t, err, ErrNoProfile)
+	assert.NotErrorIs(t, err, ErrProfileDeleted)
+}
+
+func Test_FetchProfileAvatar(t *testing.T) {
+	rr := &ProfileRepoMocker{
+		SelectProfileByIdMock: func(id string) (profile.Profile, error) {
+			return profile.Profile{Id: "test-id", Username: "test user", AvatarName: "avatar.jpg"}, nil
+		},
+	}
+
+	rs := NewProfileService(rr, &ImageServiceMocker{}, &NotificationServiceMocker{}, DefaultUsernamePolicy())
+
+	result, err := rs.FetchProfile("test-id")
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"full": "/images/avatar.jpg"}, result.AvatarURLs)
+}
+
+func Test_UpdateProfile(t *testing.T) {
+	td := []struct {
+		Args   profile.Profile
+		Assert func(result profile.Profile, updated profile.Profile, err error)
+	}{
+		{
+			Args: profile.Profile{DisplayName: "  Test  ", Bio: "Cooks things", Website: "https://example.com/me", Units: "Imperial"},
+			Assert: func(result profile.Profile, updated profile.Profile, err error) {
+				assert.NoError(t, err)
+				expected := profile.Profile{Id: "test-id", Username: "test user", DisplayName: "Test", Bio: "Cooks things", Website: "https://example.com/me", Units: "imperial", AvatarName: "avatar.jpg"}
+				assert.Equal(t, expected, updated)
+				assert.Equal(t, "imperial", result.Units)
+				assert.NotNil(t, result.AvatarURLs)
+			},
+		},
+		{
+			// nothing set, units default to metric
+			Args: profile.Profile{Username: "ignored"},
+			Assert: func(result profile.Profile, updated profile.Profile, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, profile.Profile{Id: "test-id", Username: "test user", Units: "metric", AvatarName: "avatar.jpg"}, updated)
+			},
+		},
+		{
+			Args: profile.Profile{DisplayName: strings.Repeat("a", 51)},
+			Assert: func(result profile.Profile, updated profile.Profile, err error) {
+				assert.ErrorIs(t, err, ErrProfileDetails)
+			},
+		},
+		{
+			Args: profile.Profile{Bio: strings.Repeat("é", 501)},
+			Assert: func(result profile.Profile, updated profile.Profile, err error) {
+				assert.ErrorIs(t, err, ErrProfileDetails)
+			},
+		},
+		{
+			Args: profile.Profile{Website: "javascript:alert(1)"},
+			Assert: func(result profile.Profile, updated profile.Profile, err error) {
+				assert.ErrorIs(t, err, ErrProfileDetails)
+			},
+		},
+		{
+			Args: profile.Profile{Website: "example.com"},
+			Assert: func(result profile.Profile, updated profile.Profile, err error) {
+				assert.ErrorIs(t, err, ErrProfileDetails)
+			},
+		},
+		{
+			Args: profile.Profile{Units: "furlongs"},
+			Assert: func(result profile.Profile, updated profile.Profile, err error) {
+				assert.ErrorIs(t, err, ErrProfileDetails)
+			},
+		},
+	}
+
+	for _, tr := range td {
+		var updated profile.Profile
+		rr := &ProfileRepoMocker{
+			SelectProfileByIdMock: func(id string) (profile.Profile, error) {
+				return profile.Profile{Id: "test-id", Username: "test user", Units: "metric", AvatarName: "avatar.jpg"}, nil
+			},
+			UpdateProfileMock: func(p profile.Profile) error {
+				updated = p
+				return nil
+			},
+		}
+		rs := NewProfileService(rr, &ImageServiceMocker{}, &NotificationServiceMocker{}, DefaultUsernamePolicy())
+		result, err := rs.UpdateProfile("test-id", tr.Args)
+		updated.AvatarURLs = nil
+		tr.Assert(result, updated, err)
+	}
+}
+
+func Test_UpdateProfileNoProfile(t *testing.T) {
+	rr := &ProfileRepoMocker{
+		SelectProfileByIdMock: func(id string) (profile.Profile, error) {
+			return profile.Profile{}, sql.ErrNoRows
+		},
+	}
+	rs := NewProfileService(rr, &ImageServiceMocker{}, &NotificationServiceMocker{}, DefaultUsernamePolicy())
+
+	_, err := rs.UpdateProfile("test-id", profile.Profile{})
+	assert.ErrorIs(t, err, ErrNoProfile)
+
+	_, err = rs.UpdateProfileAvatar("test-id", &multipart.FileHeader{})
+	assert.ErrorIs(t, err, ErrNoProfile)
+}
+
+func Test_UpdateProfileAvatar(t *testing.T) {
+	td := []struct {
+		SaveErr   error
+		UpdateErr error
+		Assert    func(result profile.Profile, is *ImageServiceMocker, err error)
+	}{
+		{
+			Assert: func(result profile.Profile, is *ImageServiceMocker, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, "test-hash.jpg", result.AvatarName)
+				assert.Equal(t, map[string]string{"full": "/images/test-hash.jpg"}, result.AvatarURLs)
+				// the previous avatar goes once the new one is set
+				assert.Equal(t, []string{"old.jpg"}, is.Deleted)
+				assert.Equal(t, 1, is.Committed)
+			},
+		},
+		{
+			SaveErr: ErrImageType,
+			Assert: func(result profile.Profile, is *ImageServiceMocker, err error) {
+				assert.ErrorIs(t, err, ErrImageType)
+				assert.Equal(t, 1, is.RolledBack)
+			},
+		},
+		{
+			UpdateErr: errors.New("failed"),
+			Assert: func(result profile.Profile, is *ImageServiceMocker, err error) {
+				assert.Error(t, err)
+				assert.Equal(t, 1, is.RolledBack)
+				assert.Equal(t, 0, is.Committed)
+			},
+		},
+	}
+
+	for _, tr := range td {
+		d := tr
+		rr := &ProfileRepoMocker{
+			SelectProfileByIdMock: func(id string) (profile.Profile, error) {
+				return profile.Profile{Id: "test-id", Username: "test user", AvatarName: "old.jpg"}, nil
+			},
+			UpdateProfileAvatarNameMock: func(id string, avatarName string) error {
+				return d.UpdateErr
+			},
+		}
+		is := &ImageServiceMocker{SaveImageMock: func() error { return d.SaveErr }}
+		rs := NewProfileService(rr, is, &NotificationServiceMocker{}, DefaultUsernamePolicy())
+		result, err := rs.UpdateProfileAvatar("test-id", &multipart.FileHeader{})
+		tr.Assert(result, is, err)
+	}
+}
+
+func Test_ChangeUsername(t *testing.T) {
+	now := time.Date(2022, 3, 2, 12, 0, 0, 0, time.UTC)
+
+	td := []struct {
+		Username   string
+		Changed    time.Time
+		ByUsername func(username string) (profile.Profile, error)
+		ByRedirect func(username string) (profile.Profile, error)
+		ByKey      func(key string) (profile.Profile, error)
+		Assert     func(result profile.Profile, updated string, err error)
+	}{
+		{
+			Username: " new_name ",
+			Assert: func(result profile.Profile, updated string, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, "new_name", updated)
+				assert.Equal(t, "new_name", result.Username)
+				assert.Equal(t, now, result.UsernameChanged)
+			},
+		},
+		{
+			// changed long enough ago
+			Username: "new_name",
+			Changed:  now.Add(-31 * 24 * time.Hour),
+			Assert: func(result profile.Profile, updated string, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, "new_name", updated)
+			},
+		},
+		{
+			Username: "new_name",
+			Changed:  now.Add(-24 * time.Hour),
+			Assert: func(result profile.Profile, updated string, err error) {
+				assert.ErrorIs(t, err, ErrUsernameTooSoon)
+				assert.Equal(t, "", updated)
+			},
+		},
+		{
+			// unchanged usernames are not limited
+			Username: "test_user",
+			Changed:  now.Add(-24 * time.Hour),
+			Assert: func(result profile.Profile, updated string, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, "", updated)
+				assert.Equal(t, "test_user", result.Username)
+			},
+		},
+		{
+			Username: "  ",
+			Assert: func(result profile.Profile, updated string, err error) {
+				assert.ErrorIs(t, err, ErrProfileData)
+			},
+		},
+		{
+			Username: "new name",
+			Assert: func(result profile.Profile, updated string, err error) {
+				assert.ErrorIs(t, err, ErrProfileData)
+				assert.Equal(t, "", updated)
+			},
+		},
+		{
+			Username: "n3w_name",
+			ByKey: func(key string) (profile.Profile, error) {
+				assert.Equal(t, "n3w_name", key)
+				return profile.Profile{Id: "other-id", Username: "N3W_NAME"}, nil
+			},
+			Assert: func(result profile.Profile, updated string, err error) {
+				assert.ErrorIs(t, err, ErrUsernameForbidden)
+			},
+		},
+		{
+			// only the case changes
+			Username: "Test_User",
+			ByUsername: func(username string) (profile.Profile, error) {
+				return profile.Profile{Id: "test-id", Username: "test_user"}, nil
+			},
+			ByKey: func(key string) (profile.Profile, error) {
+				return profile.Profile{Id: "test-id", Username: "test_user"}, nil
+			},
+			Assert: func(result profile.Profile, updated string, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, "Test_User", updated)
+			},
+		},
+		{
+			Username: "taken",
+			ByUsername: func(username string) (profile.Profile, error) {
+				return profile.Profile{Id: "other-id", Username: username}, nil
+			},
+			Assert: func(result profile.Profile, updated string, err error) {
+				assert.ErrorIs(t, err, ErrUsernameForbidden)
+				assert.Equal(t, "", updated)
+			},
+		},
+		{
+			Username: "previously_taken",
+			ByRedirect: func(username string) (profile.Profile, error) {
+				return profile.Profile{Id: "other-id", Username: "renamed"}, nil
+			},
+			Assert: func(result profile.Profile, updated string, err error) {
+				assert.ErrorIs(t, err, ErrUsernameForbidden)
+			},
+		},
+		{
+			// users can go back to a username they had before
+			Username: "old_name",
+			ByRedirect: func(username string) (profile.Profile, error) {
+				return profile.Profile{Id: "test-id", Username: "test_user"}, nil
+			},
+			Assert: func(result profile.Profile, updated string, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, "old_name", updated)
+			},
+		},
+	}
+
+	for _, tr := range td {
+		var updated string
+		d := tr
+		rr := &ProfileRepoMocker{
+			SelectProfileByIdMock: func(id string) (profile.Profile, error) {
+				return profile.Profile{Id: "test-id", Username: "test_user", UsernameChanged: d.Changed}, nil
+			},
+			SelectProfileByUsernameMock: func(username string) (profile.Profile, error) {
+				if d.ByUsername != nil {
+					return d.ByUsername(username)
+				}
+				return profile.Profile{}, sql.ErrNoRows
+			},
+			SelectProfileByRedirectMock: func(username string) (profile.Profile, error) {
+				if d.ByRedirect != nil {
+					return d.ByRedirect(username)
+				}
+				return profile.Profile{}, sql.ErrNoRows
+			},
+			SelectProfileByUsernameKeyMock: func(key string) (profile.Profile, error) {
+				if d.ByKey != nil {
+					return d.ByKey(key)
+				}
+				return profile.Profile{}, sql.ErrNoRows
+			},
+			UpdateProfileUsernameMock: func(id string, username string, key string, changed time.Time) error {
+				assert.Equal(t, profile.UsernameKey(username), key)
+				assert.Equal(t, now, changed)
+				updated = username
+				return nil
+			},
+		}
+		rs := &profileService{rr, &ImageServiceMocker{}, &NotificationServiceMocker{}, DefaultUsernamePolicy(), func() time.Time { return now }}
+		result, err := rs.ChangeUsername("test-id", tr.Username)
+		tr.Assert(result, updated, err)
+	}
+}
+
+func Test_FindProfile(t *testing.T) {
+	rr := &ProfileRepoMocker{
+		SelectProfileByUsernameMock: func(username string) (profile.Profile, error) {
+			if username == "current" {
+				return profile.Profile{Id: "test-id", Username: "current", Bio: "Cooks", AvatarName: "avatar.jpg"}, nil
+			}
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		SelectProfileByRedirectMock: func(username string) (profile.Profile, error) {
+			if username == "previous" {
+				return profile.Profile{Id: "test-id", Username: "current"}, nil
+			}
+			return profile.Profile{}, sql.ErrNoRows
+		},
+		SelectFollowCountsMock: func(id string) (int, int, error) {
+			return 2, 1, nil
+		},
+	}
+	rs := NewProfileService(rr, &ImageServiceMocker{}, &NotificationServiceMocker{}, DefaultUsernamePolicy())
+
+	result, err := rs.FindProfile("current")
+	assert.NoError(t, err)
+	assert.Equal(t, PublicProfile{
+		Username:   "current",
+		Bio:        "Cooks",
+		AvatarURLs: map[string]string{"full": "/images/avatar.jpg"},
+		Followers:  2,
+		Following:  1,
+	}, result)
+
+	result, err = rs.FindProfile("previous")
+	assert.NoError(t, err)
+	assert.Equal(t, "current", result.Username)
+
+	_, err = rs.FindProfile("unknown")
+	assert.ErrorIs(t, err, ErrNoProfile)
+}
+
+func Test_DeleteProfile(t *testing.T) {
+	now := time.Date(2022, 3, 2, 12, 0, 0, 0, time.UTC)
+	var deleteAfter *time.Time
+
+	rr := &ProfileRepoMocker{
+		SelectProfileByIdMock: func(id string) (profile.Profile, error) {
+			return profile.Profile{Id: "test-id", Username: "test user", DeleteAfter: deleteAfter}, nil
+		},
+		UpdateProfileDeleteAfterMock: func(id string, d *time.Time) error {
+			deleteAfter = d
+			return nil
+		},
+	}
+	rs := &profileService{rr, &ImageServiceMocker{}, &NotificationServiceMocker{}, DefaultUsernamePolicy(), func() time.Time { return now }}
+
+	result, err := rs.DeleteProfile("test-id")
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(14*24*time.Hour), *result.DeleteAfter)
+	assert.Equal(t, result.DeleteAfter, deleteAfter)
+
+	// deleting again keeps the original date
+	now = now.Add(time.Hour)
+	result, err = rs.DeleteProfile("test-id")
+	assert.NoError(t, err)
+	assert.Equal(t, deleteAfter, result.DeleteAfter)
+
+	// hidden from other users until it is deleted
+	rr.SelectProfileByUsernameMock = func(username string) (profile.Profile, error) {
+		return profile.Profile{Id: "test-id", Username: "test user", DeleteAfter: deleteAfter}, nil
+	}
+	_, err = rs.FindProfile("test user")
+	assert.ErrorIs(t, err, ErrNoProfile)
+
+	result, err = rs.RestoreProfile("test-id")
+	assert.NoError(t, err)
+	assert.Nil(t, result.DeleteAfter)
+	assert.Nil(t, deleteAfter)
+}
+
+func Test_PurgeProfiles(t *testing.T) {
+	now := time.Date(2022, 3, 2, 12, 0, 0, 0, time.UTC)
+	var deleted []string
+
+	rr := &ProfileRepoMocker{
+		SelectProfilesToDeleteMock: func(before time.Time) ([]profile.Profile, error) {
+			assert.Equal(t, now, before)
+			return []profile.Profile{{Id: "first"}, {Id: "second"}}, nil
+		},
+		SelectProfileImageNamesMock: func(id string) ([]string, error) {
+			return []string{id + "-avatar.jpg", id + "-recipe.jpg"}, nil
+		},
+		DeleteProfileMock: func(id string, at time.Time) error {
+			assert.Equal(t, now, at)
+			deleted = append(deleted, id)
+			if id == "second" {
+				return errors.New("failed")
+			}
+			return nil
+		},
+	}
+	is := &ImageServiceMocker{}
+	rs := &profileService{rr, is, &NotificationServiceMocker{}, DefaultUsernamePolicy(), func() time.Time { return now }}
+
+	n, err := rs.PurgeProfiles()
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"first", "second"}, deleted)
+	// images of the profile that failed to delete are kept
+	assert.Equal(t, []string{"first-avatar.jpg", "first-recipe.jpg", "second-avatar.jpg", "second-recipe.jpg"}, is.Deleted)
+	assert.Equal(t, 1, is.Committed)
+	assert.Equal(t, 1, is.RolledBack)
+}
@@ -0,0 +1,332 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"strings"
+
+	"github.com/eciccone/rh/api/repo/imageref"
+	"github.com/eciccone/rh/api/repo/recipe"
+)
+
+// Adds an image to the gallery of a recipe, or to one of its steps when stepNumber is set.
+// The first gallery image of a recipe becomes its cover.
+// Returns ErrNoRecipe if recipe does not exist.
+// Returns ErrRecipeForbidden if the user can not edit the recipe.
+// Returns ErrRecipeImageData if the step does not exist.
+func (s *recipeService) AddRecipeImage(id int, username string, file *multipart.FileHeader, caption string, stepNumber *int) (recipe.Image, error) {
+	r, err := s.getEditableRecipe(id, username)
+	if err != nil {
+		return recipe.Image{}, err
+	}
+
+	var stepId *int
+	if stepNumber != nil {
+		for _, step := range r.Steps {
+			if step.StepNumber == *stepNumber {
+				id := step.Id
+				stepId = &id
+			}
+		}
+
+		if stepId == nil {
+			return recipe.Image{}, fmt.Errorf("%w: step %d does not exist", ErrRecipeImageData, *stepNumber)
+		}
+	}
+
+	var result recipe.Image
+	err = withImages(s.imageService, func(images ImageUnit) error {
+		name, err := images.Save(file)
+		if err != nil {
+			return err
+		}
+
+		image := recipe.Image{
+			Name:       name,
+			Caption:    strings.TrimSpace(caption),
+			Cover:      stepNumber == nil && len(r.Images) == 0,
+			StepNumber: stepNumber,
+			StepId:     stepId,
+			RecipeId:   id,
+		}
+
+		result, err = s.recipeRepo.InsertRecipeImage(image)
+		if err != nil {
+			return fmt.Errorf("AddRecipeImage failed to insert image: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return recipe.Image{}, err
+	}
+
+	result.URLs = s.recipeImageURLs(r, result.Name)
+
+	return result, nil
+}
+
+// Updates the caption of a recipe image, and makes it the cover when args.Cover is set.
+// Returns ErrNoRecipe if recipe does not exist.
+// Returns ErrRecipeForbidden if the user can not edit the recipe.
+// Returns ErrNoRecipeImage if the image does not belong to the recipe.
+// Returns ErrRecipeImageData if a step image is made the cover.
+func (s *recipeService) EditRecipeImage(id int, username string, args recipe.Image) (recipe.Image, error) {
+	r, err := s.getEditableRecipe(id, username)
+	if err != nil {
+		return recipe.Image{}, err
+	}
+
+	old, err := s.getRecipeImage(r, args.Id)
+	if err != nil {
+		return recipe.Image{}, err
+	}
+
+	if args.Cover && old.StepNumber != nil {
+		return recipe.Image{}, fmt.Errorf("%w: a step image can not be the cover", ErrRecipeImageData)
+	}
+
+	if err := s.recipeRepo.UpdateRecipeImageCaption(old.Id, strings.TrimSpace(args.Caption)); err != nil {
+		return recipe.Image{}, fmt.Errorf("EditRecipeImage failed to update caption: %w", err)
+	}
+
+	if args.Cover && !old.Cover {
+		if err := s.recipeRepo.UpdateRecipeCoverImage(id, old.Id); err != nil {
+			return recipe.Image{}, fmt.Errorf("EditRecipeImage failed to update cover: %w", err)
+		}
+	}
+
+	return s.getRecipeImage(r, old.Id)
+}
+
+// Orders the images of a recipe, imageIds must list every image of the recipe once.
+// Returns ErrNoRecipe if recipe does not exist.
+// Returns ErrRecipeForbidden if the user can not edit the recipe.
+// Returns ErrRecipeImageData if imageIds do not match the images of the recipe.
+func (s *recipeService) ReorderRecipeImages(id int, username string, imageIds []int) ([]recipe.Image, error) {
+	r, err := s.getEditableRecipe(id, username)
+	if err != nil {
+		return nil, err
+	}
+
+	images := allImages(r)
+	if len(imageIds) != len(images) {
+		return nil, fmt.Errorf("%w: order must list every image of the recipe once", ErrRecipeImageData)
+	}
+
+	remaining := map[int]bool{}
+	for _, i := range images {
+		remaining[i.Id] = true
+	}
+	for _, imageId := range imageIds {
+		if !remaining[imageId] {
+			return nil, fmt.Errorf("%w: order must list every image of the recipe once", ErrRecipeImageData)
+		}
+		delete(remaining, imageId)
+	}
+
+	if err := s.recipeRepo.UpdateRecipeImagePositions(id, imageIds); err != nil {
+		return nil, fmt.Errorf("ReorderRecipeImages failed to update positions: %w", err)
+	}
+
+	result, err := s.recipeRepo.SelectRecipeImages(id)
+	if err != nil {
+		return nil, fmt.Errorf("ReorderRecipeImages failed to get images: %w", err)
+	}
+
+	for i := range result {
+		result[i].URLs = s.recipeImageURLs(r, result[i].Name)
+	}
+
+	return result, nil
+}
+
+// Removes an image from a recipe, deleting its file unless another recipe shares it. When the
+// cover is removed the next gallery image becomes the cover.
+// Returns ErrNoRecipe if recipe does not exist.
+// Returns ErrRecipeForbidden if the user can not edit the recipe.
+// Returns ErrNoRecipeImage if the image does not belong to the recipe.
+func (s *recipeService) RemoveRecipeImage(id int, imageId int, username string) error {
+	r, err := s.getEditableRecipe(id, username)
+	if err != nil {
+		return err
+	}
+
+	image, err := s.getRecipeImage(r, imageId)
+	if err != nil {
+		return err
+	}
+
+	if err := s.deleteRecipeImage(image); err != nil {
+		return fmt.Errorf("RemoveRecipeImage failed to remove image: %w", err)
+	}
+
+	if !image.Cover {
+		return nil
+	}
+
+	for _, i := range r.Images {
+		if i.Id != image.Id {
+			if err := s.recipeRepo.UpdateRecipeCoverImage(id, i.Id); err != nil {
+				return fmt.Errorf("RemoveRecipeImage failed to update cover: %w", err)
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+// Gets a recipe that username must be allowed to edit.
+// Returns ErrNoRecipe if recipe does not exist.
+// Returns ErrRecipeForbidden if the user can not edit the recipe.
+func (s *recipeService) getEditableRecipe(id int, username string) (recipe.Recipe, error) {
+	r, err := s.GetRecipe(id)
+	if err != nil {
+		return recipe.Recipe{}, err
+	}
+
+	ok, err := s.canEdit(r, username)
+	if err != nil {
+		return recipe.Recipe{}, err
+	}
+
+	if !ok {
+		return recipe.Recipe{}, ErrRecipeForbidden
+	}
+
+	return r, nil
+}
+
+// Gets an image that must belong to the recipe.
+// Returns ErrNoRecipeImage if it does not.
+func (s *recipeService) getRecipeImage(r recipe.Recipe, imageId int) (recipe.Image, error) {
+	image, err := s.recipeRepo.SelectRecipeImage(imageId)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && image.RecipeId != r.Id) {
+		return recipe.Image{}, ErrNoRecipeImage
+	}
+	if err != nil {
+		return recipe.Image{}, fmt.Errorf("getRecipeImage failed to get image: %w", err)
+	}
+
+	image.URLs = s.recipeImageURLs(r, image.Name)
+
+	return image, nil
+}
+
+// Returns the urls of an image of a recipe. Only images of public recipes may have urls that
+// never expire, e.g. when images are served from a CDN.
+func (s *recipeService) recipeImageURLs(r recipe.Recipe, filename string) map[string]string {
+	if publicRecipe(r) {
+		return s.imageService.ImageURLs(filename)
+	}
+
+	return s.imageService.PrivateImageURLs(filename)
+}
+
+// Deletes the database row of a recipe image, and its file unless another recipe shares it.
+func (s *recipeService) deleteRecipeImage(image recipe.Image) error {
+	return withImages(s.imageService, func(images ImageUnit) error {
+		if err := images.Delete(image.Name); err != nil {
+			return err
+		}
+
+		return s.recipeRepo.DeleteRecipeImage(image.Id)
+	})
+}
+
+// Sets the rendition urls and placeholders of the recipes' images and of their gallery and step
+// images, looking the placeholders up all at once.
+func (s *recipeService) withImageDetails(recipes ...*recipe.Recipe) error {
+	var names []string
+	for _, r := range recipes {
+		if r.ImageName != "" {
+			names = append(names, r.ImageName)
+		}
+		for _, i := range allImages(*r) {
+			names = append(names, i.Name)
+		}
+	}
+
+	placeholders, err := s.imageService.Placeholders(names)
+	if err != nil {
+		return err
+	}
+
+	placeholder := func(name string) *imageref.Placeholder {
+		if p, ok := placeholders[name]; ok {
+			return &p
+		}
+		return nil
+	}
+
+	for _, r := range recipes {
+		r.ImageURLs = s.recipeImageURLs(*r, r.ImageName)
+		r.ImagePlaceholder = placeholder(r.ImageName)
+
+		for i := range r.Images {
+			r.Images[i].URLs = s.recipeImageURLs(*r, r.Images[i].Name)
+			r.Images[i].Placeholder = placeholder(r.Images[i].Name)
+		}
+
+		for j := range r.Steps {
+			for i := range r.Steps[j].Images {
+				r.Steps[j].Images[i].URLs = s.recipeImageURLs(*r, r.Steps[j].Images[i].Name)
+				r.Steps[j].Images[i].Placeholder = placeholder(r.Steps[j].Images[i].Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Opens an image file of a recipe, or one of its renditions, for a url returned with the
+// recipe. Images of public recipes are served to anyone, any other image, including those of
+// private recipes and avatars, only for a url that is signed and has not expired.
+// Returns ErrNoRecipeImage if the file does not exist.
+// Returns ErrImageURL if the image is not public and the url is not valid.
+func (s *recipeService) OpenRecipeImage(filename string, expires string, signature string) (io.ReadCloser, error) {
+	public := false
+
+	id, err := s.recipeRepo.SelectRecipeIdByImageName(OriginalName(filename))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("OpenRecipeImage failed to get recipe: %w", err)
+	}
+
+	if err == nil {
+		r, err := s.GetRecipe(id)
+		if err != nil && !errors.Is(err, ErrNoRecipe) {
+			return nil, err
+		}
+		public = err == nil && publicRecipe(r)
+	}
+
+	if !public {
+		if err := s.imageService.VerifyImageURL(filename, expires, signature); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := s.imageService.OpenImage(filename)
+	if errors.Is(err, ErrNoImage) {
+		return nil, ErrNoRecipeImage
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Returns the gallery images of a recipe followed by the images of its steps.
+func allImages(r recipe.Recipe) []recipe.Image {
+	result := append([]recipe.Image{}, r.Images...)
+	for _, step := range r.Steps {
+		result = append(result, step.Images...)
+	}
+
+	return result
+}
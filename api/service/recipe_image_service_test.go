@@ -0,0 +1,327 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"mime/multipart"
+	"strings"
+	"testing"
+
+	"github.com/eciccone/rh/api/repo/recipe"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AddRecipeImage(t *testing.T) {
+	stepNumber, missingStep := 1, 2
+
+	td := []struct {
+		StepNumber *int
+		SelectFn   func(id int) (recipe.Recipe, error)
+		SaveImgFn  func() error
+		Assert     func(inserted recipe.Image, err error)
+	}{
+		{
+			SelectFn: func(id int) (recipe.Recipe, error) {
+				return recipe.Recipe{Id: 1, Username: "Test User"}, nil
+			},
+			SaveImgFn: func() error {
+				return nil
+			},
+			Assert: func(inserted recipe.Image, err error) {
+				assert.NoError(t, err)
+				assert.True(t, inserted.Cover)
+				assert.Equal(t, "Plated", inserted.Caption)
+			},
+		},
+		{
+			SelectFn: func(id int) (recipe.Recipe, error) {
+				return recipe.Recipe{Id: 1, Username: "Test User", Images: []recipe.Image{{Id: 1, Cover: true}}}, nil
+			},
+			SaveImgFn: func() error {
+				return nil
+			},
+			Assert: func(inserted recipe.Image, err error) {
+				assert.NoError(t, err)
+				assert.False(t, inserted.Cover)
+			},
+		},
+		{
+			StepNumber: &stepNumber,
+			SelectFn: func(id int) (recipe.Recipe, error) {
+				return recipe.Recipe{Id: 1, Username: "Test User", Steps: []recipe.Step{{Id: 7, StepNumber: 1}}}, nil
+			},
+			SaveImgFn: func() error {
+				return nil
+			},
+			Assert: func(inserted recipe.Image, err error) {
+				assert.NoError(t, err)
+				assert.False(t, inserted.Cover)
+				assert.Equal(t, &stepNumber, inserted.StepNumber)
+				if assert.NotNil(t, inserted.StepId) {
+					assert.Equal(t, 7, *inserted.StepId)
+				}
+			},
+		},
+		{
+			StepNumber: &missingStep,
+			SelectFn: func(id int) (recipe.Recipe, error) {
+				return recipe.Recipe{Id: 1, Username: "Test User", Steps: []recipe.Step{{StepNumber: 1}}}, nil
+			},
+			Assert: func(inserted recipe.Image, err error) {
+				assert.ErrorIs(t, err, ErrRecipeImageData)
+			},
+		},
+		{
+			SelectFn: func(id int) (recipe.Recipe, error) {
+				return recipe.Recipe{Id: 1, Username: "Test User 1"}, nil
+			},
+			Assert: func(inserted recipe.Image, err error) {
+				assert.ErrorIs(t, err, ErrRecipeForbidden)
+			},
+		},
+		{
+			SelectFn: func(id int) (recipe.Recipe, error) {
+				return recipe.Recipe{Id: 1, Username: "Test User"}, nil
+			},
+			SaveImgFn: func() error {
+				return errors.New("failed")
+			},
+			Assert: func(inserted recipe.Image, err error) {
+				assert.Error(t, err)
+				assert.Equal(t, recipe.Image{}, inserted)
+			},
+		},
+	}
+
+	for _, tr := range td {
+		var inserted recipe.Image
+		rr := &RecipeRepoMocker{
+			SelectRecipeGrantRoleMock: noGrants,
+			SelectRecipeByIdMock:      tr.SelectFn,
+			InsertRecipeImageMock: func(image recipe.Image) (recipe.Image, error) {
+				inserted = image
+				return image, nil
+			},
+		}
+		rs := NewRecipeService(rr, &ImageServiceMocker{SaveImageMock: tr.SaveImgFn})
+		_, err := rs.AddRecipeImage(1, "Test User", &multipart.FileHeader{Filename: "test.png"}, " Plated ", tr.StepNumber)
+		tr.Assert(inserted, err)
+	}
+}
+
+func Test_ReorderRecipeImages(t *testing.T) {
+	stepNumber := 1
+
+	rr := &RecipeRepoMocker{
+		SelectRecipeByIdMock: func(id int) (recipe.Recipe, error) {
+			return recipe.Recipe{
+				Id:       1,
+				Username: "Test User",
+				Images:   []recipe.Image{{Id: 1}, {Id: 2}},
+				Steps:    []recipe.Step{{StepNumber: 1, Images: []recipe.Image{{Id: 3, StepNumber: &stepNumber}}}},
+			}, nil
+		},
+		UpdateRecipeImagePositionsMock: func(recipeId int, imageIds []int) error {
+			return nil
+		},
+		SelectRecipeImagesMock: func(recipeId int) ([]recipe.Image, error) {
+			return []recipe.Image{{Id: 2}, {Id: 1}, {Id: 3, StepNumber: &stepNumber}}, nil
+		},
+	}
+	rs := NewRecipeService(rr, &ImageServiceMocker{})
+
+	result, err := rs.ReorderRecipeImages(1, "Test User", []int{2, 1, 3})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result[0].Id)
+
+	_, err = rs.ReorderRecipeImages(1, "Test User", []int{2, 1})
+	assert.ErrorIs(t, err, ErrRecipeImageData)
+
+	_, err = rs.ReorderRecipeImages(1, "Test User", []int{2, 2, 3})
+	assert.ErrorIs(t, err, ErrRecipeImageData)
+}
+
+func Test_RemoveRecipeImage(t *testing.T) {
+	td := []struct {
+		ImageId     int
+		SelectImgFn func(id int) (recipe.Image, error)
+		CoverId     int
+		Assert      func(coverId int, err error)
+	}{
+		{
+			ImageId: 1,
+			SelectImgFn: func(id int) (recipe.Image, error) {
+				return recipe.Image{Id: 1, Name: "cover.png", Cover: true, RecipeId: 1}, nil
+			},
+			Assert: func(coverId int, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, 2, coverId)
+			},
+		},
+		{
+			ImageId: 2,
+			SelectImgFn: func(id int) (recipe.Image, error) {
+				return recipe.Image{Id: 2, Name: "other.png", RecipeId: 1}, nil
+			},
+			Assert: func(coverId int, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, 0, coverId)
+			},
+		},
+		{
+			ImageId: 5,
+			SelectImgFn: func(id int) (recipe.Image, error) {
+				return recipe.Image{Id: 5, Name: "foreign.png", RecipeId: 9}, nil
+			},
+			Assert: func(coverId int, err error) {
+				assert.ErrorIs(t, err, ErrNoRecipeImage)
+			},
+		},
+		{
+			ImageId: 6,
+			SelectImgFn: func(id int) (recipe.Image, error) {
+				return recipe.Image{}, sql.ErrNoRows
+			},
+			Assert: func(coverId int, err error) {
+				assert.ErrorIs(t, err, ErrNoRecipeImage)
+			},
+		},
+	}
+
+	for _, tr := range td {
+		var coverId int
+		rr := &RecipeRepoMocker{
+			SelectRecipeByIdMock: func(id int) (recipe.Recipe, error) {
+				return recipe.Recipe{Id: 1, Username: "Test User", Images: []recipe.Image{{Id: 1, Cover: true}, {Id: 2}}}, nil
+			},
+			SelectRecipeImageMock: tr.SelectImgFn,
+			DeleteRecipeImageMock: func(id int) error {
+				return nil
+			},
+			UpdateRecipeCoverImageMock: func(recipeId int, imageId int) error {
+				coverId = imageId
+				return nil
+			},
+		}
+		rs := NewRecipeService(rr, &ImageServiceMocker{})
+		err := rs.RemoveRecipeImage(1, tr.ImageId, "Test User")
+		tr.Assert(coverId, err)
+	}
+}
+
+func Test_RemoveRecipeWithGallery(t *testing.T) {
+	stepNumber := 1
+
+	rr := &RecipeRepoMocker{
+		SelectRecipeByIdMock: func(id int) (recipe.Recipe, error) {
+			return recipe.Recipe{
+				Id:        1,
+				Username:  "Test User",
+				ImageName: "test.file",
+				Images:    []recipe.Image{{Id: 1, Name: "gallery.png"}},
+				Steps:     []recipe.Step{{StepNumber: 1, Images: []recipe.Image{{Id: 2, Name: "step.png", StepNumber: &stepNumber}}}},
+			}, nil
+		},
+		DeleteRecipeMock: func(id int) error {
+			return nil
+		},
+	}
+	is := &ImageServiceMocker{}
+	rs := NewRecipeService(rr, is)
+
+	err := rs.RemoveRecipe(1, "Test User")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test.file", "gallery.png", "step.png"}, is.Deleted)
+	assert.Equal(t, 1, is.Committed)
+}
+
+func Test_OpenRecipeImage(t *testing.T) {
+	td := []struct {
+		Filename   string
+		Visibility string
+		SelectErr  error
+		VerifyErr  error
+		OpenErr    error
+		Assert     func(selected string, err error)
+	}{
+		{
+			Filename:   "abc_thumb.jpg",
+			Visibility: "private",
+			Assert: func(selected string, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, "abc.jpg", selected)
+			},
+		},
+		{
+			Filename:   "abc.jpg",
+			Visibility: "private",
+			VerifyErr:  ErrImageURL,
+			Assert: func(selected string, err error) {
+				assert.ErrorIs(t, err, ErrImageURL)
+			},
+		},
+		{
+			// public images do not need a signed url
+			Filename:   "abc.jpg",
+			Visibility: "public",
+			VerifyErr:  ErrImageURL,
+			Assert: func(selected string, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			// avatars belong to no recipe and are served for signed urls
+			Filename:  "avatar.jpg",
+			SelectErr: sql.ErrNoRows,
+			Assert: func(selected string, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			Filename:  "avatar.jpg",
+			SelectErr: sql.ErrNoRows,
+			VerifyErr: ErrImageURL,
+			Assert: func(selected string, err error) {
+				assert.ErrorIs(t, err, ErrImageURL)
+			},
+		},
+		{
+			Filename:  "missing.jpg",
+			SelectErr: sql.ErrNoRows,
+			OpenErr:   ErrNoImage,
+			Assert: func(selected string, err error) {
+				assert.ErrorIs(t, err, ErrNoRecipeImage)
+			},
+		},
+	}
+
+	for _, tr := range td {
+		var selected string
+		d := tr
+		rr := &RecipeRepoMocker{
+			SelectRecipeIdByImageNameMock: func(imageName string) (int, error) {
+				selected = imageName
+				return 1, d.SelectErr
+			},
+			SelectRecipeByIdMock: func(id int) (recipe.Recipe, error) {
+				return recipe.Recipe{Id: 1, Username: "Test User", Visibility: d.Visibility}, nil
+			},
+		}
+		is := &ImageServiceMocker{
+			OpenImageMock: func(filename string) (io.ReadCloser, error) {
+				if d.OpenErr != nil {
+					return nil, d.OpenErr
+				}
+				return io.NopCloser(strings.NewReader("image")), nil
+			},
+			VerifyImageURLMock: func(filename string, expires string, signature string) error {
+				return d.VerifyErr
+			},
+		}
+		rs := NewRecipeService(rr, is)
+		_, err := rs.OpenRecipeImage(tr.Filename, "1700000000", "signature")
+		tr.Assert(selected, err)
+	}
+}
@@ -4,12 +4,13 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"io"
 	"mime/multipart"
-	"os"
-	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/eciccone/rh/api/repo/recipe"
-	"github.com/google/uuid"
 )
 
 var (
@@ -17,32 +18,164 @@ var (
 	ErrIngredientData  = errors.New("must provide name, amount, and unit for ingredient")
 	ErrNoRecipe        = errors.New("recipe not found")
 	ErrRecipeForbidden = errors.New("recipe access not allowed")
+	ErrSubrecipeData   = errors.New("sub-recipe must be an existing recipe you can view")
+	ErrSubrecipeCycle  = errors.New("sub-recipe can not reference the recipe it is used in")
+	ErrRecipeMetadata  = errors.New("invalid recipe metadata")
+	ErrRecipeQuery     = errors.New("invalid recipe query")
+	ErrNoRecipeImage   = errors.New("recipe image not found")
+	ErrRecipeImageData = errors.New("invalid recipe image")
+	ErrRecipeShareData = errors.New("invalid recipe collaborator")
+	ErrNoCollaborator  = errors.New("collaborator not found")
 )
 
+var difficulties = map[string]bool{"easy": true, "medium": true, "hard": true}
+
+var temperatureUnits = map[string]bool{"C": true, "F": true}
+
+const (
+	VisibilityPrivate = "private"
+	VisibilityPublic  = "public"
+)
+
+var visibilities = map[string]bool{VisibilityPrivate: true, VisibilityPublic: true}
+
+// roles a recipe is shared with other profiles as
+const (
+	RecipeViewer = "viewer"
+	RecipeEditor = "editor"
+)
+
+var recipeRoles = map[string]bool{RecipeViewer: true, RecipeEditor: true}
+
+// orderings a page of recipes can be sorted by, keyed by the name clients use
+var recipeOrders = map[string]string{
+	"":           "id desc",
+	"newest":     "id desc",
+	"oldest":     "id asc",
+	"name":       "name asc, id desc",
+	"total_time": "totalseconds = 0, totalseconds asc, id desc",
+	"difficulty": "CASE difficulty WHEN 'easy' THEN 1 WHEN 'medium' THEN 2 WHEN 'hard' THEN 3 ELSE 4 END, id desc",
+}
+
 type RecipeService interface {
-	// Creates a new recipe.
+	// Creates a new recipe, in a group of the user when it has one.
 	// Returns ErrRecipeData if recipe name is empty.
+	// Returns ErrRecipeMetadata if timing, difficulty or step metadata is invalid.
+	// Returns ErrSubrecipeData if an ingredient references a recipe the user can not view.
+	// Returns ErrNoGroup if the user is not in the group.
 	CreateRecipe(recipe.Recipe) (recipe.Recipe, error)
 
 	// Gets a recipe by id.
 	// Returns ErrNoRecipe if recipe does not exist.
 	GetRecipe(id int) (recipe.Recipe, error)
 
-	// Gets a page of recipes given the username, order (defaults to id desc), offset and limit.
-	GetRecipesForUsername(username string, orderBy string, offset int, limit int) (UsernameRecipePage, error)
+	// Gets a recipe by id if the user can view it, because it is theirs or it is public.
+	// Returns ErrNoRecipe if recipe does not exist.
+	// Returns ErrRecipeForbidden if the user can not view the recipe.
+	GetRecipeForUsername(id int, username string) (recipe.Recipe, error)
+
+	// Gets a recipe by id with every sub-recipe the user can view expanded, recursively.
+	// Returns ErrNoRecipe if recipe does not exist.
+	// Returns ErrRecipeForbidden if the user can not view the recipe.
+	GetRecipeWithSubrecipes(id int, username string) (recipe.Recipe, error)
+
+	// Gets a page of recipes given the username, filter, order (defaults to newest), offset and limit.
+	// When filter has a group the page has the recipes of the group instead.
+	// Returns ErrRecipeQuery if the order or filter is invalid.
+	// Returns ErrNoGroup if the user is not in the group.
+	GetRecipesForUsername(username string, filter recipe.Filter, orderBy string, offset int, limit int) (UsernameRecipePage, error)
 
 	// Updates a recipe.
 	// Returns ErrRecipeData if recipe name is empty.
+	// Returns ErrRecipeMetadata if timing, difficulty or step metadata is invalid.
 	// Returns ErrNoRecipe if recipe does not exist.
-	// Returns ErrRecipeForbidden if recipe does not belong to user.
+	// Returns ErrRecipeForbidden if the user can not edit the recipe.
+	// Returns ErrSubrecipeData if an ingredient references a recipe the user can not view.
+	// Returns ErrSubrecipeCycle if a sub-recipe leads back to the recipe.
+	// Returns ErrNoGroup if the owner moves the recipe to a group they are not in.
 	UpdateRecipe(args recipe.Recipe) (recipe.Recipe, error)
 
+	// Stores an image for a recipe, replacing its current image. Returns the filename of the
+	// image.
+	// Returns ErrNoRecipe if recipe does not exist.
+	// Returns ErrRecipeForbidden if the user can not edit the recipe.
 	UpdateRecipeImage(id int, username string, file *multipart.FileHeader) (string, error)
 
-	// Removes a recipe.
+	// Returns expiring urls of every rendition of a recipe image, keyed by rendition name.
+	ImageURLs(filename string) map[string]string
+
+	// Removes a recipe along with the images no other recipe shares. Only its owner can remove
+	// it, or the owners of its group when it is in one.
 	// Returns ErrNoRecipe if recipe does not exist.
-	// Returns ErrRecipeForbidden if recipe does not belong to user.
+	// Returns ErrRecipeForbidden if the user can not remove the recipe.
 	RemoveRecipe(id int, username string) error
+
+	// Adds an image to the gallery of a recipe, or to one of its steps when stepNumber is set.
+	// The first gallery image of a recipe becomes its cover.
+	// Returns ErrNoRecipe if recipe does not exist.
+	// Returns ErrRecipeForbidden if the user can not edit the recipe.
+	// Returns ErrRecipeImageData if the step does not exist.
+	AddRecipeImage(id int, username string, file *multipart.FileHeader, caption string, stepNumber *int) (recipe.Image, error)
+
+	// Updates the caption of a recipe image, and makes it the cover when args.Cover is set.
+	// Returns ErrNoRecipe if recipe does not exist.
+	// Returns ErrRecipeForbidden if the user can not edit the recipe.
+	// Returns ErrNoRecipeImage if the image does not belong to the recipe.
+	// Returns ErrRecipeImageData if a step image is made the cover.
+	EditRecipeImage(id int, username string, args recipe.Image) (recipe.Image, error)
+
+	// Orders the images of a recipe, imageIds must list every image of the recipe once.
+	// Returns ErrNoRecipe if recipe does not exist.
+	// Returns ErrRecipeForbidden if the user can not edit the recipe.
+	// Returns ErrRecipeImageData if imageIds do not match the images of the recipe.
+	ReorderRecipeImages(id int, username string, imageIds []int) ([]recipe.Image, error)
+
+	// Removes an image from a recipe, deleting its file unless another recipe shares it.
+	// Returns ErrNoRecipe if recipe does not exist.
+	// Returns ErrRecipeForbidden if the user can not edit the recipe.
+	// Returns ErrNoRecipeImage if the image does not belong to the recipe.
+	RemoveRecipeImage(id int, imageId int, username string) error
+
+	// Opens an image file of a recipe, or one of its renditions, for a url returned with the
+	// recipe. Images of public recipes are served to anyone, any other image, including those
+	// of private recipes and avatars, only for a url that is signed and has not expired.
+	// Returns ErrNoRecipeImage if the file does not exist.
+	// Returns ErrImageURL if the image is not public and the url is not valid.
+	OpenRecipeImage(filename string, expires string, signature string) (io.ReadCloser, error)
+
+	// Gets a page of the public recipes of the profiles a profile follows, most recently
+	// published first. The page starts after cursor, a cursor returned with the previous page,
+	// or at the most recent recipe when it is empty.
+	// Returns ErrRecipeQuery if the cursor is invalid.
+	GetFeed(profileId string, cursor string, limit int) (FeedPage, error)
+
+	// Gets the profiles a recipe is shared with, only its owner and they can see them.
+	// Returns ErrNoRecipe if recipe does not exist.
+	// Returns ErrRecipeForbidden if the user is not the owner or a collaborator.
+	GetCollaborators(id int, username string) ([]recipe.Collaborator, error)
+
+	// Shares a recipe with the profile with collaborator as its username as a viewer or editor,
+	// or changes the role it is shared with them as. Returns every collaborator.
+	// Returns ErrNoRecipe if recipe does not exist.
+	// Returns ErrRecipeForbidden if the user is not the owner.
+	// Returns ErrRecipeShareData if role is unknown or collaborator is the owner.
+	// Returns ErrNoProfile if no profile has the username.
+	ShareRecipe(id int, username string, collaborator string, role string) ([]recipe.Collaborator, error)
+
+	// Stops sharing a recipe with a collaborator. The owner can remove anyone, collaborators can
+	// only remove themselves.
+	// Returns ErrNoRecipe if recipe does not exist.
+	// Returns ErrRecipeForbidden if the user is neither the owner nor the collaborator.
+	// Returns ErrNoCollaborator if the recipe is not shared with collaborator.
+	UnshareRecipe(id int, username string, collaborator string) error
+
+	// Gives a recipe to the profile with owner as its username. The previous owner keeps it
+	// shared with them as an editor.
+	// Returns ErrNoRecipe if recipe does not exist.
+	// Returns ErrRecipeForbidden if the user is not the owner.
+	// Returns ErrRecipeShareData if owner already owns the recipe.
+	// Returns ErrNoProfile if no profile has the username.
+	TransferRecipe(id int, username string, owner string) (recipe.Recipe, error)
 }
 
 type recipeService struct {
@@ -54,17 +187,39 @@ func NewRecipeService(recipeRepo recipe.RecipeRepository, imageService ImageServ
 	return &recipeService{recipeRepo, imageService}
 }
 
-// Creates a new recipe.
+// Creates a new recipe, in a group of the user when it has one.
 // Returns ErrRecipeData if recipe name is empty.
+// Returns ErrRecipeMetadata if timing, difficulty or step metadata is invalid.
+// Returns ErrSubrecipeData if an ingredient references a recipe the user can not view.
+// Returns ErrNoGroup if the user is not in the group.
 func (s *recipeService) CreateRecipe(args recipe.Recipe) (recipe.Recipe, error) {
 	if args.Name == "" {
 		return recipe.Recipe{}, ErrRecipeData
 	}
 
-	for i := range args.Steps {
-		args.Steps[i].StepNumber = i + 1
+	if err := normalizeMetadata(&args); err != nil {
+		return recipe.Recipe{}, err
 	}
 
+	if args.Visibility == "" {
+		args.Visibility = VisibilityPrivate
+	}
+
+	if args.GroupId != nil && *args.GroupId == 0 {
+		args.GroupId = nil
+	}
+
+	if err := s.checkGroup(args.GroupId, args.Username); err != nil {
+		return recipe.Recipe{}, err
+	}
+
+	if err := s.checkSubrecipes(args); err != nil {
+		return recipe.Recipe{}, err
+	}
+
+	orderIngredients(args.Ingredients)
+	orderSteps(args.Steps)
+
 	result, err := s.recipeRepo.InsertRecipe(args)
 	if err != nil {
 		return recipe.Recipe{}, fmt.Errorf("CreateRecipe failed to create recipe: %w", err)
@@ -85,9 +240,88 @@ func (s *recipeService) GetRecipe(id int) (recipe.Recipe, error) {
 		return recipe.Recipe{}, fmt.Errorf("GetRecipe failed to get recipe: %w", err)
 	}
 
+	if err := s.withImageDetails(&result); err != nil {
+		return recipe.Recipe{}, fmt.Errorf("GetRecipe failed to get image details: %w", err)
+	}
+
+	return result, nil
+}
+
+// Gets a recipe by id if the user can view it, because it is theirs or it is public.
+// Returns ErrNoRecipe if recipe does not exist.
+// Returns ErrRecipeForbidden if the user can not view the recipe.
+func (s *recipeService) GetRecipeForUsername(id int, username string) (recipe.Recipe, error) {
+	result, err := s.GetRecipe(id)
+	if err != nil {
+		return recipe.Recipe{}, err
+	}
+
+	ok, err := s.canView(result, username)
+	if err != nil {
+		return recipe.Recipe{}, err
+	}
+
+	if !ok {
+		return recipe.Recipe{}, ErrRecipeForbidden
+	}
+
+	return result, nil
+}
+
+// Gets a recipe by id with every sub-recipe the user can view expanded, recursively.
+// Returns ErrNoRecipe if recipe does not exist.
+// Returns ErrRecipeForbidden if the user can not view the recipe.
+func (s *recipeService) GetRecipeWithSubrecipes(id int, username string) (recipe.Recipe, error) {
+	result, err := s.GetRecipeForUsername(id, username)
+	if err != nil {
+		return recipe.Recipe{}, err
+	}
+
+	if err := s.expandSubrecipes(&result, username, map[int]bool{result.Id: true}); err != nil {
+		return recipe.Recipe{}, fmt.Errorf("GetRecipeWithSubrecipes failed to expand sub-recipes: %w", err)
+	}
+
 	return result, nil
 }
 
+// Expands the sub-recipes of r in place. Recipes already on the current path are skipped so
+// a cycle that made it into the database can not recurse forever.
+func (s *recipeService) expandSubrecipes(r *recipe.Recipe, username string, path map[int]bool) error {
+	for i := range r.Ingredients {
+		ing := &r.Ingredients[i]
+		if ing.SubrecipeId == nil || path[*ing.SubrecipeId] {
+			continue
+		}
+
+		sub, err := s.GetRecipe(*ing.SubrecipeId)
+		if errors.Is(err, ErrNoRecipe) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		ok, err := s.canView(sub, username)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		path[sub.Id] = true
+		if err := s.expandSubrecipes(&sub, username, path); err != nil {
+			return err
+		}
+		delete(path, sub.Id)
+
+		ing.Subrecipe = &sub
+	}
+
+	return nil
+}
+
 type UsernameRecipePage struct {
 	Recipes []recipe.Recipe `json:"recipes"`
 	Offset  int             `json:"offset"`
@@ -95,10 +329,29 @@ type UsernameRecipePage struct {
 	Total   int             `json:"total"`
 }
 
-// Gets a page of recipes given the username, order (defaults to id desc), offset and limit.
-func (s *recipeService) GetRecipesForUsername(username string, orderBy string, offset int, limit int) (UsernameRecipePage, error) {
-	if orderBy == "" {
-		orderBy = "id desc"
+// Gets a page of recipes given the username, filter, order (defaults to newest), offset and limit.
+// When filter has a group the page has the recipes of the group instead.
+// Returns ErrRecipeQuery if the order or filter is invalid.
+// Returns ErrNoGroup if the user is not in the group.
+func (s *recipeService) GetRecipesForUsername(username string, filter recipe.Filter, orderBy string, offset int, limit int) (UsernameRecipePage, error) {
+	order, ok := recipeOrders[orderBy]
+	if !ok {
+		return UsernameRecipePage{}, fmt.Errorf("%w: unknown sort %q", ErrRecipeQuery, orderBy)
+	}
+
+	filter.Difficulty = strings.ToLower(filter.Difficulty)
+	if filter.Difficulty != "" && !difficulties[filter.Difficulty] {
+		return UsernameRecipePage{}, fmt.Errorf("%w: difficulty must be easy, medium or hard", ErrRecipeQuery)
+	}
+
+	if filter.Group < 0 {
+		return UsernameRecipePage{}, fmt.Errorf("%w: unknown group", ErrRecipeQuery)
+	}
+
+	if filter.Group > 0 {
+		if err := s.checkGroup(&filter.Group, username); err != nil {
+			return UsernameRecipePage{}, err
+		}
 	}
 
 	if offset < 0 {
@@ -109,12 +362,20 @@ func (s *recipeService) GetRecipesForUsername(username string, orderBy string, o
 		limit = 10
 	}
 
-	recipes, err := s.recipeRepo.SelectRecipesByUsername(username, orderBy, offset, limit)
+	recipes, err := s.recipeRepo.SelectRecipesByUsername(username, filter, order, offset, limit)
 	if err != nil {
 		return UsernameRecipePage{}, fmt.Errorf("GetRecipesForUsername failed to get recipes for username: %w", err)
 	}
 
-	total, err := s.recipeRepo.SelectRecipeCountByUsername(username)
+	page := make([]*recipe.Recipe, len(recipes))
+	for i := range recipes {
+		page[i] = &recipes[i]
+	}
+	if err := s.withImageDetails(page...); err != nil {
+		return UsernameRecipePage{}, fmt.Errorf("GetRecipesForUsername failed to get image details: %w", err)
+	}
+
+	total, err := s.recipeRepo.SelectRecipeCountByUsername(username, filter)
 	if err != nil {
 		return UsernameRecipePage{}, fmt.Errorf("GetRecipesForUsername failed to get total recipe count: %w", err)
 	}
@@ -129,41 +390,124 @@ func (s *recipeService) GetRecipesForUsername(username string, orderBy string, o
 
 // Updates a recipe.
 // Returns ErrRecipeData if recipe name is empty.
+// Returns ErrRecipeMetadata if timing, difficulty or step metadata is invalid.
 // Returns ErrNoRecipe if recipe does not exist.
-// Returns ErrRecipeForbidden if recipe does not belong to user.
+// Returns ErrRecipeForbidden if the user can not edit the recipe.
+// Returns ErrSubrecipeData if an ingredient references a recipe the user can not view.
+// Returns ErrSubrecipeCycle if a sub-recipe leads back to the recipe.
+// Returns ErrNoGroup if the owner moves the recipe to a group they are not in.
 func (s *recipeService) UpdateRecipe(args recipe.Recipe) (recipe.Recipe, error) {
 	if args.Name == "" {
 		return recipe.Recipe{}, ErrRecipeData
 	}
 
+	if err := normalizeMetadata(&args); err != nil {
+		return recipe.Recipe{}, err
+	}
+
 	// make sure recipe exists
 	old, err := s.GetRecipe(args.Id)
 	if err != nil {
 		return old, err
 	}
 
-	if old.Username != args.Username {
+	ok, err := s.canEdit(old, args.Username)
+	if err != nil {
+		return recipe.Recipe{}, err
+	}
+
+	if !ok {
 		return recipe.Recipe{}, ErrRecipeForbidden
 	}
 
-	// don't update imagename, seperate func for this
-	args.ImageName = old.ImageName
+	// visibility only changes when it is sent, and only the owner can change it
+	if args.Visibility == "" || args.Username != old.Username {
+		args.Visibility = old.Visibility
+	}
+
+	// sub-recipes must be ones the user editing the recipe can view
+	if err := s.checkSubrecipes(args); err != nil {
+		return recipe.Recipe{}, err
+	}
+
+	// the group only changes when it is sent, 0 taking the recipe out of its group, and only
+	// the owner can change it
+	if args.GroupId == nil || args.Username != old.Username {
+		args.GroupId = old.GroupId
+	} else if *args.GroupId == 0 {
+		args.GroupId = nil
+	} else if !sameGroup(args.GroupId, old.GroupId) {
+		if err := s.checkGroup(args.GroupId, args.Username); err != nil {
+			return recipe.Recipe{}, err
+		}
+	}
+
+	// an editor's changes don't make the recipe theirs
+	args.Username = old.Username
 
+	// don't update imagename or images, seperate funcs for this
+	args.ImageName = old.ImageName
+	args.Images = nil
 	for i := range args.Steps {
-		args.Steps[i].StepNumber = i + 1
+		args.Steps[i].Images = nil
 	}
 
-	result, err := s.recipeRepo.UpdateRecipe(args)
+	orderIngredients(args.Ingredients)
+	orderSteps(args.Steps)
+
+	// the images of steps left out are removed with them
+	kept := map[int]bool{}
+	for _, step := range args.Steps {
+		kept[step.Id] = true
+	}
+
+	var removed []recipe.Image
+	stepImages := map[int][]recipe.Image{}
+	for _, step := range old.Steps {
+		if kept[step.Id] {
+			stepImages[step.Id] = step.Images
+		} else {
+			removed = append(removed, step.Images...)
+		}
+	}
+
+	var result recipe.Recipe
+	err = withImages(s.imageService, func(images ImageUnit) error {
+		for _, i := range removed {
+			if err := images.Delete(i.Name); err != nil {
+				return err
+			}
+		}
+
+		result, err = s.recipeRepo.UpdateRecipe(args)
+		return err
+	})
 	if err != nil {
 		return recipe.Recipe{}, fmt.Errorf("UpdateRecipe failed to update recipe: %w", err)
 	}
 
+	// images stay with the recipe and with their steps, wherever those moved
+	result.Images = old.Images
+	for i := range result.Steps {
+		result.Steps[i].Images = stepImages[result.Steps[i].Id]
+		for j := range result.Steps[i].Images {
+			number := result.Steps[i].StepNumber
+			result.Steps[i].Images[j].StepNumber = &number
+		}
+	}
+
+	// the visibility may have changed, and with it the urls images can have
+	if err := s.withImageDetails(&result); err != nil {
+		return recipe.Recipe{}, fmt.Errorf("UpdateRecipe failed to get image details: %w", err)
+	}
+
 	return result, nil
 }
 
-// Updates and stores a image for a recipe.
+// Stores an image for a recipe, replacing its current image. Returns the filename of the
+// image.
 // Returns ErrNoRecipe if recipe does not exist.
-// Returns ErrRecipeForbidden if recipe does not belong to user.
+// Returns ErrRecipeForbidden if the user can not edit the recipe.
 func (s *recipeService) UpdateRecipeImage(id int, username string, file *multipart.FileHeader) (string, error) {
 	// select recipe by id to make sure it exists
 	r, err := s.GetRecipe(id)
@@ -171,34 +515,46 @@ func (s *recipeService) UpdateRecipeImage(id int, username string, file *multipa
 		return "", err
 	}
 
-	// make sure user deleting the recipe owns the recipe
-	if r.Username != username {
-		return "", ErrRecipeForbidden
+	// make sure user changing the image can edit the recipe
+	ok, err := s.canEdit(r, username)
+	if err != nil {
+		return "", err
 	}
 
-	// if recipe is empty create a unique filename, otherwise reuse the original filename
-	if r.ImageName == "" {
-		filename := uuid.New().String()
-		extension := filepath.Ext(file.Filename)
-		r.ImageName = filename + extension
+	if !ok {
+		return "", ErrRecipeForbidden
 	}
 
-	err = s.imageService.SaveImage(file, os.Getenv("IMAGE_PATH"), r.ImageName)
-	if err != nil {
-		return "", err
-	}
+	var name string
+	err = withImages(s.imageService, func(images ImageUnit) error {
+		name, err = images.Save(file)
+		if err != nil {
+			return err
+		}
+
+		// the previous image is deleted unless another recipe shares it
+		if err := images.Delete(r.ImageName); err != nil {
+			return err
+		}
 
-	err = s.recipeRepo.UpdateRecipeImageName(id, r.ImageName)
+		return s.recipeRepo.UpdateRecipeImageName(id, name)
+	})
 	if err != nil {
 		return "", err
 	}
 
-	return r.ImageName, nil
+	return name, nil
+}
+
+// Returns expiring urls of every rendition of a recipe image, keyed by rendition name.
+func (s *recipeService) ImageURLs(filename string) map[string]string {
+	return s.imageService.PrivateImageURLs(filename)
 }
 
-// Removes a recipe.
+// Removes a recipe along with the images no other recipe shares. Only its owner can remove it,
+// or the owners of its group when it is in one.
 // Returns ErrNoRecipe if recipe does not exist.
-// Returns ErrRecipeForbidden if recipe does not belong to user.
+// Returns ErrRecipeForbidden if the user can not remove the recipe.
 func (s *recipeService) RemoveRecipe(id int, username string) error {
 	// select recipe by id to make sure it exists
 	r, err := s.GetRecipe(id)
@@ -206,22 +562,357 @@ func (s *recipeService) RemoveRecipe(id int, username string) error {
 		return err
 	}
 
-	// make sure user deleting the recipe owns the recipe
-	if r.Username != username {
+	ok, err := s.canRemove(r, username)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
 		return ErrRecipeForbidden
 	}
 
-	if r.ImageName != "" {
-		err := s.imageService.DeleteImage(os.Getenv("IMAGE_PATH"), r.ImageName)
-		if err != nil {
+	return s.removeRecipe(r)
+}
+
+// Removes a recipe along with the images no other recipe shares.
+func (s *recipeService) removeRecipe(r recipe.Recipe) error {
+	return withImages(s.imageService, func(images ImageUnit) error {
+		if err := deleteRecipeImages(images, r); err != nil {
 			return err
 		}
+
+		if err := s.recipeRepo.DeleteRecipe(r.Id); err != nil {
+			return fmt.Errorf("removeRecipe failed to delete recipe: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// Deletes the cover and every other image of a recipe that is about to be deleted. Images other
+// recipes share are kept.
+func deleteRecipeImages(images ImageUnit, r recipe.Recipe) error {
+	if err := images.Delete(r.ImageName); err != nil {
+		return err
 	}
 
-	err = s.recipeRepo.DeleteRecipe(id)
+	for _, i := range allImages(r) {
+		if err := images.Delete(i.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Validates the timing, difficulty, cuisine, course and equipment of a recipe and the duration
+// and temperature of its steps, normalizing them for storage. A missing total time is the sum of
+// the prep and cook times.
+// Returns ErrRecipeMetadata if any of them is invalid.
+func normalizeMetadata(args *recipe.Recipe) error {
+	var prep, cook time.Duration
+	var err error
+
+	if args.PrepTime != "" {
+		if prep, err = recipe.ParseDuration(args.PrepTime); err != nil {
+			return fmt.Errorf("%w: prep_time: %v", ErrRecipeMetadata, err)
+		}
+		args.PrepTime = recipe.FormatDuration(prep)
+	}
+
+	if args.CookTime != "" {
+		if cook, err = recipe.ParseDuration(args.CookTime); err != nil {
+			return fmt.Errorf("%w: cook_time: %v", ErrRecipeMetadata, err)
+		}
+		args.CookTime = recipe.FormatDuration(cook)
+	}
+
+	if args.TotalTime != "" {
+		total, err := recipe.ParseDuration(args.TotalTime)
+		if err != nil {
+			return fmt.Errorf("%w: total_time: %v", ErrRecipeMetadata, err)
+		}
+		if total < prep+cook {
+			return fmt.Errorf("%w: total_time can not be less than prep_time and cook_time combined", ErrRecipeMetadata)
+		}
+		args.TotalTime = recipe.FormatDuration(total)
+	} else if prep+cook > 0 {
+		args.TotalTime = recipe.FormatDuration(prep + cook)
+	}
+
+	args.Difficulty = strings.ToLower(strings.TrimSpace(args.Difficulty))
+	if args.Difficulty != "" && !difficulties[args.Difficulty] {
+		return fmt.Errorf("%w: difficulty must be easy, medium or hard", ErrRecipeMetadata)
+	}
+
+	args.Cuisine = strings.TrimSpace(args.Cuisine)
+	args.Course = strings.TrimSpace(args.Course)
+
+	args.Visibility = strings.ToLower(strings.TrimSpace(args.Visibility))
+	if args.Visibility != "" && !visibilities[args.Visibility] {
+		return fmt.Errorf("%w: visibility must be private or public", ErrRecipeMetadata)
+	}
+
+	var equipment []string
+	for _, e := range args.Equipment {
+		if e = strings.TrimSpace(e); e != "" {
+			equipment = append(equipment, e)
+		}
+	}
+	args.Equipment = equipment
+
+	for i := range args.Steps {
+		step := &args.Steps[i]
+
+		if step.Duration != "" {
+			d, err := recipe.ParseDuration(step.Duration)
+			if err != nil {
+				return fmt.Errorf("%w: step %d duration: %v", ErrRecipeMetadata, i+1, err)
+			}
+			step.Duration = recipe.FormatDuration(d)
+		}
+
+		step.TemperatureUnit = strings.ToUpper(strings.TrimSpace(step.TemperatureUnit))
+		if step.Temperature == 0 {
+			step.TemperatureUnit = ""
+		} else if !temperatureUnits[step.TemperatureUnit] {
+			return fmt.Errorf("%w: step %d temperature_unit must be C or F", ErrRecipeMetadata, i+1)
+		}
+	}
+
+	return nil
+}
+
+// Reports whether anyone can view the recipe.
+func publicRecipe(r recipe.Recipe) bool {
+	return r.Visibility == VisibilityPublic && !r.Hidden && !r.OwnerInactive
+}
+
+// Reports whether username is allowed to view the recipe, because it is theirs, it is public,
+// it is shared with them or it is in a group of theirs. Recipes hidden by moderators, and those
+// of profiles that are suspended or scheduled for deletion, can only be viewed by their owner.
+func (s *recipeService) canView(r recipe.Recipe, username string) (bool, error) {
+	if r.Username == username {
+		return true, nil
+	}
+
+	if r.Hidden || r.OwnerInactive {
+		return false, nil
+	}
+
+	if r.Visibility == VisibilityPublic {
+		return true, nil
+	}
+
+	role, err := s.recipeRepo.SelectRecipeGrantRole(r.Id, username)
+	if err != nil {
+		return false, fmt.Errorf("canView failed to get grant: %w", err)
+	}
+
+	if role != "" {
+		return true, nil
+	}
+
+	groupRole, err := s.groupRole(r.GroupId, username)
 	if err != nil {
-		return fmt.Errorf("RemoveRecipe failed to delete recipe: %w", err)
+		return false, fmt.Errorf("canView failed to get group role: %w", err)
+	}
+
+	return groupRole != "", nil
+}
+
+// Reports whether username is allowed to edit the recipe, because it is theirs, it is shared
+// with them as an editor or it is in a group of theirs.
+func (s *recipeService) canEdit(r recipe.Recipe, username string) (bool, error) {
+	if r.Username == username {
+		return true, nil
+	}
+
+	if r.Hidden {
+		return false, nil
+	}
+
+	role, err := s.recipeRepo.SelectRecipeGrantRole(r.Id, username)
+	if err != nil {
+		return false, fmt.Errorf("canEdit failed to get grant: %w", err)
+	}
+
+	if role == RecipeEditor {
+		return true, nil
+	}
+
+	groupRole, err := s.groupRole(r.GroupId, username)
+	if err != nil {
+		return false, fmt.Errorf("canEdit failed to get group role: %w", err)
+	}
+
+	return groupRole != "", nil
+}
+
+// Reports whether username is allowed to remove the recipe, because it is theirs or it is in a
+// group they own. Editors can change a recipe, but not remove it.
+func (s *recipeService) canRemove(r recipe.Recipe, username string) (bool, error) {
+	if r.Username == username {
+		return true, nil
+	}
+
+	if r.GroupId == nil || r.Hidden {
+		return false, nil
+	}
+
+	groupRole, err := s.groupRole(r.GroupId, username)
+	if err != nil {
+		return false, fmt.Errorf("canRemove failed to get group role: %w", err)
+	}
+
+	return groupRole == GroupOwner, nil
+}
+
+// Gets the role of username in a group, or an empty role when there is no group or they are not
+// in it.
+func (s *recipeService) groupRole(groupId *int, username string) (string, error) {
+	if groupId == nil {
+		return "", nil
+	}
+
+	return s.recipeRepo.SelectGroupRole(*groupId, username)
+}
+
+// Makes sure username is in the group, when there is one.
+// Returns ErrNoGroup if they are not.
+func (s *recipeService) checkGroup(groupId *int, username string) error {
+	role, err := s.groupRole(groupId, username)
+	if err != nil {
+		return fmt.Errorf("checkGroup failed to get group role: %w", err)
+	}
+
+	if groupId != nil && role == "" {
+		return ErrNoGroup
+	}
+
+	return nil
+}
+
+// Reports whether two group ids are the same group, or both no group.
+func sameGroup(a *int, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+// Makes sure every sub-recipe referenced by the ingredients exists, can be viewed by the
+// recipe's user and does not lead back to the recipe being saved.
+// Returns ErrSubrecipeData if a sub-recipe does not exist or can not be viewed.
+// Returns ErrSubrecipeCycle if a sub-recipe leads back to the recipe.
+func (s *recipeService) checkSubrecipes(args recipe.Recipe) error {
+	visited := map[int]bool{}
+
+	for _, i := range args.Ingredients {
+		if i.SubrecipeId == nil {
+			continue
+		}
+
+		sub, err := s.GetRecipe(*i.SubrecipeId)
+		if errors.Is(err, ErrNoRecipe) {
+			return ErrSubrecipeData
+		}
+		if err != nil {
+			return fmt.Errorf("checkSubrecipes failed to get sub-recipe: %w", err)
+		}
+
+		ok, err := s.canView(sub, args.Username)
+		if err != nil {
+			return fmt.Errorf("checkSubrecipes failed to check sub-recipe: %w", err)
+		}
+
+		if !ok {
+			return ErrSubrecipeData
+		}
+
+		// a recipe that has not been created yet can not be referenced by anything
+		if args.Id == 0 {
+			continue
+		}
+
+		if err := s.checkSubrecipeCycle(sub, args.Id, visited); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Walks the sub-recipes of r looking for the recipe with id rootId.
+// Returns ErrSubrecipeCycle if it is found.
+func (s *recipeService) checkSubrecipeCycle(r recipe.Recipe, rootId int, visited map[int]bool) error {
+	if r.Id == rootId {
+		return ErrSubrecipeCycle
+	}
+
+	if visited[r.Id] {
+		return nil
+	}
+	visited[r.Id] = true
+
+	for _, i := range r.Ingredients {
+		if i.SubrecipeId == nil {
+			continue
+		}
+
+		sub, err := s.GetRecipe(*i.SubrecipeId)
+		if errors.Is(err, ErrNoRecipe) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("checkSubrecipeCycle failed to get sub-recipe: %w", err)
+		}
+
+		if err := s.checkSubrecipeCycle(sub, rootId, visited); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
+
+// Keeps ingredients of the same group together, in the order the groups first appear,
+// without changing their order within a group, then assigns their positions.
+func orderIngredients(ingredients []recipe.Ingredient) {
+	first := map[string]int{}
+	for i := range ingredients {
+		ingredients[i].Group = strings.TrimSpace(ingredients[i].Group)
+		if _, ok := first[ingredients[i].Group]; !ok {
+			first[ingredients[i].Group] = i
+		}
+	}
+
+	sort.SliceStable(ingredients, func(a, b int) bool {
+		return first[ingredients[a].Group] < first[ingredients[b].Group]
+	})
+
+	for i := range ingredients {
+		ingredients[i].Position = i + 1
+	}
+}
+
+// Keeps steps of the same section together, in the order the sections first appear,
+// without changing their order within a section, then assigns their step numbers.
+func orderSteps(steps []recipe.Step) {
+	first := map[string]int{}
+	for i := range steps {
+		steps[i].Section = strings.TrimSpace(steps[i].Section)
+		if _, ok := first[steps[i].Section]; !ok {
+			first[steps[i].Section] = i
+		}
+	}
+
+	sort.SliceStable(steps, func(a, b int) bool {
+		return first[steps[a].Section] < first[steps[b].Section]
+	})
+
+	for i := range steps {
+		steps[i].StepNumber = i + 1
+	}
+}
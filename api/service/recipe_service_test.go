@@ -3,34 +3,131 @@ package service
 import (
 	"database/sql"
 	"errors"
+	"io"
 	"mime/multipart"
 	"testing"
+	"time"
 
+	"github.com/eciccone/rh/api/repo/imageref"
 	"github.com/eciccone/rh/api/repo/recipe"
 	"github.com/stretchr/testify/assert"
 )
 
 type ImageServiceMocker struct {
-	SaveImageMock   func() error
-	DeleteImageMock func() error
+	SaveImageMock      func() error
+	DeleteImageMock    func(filename string) error
+	ListImagesMock     func() ([]StoredImage, error)
+	OpenImageMock      func(filename string) (io.ReadCloser, error)
+	VerifyImageURLMock func(filename string, expires string, signature string) error
+	RecoverImagesMock  func(createdBefore time.Time) error
+	PlaceholdersMock   func(filenames []string) (map[string]imageref.Placeholder, error)
+
+	// what units of work did with the images
+	Deleted    []string
+	Committed  int
+	RolledBack int
+}
+
+func (s *ImageServiceMocker) Begin() ImageUnit {
+	return &imageUnitMocker{s}
+}
+
+func (s *ImageServiceMocker) RecoverImages(createdBefore time.Time) error {
+	return s.RecoverImagesMock(createdBefore)
 }
 
-func (s *ImageServiceMocker) SaveImage(file *multipart.FileHeader, path string, filename string) error {
-	return s.SaveImageMock()
+type imageUnitMocker struct {
+	s *ImageServiceMocker
 }
 
-func (s *ImageServiceMocker) DeleteImage(path string, filename string) error {
-	return s.DeleteImageMock()
+func (u *imageUnitMocker) Save(file *multipart.FileHeader) (string, error) {
+	if err := u.s.SaveImageMock(); err != nil {
+		return "", err
+	}
+
+	return "test-hash.jpg", nil
+}
+
+func (u *imageUnitMocker) Delete(filename string) error {
+	if filename != "" {
+		u.s.Deleted = append(u.s.Deleted, filename)
+	}
+	return nil
+}
+
+func (u *imageUnitMocker) Commit() error {
+	u.s.Committed++
+	return nil
+}
+
+func (u *imageUnitMocker) Rollback() error {
+	u.s.RolledBack++
+	return nil
+}
+
+func (s *ImageServiceMocker) DeleteImage(filename string) error {
+	return s.DeleteImageMock(filename)
+}
+
+func (s *ImageServiceMocker) ListImages() ([]StoredImage, error) {
+	return s.ListImagesMock()
+}
+
+func (s *ImageServiceMocker) ImageURLs(filename string) map[string]string {
+	if filename == "" {
+		return nil
+	}
+
+	return map[string]string{"full": "/images/" + filename}
+}
+
+func (s *ImageServiceMocker) PrivateImageURLs(filename string) map[string]string {
+	if filename == "" {
+		return nil
+	}
+
+	return map[string]string{"full": "/images/" + filename + "?private"}
+}
+
+func (s *ImageServiceMocker) Placeholders(filenames []string) (map[string]imageref.Placeholder, error) {
+	if s.PlaceholdersMock != nil {
+		return s.PlaceholdersMock(filenames)
+	}
+
+	return map[string]imageref.Placeholder{}, nil
+}
+
+func (s *ImageServiceMocker) OpenImage(filename string) (io.ReadCloser, error) {
+	return s.OpenImageMock(filename)
+}
+
+func (s *ImageServiceMocker) VerifyImageURL(filename string, expires string, signature string) error {
+	return s.VerifyImageURLMock(filename, expires, signature)
 }
 
 type RecipeRepoMocker struct {
 	InsertRecipeMock                func(recipe recipe.Recipe) (recipe.Recipe, error)
 	SelectRecipeByIdMock            func(id int) (recipe.Recipe, error)
-	SelectRecipesByUsernameMock     func(username string, orderBy string, offset int, limit int) ([]recipe.Recipe, error)
-	SelectRecipeCountByUsernameMock func(username string) (int, error)
+	SelectRecipesByUsernameMock     func(username string, filter recipe.Filter, orderBy string, offset int, limit int) ([]recipe.Recipe, error)
+	SelectRecipeCountByUsernameMock func(username string, filter recipe.Filter) (int, error)
 	UpdateRecipeMock                func(recipe recipe.Recipe) (recipe.Recipe, error)
 	UpdateRecipeImageNameMock       func(id int, imageName string) error
 	DeleteRecipeMock                func(id int) error
+	InsertRecipeImageMock           func(image recipe.Image) (recipe.Image, error)
+	SelectRecipeImageMock           func(id int) (recipe.Image, error)
+	SelectRecipeImagesMock          func(recipeId int) ([]recipe.Image, error)
+	UpdateRecipeImageCaptionMock    func(id int, caption string) error
+	UpdateRecipeCoverImageMock      func(recipeId int, imageId int) error
+	UpdateRecipeImagePositionsMock  func(recipeId int, imageIds []int) error
+	SelectRecipeIdByImageNameMock   func(imageName string) (int, error)
+	DeleteRecipeImageMock           func(id int) error
+	SelectFeedRecipesMock           func(profileId string, after recipe.FeedCursor, limit int) ([]recipe.Recipe, error)
+	SelectRecipeGrantRoleMock       func(recipeId int, username string) (string, error)
+	SelectRecipeGrantsMock          func(recipeId int) ([]recipe.Collaborator, error)
+	UpsertRecipeGrantMock           func(recipeId int, username string, role string, created time.Time) (bool, error)
+	DeleteRecipeGrantMock           func(recipeId int, username string) (bool, error)
+	UpdateRecipeOwnerMock           func(recipeId int, username string, previousRole string, created time.Time) (bool, error)
+	SelectGroupRoleMock             func(groupId int, username string) (string, error)
 }
 
 func (r *RecipeRepoMocker) InsertRecipe(args recipe.Recipe) (recipe.Recipe, error) {
@@ -41,12 +138,12 @@ func (r *RecipeRepoMocker) SelectRecipeById(id int) (recipe.Recipe, error) {
 	return r.SelectRecipeByIdMock(id)
 }
 
-func (r *RecipeRepoMocker) SelectRecipesByUsername(username string, orderBy string, offset int, limit int) ([]recipe.Recipe, error) {
-	return r.SelectRecipesByUsernameMock(username, orderBy, offset, limit)
+func (r *RecipeRepoMocker) SelectRecipesByUsername(username string, filter recipe.Filter, orderBy string, offset int, limit int) ([]recipe.Recipe, error) {
+	return r.SelectRecipesByUsernameMock(username, filter, orderBy, offset, limit)
 }
 
-func (r *RecipeRepoMocker) SelectRecipeCountByUsername(username string) (int, error) {
-	return r.SelectRecipeCountByUsernameMock(username)
+func (r *RecipeRepoMocker) SelectRecipeCountByUsername(username string, filter recipe.Filter) (int, error) {
+	return r.SelectRecipeCountByUsernameMock(username, filter)
 }
 
 func (r *RecipeRepoMocker) UpdateRecipe(args recipe.Recipe) (recipe.Recipe, error) {
@@ -61,6 +158,66 @@ func (r *RecipeRepoMocker) DeleteRecipe(id int) error {
 	return r.DeleteRecipeMock(id)
 }
 
+func (r *RecipeRepoMocker) InsertRecipeImage(image recipe.Image) (recipe.Image, error) {
+	return r.InsertRecipeImageMock(image)
+}
+
+func (r *RecipeRepoMocker) SelectRecipeImage(id int) (recipe.Image, error) {
+	return r.SelectRecipeImageMock(id)
+}
+
+func (r *RecipeRepoMocker) SelectRecipeImages(recipeId int) ([]recipe.Image, error) {
+	return r.SelectRecipeImagesMock(recipeId)
+}
+
+func (r *RecipeRepoMocker) UpdateRecipeImageCaption(id int, caption string) error {
+	return r.UpdateRecipeImageCaptionMock(id, caption)
+}
+
+func (r *RecipeRepoMocker) UpdateRecipeCoverImage(recipeId int, imageId int) error {
+	return r.UpdateRecipeCoverImageMock(recipeId, imageId)
+}
+
+func (r *RecipeRepoMocker) UpdateRecipeImagePositions(recipeId int, imageIds []int) error {
+	return r.UpdateRecipeImagePositionsMock(recipeId, imageIds)
+}
+
+func (r *RecipeRepoMocker) SelectRecipeIdByImageName(imageName string) (int, error) {
+	return r.SelectRecipeIdByImageNameMock(imageName)
+}
+
+func (r *RecipeRepoMocker) DeleteRecipeImage(id int) error {
+	return r.DeleteRecipeImageMock(id)
+}
+
+func (r *RecipeRepoMocker) SelectFeedRecipes(profileId string, after recipe.FeedCursor, limit int) ([]recipe.Recipe, error) {
+	return r.SelectFeedRecipesMock(profileId, after, limit)
+}
+
+func (r *RecipeRepoMocker) SelectRecipeGrantRole(recipeId int, username string) (string, error) {
+	return r.SelectRecipeGrantRoleMock(recipeId, username)
+}
+
+func (r *RecipeRepoMocker) SelectRecipeGrants(recipeId int) ([]recipe.Collaborator, error) {
+	return r.SelectRecipeGrantsMock(recipeId)
+}
+
+func (r *RecipeRepoMocker) UpsertRecipeGrant(recipeId int, username string, role string, created time.Time) (bool, error) {
+	return r.UpsertRecipeGrantMock(recipeId, username, role, created)
+}
+
+func (r *RecipeRepoMocker) DeleteRecipeGrant(recipeId int, username string) (bool, error) {
+	return r.DeleteRecipeGrantMock(recipeId, username)
+}
+
+func (r *RecipeRepoMocker) UpdateRecipeOwner(recipeId int, username string, previousRole string, created time.Time) (bool, error) {
+	return r.UpdateRecipeOwnerMock(recipeId, username, previousRole, created)
+}
+
+func (r *RecipeRepoMocker) SelectGroupRole(groupId int, username string) (string, error) {
+	return r.SelectGroupRoleMock(groupId, username)
+}
+
 func Test_CreateRecipe(t *testing.T) {
 	td := []struct {
 		Input    recipe.Recipe
@@ -70,7 +227,7 @@ func Test_CreateRecipe(t *testing.T) {
 	}{
 		{
 			Input:    recipe.Recipe{Name: "Test Name", Username: "Test User"},
-			Expected: recipe.Recipe{Id: 1, Name: "Test Name", Username: "Test User"},
+			Expected: recipe.Recipe{Id: 1, Name: "Test Name", Username: "Test User", Visibility: "private"},
 			InsertFn: func(args recipe.Recipe) (recipe.Recipe, error) {
 				args.Id = 1
 				return args, nil
@@ -109,6 +266,45 @@ func Test_CreateRecipe(t *testing.T) {
 	}
 }
 
+func Test_CreateRecipeOrdersGroups(t *testing.T) {
+	input := recipe.Recipe{
+		Name:     "Test Name",
+		Username: "Test User",
+		Ingredients: []recipe.Ingredient{
+			{Name: "Flour", Amount: "2", Unit: "cups", Group: "For the dough"},
+			{Name: "Cheese", Amount: "1", Unit: "cups", Group: "For the filling"},
+			{Name: "Yeast", Amount: "1", Unit: "tsp", Group: " For the dough "},
+		},
+		Steps: []recipe.Step{
+			{Description: "Knead", Section: "Dough"},
+			{Description: "Grate cheese", Section: "Filling"},
+			{Description: "Proof", Section: "Dough"},
+		},
+	}
+
+	expectedIngredients := []recipe.Ingredient{
+		{Name: "Flour", Amount: "2", Unit: "cups", Group: "For the dough", Position: 1},
+		{Name: "Yeast", Amount: "1", Unit: "tsp", Group: "For the dough", Position: 2},
+		{Name: "Cheese", Amount: "1", Unit: "cups", Group: "For the filling", Position: 3},
+	}
+
+	expectedSteps := []recipe.Step{
+		{StepNumber: 1, Description: "Knead", Section: "Dough"},
+		{StepNumber: 2, Description: "Proof", Section: "Dough"},
+		{StepNumber: 3, Description: "Grate cheese", Section: "Filling"},
+	}
+
+	rr := &RecipeRepoMocker{InsertRecipeMock: func(args recipe.Recipe) (recipe.Recipe, error) {
+		return args, nil
+	}}
+	rs := NewRecipeService(rr, &ImageServiceMocker{})
+	result, err := rs.CreateRecipe(input)
+
+	assert.NoError(t, err)
+	assert.Equal(t, expectedIngredients, result.Ingredients)
+	assert.Equal(t, expectedSteps, result.Steps)
+}
+
 func Test_GetRecipe(t *testing.T) {
 	td := []struct {
 		Input    int
@@ -163,8 +359,8 @@ func Test_GetRecipesForUsername(t *testing.T) {
 	td := []struct {
 		Username        string
 		Expected        UsernameRecipePage
-		SelectRecipesFn func(username string, orderBy string, offset int, limit int) ([]recipe.Recipe, error)
-		SelectCountFn   func(username string) (int, error)
+		SelectRecipesFn func(username string, filter recipe.Filter, orderBy string, offset int, limit int) ([]recipe.Recipe, error)
+		SelectCountFn   func(username string, filter recipe.Filter) (int, error)
 		Assert          func(expected UsernameRecipePage, actual UsernameRecipePage, err error)
 	}{
 		{
@@ -177,10 +373,10 @@ func Test_GetRecipesForUsername(t *testing.T) {
 				Limit:  2,
 				Total:  1,
 			},
-			SelectRecipesFn: func(username, orderBy string, offset, limit int) ([]recipe.Recipe, error) {
+			SelectRecipesFn: func(username string, filter recipe.Filter, orderBy string, offset, limit int) ([]recipe.Recipe, error) {
 				return []recipe.Recipe{{Id: 1, Name: "Recipe 1", Username: "Test User"}}, nil
 			},
-			SelectCountFn: func(username string) (int, error) {
+			SelectCountFn: func(username string, filter recipe.Filter) (int, error) {
 				return 1, nil
 			},
 			Assert: func(expected, actual UsernameRecipePage, err error) {
@@ -191,10 +387,10 @@ func Test_GetRecipesForUsername(t *testing.T) {
 		{
 			Username: "Test User",
 			Expected: UsernameRecipePage{},
-			SelectRecipesFn: func(username, orderBy string, offset, limit int) ([]recipe.Recipe, error) {
+			SelectRecipesFn: func(username string, filter recipe.Filter, orderBy string, offset, limit int) ([]recipe.Recipe, error) {
 				return nil, errors.New("failed")
 			},
-			SelectCountFn: func(username string) (int, error) {
+			SelectCountFn: func(username string, filter recipe.Filter) (int, error) {
 				return 1, nil
 			},
 			Assert: func(expected, actual UsernameRecipePage, err error) {
@@ -205,10 +401,10 @@ func Test_GetRecipesForUsername(t *testing.T) {
 		{
 			Username: "Test User",
 			Expected: UsernameRecipePage{},
-			SelectRecipesFn: func(username, orderBy string, offset, limit int) ([]recipe.Recipe, error) {
+			SelectRecipesFn: func(username string, filter recipe.Filter, orderBy string, offset, limit int) ([]recipe.Recipe, error) {
 				return []recipe.Recipe{{Id: 1, Name: "Recipe 1", Username: "Test User"}}, nil
 			},
-			SelectCountFn: func(username string) (int, error) {
+			SelectCountFn: func(username string, filter recipe.Filter) (int, error) {
 				return 0, errors.New("failed")
 			},
 			Assert: func(expected, actual UsernameRecipePage, err error) {
@@ -221,11 +417,100 @@ func Test_GetRecipesForUsername(t *testing.T) {
 	for _, tr := range td {
 		rr := &RecipeRepoMocker{SelectRecipesByUsernameMock: tr.SelectRecipesFn, SelectRecipeCountByUsernameMock: tr.SelectCountFn}
 		rs := NewRecipeService(rr, &ImageServiceMocker{})
-		result, err := rs.GetRecipesForUsername(tr.Username, "", tr.Expected.Offset, tr.Expected.Limit)
+		result, err := rs.GetRecipesForUsername(tr.Username, recipe.Filter{}, "", tr.Expected.Offset, tr.Expected.Limit)
 		tr.Assert(tr.Expected, result, err)
 	}
 }
 
+func Test_GetRecipesForUsernameQuery(t *testing.T) {
+	var orderBy string
+	var filter recipe.Filter
+
+	rr := &RecipeRepoMocker{
+		SelectRecipesByUsernameMock: func(username string, f recipe.Filter, o string, offset, limit int) ([]recipe.Recipe, error) {
+			filter, orderBy = f, o
+			return nil, nil
+		},
+		SelectRecipeCountByUsernameMock: func(username string, f recipe.Filter) (int, error) {
+			return 0, nil
+		},
+	}
+	rs := NewRecipeService(rr, &ImageServiceMocker{})
+
+	_, err := rs.GetRecipesForUsername("Test User", recipe.Filter{Difficulty: "Easy"}, "total_time", 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "easy", filter.Difficulty)
+	assert.Equal(t, recipeOrders["total_time"], orderBy)
+
+	_, err = rs.GetRecipesForUsername("Test User", recipe.Filter{}, "id; DROP TABLE recipe", 0, 10)
+	assert.ErrorIs(t, err, ErrRecipeQuery)
+
+	_, err = rs.GetRecipesForUsername("Test User", recipe.Filter{Difficulty: "impossible"}, "", 0, 10)
+	assert.ErrorIs(t, err, ErrRecipeQuery)
+}
+
+func Test_CreateRecipeMetadata(t *testing.T) {
+	td := []struct {
+		Input  recipe.Recipe
+		Assert func(actual recipe.Recipe, err error)
+	}{
+		{
+			Input: recipe.Recipe{
+				Name: "Test Name", Username: "Test User", PrepTime: "PT10M", CookTime: "PT90M", Difficulty: " Medium ",
+				Equipment: []string{" Dutch oven ", ""},
+				Steps:     []recipe.Step{{Description: "Bake", Duration: "PT90M", Temperature: 350, TemperatureUnit: "f"}},
+			},
+			Assert: func(actual recipe.Recipe, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, "PT1H30M", actual.CookTime)
+				assert.Equal(t, "PT1H40M", actual.TotalTime)
+				assert.Equal(t, "medium", actual.Difficulty)
+				assert.Equal(t, []string{"Dutch oven"}, actual.Equipment)
+				assert.Equal(t, "F", actual.Steps[0].TemperatureUnit)
+			},
+		},
+		{
+			Input: recipe.Recipe{Name: "Test Name", Username: "Test User", PrepTime: "10 minutes"},
+			Assert: func(actual recipe.Recipe, err error) {
+				assert.ErrorIs(t, err, ErrRecipeMetadata)
+			},
+		},
+		{
+			Input: recipe.Recipe{Name: "Test Name", Username: "Test User", CookTime: "PT9999999999999H"},
+			Assert: func(actual recipe.Recipe, err error) {
+				assert.ErrorIs(t, err, ErrRecipeMetadata)
+			},
+		},
+		{
+			Input: recipe.Recipe{Name: "Test Name", Username: "Test User", PrepTime: "PT30M", TotalTime: "PT20M"},
+			Assert: func(actual recipe.Recipe, err error) {
+				assert.ErrorIs(t, err, ErrRecipeMetadata)
+			},
+		},
+		{
+			Input: recipe.Recipe{Name: "Test Name", Username: "Test User", Difficulty: "impossible"},
+			Assert: func(actual recipe.Recipe, err error) {
+				assert.ErrorIs(t, err, ErrRecipeMetadata)
+			},
+		},
+		{
+			Input: recipe.Recipe{Name: "Test Name", Username: "Test User", Steps: []recipe.Step{{Description: "Bake", Temperature: 200}}},
+			Assert: func(actual recipe.Recipe, err error) {
+				assert.ErrorIs(t, err, ErrRecipeMetadata)
+			},
+		},
+	}
+
+	for _, tr := range td {
+		rr := &RecipeRepoMocker{InsertRecipeMock: func(args recipe.Recipe) (recipe.Recipe, error) {
+			return args, nil
+		}}
+		rs := NewRecipeService(rr, &ImageServiceMocker{})
+		result, err := rs.CreateRecipe(tr.Input)
+		tr.Assert(result, err)
+	}
+}
+
 func Test_UpdateRecipe(t *testing.T) {
 	td := []struct {
 		Input    recipe.Recipe
@@ -290,7 +575,7 @@ func Test_UpdateRecipe(t *testing.T) {
 	}
 
 	for _, tr := range td {
-		rr := &RecipeRepoMocker{SelectRecipeByIdMock: tr.SelectFn, UpdateRecipeMock: tr.UpdateFn}
+		rr := &RecipeRepoMocker{SelectRecipeGrantRoleMock: noGrants, SelectRecipeByIdMock: tr.SelectFn, UpdateRecipeMock: tr.UpdateFn}
 		rs := NewRecipeService(rr, &ImageServiceMocker{})
 		result, err := rs.UpdateRecipe(tr.Input)
 		tr.Assert(tr.Expected, result, err)
@@ -359,62 +644,38 @@ func Test_RemoveRecipe(t *testing.T) {
 	}
 
 	for _, tr := range td {
-		rr := &RecipeRepoMocker{SelectRecipeByIdMock: tr.SelectFn, DeleteRecipeMock: tr.DeleteFn}
-		rs := NewRecipeService(rr, &ImageServiceMocker{})
+		rr := &RecipeRepoMocker{SelectRecipeGrantRoleMock: noGrants, SelectRecipeByIdMock: tr.SelectFn, DeleteRecipeMock: tr.DeleteFn}
+		is := &ImageServiceMocker{}
+		rs := NewRecipeService(rr, is)
 		err := rs.RemoveRecipe(tr.Id, tr.Username)
 		tr.Assert(err)
+
+		// images are only deleted when the recipe is
+		if tr.DeleteFn != nil && err != nil {
+			assert.Equal(t, 0, is.Committed)
+			assert.Equal(t, 1, is.RolledBack)
+		}
 	}
 }
 
+// The image is deleted once the recipe is, unless another recipe shares it.
 func Test_RemoveRecipeWithImage(t *testing.T) {
-	td := []struct {
-		Id          int
-		Username    string
-		SelectFn    func(id int) (recipe.Recipe, error)
-		DeleteFn    func(id int) error
-		DeleteImgFn func() error
-		Assert      func(err error)
-	}{
-		{
-			Id:       1,
-			Username: "Test User",
-			SelectFn: func(id int) (recipe.Recipe, error) {
-				return recipe.Recipe{Id: 1, Name: "Test Recipe", Username: "Test User", ImageName: "test.file"}, nil
-			},
-			DeleteImgFn: func() error {
-				return nil
-			},
-			DeleteFn: func(id int) error {
-				return nil
-			},
-			Assert: func(err error) {
-				assert.NoError(t, err)
-			},
+	rr := &RecipeRepoMocker{
+		SelectRecipeByIdMock: func(id int) (recipe.Recipe, error) {
+			return recipe.Recipe{Id: 1, Name: "Test Recipe", Username: "Test User", ImageName: "test.file"}, nil
 		},
-		{
-			Id:       1,
-			Username: "Test User",
-			SelectFn: func(id int) (recipe.Recipe, error) {
-				return recipe.Recipe{Id: 1, Name: "Test Recipe", Username: "Test User", ImageName: "test.file"}, nil
-			},
-			DeleteImgFn: func() error {
-				return errors.New("failed")
-			},
-			DeleteFn: func(id int) error {
-				return nil
-			},
-			Assert: func(err error) {
-				assert.Error(t, err)
-			},
+		DeleteRecipeMock: func(id int) error {
+			return nil
 		},
 	}
+	is := &ImageServiceMocker{}
+	rs := NewRecipeService(rr, is)
 
-	for _, tr := range td {
-		rr := &RecipeRepoMocker{SelectRecipeByIdMock: tr.SelectFn, DeleteRecipeMock: tr.DeleteFn}
-		rs := NewRecipeService(rr, &ImageServiceMocker{DeleteImageMock: tr.DeleteImgFn})
-		err := rs.RemoveRecipe(tr.Id, tr.Username)
-		tr.Assert(err)
-	}
+	err := rs.RemoveRecipe(1, "Test User")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test.file"}, is.Deleted)
+	assert.Equal(t, 1, is.Committed)
 }
 
 func Test_UpdateRecipeImage(t *testing.T) {
@@ -441,8 +702,9 @@ func Test_UpdateRecipeImage(t *testing.T) {
 				return nil
 			},
 			Assert: func(result string, err error) {
+				// the new image is stored under its own name instead of replacing the old file
 				assert.NoError(t, err)
-				assert.Equal(t, "test.file", result)
+				assert.Equal(t, "test-hash.jpg", result)
 			},
 		},
 		{
@@ -503,8 +765,381 @@ func Test_UpdateRecipeImage(t *testing.T) {
 
 	for _, tr := range td {
 		rr := &RecipeRepoMocker{SelectRecipeByIdMock: tr.SelectFn, UpdateRecipeImageNameMock: tr.UpdateImgNameFn}
-		rs := NewRecipeService(rr, &ImageServiceMocker{SaveImageMock: tr.SaveImgFn})
+		is := &ImageServiceMocker{SaveImageMock: tr.SaveImgFn}
+		rs := NewRecipeService(rr, is)
 		result, err := rs.UpdateRecipeImage(tr.Id, tr.Username, tr.MockFile)
 		tr.Assert(result, err)
+
+		// the new image is undone when it can't be set, the old one is deleted when it is
+		if err != nil {
+			assert.Equal(t, 1, is.RolledBack)
+			assert.Equal(t, 0, is.Committed)
+		} else {
+			assert.Equal(t, 1, is.Committed)
+		}
+	}
+}
+
+func Test_UpdateRecipeImageDeletesPrevious(t *testing.T) {
+	rr := &RecipeRepoMocker{
+		SelectRecipeByIdMock: func(id int) (recipe.Recipe, error) {
+			return recipe.Recipe{Id: 1, Name: "Test Recipe", Username: "Test User", ImageName: "old.jpg"}, nil
+		},
+		UpdateRecipeImageNameMock: func(id int, imageName string) error {
+			return nil
+		},
+	}
+	is := &ImageServiceMocker{SaveImageMock: func() error { return nil }}
+	rs := NewRecipeService(rr, is)
+
+	_, err := rs.UpdateRecipeImage(1, "Test User", &multipart.FileHeader{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"old.jpg"}, is.Deleted)
+	assert.Equal(t, 1, is.Committed)
+}
+
+// Step images follow their step when steps are removed or reordered, and the images of a
+// removed step are removed with it.
+func Test_UpdateRecipeStepImages(t *testing.T) {
+	first, second := 1, 2
+	rr := &RecipeRepoMocker{
+		SelectRecipeGrantRoleMock: noGrants,
+		SelectRecipeByIdMock: func(id int) (recipe.Recipe, error) {
+			return recipe.Recipe{Id: 1, Name: "Test Recipe", Username: "Test User", Steps: []recipe.Step{
+				{Id: 1, StepNumber: 1, Description: "Knead", Images: []recipe.Image{{Id: 1, Name: "knead.jpg", StepNumber: &first}}},
+				{Id: 2, StepNumber: 2, Description: "Bake", Images: []recipe.Image{{Id: 2, Name: "bake.jpg", StepNumber: &second}}},
+			}}, nil
+		},
+		UpdateRecipeMock: func(input recipe.Recipe) (recipe.Recipe, error) {
+			return input, nil
+		},
+	}
+	is := &ImageServiceMocker{}
+	rs := NewRecipeService(rr, is)
+
+	result, err := rs.UpdateRecipe(recipe.Recipe{Id: 1, Name: "Test Recipe", Username: "Test User", Steps: []recipe.Step{
+		{Id: 2, StepNumber: 2, Description: "Bake"},
+		{StepNumber: 3, Description: "Serve"},
+	}})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"knead.jpg"}, is.Deleted)
+	assert.Equal(t, 1, is.Committed)
+	assert.Len(t, result.Steps[0].Images, 1)
+	assert.Equal(t, "bake.jpg", result.Steps[0].Images[0].Name)
+	assert.Equal(t, 1, *result.Steps[0].Images[0].StepNumber)
+	assert.Empty(t, result.Steps[1].Images)
+}
+
+func Test_CreateRecipeSubrecipe(t *testing.T) {
+	subrecipeId := 2
+
+	td := []struct {
+		SelectFn func(id int) (recipe.Recipe, error)
+		Assert   func(err error)
+	}{
+		{
+			SelectFn: func(id int) (recipe.Recipe, error) {
+				return recipe.Recipe{Id: 2, Name: "Pizza Dough", Username: "Test User"}, nil
+			},
+			Assert: func(err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			SelectFn: func(id int) (recipe.Recipe, error) {
+				return recipe.Recipe{Id: 2, Name: "Pizza Dough", Username: "Test User 1"}, nil
+			},
+			Assert: func(err error) {
+				assert.ErrorIs(t, err, ErrSubrecipeData)
+			},
+		},
+		{
+			SelectFn: func(id int) (recipe.Recipe, error) {
+				return recipe.Recipe{}, sql.ErrNoRows
+			},
+			Assert: func(err error) {
+				assert.ErrorIs(t, err, ErrSubrecipeData)
+			},
+		},
+	}
+
+	for _, tr := range td {
+		rr := &RecipeRepoMocker{
+			SelectRecipeGrantRoleMock: noGrants,
+			SelectRecipeByIdMock:      tr.SelectFn,
+			InsertRecipeMock: func(args recipe.Recipe) (recipe.Recipe, error) {
+				return args, nil
+			},
+		}
+		rs := NewRecipeService(rr, &ImageServiceMocker{})
+		_, err := rs.CreateRecipe(recipe.Recipe{
+			Name:        "Pizza",
+			Username:    "Test User",
+			Ingredients: []recipe.Ingredient{{Name: "Pizza Dough", Amount: "1", Unit: "batch", SubrecipeId: &subrecipeId}},
+		})
+		tr.Assert(err)
 	}
 }
+
+func Test_UpdateRecipeSubrecipeCycle(t *testing.T) {
+	pizzaId, doughId := 1, 2
+
+	recipes := map[int]recipe.Recipe{
+		1: {Id: 1, Name: "Pizza", Username: "Test User"},
+		2: {Id: 2, Name: "Pizza Dough", Username: "Test User", Ingredients: []recipe.Ingredient{
+			{Name: "Pizza", Amount: "1", Unit: "whole", SubrecipeId: &pizzaId},
+		}},
+	}
+
+	rr := &RecipeRepoMocker{
+		SelectRecipeByIdMock: func(id int) (recipe.Recipe, error) {
+			return recipes[id], nil
+		},
+		UpdateRecipeMock: func(args recipe.Recipe) (recipe.Recipe, error) {
+			return args, nil
+		},
+	}
+	rs := NewRecipeService(rr, &ImageServiceMocker{})
+
+	_, err := rs.UpdateRecipe(recipe.Recipe{
+		Id:          1,
+		Name:        "Pizza",
+		Username:    "Test User",
+		Ingredients: []recipe.Ingredient{{Name: "Pizza Dough", Amount: "1", Unit: "batch", SubrecipeId: &doughId}},
+	})
+	assert.ErrorIs(t, err, ErrSubrecipeCycle)
+
+	_, err = rs.UpdateRecipe(recipe.Recipe{
+		Id:          1,
+		Name:        "Pizza",
+		Username:    "Test User",
+		Ingredients: []recipe.Ingredient{{Name: "Pizza", Amount: "1", Unit: "whole", SubrecipeId: &pizzaId}},
+	})
+	assert.ErrorIs(t, err, ErrSubrecipeCycle)
+}
+
+func Test_GetRecipeWithSubrecipes(t *testing.T) {
+	doughId, sauceId := 2, 3
+
+	recipes := map[int]recipe.Recipe{
+		1: {Id: 1, Name: "Pizza", Username: "Test User", Ingredients: []recipe.Ingredient{
+			{Name: "Pizza Dough", Amount: "1", Unit: "batch", SubrecipeId: &doughId},
+			{Name: "Sauce", Amount: "1", Unit: "cup", SubrecipeId: &sauceId},
+		}},
+		2: {Id: 2, Name: "Pizza Dough", Username: "Test User"},
+		3: {Id: 3, Name: "Sauce", Username: "Test User 1"},
+	}
+
+	rr := &RecipeRepoMocker{
+		SelectRecipeGrantRoleMock: noGrants,
+		SelectRecipeByIdMock: func(id int) (recipe.Recipe, error) {
+			return recipes[id], nil
+		},
+	}
+	rs := NewRecipeService(rr, &ImageServiceMocker{})
+
+	result, err := rs.GetRecipeWithSubrecipes(1, "Test User")
+
+	assert.NoError(t, err)
+	assert.Equal(t, recipes[2], *result.Ingredients[0].Subrecipe)
+	assert.Nil(t, result.Ingredients[1].Subrecipe)
+}
+
+func Test_RecipeVisibility(t *testing.T) {
+	rr := &RecipeRepoMocker{
+		InsertRecipeMock: func(args recipe.Recipe) (recipe.Recipe, error) {
+			return args, nil
+		},
+	}
+	rs := NewRecipeService(rr, &ImageServiceMocker{})
+
+	result, err := rs.CreateRecipe(recipe.Recipe{Name: "Test Name", Username: "Test User", Visibility: " Public "})
+	assert.NoError(t, err)
+	assert.Equal(t, "public", result.Visibility)
+
+	_, err = rs.CreateRecipe(recipe.Recipe{Name: "Test Name", Username: "Test User", Visibility: "friends"})
+	assert.ErrorIs(t, err, ErrRecipeMetadata)
+
+	// visibility is kept when an update leaves it out
+	rr.SelectRecipeByIdMock = func(id int) (recipe.Recipe, error) {
+		return recipe.Recipe{Id: 1, Name: "Test Name", Username: "Test User", Visibility: "public"}, nil
+	}
+	rr.SelectRecipeImagesMock = func(recipeId int) ([]recipe.Image, error) {
+		return nil, nil
+	}
+	rr.UpdateRecipeMock = func(args recipe.Recipe) (recipe.Recipe, error) {
+		return args, nil
+	}
+
+	result, err = rs.UpdateRecipe(recipe.Recipe{Id: 1, Name: "New Name", Username: "Test User"})
+	assert.NoError(t, err)
+	assert.Equal(t, "public", result.Visibility)
+}
+
+func Test_GetRecipeForUsername(t *testing.T) {
+	td := []struct {
+		Recipe   recipe.Recipe
+		Username string
+		Assert   func(result recipe.Recipe, err error)
+	}{
+		{
+			Recipe:   recipe.Recipe{Id: 1, Username: "Test User", Visibility: "private"},
+			Username: "Test User",
+			Assert: func(result recipe.Recipe, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, 1, result.Id)
+			},
+		},
+		{
+			Recipe:   recipe.Recipe{Id: 1, Username: "Test User", Visibility: "public"},
+			Username: "Other User",
+			Assert: func(result recipe.Recipe, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, 1, result.Id)
+			},
+		},
+		{
+			Recipe:   recipe.Recipe{Id: 1, Username: "Test User", Visibility: "private"},
+			Username: "Other User",
+			Assert: func(result recipe.Recipe, err error) {
+				assert.ErrorIs(t, err, ErrRecipeForbidden)
+				assert.Equal(t, recipe.Recipe{}, result)
+			},
+		},
+		{
+			Recipe:   recipe.Recipe{Id: 1, Username: "Test User", Visibility: "public", OwnerInactive: true},
+			Username: "Other User",
+			Assert: func(result recipe.Recipe, err error) {
+				assert.ErrorIs(t, err, ErrRecipeForbidden)
+				assert.Equal(t, recipe.Recipe{}, result)
+			},
+		},
+		{
+			Recipe:   recipe.Recipe{Id: 1, Username: "Test User", Visibility: "public", OwnerInactive: true},
+			Username: "Test User",
+			Assert: func(result recipe.Recipe, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, 1, result.Id)
+			},
+		},
+	}
+
+	for _, tr := range td {
+		r := tr.Recipe
+		rr := &RecipeRepoMocker{
+			SelectRecipeGrantRoleMock: noGrants,
+			SelectRecipeByIdMock: func(id int) (recipe.Recipe, error) {
+				return r, nil
+			},
+		}
+		rs := NewRecipeService(rr, &ImageServiceMocker{})
+		result, err := rs.GetRecipeForUsername(1, tr.Username)
+		tr.Assert(result, err)
+	}
+}
+
+// Images of recipes that aren't public never get urls that don't expire.
+func Test_GetRecipeImageURLs(t *testing.T) {
+	td := []struct {
+		R      recipe.Recipe
+		Public bool
+	}{
+		{R: recipe.Recipe{Id: 1, Username: "Test User", ImageName: "cover.jpg", Visibility: VisibilityPublic}, Public: true},
+		{R: recipe.Recipe{Id: 1, Username: "Test User", ImageName: "cover.jpg", Visibility: VisibilityPrivate}},
+		{R: recipe.Recipe{Id: 1, Username: "Test User", ImageName: "cover.jpg", Visibility: VisibilityPublic, Hidden: true}},
+	}
+
+	for _, tr := range td {
+		r := tr.R
+		rr := &RecipeRepoMocker{
+			SelectRecipeByIdMock: func(id int) (recipe.Recipe, error) {
+				return r, nil
+			},
+		}
+		is := &ImageServiceMocker{}
+		rs := NewRecipeService(rr, is)
+
+		result, err := rs.GetRecipe(1)
+
+		assert.NoError(t, err)
+		if tr.Public {
+			assert.Equal(t, is.ImageURLs("cover.jpg"), result.ImageURLs)
+		} else {
+			assert.Equal(t, is.PrivateImageURLs("cover.jpg"), result.ImageURLs)
+		}
+	}
+}
+
+func Test_GetRecipePlaceholders(t *testing.T) {
+	stepNumber := 1
+	rr := &RecipeRepoMocker{
+		SelectRecipeByIdMock: func(id int) (recipe.Recipe, error) {
+			return recipe.Recipe{
+				Id:        1,
+				Username:  "Test User",
+				ImageName: "cover.jpg",
+				Images:    []recipe.Image{{Id: 1, Name: "gallery.jpg"}},
+				Steps:     []recipe.Step{{StepNumber: 1, Images: []recipe.Image{{Id: 2, Name: "old.jpg", StepNumber: &stepNumber}}}},
+			}, nil
+		},
+	}
+
+	var looked [][]string
+	is := &ImageServiceMocker{PlaceholdersMock: func(filenames []string) (map[string]imageref.Placeholder, error) {
+		looked = append(looked, filenames)
+		return map[string]imageref.Placeholder{
+			"cover.jpg":   {Blurhash: "cover", Color: "#a0522d", Width: 1600, Height: 1200},
+			"gallery.jpg": {Blurhash: "gallery", Color: "#ffffff", Width: 640, Height: 480},
+		}, nil
+	}}
+	rs := NewRecipeService(rr, is)
+
+	result, err := rs.GetRecipe(1)
+
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"cover.jpg", "gallery.jpg", "old.jpg"}}, looked)
+	assert.Equal(t, &imageref.Placeholder{Blurhash: "cover", Color: "#a0522d", Width: 1600, Height: 1200}, result.ImagePlaceholder)
+	assert.Equal(t, "gallery", result.Images[0].Placeholder.Blurhash)
+	// stored before placeholders existed
+	assert.Nil(t, result.Steps[0].Images[0].Placeholder)
+
+	is.PlaceholdersMock = func(filenames []string) (map[string]imageref.Placeholder, error) {
+		return nil, errors.New("failed")
+	}
+	_, err = rs.GetRecipe(1)
+	assert.Error(t, err)
+}
+
+func Test_GetRecipesForUsernamePlaceholders(t *testing.T) {
+	rr := &RecipeRepoMocker{
+		SelectRecipesByUsernameMock: func(username string, filter recipe.Filter, orderBy string, offset int, limit int) ([]recipe.Recipe, error) {
+			return []recipe.Recipe{{Id: 1, ImageName: "a.jpg"}, {Id: 2}, {Id: 3, ImageName: "b.jpg"}}, nil
+		},
+		SelectRecipeCountByUsernameMock: func(username string, filter recipe.Filter) (int, error) {
+			return 3, nil
+		},
+	}
+
+	calls := 0
+	is := &ImageServiceMocker{PlaceholdersMock: func(filenames []string) (map[string]imageref.Placeholder, error) {
+		calls++
+		assert.Equal(t, []string{"a.jpg", "b.jpg"}, filenames)
+		return map[string]imageref.Placeholder{"a.jpg": {Color: "#000000"}, "b.jpg": {Color: "#ffffff"}}, nil
+	}}
+	rs := NewRecipeService(rr, is)
+
+	result, err := rs.GetRecipesForUsername("Test User", recipe.Filter{}, "", 0, 10)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, "#000000", result.Recipes[0].ImagePlaceholder.Color)
+	assert.Nil(t, result.Recipes[1].ImagePlaceholder)
+	assert.Equal(t, "#ffffff", result.Recipes[2].ImagePlaceholder.Color)
+}
+
+// The grant lookup for a recipe that has not been shared with anyone.
+func noGrants(recipeId int, username string) (string, error) {
+	return "", nil
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/eciccone/rh/api/repo/recipe"
+)
+
+// Gets the profiles a recipe is shared with, only its owner and they can see them.
+// Returns ErrNoRecipe if recipe does not exist.
+// Returns ErrRecipeForbidden if the user is not the owner or a collaborator.
+func (s *recipeService) GetCollaborators(id int, username string) ([]recipe.Collaborator, error) {
+	r, err := s.GetRecipe(id)
+	if err != nil {
+		return nil, err
+	}
+
+	collaborators, err := s.collaborators(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Username == username {
+		return collaborators, nil
+	}
+
+	for _, c := range collaborators {
+		if c.Username == username {
+			return collaborators, nil
+		}
+	}
+
+	return nil, ErrRecipeForbidden
+}
+
+// Shares a recipe with the profile with collaborator as its username as a viewer or editor, or
+// changes the role it is shared with them as. Returns every collaborator.
+// Returns ErrNoRecipe if recipe does not exist.
+// Returns ErrRecipeForbidden if the user is not the owner.
+// Returns ErrRecipeShareData if role is unknown or collaborator is the owner.
+// Returns ErrNoProfile if no profile has the username.
+func (s *recipeService) ShareRecipe(id int, username string, collaborator string, role string) ([]recipe.Collaborator, error) {
+	if !recipeRoles[role] {
+		return nil, fmt.Errorf("%w: role must be viewer or editor", ErrRecipeShareData)
+	}
+
+	r, err := s.getOwnRecipe(id, username)
+	if err != nil {
+		return nil, err
+	}
+
+	// usernames are unique regardless of case
+	if strings.EqualFold(collaborator, r.Username) {
+		return nil, fmt.Errorf("%w: the owner can not be a collaborator", ErrRecipeShareData)
+	}
+
+	found, err := s.recipeRepo.UpsertRecipeGrant(id, collaborator, role, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("ShareRecipe failed to share recipe: %w", err)
+	}
+
+	if !found {
+		return nil, ErrNoProfile
+	}
+
+	return s.collaborators(id)
+}
+
+// Stops sharing a recipe with a collaborator. The owner can remove anyone, collaborators can only
+// remove themselves.
+// Returns ErrNoRecipe if recipe does not exist.
+// Returns ErrRecipeForbidden if the user is neither the owner nor the collaborator.
+// Returns ErrNoCollaborator if the recipe is not shared with collaborator.
+func (s *recipeService) UnshareRecipe(id int, username string, collaborator string) error {
+	r, err := s.GetRecipe(id)
+	if err != nil {
+		return err
+	}
+
+	if r.Username != username && !strings.EqualFold(collaborator, username) {
+		return ErrRecipeForbidden
+	}
+
+	deleted, err := s.recipeRepo.DeleteRecipeGrant(id, collaborator)
+	if err != nil {
+		return fmt.Errorf("UnshareRecipe failed to unshare recipe: %w", err)
+	}
+
+	if !deleted {
+		return ErrNoCollaborator
+	}
+
+	return nil
+}
+
+// Gives a recipe to the profile with owner as its username. The previous owner keeps it shared
+// with them as an editor.
+// Returns ErrNoRecipe if recipe does not exist.
+// Returns ErrRecipeForbidden if the user is not the owner.
+// Returns ErrRecipeShareData if owner already owns the recipe.
+// Returns ErrNoProfile if no profile has the username.
+func (s *recipeService) TransferRecipe(id int, username string, owner string) (recipe.Recipe, error) {
+	r, err := s.getOwnRecipe(id, username)
+	if err != nil {
+		return recipe.Recipe{}, err
+	}
+
+	if strings.EqualFold(owner, r.Username) {
+		return recipe.Recipe{}, fmt.Errorf("%w: the recipe is already theirs", ErrRecipeShareData)
+	}
+
+	found, err := s.recipeRepo.UpdateRecipeOwner(id, owner, RecipeEditor, time.Now())
+	if err != nil {
+		return recipe.Recipe{}, fmt.Errorf("TransferRecipe failed to update owner: %w", err)
+	}
+
+	if !found {
+		return recipe.Recipe{}, ErrNoProfile
+	}
+
+	return s.GetRecipe(id)
+}
+
+// Gets a recipe that must belong to username, for what only its owner can do.
+// Returns ErrNoRecipe if recipe does not exist.
+// Returns ErrRecipeForbidden if the recipe does not belong to the user.
+func (s *recipeService) getOwnRecipe(id int, username string) (recipe.Recipe, error) {
+	r, err := s.GetRecipe(id)
+	if err != nil {
+		return recipe.Recipe{}, err
+	}
+
+	if r.Username != username {
+		return recipe.Recipe{}, ErrRecipeForbidden
+	}
+
+	return r, nil
+}
+
+// Gets the collaborators of a recipe with the urls of their avatars.
+func (s *recipeService) collaborators(id int) ([]recipe.Collaborator, error) {
+	collaborators, err := s.recipeRepo.SelectRecipeGrants(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get collaborators: %w", err)
+	}
+
+	for i := range collaborators {
+		if collaborators[i].AvatarName != "" {
+			collaborators[i].AvatarURLs = s.imageService.ImageURLs(collaborators[i].AvatarName)
+		}
+	}
+
+	return collaborators, nil
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/eciccone/rh/api/repo/recipe"
+	"github.com/stretchr/testify/assert"
+)
+
+// A recipe repository with one private recipe owned by owner and shared with bob as a viewer and
+// carol as an editor.
+func sharedRecipeRepo() *RecipeRepoMocker {
+	grants := map[string]string{"bob": RecipeViewer, "carol": RecipeEditor}
+
+	return &RecipeRepoMocker{
+		SelectRecipeByIdMock: func(id int) (recipe.Recipe, error) {
+			if id != 1 {
+				return recipe.Recipe{}, sql.ErrNoRows
+			}
+			return recipe.Recipe{Id: 1, Name: "Soup", Username: "owner", Visibility: "private"}, nil
+		},
+		SelectRecipeGrantRoleMock: func(recipeId int, username string) (string, error) {
+			return grants[username], nil
+		},
+		SelectRecipeGrantsMock: func(recipeId int) ([]recipe.Collaborator, error) {
+			return []recipe.Collaborator{
+				{Username: "bob", Role: grants["bob"]},
+				{Username: "carol", Role: grants["carol"]},
+			}, nil
+		},
+		UpsertRecipeGrantMock: func(recipeId int, username string, role string, created time.Time) (bool, error) {
+			if username == "nobody" {
+				return false, nil
+			}
+			grants[username] = role
+			return true, nil
+		},
+		DeleteRecipeGrantMock: func(recipeId int, username string) (bool, error) {
+			_, ok := grants[username]
+			delete(grants, username)
+			return ok, nil
+		},
+	}
+}
+
+func Test_SharedRecipeAccess(t *testing.T) {
+	rr := sharedRecipeRepo()
+	rr.UpdateRecipeMock = func(r recipe.Recipe) (recipe.Recipe, error) {
+		// an editor's changes keep the recipe with its owner
+		assert.Equal(t, "owner", r.Username)
+		return r, nil
+	}
+	rs := NewRecipeService(rr, &ImageServiceMocker{})
+
+	td := []struct {
+		Username string
+		CanView  bool
+		CanEdit  bool
+	}{
+		{"owner", true, true},
+		{"bob", true, false},
+		{"carol", true, true},
+		{"dave", false, false},
+	}
+
+	for _, tr := range td {
+		_, err := rs.GetRecipeForUsername(1, tr.Username)
+		assert.Equal(t, tr.CanView, err == nil, tr.Username)
+
+		_, err = rs.UpdateRecipe(recipe.Recipe{Id: 1, Name: "Soup", Username: tr.Username, Visibility: "private"})
+		if tr.CanEdit {
+			assert.NoError(t, err, tr.Username)
+		} else {
+			assert.ErrorIs(t, err, ErrRecipeForbidden, tr.Username)
+		}
+	}
+}
+
+func Test_SharedRecipeEditorLimits(t *testing.T) {
+	rr := sharedRecipeRepo()
+	rr.UpdateRecipeMock = func(r recipe.Recipe) (recipe.Recipe, error) {
+		return r, nil
+	}
+	rr.DeleteRecipeMock = func(id int) error {
+		return nil
+	}
+	rs := NewRecipeService(rr, &ImageServiceMocker{})
+
+	// an editor can't publish the recipe
+	result, err := rs.UpdateRecipe(recipe.Recipe{Id: 1, Name: "Soup", Username: "carol", Visibility: "public"})
+	assert.NoError(t, err)
+	assert.Equal(t, "private", result.Visibility)
+
+	// but its owner can
+	result, err = rs.UpdateRecipe(recipe.Recipe{Id: 1, Name: "Soup", Username: "owner", Visibility: "public"})
+	assert.NoError(t, err)
+	assert.Equal(t, "public", result.Visibility)
+
+	// an editor can't remove the recipe
+	err = rs.RemoveRecipe(1, "carol")
+	assert.ErrorIs(t, err, ErrRecipeForbidden)
+
+	err = rs.RemoveRecipe(1, "owner")
+	assert.NoError(t, err)
+}
+
+func Test_GetCollaborators(t *testing.T) {
+	rs := NewRecipeService(sharedRecipeRepo(), &ImageServiceMocker{})
+
+	result, err := rs.GetCollaborators(1, "bob")
+	assert.NoError(t, err)
+	assert.Len(t, result, 2)
+
+	_, err = rs.GetCollaborators(1, "dave")
+	assert.ErrorIs(t, err, ErrRecipeForbidden)
+
+	_, err = rs.GetCollaborators(2, "owner")
+	assert.ErrorIs(t, err, ErrNoRecipe)
+}
+
+func Test_ShareRecipe(t *testing.T) {
+	td := []struct {
+		Username     string
+		Collaborator string
+		Role         string
+		Expected     error
+	}{
+		{"owner", "bob", RecipeEditor, nil},
+		{"owner", "bob", "admin", ErrRecipeShareData},
+		{"owner", "Owner", RecipeViewer, ErrRecipeShareData},
+		{"owner", "nobody", RecipeViewer, ErrNoProfile},
+		{"carol", "dave", RecipeViewer, ErrRecipeForbidden},
+	}
+
+	for _, tr := range td {
+		rs := NewRecipeService(sharedRecipeRepo(), &ImageServiceMocker{})
+		result, err := rs.ShareRecipe(1, tr.Username, tr.Collaborator, tr.Role)
+		if tr.Expected != nil {
+			assert.ErrorIs(t, err, tr.Expected)
+			continue
+		}
+
+		assert.NoError(t, err)
+		assert.Equal(t, recipe.Collaborator{Username: "bob", Role: RecipeEditor}, result[0])
+	}
+}
+
+func Test_UnshareRecipe(t *testing.T) {
+	td := []struct {
+		Username     string
+		Collaborator string
+		Expected     error
+	}{
+		{"owner", "bob", nil},
+		{"bob", "bob", nil},
+		{"bob", "carol", ErrRecipeForbidden},
+		{"owner", "dave", ErrNoCollaborator},
+	}
+
+	for _, tr := range td {
+		rs := NewRecipeService(sharedRecipeRepo(), &ImageServiceMocker{})
+		err := rs.UnshareRecipe(1, tr.Username, tr.Collaborator)
+		if tr.Expected != nil {
+			assert.ErrorIs(t, err, tr.Expected)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func Test_TransferRecipe(t *testing.T) {
+	td := []struct {
+		Username string
+		Owner    string
+		Expected error
+	}{
+		{"owner", "carol", nil},
+		{"owner", "OWNER", ErrRecipeShareData},
+		{"owner", "nobody", ErrNoProfile},
+		{"carol", "carol", ErrRecipeForbidden},
+	}
+
+	for _, tr := range td {
+		var previousRole string
+		rr := sharedRecipeRepo()
+		rr.UpdateRecipeOwnerMock = func(recipeId int, username string, role string, created time.Time) (bool, error) {
+			previousRole = role
+			return username != "nobody", nil
+		}
+		rs := NewRecipeService(rr, &ImageServiceMocker{})
+
+		_, err := rs.TransferRecipe(1, tr.Username, tr.Owner)
+		if tr.Expected != nil {
+			assert.ErrorIs(t, err, tr.Expected)
+			continue
+		}
+
+		assert.NoError(t, err)
+		assert.Equal(t, RecipeEditor, previousRole)
+	}
+}
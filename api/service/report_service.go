@@ -0,0 +1,389 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/eciccone/rh/api/repo/admin"
+	"github.com/eciccone/rh/api/repo/profile"
+)
+
+var (
+	ErrReportData     = errors.New("invalid report")
+	ErrReportExists   = errors.New("already reported, the report is waiting for a moderator")
+	ErrReportResolved = errors.New("report was already resolved")
+	ErrNoReport       = errors.New("report not found")
+)
+
+// what can be reported
+const (
+	ReportRecipe  = "recipe"
+	ReportProfile = "profile"
+)
+
+// states of a report in the moderation queue, open and reviewing reports are unresolved
+const (
+	ReportOpen      = "open"
+	ReportReviewing = "reviewing"
+	ReportActioned  = "actioned"
+	ReportDismissed = "dismissed"
+)
+
+// what a moderator can do about the content of an actioned report
+const (
+	ReportActionHide    = "hide"
+	ReportActionSuspend = "suspend"
+)
+
+// written to the audit log when a moderator resolves a report
+const AuditReportResolve = "report.resolve"
+
+var reportReasons = map[string]bool{"spam": true, "harassment": true, "inappropriate": true, "copyright": true, "other": true}
+
+var reportStatuses = map[string]bool{ReportOpen: true, ReportReviewing: true, ReportActioned: true, ReportDismissed: true}
+
+const (
+	maxReportDetailsLength    = 1000
+	maxReportResolutionLength = 1000
+)
+
+type ReportService interface {
+	// Reports a recipe, by its id, or a profile, by its username, to the moderators.
+	// Returns ErrReportData if the type or reason is unknown, the details are too long or the
+	// content is the reporter's own.
+	// Returns ErrNoRecipe if the recipe does not exist.
+	// Returns ErrRecipeForbidden if the reporter can not view the recipe.
+	// Returns ErrNoProfile if the profile does not exist.
+	// Returns ErrReportExists if the reporter already has an unresolved report about it.
+	CreateReport(reporterId string, targetType string, targetId string, reason string, details string) (admin.Report, error)
+
+	// Gets a page of the reports with status, or of the unresolved reports when status is
+	// empty, oldest first.
+	// Returns ErrReportData if the status is unknown.
+	GetReportQueue(status string, offset int, limit int) (ReportPage, error)
+
+	// Moves a report to status, hiding the reported recipe or suspending the profile the
+	// reported content belongs to when action is set. Actioning a report resolves the other
+	// unresolved reports about the same content with it. Either all of it happens or none of it.
+	// Returns ErrReportData if the status or action is unknown, or action is set without
+	// actioning the report or does not apply to what was reported.
+	// Returns ErrNoReport if the report does not exist.
+	// Returns ErrReportResolved if the report was already actioned or dismissed.
+	// Returns ErrNoRecipe if the reported recipe was removed since.
+	// Returns ErrRoleForbidden if the actor can't suspend the profile.
+	TriageReport(actorId string, id int, status string, action string, resolution string) (admin.Report, error)
+
+	// Gets a page of the reports about the content of a profile, most recent first, without
+	// who reported it.
+	GetOwnReports(profileId string, offset int, limit int) (ReportPage, error)
+}
+
+type ReportPage struct {
+	Reports []admin.Report `json:"reports"`
+	Offset  int            `json:"offset"`
+	Limit   int            `json:"limit"`
+	Total   int            `json:"total"`
+}
+
+type reportService struct {
+	adminRepo     admin.AdminRepository
+	profileRepo   profile.ProfileRepository
+	recipeService RecipeService
+	now           func() time.Time
+}
+
+func NewReportService(adminRepo admin.AdminRepository, profileRepo profile.ProfileRepository, recipeService RecipeService) ReportService {
+	return &reportService{adminRepo, profileRepo, recipeService, time.Now}
+}
+
+// Reports a recipe, by its id, or a profile, by its username, to the moderators.
+// Returns ErrReportData if the type or reason is unknown, the details are too long or the
+// content is the reporter's own.
+// Returns ErrNoRecipe if the recipe does not exist.
+// Returns ErrRecipeForbidden if the reporter can not view the recipe.
+// Returns ErrNoProfile if the profile does not exist.
+// Returns ErrReportExists if the reporter already has an unresolved report about it.
+func (s *reportService) CreateReport(reporterId string, targetType string, targetId string, reason string, details string) (admin.Report, error) {
+	details = strings.TrimSpace(details)
+	if !reportReasons[reason] {
+		return admin.Report{}, fmt.Errorf("%w: unknown reason %q", ErrReportData, reason)
+	}
+
+	if utf8.RuneCountInString(details) > maxReportDetailsLength {
+		return admin.Report{}, fmt.Errorf("%w: details must be at most %d characters", ErrReportData, maxReportDetailsLength)
+	}
+
+	reporter, err := s.profileById(reporterId)
+	if err != nil {
+		return admin.Report{}, err
+	}
+
+	var owner profile.Profile
+	switch targetType {
+	case ReportRecipe:
+		id, err := strconv.Atoi(targetId)
+		if err != nil {
+			return admin.Report{}, ErrNoRecipe
+		}
+
+		// only what the reporter can see can be reported, so reports don't reveal private recipes
+		r, err := s.recipeService.GetRecipeForUsername(id, reporter.Username)
+		if err != nil {
+			return admin.Report{}, err
+		}
+
+		if owner, err = s.profileByUsername(r.Username); err != nil {
+			return admin.Report{}, err
+		}
+		targetId = strconv.Itoa(r.Id)
+	case ReportProfile:
+		if owner, err = s.profileByUsername(targetId); err != nil {
+			return admin.Report{}, err
+		}
+		targetId = owner.Id
+	default:
+		return admin.Report{}, fmt.Errorf("%w: only recipes and profiles can be reported", ErrReportData)
+	}
+
+	if owner.Id == reporter.Id {
+		return admin.Report{}, fmt.Errorf("%w: can't report your own %s", ErrReportData, targetType)
+	}
+
+	result, inserted, err := s.adminRepo.InsertReport(admin.Report{
+		ReporterId: reporter.Id,
+		TargetType: targetType,
+		TargetId:   targetId,
+		OwnerId:    owner.Id,
+		Reason:     reason,
+		Details:    details,
+		Created:    s.now(),
+	})
+	if err != nil {
+		return admin.Report{}, fmt.Errorf("CreateReport failed to insert report: %w", err)
+	}
+
+	if !inserted {
+		return admin.Report{}, ErrReportExists
+	}
+	result.ReporterUsername = reporter.Username
+
+	return result, nil
+}
+
+// Gets a page of the reports with status, or of the unresolved reports when status is empty,
+// oldest first.
+// Returns ErrReportData if the status is unknown.
+func (s *reportService) GetReportQueue(status string, offset int, limit int) (ReportPage, error) {
+	statuses := []string{ReportOpen, ReportReviewing}
+	if status != "" {
+		if !reportStatuses[status] {
+			return ReportPage{}, fmt.Errorf("%w: unknown status %q", ErrReportData, status)
+		}
+		statuses = []string{status}
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	if limit <= 0 {
+		limit = 10
+	}
+
+	reports, err := s.adminRepo.SelectReports(statuses, offset, limit)
+	if err != nil {
+		return ReportPage{}, fmt.Errorf("GetReportQueue failed to get reports: %w", err)
+	}
+
+	total, err := s.adminRepo.SelectReportCount(statuses)
+	if err != nil {
+		return ReportPage{}, fmt.Errorf("GetReportQueue failed to count reports: %w", err)
+	}
+
+	return ReportPage{
+		Reports: reports,
+		Offset:  offset,
+		Limit:   limit,
+		Total:   total,
+	}, nil
+}
+
+// Moves a report to status, hiding the reported recipe or suspending the profile the reported
+// content belongs to when action is set. Actioning a report resolves the other unresolved
+// reports about the same content with it. Either all of it happens or none of it.
+// Returns ErrReportData if the status or action is unknown, or action is set without actioning
+// the report or does not apply to what was reported.
+// Returns ErrNoReport if the report does not exist.
+// Returns ErrReportResolved if the report was already actioned or dismissed.
+// Returns ErrNoRecipe if the reported recipe was removed since.
+// Returns ErrRoleForbidden if the actor can't suspend the profile.
+func (s *reportService) TriageReport(actorId string, id int, status string, action string, resolution string) (admin.Report, error) {
+	resolution = strings.TrimSpace(resolution)
+	if !reportStatuses[status] {
+		return admin.Report{}, fmt.Errorf("%w: unknown status %q", ErrReportData, status)
+	}
+
+	if utf8.RuneCountInString(resolution) > maxReportResolutionLength {
+		return admin.Report{}, fmt.Errorf("%w: resolution must be at most %d characters", ErrReportData, maxReportResolutionLength)
+	}
+
+	if action != "" && action != ReportActionHide && action != ReportActionSuspend {
+		return admin.Report{}, fmt.Errorf("%w: unknown action %q", ErrReportData, action)
+	}
+
+	if action != "" && status != ReportActioned {
+		return admin.Report{}, fmt.Errorf("%w: only actioned reports can %s", ErrReportData, action)
+	}
+
+	report, err := s.adminRepo.SelectReport(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return admin.Report{}, ErrNoReport
+	}
+	if err != nil {
+		return admin.Report{}, fmt.Errorf("TriageReport failed to get report: %w", err)
+	}
+
+	if report.Status == ReportActioned || report.Status == ReportDismissed {
+		return admin.Report{}, ErrReportResolved
+	}
+
+	// the audit entry of the action points back at the report
+	reason := fmt.Sprintf("report %d", report.Id)
+	if resolution != "" {
+		reason += ": " + resolution
+	}
+
+	var moderation admin.Moderation
+	var entries []admin.AuditEntry
+
+	switch action {
+	case ReportActionHide:
+		if report.TargetType != ReportRecipe {
+			return admin.Report{}, fmt.Errorf("%w: only reported recipes can be hidden", ErrReportData)
+		}
+
+		recipeId, _ := strconv.Atoi(report.TargetId)
+		if _, err := s.recipeService.GetRecipe(recipeId); err != nil {
+			return admin.Report{}, err
+		}
+
+		moderation.HideRecipeId = recipeId
+		entries = append(entries, s.auditEntry(actorId, AuditRecipeHide, "recipe", report.TargetId, reason))
+	case ReportActionSuspend:
+		actor, err := s.profileById(actorId)
+		if err != nil {
+			return admin.Report{}, err
+		}
+
+		owner, err := s.profileById(report.OwnerId)
+		if err != nil {
+			return admin.Report{}, err
+		}
+
+		if !canModerate(actor, owner) {
+			return admin.Report{}, ErrRoleForbidden
+		}
+
+		moderation.SuspendProfileId = owner.Id
+		entries = append(entries, s.auditEntry(actorId, AuditProfileSuspend, "profile", owner.Id, reason))
+	}
+
+	report.Status = status
+	report.Resolution = resolution
+	report.HandlerId = actorId
+	report.Updated = s.now()
+
+	if status == ReportActioned || status == ReportDismissed {
+		details := status
+		if resolution != "" {
+			details += ": " + resolution
+		}
+
+		entries = append(entries, s.auditEntry(actorId, AuditReportResolve, "report", strconv.Itoa(report.Id), details))
+	}
+
+	// the report, what was done about it and the audit log are written at once
+	if err := s.adminRepo.TriageReport(report, moderation, entries); err != nil {
+		return admin.Report{}, fmt.Errorf("TriageReport failed to update report: %w", err)
+	}
+
+	return report, nil
+}
+
+// Gets a page of the reports about the content of a profile, most recent first, without who
+// reported it.
+func (s *reportService) GetOwnReports(profileId string, offset int, limit int) (ReportPage, error) {
+	if offset < 0 {
+		offset = 0
+	}
+
+	if limit <= 0 {
+		limit = 10
+	}
+
+	reports, err := s.adminRepo.SelectReportsByOwner(profileId, offset, limit)
+	if err != nil {
+		return ReportPage{}, fmt.Errorf("GetOwnReports failed to get reports: %w", err)
+	}
+
+	total, err := s.adminRepo.SelectReportCountByOwner(profileId)
+	if err != nil {
+		return ReportPage{}, fmt.Errorf("GetOwnReports failed to count reports: %w", err)
+	}
+
+	// reporters stay anonymous, and so do the moderators handling their reports
+	for i := range reports {
+		reports[i].ReporterId = ""
+		reports[i].ReporterUsername = ""
+		reports[i].Details = ""
+		reports[i].HandlerId = ""
+	}
+
+	return ReportPage{
+		Reports: reports,
+		Offset:  offset,
+		Limit:   limit,
+		Total:   total,
+	}, nil
+}
+
+// The audit log entry of what an actor did, written along with the report.
+func (s *reportService) auditEntry(actorId string, action string, targetType string, targetId string, details string) admin.AuditEntry {
+	return admin.AuditEntry{
+		ActorId:    actorId,
+		Action:     action,
+		TargetType: targetType,
+		TargetId:   targetId,
+		Details:    details,
+		Created:    s.now(),
+	}
+}
+
+func (s *reportService) profileById(id string) (profile.Profile, error) {
+	p, err := s.profileRepo.SelectProfileById(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return profile.Profile{}, ErrNoProfile
+	}
+	if err != nil {
+		return profile.Profile{}, fmt.Errorf("failed to get profile: %w", err)
+	}
+
+	return p, nil
+}
+
+func (s *reportService) profileByUsername(username string) (profile.Profile, error) {
+	p, err := s.profileRepo.SelectProfileByUsername(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return profile.Profile{}, ErrNoProfile
+	}
+	if err != nil {
+		return profile.Profile{}, fmt.Errorf("failed to get profile: %w", err)
+	}
+
+	return p, nil
+}
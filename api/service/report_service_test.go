@@ -0,0 +1,222 @@
+package service
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/eciccone/rh/api/repo/admin"
+	"github.com/eciccone/rh/api/repo/recipe"
+	"github.com/stretchr/testify/assert"
+)
+
+// a recipe repo with a public and a private recipe of the cook
+func reportedRecipeRepo() *RecipeRepoMocker {
+	return &RecipeRepoMocker{
+		SelectRecipeByIdMock: func(id int) (recipe.Recipe, error) {
+			switch id {
+			case 4:
+				return recipe.Recipe{Id: 4, Name: "Soup", Username: "cook", Visibility: VisibilityPublic}, nil
+			case 5:
+				return recipe.Recipe{Id: 5, Name: "Stew", Username: "cook", Visibility: VisibilityPrivate}, nil
+			}
+			return recipe.Recipe{}, sql.ErrNoRows
+		},
+		SelectRecipeGrantRoleMock: noGrants,
+	}
+}
+
+// an admin repo with an open report by the moderator about the public recipe, and a reviewed
+// one by the admin about the cook
+func newReportRepo() (*AdminRepoMocker, *[]admin.Report, *[]admin.AuditEntry) {
+	ar, entries := newAuditRepo()
+	reports := &[]admin.Report{
+		{Id: 1, ReporterId: "moderator-id", TargetType: ReportRecipe, TargetId: "4", OwnerId: "cook-id", Reason: "spam", Status: ReportOpen},
+		{Id: 2, ReporterId: "admin-id", TargetType: ReportProfile, TargetId: "cook-id", OwnerId: "cook-id", Reason: "harassment", Details: "rude", Status: ReportReviewing},
+		{Id: 3, ReporterId: "admin-id", TargetType: ReportRecipe, TargetId: "4", OwnerId: "cook-id", Reason: "spam", Status: ReportDismissed},
+	}
+
+	ar.InsertReportMock = func(report admin.Report) (admin.Report, bool, error) {
+		for _, r := range *reports {
+			if r.ReporterId == report.ReporterId && r.TargetType == report.TargetType && r.TargetId == report.TargetId && (r.Status == ReportOpen || r.Status == ReportReviewing) {
+				return admin.Report{}, false, nil
+			}
+		}
+		report.Id = len(*reports) + 1
+		report.Status = ReportOpen
+		*reports = append(*reports, report)
+		return report, true, nil
+	}
+	ar.SelectReportMock = func(id int) (admin.Report, error) {
+		for _, r := range *reports {
+			if r.Id == id {
+				return r, nil
+			}
+		}
+		return admin.Report{}, sql.ErrNoRows
+	}
+	ar.TriageReportMock = func(report admin.Report, moderation admin.Moderation, triaged []admin.AuditEntry) error {
+		(*reports)[report.Id-1] = report
+		if report.Status == ReportActioned {
+			for i, r := range *reports {
+				if r.TargetType == report.TargetType && r.TargetId == report.TargetId && (r.Status == ReportOpen || r.Status == ReportReviewing) {
+					(*reports)[i].Status = report.Status
+					(*reports)[i].Resolution = report.Resolution
+				}
+			}
+		}
+		*entries = append(*entries, triaged...)
+		return nil
+	}
+
+	return ar, reports, entries
+}
+
+func newReportService(ar *AdminRepoMocker) ReportService {
+	pr := newModerationProfileRepo()
+	rs := NewRecipeService(reportedRecipeRepo(), &ImageServiceMocker{})
+	return NewReportService(ar, pr, rs)
+}
+
+func Test_CreateReport(t *testing.T) {
+	ar, reports, _ := newReportRepo()
+	rs := newReportService(ar)
+
+	result, err := rs.CreateReport("admin-id", ReportRecipe, "4", "spam", " ads everywhere ")
+	assert.NoError(t, err)
+	assert.Equal(t, "cook-id", result.OwnerId)
+	assert.Equal(t, "ads everywhere", result.Details)
+	assert.Equal(t, "admin", result.ReporterUsername)
+	assert.Len(t, *reports, 4)
+
+	result, err = rs.CreateReport("moderator-id", ReportProfile, "cook", "other", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "cook-id", result.TargetId)
+
+	_, err = rs.CreateReport("moderator-id", ReportRecipe, "4", "spam", "")
+	assert.ErrorIs(t, err, ErrReportExists)
+
+	_, err = rs.CreateReport("moderator-id", ReportRecipe, "5", "spam", "")
+	assert.ErrorIs(t, err, ErrRecipeForbidden)
+
+	_, err = rs.CreateReport("moderator-id", ReportRecipe, "6", "spam", "")
+	assert.ErrorIs(t, err, ErrNoRecipe)
+
+	_, err = rs.CreateReport("moderator-id", ReportProfile, "nobody", "spam", "")
+	assert.ErrorIs(t, err, ErrNoProfile)
+
+	_, err = rs.CreateReport("cook-id", ReportRecipe, "5", "spam", "")
+	assert.ErrorIs(t, err, ErrReportData)
+
+	_, err = rs.CreateReport("moderator-id", "comment", "1", "spam", "")
+	assert.ErrorIs(t, err, ErrReportData)
+
+	_, err = rs.CreateReport("moderator-id", ReportRecipe, "4", "boring", "")
+	assert.ErrorIs(t, err, ErrReportData)
+	assert.Len(t, *reports, 5)
+}
+
+func Test_GetReportQueue(t *testing.T) {
+	var queried [][]string
+	ar := &AdminRepoMocker{
+		SelectReportsMock: func(statuses []string, offset int, limit int) ([]admin.Report, error) {
+			queried = append(queried, statuses)
+			assert.Equal(t, 0, offset)
+			assert.Equal(t, 10, limit)
+			return []admin.Report{}, nil
+		},
+		SelectReportCountMock: func(statuses []string) (int, error) {
+			return 0, nil
+		},
+	}
+	rs := NewReportService(ar, nil, nil)
+
+	_, err := rs.GetReportQueue("", -1, 0)
+	assert.NoError(t, err)
+	_, err = rs.GetReportQueue(ReportDismissed, 0, 10)
+	assert.NoError(t, err)
+	_, err = rs.GetReportQueue("closed", 0, 10)
+	assert.ErrorIs(t, err, ErrReportData)
+
+	assert.Equal(t, [][]string{{ReportOpen, ReportReviewing}, {ReportDismissed}}, queried)
+}
+
+func Test_TriageReport(t *testing.T) {
+	ar, reports, entries := newReportRepo()
+	rs := newReportService(ar).(*reportService)
+	rs.now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	// the report is written with what was done about it
+	var moderations []admin.Moderation
+	triage := ar.TriageReportMock
+	ar.TriageReportMock = func(report admin.Report, moderation admin.Moderation, entries []admin.AuditEntry) error {
+		moderations = append(moderations, moderation)
+		return triage(report, moderation, entries)
+	}
+
+	_, err := rs.TriageReport("moderator-id", 1, ReportReviewing, ReportActionHide, "")
+	assert.ErrorIs(t, err, ErrReportData)
+	_, err = rs.TriageReport("moderator-id", 2, ReportActioned, ReportActionHide, "")
+	assert.ErrorIs(t, err, ErrReportData)
+	_, err = rs.TriageReport("moderator-id", 1, "closed", "", "")
+	assert.ErrorIs(t, err, ErrReportData)
+	assert.EqualError(t, err, `invalid report: unknown status "closed"`)
+	_, err = rs.TriageReport("moderator-id", 9, ReportDismissed, "", "")
+	assert.ErrorIs(t, err, ErrNoReport)
+	_, err = rs.TriageReport("moderator-id", 3, ReportActioned, "", "")
+	assert.ErrorIs(t, err, ErrReportResolved)
+	assert.Empty(t, *entries)
+
+	result, err := rs.TriageReport("moderator-id", 1, ReportReviewing, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "moderator-id", result.HandlerId)
+	assert.Empty(t, *entries)
+
+	// a second report about the soup is settled along with the first
+	_, err = rs.CreateReport("admin-id", ReportRecipe, "4", "spam", "")
+	assert.NoError(t, err)
+
+	result, err = rs.TriageReport("moderator-id", 1, ReportActioned, ReportActionHide, "advert")
+	assert.NoError(t, err)
+	assert.Equal(t, ReportActioned, result.Status)
+	assert.Equal(t, time.Unix(1700000000, 0), result.Updated)
+	assert.Equal(t, ReportActioned, (*reports)[3].Status)
+	assert.Equal(t, "advert", (*reports)[3].Resolution)
+
+	assert.Len(t, *entries, 2)
+	assert.Equal(t, AuditRecipeHide, (*entries)[0].Action)
+	assert.Equal(t, "report 1: advert", (*entries)[0].Details)
+	assert.Equal(t, AuditReportResolve, (*entries)[1].Action)
+	assert.Equal(t, "1", (*entries)[1].TargetId)
+
+	_, err = rs.TriageReport("admin-id", 2, ReportActioned, ReportActionSuspend, "")
+	assert.NoError(t, err)
+	assert.Len(t, *entries, 4)
+	assert.Equal(t, AuditProfileSuspend, (*entries)[2].Action)
+	assert.Equal(t, "cook-id", (*entries)[2].TargetId)
+
+	assert.Equal(t, []admin.Moderation{{}, {HideRecipeId: 4}, {SuspendProfileId: "cook-id"}}, moderations)
+}
+
+func Test_GetOwnReports(t *testing.T) {
+	ar, reports, _ := newReportRepo()
+	ar.SelectReportsByOwnerMock = func(ownerId string, offset int, limit int) ([]admin.Report, error) {
+		assert.Equal(t, "cook-id", ownerId)
+		return append([]admin.Report{}, *reports...), nil
+	}
+	ar.SelectReportCountByOwnerMock = func(ownerId string) (int, error) {
+		return len(*reports), nil
+	}
+	rs := newReportService(ar)
+
+	result, err := rs.GetOwnReports("cook-id", 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, result.Total)
+	assert.Equal(t, 10, result.Limit)
+	for _, r := range result.Reports {
+		assert.Empty(t, r.ReporterId)
+		assert.Empty(t, r.Details)
+		assert.Empty(t, r.HandlerId)
+	}
+	assert.Equal(t, "rude", (*reports)[1].Details)
+}
@@ -0,0 +1,206 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/eciccone/rh/api/repo/token"
+)
+
+var (
+	ErrTokenData            = errors.New("invalid access token details")
+	ErrNoToken              = errors.New("access token not found")
+	ErrInvalidPersonalToken = errors.New("invalid access token")
+)
+
+// PersonalTokenPrefix starts every personal access token, telling them apart from the access
+// tokens of providers.
+const PersonalTokenPrefix = "rhp_"
+
+// scopes a personal access token can carry
+const (
+	ScopeRecipesRead  = "recipes:read"
+	ScopeRecipesWrite = "recipes:write"
+	ScopeImagesWrite  = "images:write"
+)
+
+var personalTokenScopes = map[string]bool{
+	ScopeRecipesRead:  true,
+	ScopeRecipesWrite: true,
+	ScopeImagesWrite:  true,
+}
+
+const (
+	maxPersonalTokens          = 50
+	maxPersonalTokenNameLength = 100
+
+	// how stale the last used time of a token may get, so busy scripts don't write on every
+	// request
+	tokenLastUsedResolution = time.Minute
+)
+
+type TokenService interface {
+	// Creates a personal access token for a profile. The token itself is only ever returned
+	// here.
+	// Returns ErrTokenData if the name, scopes or expiry are invalid or the profile has too many
+	// tokens.
+	CreateToken(profileId string, name string, scopes []string, expires *time.Time) (NewPersonalToken, error)
+
+	// Gets the personal access tokens of a profile, most recently created first.
+	ListTokens(profileId string) ([]token.PersonalToken, error)
+
+	// Returns ErrNoToken if the profile has no token with the id.
+	RevokeToken(profileId string, id int) error
+
+	// Gets the personal access token a request was made with and records its use.
+	// Returns ErrInvalidPersonalToken if there is no such token or it expired.
+	Authenticate(raw string) (token.PersonalToken, error)
+}
+
+// NewPersonalToken is a personal access token along with the token itself, which is not stored.
+type NewPersonalToken struct {
+	token.PersonalToken
+	Token string `json:"token"`
+}
+
+type tokenService struct {
+	tokenRepo token.TokenRepository
+	now       func() time.Time
+}
+
+func NewTokenService(tokenRepo token.TokenRepository) TokenService {
+	return &tokenService{tokenRepo, time.Now}
+}
+
+// Creates a personal access token for a profile. The token itself is only ever returned here.
+// Returns ErrTokenData if the name, scopes or expiry are invalid or the profile has too many
+// tokens.
+func (s *tokenService) CreateToken(profileId string, name string, scopes []string, expires *time.Time) (NewPersonalToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxPersonalTokenNameLength {
+		return NewPersonalToken{}, fmt.Errorf("%w: name must be 1 to %d characters", ErrTokenData, maxPersonalTokenNameLength)
+	}
+
+	scopes, err := normalizeScopes(scopes)
+	if err != nil {
+		return NewPersonalToken{}, err
+	}
+
+	now := s.now()
+	if expires != nil && !expires.After(now) {
+		return NewPersonalToken{}, fmt.Errorf("%w: expiry must be in the future", ErrTokenData)
+	}
+
+	existing, err := s.tokenRepo.SelectTokens(profileId)
+	if err != nil {
+		return NewPersonalToken{}, fmt.Errorf("CreateToken failed to select tokens: %w", err)
+	}
+
+	if len(existing) >= maxPersonalTokens {
+		return NewPersonalToken{}, fmt.Errorf("%w: at most %d tokens", ErrTokenData, maxPersonalTokens)
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return NewPersonalToken{}, fmt.Errorf("CreateToken failed to generate token: %w", err)
+	}
+	raw := PersonalTokenPrefix + secret
+
+	t, err := s.tokenRepo.InsertToken(token.PersonalToken{
+		ProfileId: profileId,
+		Name:      name,
+		TokenHash: hashToken(raw),
+		Scopes:    scopes,
+		Created:   now,
+		Expires:   expires,
+	})
+	if err != nil {
+		return NewPersonalToken{}, fmt.Errorf("CreateToken failed to insert token: %w", err)
+	}
+
+	return NewPersonalToken{t, raw}, nil
+}
+
+// Gets the personal access tokens of a profile, most recently created first.
+func (s *tokenService) ListTokens(profileId string) ([]token.PersonalToken, error) {
+	tokens, err := s.tokenRepo.SelectTokens(profileId)
+	if err != nil {
+		return nil, fmt.Errorf("ListTokens failed to select tokens: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// Returns ErrNoToken if the profile has no token with the id.
+func (s *tokenService) RevokeToken(profileId string, id int) error {
+	deleted, err := s.tokenRepo.DeleteToken(profileId, id)
+	if err != nil {
+		return fmt.Errorf("RevokeToken failed to delete token: %w", err)
+	}
+
+	if !deleted {
+		return ErrNoToken
+	}
+
+	return nil
+}
+
+// Gets the personal access token a request was made with and records its use.
+// Returns ErrInvalidPersonalToken if there is no such token or it expired.
+func (s *tokenService) Authenticate(raw string) (token.PersonalToken, error) {
+	if !strings.HasPrefix(raw, PersonalTokenPrefix) {
+		return token.PersonalToken{}, ErrInvalidPersonalToken
+	}
+
+	t, err := s.tokenRepo.SelectTokenByHash(hashToken(raw))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return token.PersonalToken{}, ErrInvalidPersonalToken
+		}
+
+		return token.PersonalToken{}, fmt.Errorf("Authenticate failed to select token: %w", err)
+	}
+
+	now := s.now()
+	if t.Expires != nil && !t.Expires.After(now) {
+		return token.PersonalToken{}, ErrInvalidPersonalToken
+	}
+
+	// failing to record the use of a token shouldn't fail the request made with it
+	if err := s.tokenRepo.UpdateTokenLastUsed(t.Id, now, now.Add(-tokenLastUsedResolution)); err != nil {
+		log.Printf("failed to record use of access token %d: %v", t.Id, err)
+	}
+
+	return t, nil
+}
+
+// Checks scopes are known, removing duplicates and sorting them.
+// Returns ErrTokenData if there are none or any is unknown.
+func normalizeScopes(scopes []string) ([]string, error) {
+	seen := make(map[string]bool, len(scopes))
+	result := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if !personalTokenScopes[scope] {
+			return nil, fmt.Errorf("%w: unknown scope %q", ErrTokenData, scope)
+		}
+
+		if !seen[scope] {
+			seen[scope] = true
+			result = append(result, scope)
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%w: requires at least one scope", ErrTokenData)
+	}
+
+	sort.Strings(result)
+
+	return result, nil
+}
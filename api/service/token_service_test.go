@@ -0,0 +1,136 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eciccone/rh/api/repo/token"
+	"github.com/stretchr/testify/assert"
+)
+
+type TokenRepoMocker struct {
+	InsertTokenMock         func(t token.PersonalToken) (token.PersonalToken, error)
+	SelectTokensMock        func(profileId string) ([]token.PersonalToken, error)
+	SelectTokenByHashMock   func(hash string) (token.PersonalToken, error)
+	UpdateTokenLastUsedMock func(id int, used time.Time, before time.Time) error
+	DeleteTokenMock         func(profileId string, id int) (bool, error)
+}
+
+func (r *TokenRepoMocker) InsertToken(t token.PersonalToken) (token.PersonalToken, error) {
+	return r.InsertTokenMock(t)
+}
+
+func (r *TokenRepoMocker) SelectTokens(profileId string) ([]token.PersonalToken, error) {
+	return r.SelectTokensMock(profileId)
+}
+
+func (r *TokenRepoMocker) SelectTokenByHash(hash string) (token.PersonalToken, error) {
+	return r.SelectTokenByHashMock(hash)
+}
+
+func (r *TokenRepoMocker) UpdateTokenLastUsed(id int, used time.Time, before time.Time) error {
+	return r.UpdateTokenLastUsedMock(id, used, before)
+}
+
+func (r *TokenRepoMocker) DeleteToken(profileId string, id int) (bool, error) {
+	return r.DeleteTokenMock(profileId, id)
+}
+
+func Test_CreateToken(t *testing.T) {
+	now := time.Date(2022, 3, 2, 12, 0, 0, 0, time.UTC)
+	var inserted token.PersonalToken
+
+	tr := &TokenRepoMocker{
+		SelectTokensMock: func(profileId string) ([]token.PersonalToken, error) {
+			if profileId == "full-id" {
+				return make([]token.PersonalToken, maxPersonalTokens), nil
+			}
+			return []token.PersonalToken{}, nil
+		},
+		InsertTokenMock: func(t token.PersonalToken) (token.PersonalToken, error) {
+			inserted = t
+			t.Id = 7
+			return t, nil
+		},
+	}
+	ts := &tokenService{tr, func() time.Time { return now }}
+
+	result, err := ts.CreateToken("test-id", " backup ", []string{ScopeRecipesWrite, ScopeRecipesRead, ScopeRecipesWrite}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, result.Id)
+	assert.Equal(t, "backup", result.Name)
+	assert.Equal(t, []string{ScopeRecipesRead, ScopeRecipesWrite}, result.Scopes)
+	assert.True(t, strings.HasPrefix(result.Token, PersonalTokenPrefix))
+	// only the hash is stored
+	assert.Equal(t, hashToken(result.Token), inserted.TokenHash)
+	assert.Equal(t, now, inserted.Created)
+
+	past := now.Add(-time.Hour)
+	_, err = ts.CreateToken("test-id", "backup", []string{ScopeRecipesRead}, &past)
+	assert.ErrorIs(t, err, ErrTokenData)
+	_, err = ts.CreateToken("test-id", "backup", []string{"admin"}, nil)
+	assert.ErrorIs(t, err, ErrTokenData)
+	_, err = ts.CreateToken("test-id", "backup", nil, nil)
+	assert.ErrorIs(t, err, ErrTokenData)
+	_, err = ts.CreateToken("test-id", "  ", []string{ScopeRecipesRead}, nil)
+	assert.ErrorIs(t, err, ErrTokenData)
+	_, err = ts.CreateToken("full-id", "backup", []string{ScopeRecipesRead}, nil)
+	assert.ErrorIs(t, err, ErrTokenData)
+}
+
+func Test_RevokeToken(t *testing.T) {
+	tr := &TokenRepoMocker{
+		DeleteTokenMock: func(profileId string, id int) (bool, error) {
+			if id == 500 {
+				return false, errors.New("failed")
+			}
+			return profileId == "test-id", nil
+		},
+	}
+	ts := NewTokenService(tr)
+
+	assert.NoError(t, ts.RevokeToken("test-id", 1))
+	assert.ErrorIs(t, ts.RevokeToken("other-id", 1), ErrNoToken)
+	assert.Error(t, ts.RevokeToken("test-id", 500))
+}
+
+func Test_Authenticate(t *testing.T) {
+	now := time.Date(2022, 3, 2, 12, 0, 0, 0, time.UTC)
+	expired := now.Add(-time.Second)
+	later := now.Add(time.Hour)
+	var used []int
+
+	tr := &TokenRepoMocker{
+		SelectTokenByHashMock: func(hash string) (token.PersonalToken, error) {
+			switch hash {
+			case hashToken("rhp_valid"):
+				return token.PersonalToken{Id: 1, ProfileId: "test-id", Scopes: []string{ScopeRecipesRead}, Expires: &later}, nil
+			case hashToken("rhp_expired"):
+				return token.PersonalToken{Id: 2, ProfileId: "test-id", Expires: &expired}, nil
+			}
+			return token.PersonalToken{}, sql.ErrNoRows
+		},
+		UpdateTokenLastUsedMock: func(id int, at time.Time, before time.Time) error {
+			assert.Equal(t, now.Add(-tokenLastUsedResolution), before)
+			used = append(used, id)
+			return errors.New("failed")
+		},
+	}
+	ts := &tokenService{tr, func() time.Time { return now }}
+
+	// failing to record use doesn't fail authentication
+	result, err := ts.Authenticate("rhp_valid")
+	assert.NoError(t, err)
+	assert.Equal(t, "test-id", result.ProfileId)
+
+	_, err = ts.Authenticate("rhp_expired")
+	assert.ErrorIs(t, err, ErrInvalidPersonalToken)
+	_, err = ts.Authenticate("rhp_missing")
+	assert.ErrorIs(t, err, ErrInvalidPersonalToken)
+	_, err = ts.Authenticate("valid")
+	assert.ErrorIs(t, err, ErrInvalidPersonalToken)
+	assert.Equal(t, []int{1}, used)
+}
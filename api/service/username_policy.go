@@ -0,0 +1,115 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/eciccone/rh/api/repo/profile"
+	"golang.org/x/text/unicode/norm"
+)
+
+// UsernamePolicy decides which usernames profiles can have. Usernames are unique regardless of
+// case, and usernames that only differ by characters that look alike, like "b0b" and "bob",
+// count as the same username.
+type UsernamePolicy struct {
+	MinLength int
+	MaxLength int
+
+	// the characters a username can have, it has to be anchored to match the whole username
+	Pattern *regexp.Regexp
+
+	// usernames nobody can take, look-alikes of them are reserved too
+	Reserved []string
+}
+
+// Letters, numbers, underscores, hyphens and periods, starting and ending with a letter or
+// number.
+var defaultUsernamePattern = regexp.MustCompile(`^[A-Za-z0-9](?:[A-Za-z0-9_.-]*[A-Za-z0-9])?$`)
+
+// names that could be mistaken for the site itself, or for a path of it
+var defaultReservedUsernames = []string{
+	"admin", "administrator", "moderator", "mod", "staff", "support", "help", "system", "root",
+	"recihub", "official", "api", "www", "mail", "profile", "users", "recipes", "images",
+	"settings", "login", "logout", "signup", "register", "me", "anonymous", "null", "undefined",
+}
+
+func DefaultUsernamePolicy() UsernamePolicy {
+	return UsernamePolicy{
+		MinLength: 3,
+		MaxLength: 30,
+		Pattern:   defaultUsernamePattern,
+		Reserved:  defaultReservedUsernames,
+	}
+}
+
+// Returns the default policy changed by USERNAME_MIN_LENGTH, USERNAME_MAX_LENGTH,
+// USERNAME_PATTERN, a regular expression whole usernames have to match, and USERNAME_RESERVED, a
+// comma separated list of names reserved on top of the default ones.
+func UsernamePolicyFromEnv() (UsernamePolicy, error) {
+	policy := DefaultUsernamePolicy()
+
+	for key, length := range map[string]*int{"USERNAME_MIN_LENGTH": &policy.MinLength, "USERNAME_MAX_LENGTH": &policy.MaxLength} {
+		if value := os.Getenv(key); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return UsernamePolicy{}, fmt.Errorf("invalid %s %q", key, value)
+			}
+			*length = n
+		}
+	}
+	if policy.MinLength > policy.MaxLength {
+		return UsernamePolicy{}, fmt.Errorf("USERNAME_MIN_LENGTH is greater than USERNAME_MAX_LENGTH")
+	}
+
+	if value := os.Getenv("USERNAME_PATTERN"); value != "" {
+		// anchored, so a pattern like [a-z]+ can't match just part of a username
+		pattern, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return UsernamePolicy{}, fmt.Errorf("invalid USERNAME_PATTERN: %w", err)
+		}
+		policy.Pattern = pattern
+	}
+
+	if value := os.Getenv("USERNAME_RESERVED"); value != "" {
+		reserved := append([]string{}, policy.Reserved...)
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				reserved = append(reserved, name)
+			}
+		}
+		policy.Reserved = reserved
+	}
+
+	return policy, nil
+}
+
+// Checks a username against the policy and returns it normalized, along with the key it is
+// unique by.
+// Returns a ValidationError wrapping ErrProfileData if the username is not allowed.
+func (p UsernamePolicy) Validate(username string) (string, string, error) {
+	username = norm.NFKC.String(strings.TrimSpace(username))
+	if username == "" {
+		return "", "", fieldError(ErrProfileData, "username", "is required")
+	}
+
+	if n := utf8.RuneCountInString(username); n < p.MinLength || n > p.MaxLength {
+		return "", "", fieldError(ErrProfileData, "username", fmt.Sprintf("must be between %d and %d characters", p.MinLength, p.MaxLength))
+	}
+
+	if p.Pattern != nil && !p.Pattern.MatchString(username) {
+		return "", "", fieldError(ErrProfileData, "username", "contains characters that are not allowed")
+	}
+
+	key := profile.UsernameKey(username)
+	for _, reserved := range p.Reserved {
+		if key == profile.UsernameKey(reserved) {
+			return "", "", fieldError(ErrProfileData, "username", "is reserved")
+		}
+	}
+
+	return username, key, nil
+}
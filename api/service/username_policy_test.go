@@ -0,0 +1,85 @@
+package service
+
+import (
+	"os"
+	"testing"
+
+	"github.com/eciccone/rh/api/repo/profile"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UsernamePolicyValidate(t *testing.T) {
+	policy := DefaultUsernamePolicy()
+
+	td := []struct {
+		Username string
+		Expected string
+		Field    string
+	}{
+		{Username: "alice", Expected: "alice"},
+		{Username: "  Bob.Smith-99 ", Expected: "Bob.Smith-99"},
+		// fullwidth letters are normalized to ascii
+		{Username: "ｃｈｅｆ", Expected: "chef"},
+		{Username: "", Field: "is required"},
+		{Username: "al", Field: "must be between 3 and 30 characters"},
+		{Username: "abcdefghijklmnopqrstuvwxyz12345", Field: "must be between 3 and 30 characters"},
+		{Username: "test user", Field: "contains characters that are not allowed"},
+		{Username: "chef🍳", Field: "contains characters that are not allowed"},
+		{Username: "_chef", Field: "contains characters that are not allowed"},
+		{Username: "ADMIN", Field: "is reserved"},
+		{Username: "adm1n", Field: "is reserved"},
+		{Username: "r00t", Field: "is reserved"},
+	}
+
+	for _, tr := range td {
+		username, key, err := policy.Validate(tr.Username)
+		if tr.Field == "" {
+			assert.NoError(t, err, tr.Username)
+			assert.Equal(t, tr.Expected, username)
+			assert.Equal(t, profile.UsernameKey(tr.Expected), key)
+			continue
+		}
+
+		assert.ErrorIs(t, err, ErrProfileData, tr.Username)
+		var validationErr *ValidationError
+		if assert.ErrorAs(t, err, &validationErr) {
+			assert.Equal(t, map[string]string{"username": tr.Field}, validationErr.Fields, tr.Username)
+		}
+	}
+}
+
+func Test_UsernamePolicyFromEnv(t *testing.T) {
+	defer os.Unsetenv("USERNAME_MIN_LENGTH")
+	defer os.Unsetenv("USERNAME_PATTERN")
+	defer os.Unsetenv("USERNAME_RESERVED")
+
+	os.Setenv("USERNAME_MIN_LENGTH", "5")
+	// custom patterns have to match the whole username, even when they are not anchored
+	os.Setenv("USERNAME_PATTERN", `[a-z]+`)
+	os.Setenv("USERNAME_RESERVED", "kitchen, chef")
+
+	policy, err := UsernamePolicyFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, 5, policy.MinLength)
+	assert.Equal(t, 30, policy.MaxLength)
+	assert.Contains(t, policy.Reserved, "admin")
+	assert.Contains(t, policy.Reserved, "kitchen")
+
+	_, _, err = policy.Validate("Alice")
+	assert.ErrorIs(t, err, ErrProfileData)
+	_, _, err = policy.Validate("alice!")
+	assert.ErrorIs(t, err, ErrProfileData)
+	_, _, err = policy.Validate("alice")
+	assert.NoError(t, err)
+	_, _, err = policy.Validate("kitchen")
+	assert.ErrorIs(t, err, ErrProfileData)
+
+	os.Setenv("USERNAME_PATTERN", `^[a-z`)
+	_, err = UsernamePolicyFromEnv()
+	assert.Error(t, err)
+
+	os.Setenv("USERNAME_PATTERN", "")
+	os.Setenv("USERNAME_MIN_LENGTH", "50")
+	_, err = UsernamePolicyFromEnv()
+	assert.Error(t, err)
+}
@@ -0,0 +1,35 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ValidationError explains which fields of a request are invalid and why, keyed by field name.
+// It wraps the sentinel error describing the request as a whole, so errors.Is keeps working:
+//
+//	&ValidationError{Err: ErrProfileData, Fields: map[string]string{"username": "is reserved"}}
+type ValidationError struct {
+	Err    error
+	Fields map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for field, msg := range e.Fields {
+		fields = append(fields, fmt.Sprintf("%s %s", field, msg))
+	}
+	sort.Strings(fields)
+
+	return fmt.Sprintf("%s: %s", e.Err, strings.Join(fields, ", "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Returns a ValidationError for a single field.
+func fieldError(err error, field string, msg string) error {
+	return &ValidationError{Err: err, Fields: map[string]string{field: msg}}
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Disk stores blobs as files in a single directory on the local filesystem. The files are
+// expected to be served by the api itself under URLPrefix, which checks the signed urls
+// handed out by URL with Verify.
+type Disk struct {
+	Root      string
+	URLPrefix string
+	Secret    []byte
+
+	// Defaults to time.Now, replaced in tests.
+	Now func() time.Time
+}
+
+// Returns a Disk storing files in root, creating the directory if it does not exist.
+func NewDisk(root string, urlPrefix string, secret []byte) (*Disk, error) {
+	if root == "" {
+		return nil, fmt.Errorf("%w: IMAGE_PATH is required", ErrConfig)
+	}
+
+	// anyone who knows the secret can read every image
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("%w: IMAGE_URL_SECRET must be at least 32 bytes", ErrConfig)
+	}
+
+	// the api serves the files itself, so the prefix is a path on it and not a url elsewhere
+	urlPrefix = strings.TrimSuffix(urlPrefix, "/")
+	if !strings.HasPrefix(urlPrefix, "/") || strings.ContainsAny(urlPrefix, ":*?#") || urlPrefix != path.Clean(urlPrefix) {
+		return nil, fmt.Errorf("%w: IMAGE_URL must be a path like /images, not %q", ErrConfig, urlPrefix)
+	}
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("NewDisk failed to create %s: %w", root, err)
+	}
+
+	return &Disk{Root: root, URLPrefix: urlPrefix, Secret: secret}, nil
+}
+
+func (d *Disk) Create(key string, r io.Reader) error {
+	if !validKey(key) {
+		return fmt.Errorf("Create invalid key %q", key)
+	}
+
+	// write to a temporary file first so readers never see a partially written file
+	tmp, err := os.CreateTemp(d.Root, ".upload-*")
+	if err != nil {
+		return fmt.Errorf("Create failed to create file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Create failed to write file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Create failed to write file: %w", err)
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("Create failed to set file mode: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(d.Root, key)); err != nil {
+		return fmt.Errorf("Create failed to move file into place: %w", err)
+	}
+
+	return nil
+}
+
+func (d *Disk) Open(key string) (io.ReadCloser, error) {
+	if !validKey(key) {
+		return nil, ErrNotExist
+	}
+
+	f, err := os.Open(filepath.Join(d.Root, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Open failed to open file: %w", err)
+	}
+
+	return f, nil
+}
+
+func (d *Disk) Remove(key string) error {
+	if !validKey(key) {
+		return ErrNotExist
+	}
+
+	err := os.Remove(filepath.Join(d.Root, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotExist
+	}
+	if err != nil {
+		return fmt.Errorf("Remove failed to remove file: %w", err)
+	}
+
+	return nil
+}
+
+// Files being written by Create are hidden and are not listed.
+func (d *Disk) List() ([]Object, error) {
+	entries, err := os.ReadDir(d.Root)
+	if err != nil {
+		return nil, fmt.Errorf("List failed to read directory: %w", err)
+	}
+
+	var result []Object
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		info, err := e.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("List failed to stat file: %w", err)
+		}
+
+		result = append(result, Object{Key: e.Name(), Modified: info.ModTime()})
+	}
+
+	return result, nil
+}
+
+func (d *Disk) URL(key string, expires time.Time) string {
+	e := strconv.FormatInt(expires.Unix(), 10)
+
+	q := url.Values{}
+	q.Set("expires", e)
+	q.Set("signature", d.signature(key, e))
+
+	return d.URLPrefix + "/" + url.PathEscape(key) + "?" + q.Encode()
+}
+
+func (d *Disk) Verify(key string, expires string, signature string) error {
+	e, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrSignature
+	}
+
+	now := time.Now
+	if d.Now != nil {
+		now = d.Now
+	}
+
+	if now().Unix() > e {
+		return ErrSignature
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(d.signature(key, expires))) {
+		return ErrSignature
+	}
+
+	return nil
+}
+
+func (d *Disk) signature(key string, expires string) string {
+	h := hmac.New(sha256.New, d.Secret)
+	h.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,381 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Requests to the bucket, reading the response included, give up after this long so a stalled
+// store can't hang requests or garbage collection.
+const defaultS3Timeout = 30 * time.Second
+
+var defaultS3Client = &http.Client{Timeout: defaultS3Timeout}
+
+// S3 stores blobs in a bucket of an S3 compatible object store such as AWS S3 or MinIO.
+// Requests are addressed path style, {Endpoint}/{Bucket}/{key}, which every compatible
+// store supports, and signed with AWS signature version 4.
+type S3 struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	// Base url objects are served publicly from, e.g. a CDN in front of the bucket. When it
+	// is empty urls are presigned bucket urls, which keeps the bucket private.
+	PublicURL string
+
+	// Defaults to a client that gives up after defaultS3Timeout.
+	Client *http.Client
+
+	// Defaults to time.Now, replaced in tests.
+	Now func() time.Time
+}
+
+func (s *S3) Create(key string, r io.Reader) error {
+	if !validKey(key) {
+		return fmt.Errorf("Create invalid key %q", key)
+	}
+
+	// the payload hash is part of the signature, so the body has to be read up front
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("Create failed to read body: %w", err)
+	}
+
+	res, err := s.do(http.MethodPut, key, body)
+	if err != nil {
+		return fmt.Errorf("Create failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Create failed: %w", responseError(res))
+	}
+
+	return nil
+}
+
+func (s *S3) Open(key string) (io.ReadCloser, error) {
+	if !validKey(key) {
+		return nil, ErrNotExist
+	}
+
+	res, err := s.do(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Open failed: %w", err)
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, ErrNotExist
+	}
+
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, fmt.Errorf("Open failed: %w", responseError(res))
+	}
+
+	return res.Body, nil
+}
+
+// S3 answers deletes of missing keys with success, so Remove can rarely tell a key did not
+// exist.
+func (s *S3) Remove(key string) error {
+	if !validKey(key) {
+		return ErrNotExist
+	}
+
+	res, err := s.do(http.MethodDelete, key, nil)
+	if err != nil {
+		return fmt.Errorf("Remove failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return ErrNotExist
+	}
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Remove failed: %w", responseError(res))
+	}
+
+	return nil
+}
+
+// Lists the bucket a page at a time with ListObjectsV2.
+func (s *S3) List() ([]Object, error) {
+	var result []Object
+	token := ""
+
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+
+		page, err := s.listPage(q)
+		if err != nil {
+			return nil, fmt.Errorf("List failed: %w", err)
+		}
+
+		for _, c := range page.Contents {
+			result = append(result, Object{Key: c.Key, Modified: c.LastModified})
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return result, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3) listPage(q url.Values) (listBucketResult, error) {
+	var result listBucketResult
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(s.Endpoint, "/")+"/"+escapePath(s.Bucket)+"?"+canonicalQuery(q), nil)
+	if err != nil {
+		return result, err
+	}
+
+	s.sign(req, hashHex(nil), s.now())
+
+	res, err := s.client().Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return result, responseError(res)
+	}
+
+	if err := xml.NewDecoder(res.Body).Decode(&result); err != nil {
+		return result, fmt.Errorf("failed to decode listing: %w", err)
+	}
+
+	return result, nil
+}
+
+// Public urls never expire, so expires only applies to presigned urls.
+func (s *S3) URL(key string, expires time.Time) string {
+	if s.PublicURL != "" {
+		return strings.TrimSuffix(s.PublicURL, "/") + "/" + escapePath(key)
+	}
+
+	return s.PrivateURL(key, expires)
+}
+
+// Returns a presigned bucket url, even when objects are also served from PublicURL.
+func (s *S3) PrivateURL(key string, expires time.Time) string {
+	u, err := url.Parse(s.objectURL(key))
+	if err != nil {
+		return ""
+	}
+
+	// sign from the start of the hour so urls handed out within the hour match and can be
+	// cached by clients
+	t := s.now().Truncate(time.Hour)
+
+	return s.presign(u, t, expires.Sub(t))
+}
+
+// longest lifetime signature version 4 allows for a presigned url
+const maxPresignLifetime = 7 * 24 * time.Hour
+
+func (s *S3) objectURL(key string) string {
+	return strings.TrimSuffix(s.Endpoint, "/") + "/" + escapePath(s.Bucket) + "/" + escapePath(key)
+}
+
+func (s *S3) do(method string, key string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", http.DetectContentType(body))
+	}
+
+	s.sign(req, hashHex(body), s.now())
+
+	return s.client().Do(req)
+}
+
+func (s *S3) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+
+	return defaultS3Client
+}
+
+func (s *S3) now() time.Time {
+	if s.Now != nil {
+		return s.Now().UTC()
+	}
+
+	return time.Now().UTC()
+}
+
+func (s *S3) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.Region + "/s3/aws4_request"
+}
+
+// Signs a request with AWS signature version 4 by setting its x-amz-date,
+// x-amz-content-sha256 and Authorization headers. Every header already set on the request,
+// along with the host, is signed.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *S3) sign(req *http.Request, payloadHash string, t time.Time) {
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	signedHeaders, signature := s.signature(req.Method, req.URL, headers, payloadHash, t)
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, s.scope(t), signedHeaders, signature,
+	))
+}
+
+// Returns a presigned GET url for u, signed at t and valid for lifetime.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+func (s *S3) presign(u *url.URL, t time.Time, lifetime time.Duration) string {
+	if lifetime > maxPresignLifetime {
+		lifetime = maxPresignLifetime
+	}
+	if lifetime < time.Second {
+		lifetime = time.Second
+	}
+
+	q := u.Query()
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", s.AccessKey+"/"+s.scope(t))
+	q.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	q.Set("X-Amz-Expires", fmt.Sprint(int64(lifetime/time.Second)))
+	q.Set("X-Amz-SignedHeaders", "host")
+
+	signed := *u
+	signed.RawQuery = canonicalQuery(q)
+
+	_, signature := s.signature(http.MethodGet, &signed, map[string]string{"host": u.Host}, "UNSIGNED-PAYLOAD", t)
+
+	return signed.String() + "&X-Amz-Signature=" + signature
+}
+
+// Returns the signed header list and signature of a request.
+func (s *S3) signature(method string, u *url.URL, headers map[string]string, payloadHash string, t time.Time) (string, string) {
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		canonicalQuery(u.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + s.scope(t) + "\n" + hashHex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), t.Format("20060102"))
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	return signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func canonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string{}, values[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, escape(k)+"="+escape(v))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// Escapes every byte other than the unreserved characters, as signature version 4 requires.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func escapePath(s string) string {
+	parts := strings.Split(s, "/")
+	for i := range parts {
+		parts[i] = escape(parts[i])
+	}
+
+	return strings.Join(parts, "/")
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func responseError(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("unexpected status %s: %s", res.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Returned when a key that does not exist is opened. It wraps os.ErrNotExist so callers can
+// check for either.
+var ErrNotExist = fmt.Errorf("storage: object does not exist: %w", os.ErrNotExist)
+
+var ErrConfig = errors.New("storage: invalid configuration")
+
+var ErrSignature = errors.New("storage: url signature is invalid or has expired")
+
+// Storage stores blobs such as uploaded images under flat keys.
+type Storage interface {
+	// Stores the contents of r under key, replacing anything stored there before.
+	Create(key string, r io.Reader) error
+
+	// Opens the blob stored under key.
+	// Returns ErrNotExist if nothing is stored under key.
+	Open(key string) (io.ReadCloser, error)
+
+	// Removes the blob stored under key.
+	// Returns ErrNotExist if nothing is stored under key and the backend can tell.
+	Remove(key string) error
+
+	// Returns every stored blob.
+	List() ([]Object, error)
+
+	// Returns a url clients can fetch the blob stored under key from until expires. Backends
+	// implementing PrivateURLer may return one that never expires.
+	URL(key string, expires time.Time) string
+}
+
+// Object describes a stored blob.
+type Object struct {
+	Key      string
+	Modified time.Time
+}
+
+// PrivateURLer is implemented by backends whose urls can be permanent and public, e.g. when
+// served by a CDN, so blobs that must stay private can still be handed out.
+type PrivateURLer interface {
+	// Returns a url clients can fetch the blob stored under key from until expires, and no
+	// longer.
+	PrivateURL(key string, expires time.Time) string
+}
+
+// Verifier is implemented by backends whose urls are served by the api itself, which then
+// has to check the urls it is handed.
+type Verifier interface {
+	// Returns ErrSignature unless expires and signature came from a url for key that has
+	// not expired yet.
+	Verify(key string, expires string, signature string) error
+}
+
+// Builds the storage backend selected by the STORAGE environment variable, "local" (the
+// default) or "s3".
+//
+// local reads IMAGE_PATH for the directory files are written to, IMAGE_URL for the path on the
+// api they are served from, defaulting to /images, and IMAGE_URL_SECRET for the key urls
+// are signed with.
+//
+// s3 reads S3_ENDPOINT, S3_BUCKET, S3_REGION, S3_ACCESS_KEY and S3_SECRET_KEY, and optionally
+// S3_PUBLIC_URL when objects are served publicly from somewhere other than the bucket itself,
+// e.g. a CDN.
+func FromEnv() (Storage, error) {
+	switch backend := os.Getenv("STORAGE"); backend {
+	case "", "local":
+		urlPrefix := os.Getenv("IMAGE_URL")
+		if urlPrefix == "" {
+			urlPrefix = "/images"
+		}
+
+		return NewDisk(os.Getenv("IMAGE_PATH"), urlPrefix, []byte(os.Getenv("IMAGE_URL_SECRET")))
+	case "s3":
+		s := &S3{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			Region:    os.Getenv("S3_REGION"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			PublicURL: os.Getenv("S3_PUBLIC_URL"),
+		}
+		if s.Endpoint == "" || s.Bucket == "" || s.AccessKey == "" || s.SecretKey == "" {
+			return nil, fmt.Errorf("%w: S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required", ErrConfig)
+		}
+		if s.Region == "" {
+			s.Region = "us-east-1"
+		}
+
+		return s, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown STORAGE %q", ErrConfig, backend)
+	}
+}
+
+// Keys are generated by the api, but never let one escape the bucket or directory it is
+// stored in.
+func validKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, `/\`) && key != "." && key != ".."
+}
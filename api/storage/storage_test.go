@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Runs the behaviour every backend must share.
+func testStorage(t *testing.T, s Storage) {
+	err := s.Create("a.jpg", strings.NewReader("first"))
+	assert.NoError(t, err)
+
+	err = s.Create("a.jpg", strings.NewReader("second"))
+	assert.NoError(t, err)
+
+	r, err := s.Open("a.jpg")
+	assert.NoError(t, err)
+	data, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "second", string(data))
+
+	err = s.Create("b.jpg", strings.NewReader("other"))
+	assert.NoError(t, err)
+
+	objects, err := s.List()
+	assert.NoError(t, err)
+	var keys []string
+	for _, o := range objects {
+		keys = append(keys, o.Key)
+		assert.False(t, o.Modified.IsZero())
+	}
+	assert.ElementsMatch(t, []string{"a.jpg", "b.jpg"}, keys)
+
+	assert.NoError(t, s.Remove("b.jpg"))
+
+	err = s.Remove("a.jpg")
+	assert.NoError(t, err)
+
+	_, err = s.Open("a.jpg")
+	assert.ErrorIs(t, err, ErrNotExist)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	err = s.Create("../escape.jpg", strings.NewReader("data"))
+	assert.Error(t, err)
+}
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func Test_Disk(t *testing.T) {
+	d, err := NewDisk(t.TempDir(), "/images/", testSecret)
+	assert.NoError(t, err)
+
+	testStorage(t, d)
+
+	assert.ErrorIs(t, d.Remove("missing.jpg"), ErrNotExist)
+
+	_, err = NewDisk(t.TempDir(), "/images", []byte("short"))
+	assert.ErrorIs(t, err, ErrConfig)
+}
+
+func Test_DiskURL(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	d := &Disk{URLPrefix: "/images", Secret: testSecret, Now: func() time.Time { return now }}
+
+	u, err := url.Parse(d.URL("a.jpg", now.Add(time.Hour)))
+	assert.NoError(t, err)
+	assert.Equal(t, "/images/a.jpg", u.Path)
+	assert.Equal(t, "1700003600", u.Query().Get("expires"))
+
+	expires, signature := u.Query().Get("expires"), u.Query().Get("signature")
+
+	assert.NoError(t, d.Verify("a.jpg", expires, signature))
+
+	// signed for another key
+	assert.ErrorIs(t, d.Verify("b.jpg", expires, signature), ErrSignature)
+
+	// expiry pushed back by the client
+	assert.ErrorIs(t, d.Verify("a.jpg", "1800000000", signature), ErrSignature)
+	assert.ErrorIs(t, d.Verify("a.jpg", "soon", signature), ErrSignature)
+
+	// signed with another secret
+	other := &Disk{URLPrefix: "/images", Secret: []byte("fedcba9876543210fedcba9876543210")}
+	assert.ErrorIs(t, d.Verify("a.jpg", expires, signatureOf(other, "a.jpg", expires)), ErrSignature)
+
+	now = now.Add(2 * time.Hour)
+	assert.ErrorIs(t, d.Verify("a.jpg", expires, signature), ErrSignature)
+}
+
+func signatureOf(d *Disk, key string, expires string) string {
+	return d.signature(key, expires)
+}
+
+func Test_FromEnv(t *testing.T) {
+	dir := t.TempDir()
+
+	data := []struct {
+		Env    map[string]string
+		Assert func(s Storage, err error)
+	}{
+		{
+			Env: map[string]string{"STORAGE": "", "IMAGE_PATH": dir, "IMAGE_URL": "", "IMAGE_URL_SECRET": string(testSecret)},
+			Assert: func(s Storage, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, &Disk{Root: dir, URLPrefix: "/images", Secret: testSecret}, s)
+			},
+		},
+		{
+			Env: map[string]string{"STORAGE": "local", "IMAGE_PATH": dir, "IMAGE_URL_SECRET": ""},
+			Assert: func(s Storage, err error) {
+				assert.ErrorIs(t, err, ErrConfig)
+			},
+		},
+		{
+			Env: map[string]string{"STORAGE": "local", "IMAGE_PATH": dir, "IMAGE_URL": "/static/images/", "IMAGE_URL_SECRET": string(testSecret)},
+			Assert: func(s Storage, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, "/static/images", s.(*Disk).URLPrefix)
+			},
+		},
+		{
+			Env: map[string]string{"STORAGE": "local", "IMAGE_PATH": dir, "IMAGE_URL": "https://cdn.example.com/images", "IMAGE_URL_SECRET": string(testSecret)},
+			Assert: func(s Storage, err error) {
+				assert.ErrorIs(t, err, ErrConfig)
+			},
+		},
+		{
+			Env: map[string]string{"STORAGE": "local", "IMAGE_PATH": dir, "IMAGE_URL": "images", "IMAGE_URL_SECRET": string(testSecret)},
+			Assert: func(s Storage, err error) {
+				assert.ErrorIs(t, err, ErrConfig)
+			},
+		},
+		{
+			Env: map[string]string{"STORAGE": "s3", "S3_ENDPOINT": "http://minio:9000", "S3_BUCKET": "images", "S3_REGION": "", "S3_ACCESS_KEY": "key", "S3_SECRET_KEY": "secret", "S3_PUBLIC_URL": ""},
+			Assert: func(s Storage, err error) {
+				assert.NoError(t, err)
+				assert.True(t, strings.HasPrefix(s.URL("a.jpg", time.Now().Add(time.Hour)), "http://minio:9000/images/a.jpg?"))
+				assert.Equal(t, "us-east-1", s.(*S3).Region)
+			},
+		},
+		{
+			Env: map[string]string{"STORAGE": "s3", "S3_ENDPOINT": "", "S3_BUCKET": "images"},
+			Assert: func(s Storage, err error) {
+				assert.ErrorIs(t, err, ErrConfig)
+			},
+		},
+		{
+			Env: map[string]string{"STORAGE": "ftp"},
+			Assert: func(s Storage, err error) {
+				assert.ErrorIs(t, err, ErrConfig)
+			},
+		},
+	}
+
+	for _, d := range data {
+		for k, v := range d.Env {
+			os.Setenv(k, v)
+		}
+		d.Assert(FromEnv())
+		for k := range d.Env {
+			os.Unsetenv(k)
+		}
+	}
+}
@@ -13,17 +13,219 @@ var (
 const createProfileTable = `
 	CREATE TABLE IF NOT EXISTS profile (
   	id TEXT NOT NULL PRIMARY KEY,
-  	username TEXT NOT NULL UNIQUE
+  	username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+  	usernamekey TEXT NOT NULL DEFAULT '',
+  	displayname TEXT NOT NULL DEFAULT '',
+  	bio TEXT NOT NULL DEFAULT '',
+  	website TEXT NOT NULL DEFAULT '',
+  	units TEXT NOT NULL DEFAULT 'metric',
+  	avatarname TEXT NOT NULL DEFAULT '',
+  	usernamechanged INTEGER NOT NULL DEFAULT 0,
+  	deleteafter INTEGER NOT NULL DEFAULT 0,
+  	role TEXT NOT NULL DEFAULT 'user',
+  	suspended INTEGER NOT NULL DEFAULT 0,
+  	CHECK (units IN ('metric', 'imperial')),
+  	CHECK (role IN ('user', 'moderator', 'admin'))
   );`
 
+// Usernames that look alike share a key, see service.UsernamePolicy. Profiles that looked like
+// an older one when keys were first stored have none until they are renamed.
+const createProfileIndexes = `
+	CREATE UNIQUE INDEX IF NOT EXISTS profile_usernamekey ON profile(usernamekey) WHERE usernamekey <> '';`
+
+// Usernames profiles were renamed from, so links to them keep working. They can't be taken by
+// anyone else.
+const createUsernameRedirectTable = `
+	CREATE TABLE IF NOT EXISTS username_redirect (
+		username TEXT NOT NULL PRIMARY KEY COLLATE NOCASE,
+		profileid TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		FOREIGN KEY(profileid) REFERENCES profile(id) ON DELETE CASCADE
+	);`
+
+// Profiles that were deleted, so a user signing in again with the same subject is told their
+// profile was deleted and starts over with a new one. Removed when the profile is created again.
+const createProfileTombstoneTable = `
+	CREATE TABLE IF NOT EXISTS profile_tombstone (
+		id TEXT NOT NULL PRIMARY KEY,
+		deleted INTEGER NOT NULL
+	);`
+
+// Groups of profiles, like a household, that own recipes together. Members are owners, who
+// manage the group, or members. Invites are codes anyone can join with until they expire, only
+// the hash of a code is stored.
+const createGroupTables = `
+	CREATE TABLE IF NOT EXISTS profile_group (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		CHECK (name <> '')
+	);
+	CREATE TABLE IF NOT EXISTS group_member (
+		groupid INTEGER NOT NULL,
+		profileid TEXT NOT NULL,
+		role TEXT NOT NULL,
+		joined INTEGER NOT NULL,
+		PRIMARY KEY(groupid, profileid),
+		CHECK (role IN ('owner', 'member')),
+		FOREIGN KEY(groupid) REFERENCES profile_group(id) ON DELETE CASCADE,
+		FOREIGN KEY(profileid) REFERENCES profile(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS group_member_profileid ON group_member(profileid);
+	CREATE TABLE IF NOT EXISTS group_invite (
+		codehash TEXT NOT NULL PRIMARY KEY,
+		groupid INTEGER NOT NULL,
+		created INTEGER NOT NULL,
+		expires INTEGER NOT NULL,
+		FOREIGN KEY(groupid) REFERENCES profile_group(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS group_invite_groupid ON group_invite(groupid);`
+
+// Recipes in a group stay with the profile that created them, and go back to being only theirs
+// when the group is deleted.
 const createRecipeTable = `
 	CREATE TABLE IF NOT EXISTS recipe (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		name TEXT NOT NULL,
 		username TEXT NOT NULL,
 		imagename TEXT default "",
+		preptime TEXT NOT NULL DEFAULT '',
+		cooktime TEXT NOT NULL DEFAULT '',
+		totaltime TEXT NOT NULL DEFAULT '',
+		totalseconds INTEGER NOT NULL DEFAULT 0,
+		difficulty TEXT NOT NULL DEFAULT '',
+		cuisine TEXT NOT NULL DEFAULT '',
+		course TEXT NOT NULL DEFAULT '',
+		visibility TEXT NOT NULL DEFAULT 'private',
+		published INTEGER NOT NULL DEFAULT 0,
+		hidden INTEGER NOT NULL DEFAULT 0,
+		groupid INTEGER DEFAULT NULL,
 		CHECK (name <> '' AND username <> ''),
-		FOREIGN KEY(username) REFERENCES profile(username) ON DELETE CASCADE
+		CHECK (visibility IN ('private', 'public')),
+		FOREIGN KEY(username) REFERENCES profile(username) ON DELETE CASCADE,
+		FOREIGN KEY(groupid) REFERENCES profile_group(id) ON DELETE SET NULL
+	);`
+
+// Profiles following other profiles. Profiles are referenced by id so follows survive renames.
+const createFollowTable = `
+	CREATE TABLE IF NOT EXISTS follow (
+		followerid TEXT NOT NULL,
+		followeeid TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		PRIMARY KEY(followerid, followeeid),
+		CHECK (followerid <> followeeid),
+		FOREIGN KEY(followerid) REFERENCES profile(id) ON DELETE CASCADE,
+		FOREIGN KEY(followeeid) REFERENCES profile(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS follow_followeeid_created ON follow(followeeid, created);`
+
+// Accounts of users who sign in with a username and password instead of an external identity
+// provider. Refresh tokens are stored by their hash. Tokens rotated from the same login share a
+// family, so reusing a rotated one can revoke the rest.
+const createAccountTables = `
+	CREATE TABLE IF NOT EXISTS account (
+		id TEXT NOT NULL PRIMARY KEY,
+		username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		passwordhash TEXT NOT NULL,
+		failedlogins INTEGER NOT NULL DEFAULT 0,
+		lockeduntil INTEGER NOT NULL DEFAULT 0,
+		created INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS refresh_token (
+		id TEXT NOT NULL PRIMARY KEY,
+		accountid TEXT NOT NULL,
+		family TEXT NOT NULL,
+		used INTEGER NOT NULL DEFAULT 0,
+		expires INTEGER NOT NULL,
+		created INTEGER NOT NULL,
+		FOREIGN KEY(accountid) REFERENCES account(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS refresh_token_family ON refresh_token(family);
+	CREATE INDEX IF NOT EXISTS refresh_token_accountid ON refresh_token(accountid);`
+
+// Personal access tokens let scripts use the api on behalf of a profile, limited to the scopes
+// they carry. Only the hash of a token is stored.
+const createPersonalTokenTable = `
+	CREATE TABLE IF NOT EXISTS personal_token (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		profileid TEXT NOT NULL,
+		name TEXT NOT NULL,
+		tokenhash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		lastused INTEGER NOT NULL DEFAULT 0,
+		expires INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(profileid) REFERENCES profile(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS personal_token_profileid ON personal_token(profileid);`
+
+// What moderators and admins did. Entries outlive the profiles they mention, so they aren't
+// foreign keys.
+const createAuditLogTable = `
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		actorid TEXT NOT NULL,
+		action TEXT NOT NULL,
+		targettype TEXT NOT NULL,
+		targetid TEXT NOT NULL,
+		details TEXT NOT NULL DEFAULT '',
+		created INTEGER NOT NULL
+	);`
+
+// Reports of abuse for moderators to triage. ownerid is the profile the reported content
+// belongs to, so they can see what happened to reports about it. Like the audit log, reports
+// outlive the profiles they mention. A profile can only have one unresolved report about the
+// same content.
+const createReportTable = `
+	CREATE TABLE IF NOT EXISTS report (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		reporterid TEXT NOT NULL,
+		targettype TEXT NOT NULL,
+		targetid TEXT NOT NULL,
+		ownerid TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		details TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'open',
+		resolution TEXT NOT NULL DEFAULT '',
+		handlerid TEXT NOT NULL DEFAULT '',
+		created INTEGER NOT NULL,
+		updated INTEGER NOT NULL,
+		CHECK (targettype IN ('recipe', 'profile')),
+		CHECK (status IN ('open', 'reviewing', 'actioned', 'dismissed'))
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS report_unresolved ON report(reporterid, targettype, targetid) WHERE status IN ('open', 'reviewing');
+	CREATE INDEX IF NOT EXISTS report_status ON report(status, id);
+	CREATE INDEX IF NOT EXISTS report_ownerid ON report(ownerid);`
+
+// Notifications of what others did, like following a profile. Events of the same type about
+// the same subject are merged into one unread notification, with everyone who caused them in
+// notification_actor, so a burst of them reads "12 people ...".
+const createNotificationTables = `
+	CREATE TABLE IF NOT EXISTS notification (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		profileid TEXT NOT NULL,
+		type TEXT NOT NULL,
+		subject TEXT NOT NULL DEFAULT '',
+		read INTEGER NOT NULL DEFAULT 0,
+		created INTEGER NOT NULL,
+		updated INTEGER NOT NULL,
+		FOREIGN KEY(profileid) REFERENCES profile(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS notification_profileid_updated ON notification(profileid, updated);
+	CREATE TABLE IF NOT EXISTS notification_actor (
+		notificationid INTEGER NOT NULL,
+		actorid TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		PRIMARY KEY(notificationid, actorid),
+		FOREIGN KEY(notificationid) REFERENCES notification(id) ON DELETE CASCADE,
+		FOREIGN KEY(actorid) REFERENCES profile(id) ON DELETE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS notification_preference (
+		profileid TEXT NOT NULL,
+		type TEXT NOT NULL,
+		enabled INTEGER NOT NULL,
+		PRIMARY KEY(profileid, type),
+		FOREIGN KEY(profileid) REFERENCES profile(id) ON DELETE CASCADE
 	);`
 
 const createIngredientTable = `
@@ -32,19 +234,143 @@ const createIngredientTable = `
 		name TEXT NOT NULL,
 		amount TEXT NOT NULL,
 		unit TEXT NOT NULL,
+		groupname TEXT NOT NULL DEFAULT '',
+		position INTEGER NOT NULL DEFAULT 0,
+		subrecipeid INTEGER,
 		recipeid INTEGER NOT NULL,
+		FOREIGN KEY(subrecipeid) REFERENCES recipe(id) ON DELETE SET NULL,
 		FOREIGN KEY(recipeid) REFERENCES recipe(id) ON DELETE CASCADE
 	);`
 
+// Steps have an id of their own, so a step stays the same step, with the same images, when
+// steps before it are added, removed or moved.
 const createStepTable = `
 	CREATE TABLE IF NOT EXISTS step (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		stepnumber INTEGER NOT NULL,
 		description TEXT NOT NULL,
+		section TEXT NOT NULL DEFAULT '',
+		duration TEXT NOT NULL DEFAULT '',
+		temperature INTEGER NOT NULL DEFAULT 0,
+		temperatureunit TEXT NOT NULL DEFAULT '',
+		recipeid INTEGER NOT NULL,
+		FOREIGN KEY(recipeid) REFERENCES recipe(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS step_recipeid ON step(recipeid, stepnumber);`
+
+const createEquipmentTable = `
+	CREATE TABLE IF NOT EXISTS equipment (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		recipeid INTEGER NOT NULL,
+		FOREIGN KEY(recipeid) REFERENCES recipe(id) ON DELETE CASCADE
+	);`
+
+// Profiles a recipe is shared with besides its owner. Viewers can view it, editors can also
+// change it. Profiles are referenced by id so grants survive renames.
+const createRecipeGrantTable = `
+	CREATE TABLE IF NOT EXISTS recipe_grant (
 		recipeid INTEGER NOT NULL,
-		PRIMARY KEY(stepnumber, recipeid),
+		profileid TEXT NOT NULL,
+		role TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		PRIMARY KEY(recipeid, profileid),
+		CHECK (role IN ('viewer', 'editor')),
+		FOREIGN KEY(recipeid) REFERENCES recipe(id) ON DELETE CASCADE,
+		FOREIGN KEY(profileid) REFERENCES profile(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS recipe_grant_profileid ON recipe_grant(profileid);`
+
+const createRecipeImageTable = `
+	CREATE TABLE IF NOT EXISTS recipe_image (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		imagename TEXT NOT NULL,
+		caption TEXT NOT NULL DEFAULT '',
+		position INTEGER NOT NULL,
+		cover INTEGER NOT NULL DEFAULT 0,
+		stepid INTEGER DEFAULT NULL,
+		recipeid INTEGER NOT NULL,
+		FOREIGN KEY(stepid) REFERENCES step(id) ON DELETE CASCADE,
 		FOREIGN KEY(recipeid) REFERENCES recipe(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS recipe_image_stepid ON recipe_image(stepid) WHERE stepid IS NOT NULL;`
+
+// Every stored image file with the number of rows referencing it. Files are named after a hash
+// of their content, so one file can be shared by many recipes. created is refreshed on every
+// upload so garbage collection never removes a file that is about to be referenced. blurhash,
+// color, width and height describe the full rendition so clients can show a placeholder while
+// it loads.
+const createImageTable = `
+	CREATE TABLE IF NOT EXISTS image (
+		name TEXT NOT NULL PRIMARY KEY,
+		refs INTEGER NOT NULL DEFAULT 0,
+		created INTEGER NOT NULL,
+		blurhash TEXT NOT NULL DEFAULT '',
+		color TEXT NOT NULL DEFAULT '',
+		width INTEGER NOT NULL DEFAULT 0,
+		height INTEGER NOT NULL DEFAULT 0
+	);`
+
+// Outbox of image file operations. An operation is recorded before its database change is
+// made and removed once the files agree with the database, so operations left behind by a
+// crash can be finished on startup.
+const createFileOpTable = `
+	CREATE TABLE IF NOT EXISTS file_op (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		op TEXT NOT NULL,
+		name TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		CHECK (op IN ('create', 'delete'))
 	);`
 
+// Keep image.refs in step with the rows referencing images, including rows removed by
+// cascading deletes. Profiles are created without an avatar, so only updates and deletes of
+// them count.
+const createImageTriggers = `
+	CREATE TRIGGER IF NOT EXISTS recipe_imagename_insert AFTER INSERT ON recipe WHEN NEW.imagename <> '' BEGIN
+		INSERT INTO image(name, refs, created) VALUES (NEW.imagename, 1, strftime('%s', 'now'))
+			ON CONFLICT(name) DO UPDATE SET refs = refs + 1;
+	END;
+	CREATE TRIGGER IF NOT EXISTS recipe_imagename_update AFTER UPDATE OF imagename ON recipe WHEN OLD.imagename IS NOT NEW.imagename BEGIN
+		UPDATE image SET refs = MAX(refs - 1, 0) WHERE name = OLD.imagename;
+		INSERT INTO image(name, refs, created) SELECT NEW.imagename, 1, strftime('%s', 'now') WHERE NEW.imagename <> ''
+			ON CONFLICT(name) DO UPDATE SET refs = refs + 1;
+	END;
+	CREATE TRIGGER IF NOT EXISTS recipe_imagename_delete AFTER DELETE ON recipe BEGIN
+		UPDATE image SET refs = MAX(refs - 1, 0) WHERE name = OLD.imagename;
+	END;
+	CREATE TRIGGER IF NOT EXISTS recipe_image_insert AFTER INSERT ON recipe_image BEGIN
+		INSERT INTO image(name, refs, created) VALUES (NEW.imagename, 1, strftime('%s', 'now'))
+			ON CONFLICT(name) DO UPDATE SET refs = refs + 1;
+	END;
+	CREATE TRIGGER IF NOT EXISTS recipe_image_delete AFTER DELETE ON recipe_image BEGIN
+		UPDATE image SET refs = MAX(refs - 1, 0) WHERE name = OLD.imagename;
+	END;
+	CREATE TRIGGER IF NOT EXISTS profile_avatarname_update AFTER UPDATE OF avatarname ON profile WHEN OLD.avatarname IS NOT NEW.avatarname BEGIN
+		UPDATE image SET refs = MAX(refs - 1, 0) WHERE name = OLD.avatarname;
+		INSERT INTO image(name, refs, created) SELECT NEW.avatarname, 1, strftime('%s', 'now') WHERE NEW.avatarname <> ''
+			ON CONFLICT(name) DO UPDATE SET refs = refs + 1;
+	END;
+	CREATE TRIGGER IF NOT EXISTS profile_avatarname_delete AFTER DELETE ON profile BEGIN
+		UPDATE image SET refs = MAX(refs - 1, 0) WHERE name = OLD.avatarname;
+	END;`
+
+// recipe.published is when a recipe was last made public, feeds list recipes by it.
+const createRecipeTriggers = `
+	CREATE TRIGGER IF NOT EXISTS recipe_published_insert AFTER INSERT ON recipe WHEN NEW.visibility = 'public' BEGIN
+		UPDATE recipe SET published = strftime('%s', 'now') WHERE id = NEW.id;
+	END;
+	CREATE TRIGGER IF NOT EXISTS recipe_published_update AFTER UPDATE OF visibility ON recipe WHEN NEW.visibility = 'public' AND OLD.visibility <> 'public' BEGIN
+		UPDATE recipe SET published = strftime('%s', 'now') WHERE id = NEW.id;
+	END;`
+
+const createRecipeIndexes = `
+	CREATE INDEX IF NOT EXISTS recipe_username_totalseconds ON recipe(username, totalseconds);
+	CREATE INDEX IF NOT EXISTS recipe_username_difficulty ON recipe(username, difficulty);
+	CREATE INDEX IF NOT EXISTS recipe_username_published ON recipe(username, published, id) WHERE visibility = 'public';
+	CREATE INDEX IF NOT EXISTS recipe_groupid ON recipe(groupid) WHERE groupid IS NOT NULL;`
+
 func Open() (*sql.DB, error) {
 	connName := fmt.Sprintf("%v?_foreign_keys=on", dbfile)
 
@@ -53,6 +379,10 @@ func Open() (*sql.DB, error) {
 		return nil, err
 	}
 
+	if err := migrate(db); err != nil {
+		return nil, err
+	}
+
 	createSQLiteTables(db)
 
 	return db, nil
@@ -63,10 +393,50 @@ func createSQLiteTables(conn *sql.DB) {
 		log.Fatalf("failed to create PROFILE table: %s", err)
 	}
 
+	if _, err := conn.Exec(createProfileIndexes); err != nil {
+		log.Fatalf("failed to create PROFILE indexes: %s", err)
+	}
+
+	if _, err := conn.Exec(createUsernameRedirectTable); err != nil {
+		log.Fatalf("failed to create USERNAME_REDIRECT table: %s", err)
+	}
+
+	if _, err := conn.Exec(createProfileTombstoneTable); err != nil {
+		log.Fatalf("failed to create PROFILE_TOMBSTONE table: %s", err)
+	}
+
+	if _, err := conn.Exec(createGroupTables); err != nil {
+		log.Fatalf("failed to create GROUP tables: %s", err)
+	}
+
 	if _, err := conn.Exec(createRecipeTable); err != nil {
 		log.Fatalf("failed to create RECIPE table: %s", err)
 	}
 
+	if _, err := conn.Exec(createFollowTable); err != nil {
+		log.Fatalf("failed to create FOLLOW table: %s", err)
+	}
+
+	if _, err := conn.Exec(createAccountTables); err != nil {
+		log.Fatalf("failed to create ACCOUNT tables: %s", err)
+	}
+
+	if _, err := conn.Exec(createPersonalTokenTable); err != nil {
+		log.Fatalf("failed to create PERSONAL_TOKEN table: %s", err)
+	}
+
+	if _, err := conn.Exec(createAuditLogTable); err != nil {
+		log.Fatalf("failed to create AUDIT_LOG table: %s", err)
+	}
+
+	if _, err := conn.Exec(createReportTable); err != nil {
+		log.Fatalf("failed to create REPORT table: %s", err)
+	}
+
+	if _, err := conn.Exec(createNotificationTables); err != nil {
+		log.Fatalf("failed to create NOTIFICATION tables: %s", err)
+	}
+
 	if _, err := conn.Exec(createIngredientTable); err != nil {
 		log.Fatalf("failed to create INGREDIENT table: %s", err)
 	}
@@ -74,4 +444,36 @@ func createSQLiteTables(conn *sql.DB) {
 	if _, err := conn.Exec(createStepTable); err != nil {
 		log.Fatalf("failed to create STEP table: %s", err)
 	}
+
+	if _, err := conn.Exec(createEquipmentTable); err != nil {
+		log.Fatalf("failed to create EQUIPMENT table: %s", err)
+	}
+
+	if _, err := conn.Exec(createRecipeGrantTable); err != nil {
+		log.Fatalf("failed to create RECIPE_GRANT table: %s", err)
+	}
+
+	if _, err := conn.Exec(createRecipeImageTable); err != nil {
+		log.Fatalf("failed to create RECIPE_IMAGE table: %s", err)
+	}
+
+	if _, err := conn.Exec(createImageTable); err != nil {
+		log.Fatalf("failed to create IMAGE table: %s", err)
+	}
+
+	if _, err := conn.Exec(createImageTriggers); err != nil {
+		log.Fatalf("failed to create IMAGE triggers: %s", err)
+	}
+
+	if _, err := conn.Exec(createFileOpTable); err != nil {
+		log.Fatalf("failed to create FILE_OP table: %s", err)
+	}
+
+	if _, err := conn.Exec(createRecipeTriggers); err != nil {
+		log.Fatalf("failed to create RECIPE triggers: %s", err)
+	}
+
+	if _, err := conn.Exec(createRecipeIndexes); err != nil {
+		log.Fatalf("failed to create RECIPE indexes: %s", err)
+	}
 }
@@ -0,0 +1,477 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/eciccone/rh/api/repo/profile"
+)
+
+// A migration brings the tables of a database created by an earlier version up to date. Tables
+// are created with every column they have now, so a migration only changes the tables that
+// already exist, and skips what is already done. That makes migrations safe to run on a
+// database of any age, including a new one.
+type migration func(tx *sql.Tx) error
+
+// Migrations in the order they were added, only ever append to them. PRAGMA user_version is
+// the number of migrations a database has had.
+var migrations = []migration{
+	migrateIngredientGroups,
+	migrateSubrecipes,
+	migrateRecipeMetadata,
+	migrateStepIds,
+	migrateRecipeVisibility,
+	migrateImagePlaceholders,
+	migrateProfileFields,
+	migrateUsernameChanged,
+	migrateDeleteAfter,
+	migrateUsernameKeys,
+	migratePublished,
+	migrateModeration,
+	migrateRecipeGroups,
+}
+
+// Runs the migrations a database has not had yet, each in a transaction of its own. They run
+// before the tables are created, so indexes and triggers on new columns find them.
+func migrate(db *sql.DB) error {
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	var version int
+	if err := conn.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to get schema version: %w", err)
+	}
+
+	if version >= len(migrations) {
+		return nil
+	}
+
+	// some migrations rebuild tables, which must not cascade to the rows referencing them. The
+	// pragma has no effect inside a transaction, and foreign keys are checked after each one.
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return fmt.Errorf("failed to turn off foreign keys: %w", err)
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+
+	for i := version; i < len(migrations); i++ {
+		if err := runMigration(ctx, conn, i+1, migrations[i]); err != nil {
+			return fmt.Errorf("migration %d failed: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+func runMigration(ctx context.Context, conn *sql.Conn, version int, m migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m(tx); err != nil {
+		return err
+	}
+
+	var table string
+	err = tx.QueryRow("SELECT \"table\" FROM pragma_foreign_key_check LIMIT 1").Scan(&table)
+	if err == nil {
+		return fmt.Errorf("rows of %s reference rows that don't exist", table)
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func tableExists(tx *sql.Tx, table string) (bool, error) {
+	var count int
+	err := tx.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	return count > 0, err
+}
+
+// Reports whether a column of a table was created with COLLATE NOCASE. SQLite only keeps the
+// statement a table was created with, so that is what is checked.
+func hasNoCase(tx *sql.Tx, table string) (bool, error) {
+	var statement string
+	if err := tx.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&statement); err != nil {
+		return false, err
+	}
+
+	return strings.Contains(strings.ToUpper(statement), "COLLATE NOCASE"), nil
+}
+
+// Adds a column to a table unless the table doesn't exist yet or already has it. Returns
+// whether it was added, so the migration can fill it in.
+func addColumn(tx *sql.Tx, table string, column string, definition string) (bool, error) {
+	exists, err := tableExists(tx, table)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count); err != nil {
+		return false, err
+	}
+
+	if count > 0 {
+		return false, nil
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return false, fmt.Errorf("failed to add %s.%s: %w", table, column, err)
+	}
+
+	return true, nil
+}
+
+// Ingredients can be grouped and ordered, and steps put in sections. Existing ingredients keep
+// the order they were added in.
+func migrateIngredientGroups(tx *sql.Tx) error {
+	if _, err := addColumn(tx, "ingredient", "groupname", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	added, err := addColumn(tx, "ingredient", "position", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	if added {
+		_, err := tx.Exec("UPDATE ingredient SET position = (SELECT COUNT(*) FROM ingredient AS earlier WHERE earlier.recipeid = ingredient.recipeid AND earlier.id <= ingredient.id)")
+		if err != nil {
+			return fmt.Errorf("failed to number ingredients: %w", err)
+		}
+	}
+
+	_, err = addColumn(tx, "step", "section", "TEXT NOT NULL DEFAULT ''")
+	return err
+}
+
+// Ingredients can be other recipes.
+func migrateSubrecipes(tx *sql.Tx) error {
+	_, err := addColumn(tx, "ingredient", "subrecipeid", "INTEGER REFERENCES recipe(id) ON DELETE SET NULL")
+	return err
+}
+
+// Recipes have timing, difficulty, cuisine and course, and steps a duration and temperature.
+func migrateRecipeMetadata(tx *sql.Tx) error {
+	columns := []struct{ table, column, definition string }{
+		{"recipe", "preptime", "TEXT NOT NULL DEFAULT ''"},
+		{"recipe", "cooktime", "TEXT NOT NULL DEFAULT ''"},
+		{"recipe", "totaltime", "TEXT NOT NULL DEFAULT ''"},
+		{"recipe", "totalseconds", "INTEGER NOT NULL DEFAULT 0"},
+		{"recipe", "difficulty", "TEXT NOT NULL DEFAULT ''"},
+		{"recipe", "cuisine", "TEXT NOT NULL DEFAULT ''"},
+		{"recipe", "course", "TEXT NOT NULL DEFAULT ''"},
+		{"step", "duration", "TEXT NOT NULL DEFAULT ''"},
+		{"step", "temperature", "INTEGER NOT NULL DEFAULT 0"},
+		{"step", "temperatureunit", "TEXT NOT NULL DEFAULT ''"},
+	}
+
+	for _, c := range columns {
+		if _, err := addColumn(tx, c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Steps have ids. SQLite can't add a primary key to a table, so the table is copied into a new
+// one, numbering the steps in order.
+func migrateStepIds(tx *sql.Tx) error {
+	exists, err := tableExists(tx, "step")
+	if err != nil || !exists {
+		return err
+	}
+
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info('step') WHERE name = 'id'").Scan(&count); err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	statements := []string{
+		`CREATE TABLE step_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			stepnumber INTEGER NOT NULL,
+			description TEXT NOT NULL,
+			section TEXT NOT NULL DEFAULT '',
+			duration TEXT NOT NULL DEFAULT '',
+			temperature INTEGER NOT NULL DEFAULT 0,
+			temperatureunit TEXT NOT NULL DEFAULT '',
+			recipeid INTEGER NOT NULL,
+			FOREIGN KEY(recipeid) REFERENCES recipe(id) ON DELETE CASCADE
+		)`,
+		`INSERT INTO step_new(stepnumber, description, section, duration, temperature, temperatureunit, recipeid)
+			SELECT stepnumber, description, section, duration, temperature, temperatureunit, recipeid FROM step ORDER BY recipeid, stepnumber`,
+		"DROP TABLE step",
+		"ALTER TABLE step_new RENAME TO step",
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to rebuild step: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// New recipes are private unless made public. Every profile could view every recipe before, so
+// existing recipes stay public.
+func migrateRecipeVisibility(tx *sql.Tx) error {
+	added, err := addColumn(tx, "recipe", "visibility", "TEXT NOT NULL DEFAULT 'private' CHECK (visibility IN ('private', 'public'))")
+	if err != nil || !added {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE recipe SET visibility = 'public'"); err != nil {
+		return fmt.Errorf("failed to keep existing recipes public: %w", err)
+	}
+
+	return nil
+}
+
+// Images have a placeholder to show while they load. Images stored before are left without
+// one.
+func migrateImagePlaceholders(tx *sql.Tx) error {
+	columns := []struct{ column, definition string }{
+		{"blurhash", "TEXT NOT NULL DEFAULT ''"},
+		{"color", "TEXT NOT NULL DEFAULT ''"},
+		{"width", "INTEGER NOT NULL DEFAULT 0"},
+		{"height", "INTEGER NOT NULL DEFAULT 0"},
+	}
+
+	for _, c := range columns {
+		if _, err := addColumn(tx, "image", c.column, c.definition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Profiles have a display name, bio, website, preferred units and avatar.
+func migrateProfileFields(tx *sql.Tx) error {
+	columns := []struct{ column, definition string }{
+		{"displayname", "TEXT NOT NULL DEFAULT ''"},
+		{"bio", "TEXT NOT NULL DEFAULT ''"},
+		{"website", "TEXT NOT NULL DEFAULT ''"},
+		{"units", "TEXT NOT NULL DEFAULT 'metric' CHECK (units IN ('metric', 'imperial'))"},
+		{"avatarname", "TEXT NOT NULL DEFAULT ''"},
+	}
+
+	for _, c := range columns {
+		if _, err := addColumn(tx, "profile", c.column, c.definition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Usernames can only be changed so often. Profiles that never changed theirs can change it
+// right away.
+func migrateUsernameChanged(tx *sql.Tx) error {
+	_, err := addColumn(tx, "profile", "usernamechanged", "INTEGER NOT NULL DEFAULT 0")
+	return err
+}
+
+// Profiles can be scheduled for deletion, none of the existing ones are.
+func migrateDeleteAfter(tx *sql.Tx) error {
+	_, err := addColumn(tx, "profile", "deleteafter", "INTEGER NOT NULL DEFAULT 0")
+	return err
+}
+
+// Usernames are unique regardless of case, and each profile has the key usernames that look
+// alike share. The tables are rebuilt to change how usernames are compared, which fails if two
+// profiles have usernames that only differ by case, one of them has to be renamed first. Of the
+// redirects that only differ by case, the oldest one is kept. Of profiles whose usernames look
+// alike, only the oldest gets the key, the others get theirs when they are renamed.
+func migrateUsernameKeys(tx *sql.Tx) error {
+	exists, err := tableExists(tx, "profile")
+	if err != nil || !exists {
+		return err
+	}
+
+	noCase, err := hasNoCase(tx, "profile")
+	if err != nil {
+		return err
+	}
+
+	if !noCase {
+		var a, b string
+		err := tx.QueryRow("SELECT a.username, b.username FROM profile AS a JOIN profile AS b ON a.username = b.username COLLATE NOCASE AND a.rowid < b.rowid LIMIT 1").Scan(&a, &b)
+		if err == nil {
+			return fmt.Errorf("usernames %q and %q only differ by case, rename one of them", a, b)
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		// the columns profile had when usernames became case insensitive
+		statements := []string{
+			`CREATE TABLE profile_new (
+				id TEXT NOT NULL PRIMARY KEY,
+				username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+				usernamekey TEXT NOT NULL DEFAULT '',
+				displayname TEXT NOT NULL DEFAULT '',
+				bio TEXT NOT NULL DEFAULT '',
+				website TEXT NOT NULL DEFAULT '',
+				units TEXT NOT NULL DEFAULT 'metric',
+				avatarname TEXT NOT NULL DEFAULT '',
+				usernamechanged INTEGER NOT NULL DEFAULT 0,
+				deleteafter INTEGER NOT NULL DEFAULT 0,
+				CHECK (units IN ('metric', 'imperial'))
+			)`,
+			`INSERT INTO profile_new(id, username, displayname, bio, website, units, avatarname, usernamechanged, deleteafter)
+				SELECT id, username, displayname, bio, website, units, avatarname, usernamechanged, deleteafter FROM profile ORDER BY rowid`,
+			"DROP TABLE profile",
+			"ALTER TABLE profile_new RENAME TO profile",
+		}
+
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return fmt.Errorf("failed to rebuild profile: %w", err)
+			}
+		}
+	}
+
+	if err := backfillUsernameKeys(tx); err != nil {
+		return err
+	}
+
+	exists, err = tableExists(tx, "username_redirect")
+	if err != nil || !exists {
+		return err
+	}
+
+	noCase, err = hasNoCase(tx, "username_redirect")
+	if err != nil || noCase {
+		return err
+	}
+
+	statements := []string{
+		`CREATE TABLE username_redirect_new (
+			username TEXT NOT NULL PRIMARY KEY COLLATE NOCASE,
+			profileid TEXT NOT NULL,
+			created INTEGER NOT NULL,
+			FOREIGN KEY(profileid) REFERENCES profile(id) ON DELETE CASCADE
+		)`,
+		`INSERT OR IGNORE INTO username_redirect_new(username, profileid, created)
+			SELECT username, profileid, created FROM username_redirect ORDER BY created`,
+		"DROP TABLE username_redirect",
+		"ALTER TABLE username_redirect_new RENAME TO username_redirect",
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to rebuild username_redirect: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Stores the key of every profile that has none, unless a profile that looks alike has it.
+func backfillUsernameKeys(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, username, usernamekey FROM profile ORDER BY rowid")
+	if err != nil {
+		return fmt.Errorf("failed to select usernames: %w", err)
+	}
+
+	taken := map[string]bool{}
+	keys := map[string]string{}
+	var missing []string
+	for rows.Next() {
+		var id, username, key string
+		if err := rows.Scan(&id, &username, &key); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan username: %w", err)
+		}
+
+		if key != "" {
+			taken[key] = true
+			continue
+		}
+
+		keys[id] = profile.UsernameKey(username)
+		missing = append(missing, id)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return fmt.Errorf("failed to select usernames: %w", err)
+	}
+	rows.Close()
+
+	for _, id := range missing {
+		key := keys[id]
+		if taken[key] {
+			continue
+		}
+		taken[key] = true
+
+		if _, err := tx.Exec("UPDATE profile SET usernamekey = ? WHERE id = ?", key, id); err != nil {
+			return fmt.Errorf("failed to store username key: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Feeds list public recipes by when they were made public. Recipes that already are count as
+// made public now, so they show up in feeds of everyone following their owner.
+func migratePublished(tx *sql.Tx) error {
+	added, err := addColumn(tx, "recipe", "published", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil || !added {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE recipe SET published = strftime('%s', 'now') WHERE visibility = 'public'"); err != nil {
+		return fmt.Errorf("failed to publish public recipes: %w", err)
+	}
+
+	return nil
+}
+
+// Profiles have a role and can be suspended, and recipes can be hidden by moderators. Existing
+// profiles are users.
+func migrateModeration(tx *sql.Tx) error {
+	columns := []struct{ table, column, definition string }{
+		{"profile", "role", "TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'moderator', 'admin'))"},
+		{"profile", "suspended", "INTEGER NOT NULL DEFAULT 0"},
+		{"recipe", "hidden", "INTEGER NOT NULL DEFAULT 0"},
+	}
+
+	for _, c := range columns {
+		if _, err := addColumn(tx, c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Recipes can be shared with a group. Existing recipes are in none, and recipes of a deleted group
+// fall back to their owner alone.
+func migrateRecipeGroups(tx *sql.Tx) error {
+	_, err := addColumn(tx, "recipe", "groupid", "INTEGER DEFAULT NULL REFERENCES profile_group(id) ON DELETE SET NULL")
+	return err
+}
@@ -1,14 +1,33 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/eciccone/rh/api/middleware"
+	"github.com/eciccone/rh/api/repo/admin"
+	"github.com/eciccone/rh/api/repo/imageref"
+	"github.com/eciccone/rh/api/repo/notification"
+	"github.com/eciccone/rh/api/repo/profile"
+	"github.com/eciccone/rh/api/repo/recipe"
+	"github.com/eciccone/rh/api/service"
+	"github.com/eciccone/rh/api/storage"
 	"github.com/eciccone/rh/database"
 	"github.com/eciccone/rh/router"
 	"github.com/joho/godotenv"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// Usage:
+//
+//	rh             runs the api
+//	rh gc [-grace] removes images nothing references and exits
 func main() {
 	if godotenv.Load() != nil {
 		log.Fatal("Error loading .env file")
@@ -20,7 +39,224 @@ func main() {
 	}
 	defer db.Close()
 
+	store, err := storage.FromEnv()
+	if err != nil {
+		log.Fatalf("failed to configure storage: %s", err)
+	}
+
+	policy, err := service.UsernamePolicyFromEnv()
+	if err != nil {
+		log.Fatalf("failed to configure usernames: %s", err)
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "gc":
+			collectImages(db, store, os.Args[2:])
+		default:
+			log.Fatalf("unknown command %q", os.Args[1])
+		}
+		return
+	}
+
+	// other instances may be in the middle of units of work, only those older than
+	// IMAGE_RECOVERY_GRACE, defaulting to 10 minutes, were cut short
+	recoveryGrace := envDuration("IMAGE_RECOVERY_GRACE", 10*time.Minute)
+	if err := newImageService(db, store).RecoverImages(time.Now().Add(-recoveryGrace)); err != nil {
+		log.Fatalf("failed to recover images: %s", err)
+	}
+
+	// ADMIN_USERNAMES bootstraps the first admins, who can grant roles to others from then on
+	if admins := os.Getenv("ADMIN_USERNAMES"); admins != "" {
+		if err := newAdminService(db, store).GrantAdmins(strings.Split(admins, ",")); err != nil {
+			log.Fatalf("failed to grant admins: %s", err)
+		}
+	}
+
+	go recoverImagesPeriodically(newImageService(db, store), recoveryGrace)
+	go collectImagesPeriodically(newImageGCService(db, store))
+	go purgeProfilesPeriodically(newProfileService(db, store, policy))
+
+	providers, err := middleware.ProvidersFromEnv()
+	if err != nil {
+		log.Fatalf("failed to configure identity providers: %s", err)
+	}
+
+	localAuth, err := service.LocalAuthFromEnv()
+	if err != nil {
+		log.Fatalf("failed to configure local accounts: %s", err)
+	}
+
+	// tokens of local accounts are verified like those of any other issuer
+	if localAuth != nil {
+		keys, err := localAuth.PublicKeys()
+		if err != nil {
+			log.Fatalf("failed to configure local accounts: %s", err)
+		}
+
+		for _, p := range providers {
+			if p.Issuer() == localAuth.Issuer {
+				log.Fatalf("LOCAL_AUTH_ISSUER %q is also configured in AUTH_PROVIDERS", localAuth.Issuer)
+			}
+		}
+
+		providers = append(providers, middleware.NewKeysProvider(middleware.ProviderConfig{Issuer: localAuth.Issuer, Audience: localAuth.Audience}, middleware.NewStaticKeys(keys)))
+	}
+
+	if len(providers) == 0 {
+		log.Fatal("AUTH_PROVIDERS, AUTH0_DOMAIN or LOCAL_AUTH_KEY_FILE must be set")
+	}
+
+	// requests are answered with 503 until the keys of their issuer can be fetched
+	refreshKeys(providers)
+	go refreshKeysPeriodically(providers)
+
+	limits, err := middleware.RateLimitsFromEnv()
+	if err != nil {
+		log.Fatalf("failed to configure rate limits: %s", err)
+	}
+
+	// buckets are kept in memory, so each instance of the api limits requests on its own
+	limiter := middleware.NewRateLimiter(middleware.NewMemoryStore(), limits)
+
 	r := router.New()
-	r.BuildRoutes(db)
+
+	// TRUSTED_PROXIES, comma separated addresses or CIDRs, are the proxies in front of the api,
+	// without it the client ip is the address requests come from
+	if value := os.Getenv("TRUSTED_PROXIES"); value != "" {
+		var proxies []string
+		for _, proxy := range strings.Split(value, ",") {
+			proxies = append(proxies, strings.TrimSpace(proxy))
+		}
+
+		if err := r.SetTrustedProxies(proxies); err != nil {
+			log.Fatalf("invalid TRUSTED_PROXIES: %s", err)
+		}
+	}
+
+	r.BuildRoutes(db, store, policy, providers, localAuth, limiter)
 	r.Run(":8080")
 }
+
+func newImageService(db *sql.DB, store storage.Storage) service.ImageService {
+	return service.NewFileProcessor(store, imageref.NewRepo(db))
+}
+
+func newProfileService(db *sql.DB, store storage.Storage, policy service.UsernamePolicy) service.ProfileService {
+	is := newImageService(db, store)
+	ns := service.NewNotificationService(notification.NewRepo(db), is)
+	return service.NewProfileService(profile.NewRepo(db), is, ns, policy)
+}
+
+func newAdminService(db *sql.DB, store storage.Storage) service.AdminService {
+	is := newImageService(db, store)
+	rs := service.NewRecipeService(recipe.NewRepo(db), is)
+	return service.NewAdminService(admin.NewRepo(db), profile.NewRepo(db), rs, is)
+}
+
+func newImageGCService(db *sql.DB, store storage.Storage) service.ImageGCService {
+	return service.NewImageGCService(imageref.NewRepo(db), newImageService(db, store))
+}
+
+// Runs image garbage collection once, for the gc command.
+func collectImages(db *sql.DB, store storage.Storage, args []string) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	grace := flags.Duration("grace", envDuration("IMAGE_GC_GRACE", 24*time.Hour), "keep unreferenced images stored more recently than this")
+	flags.Parse(args)
+
+	report, err := newImageGCService(db, store).CollectImages(*grace)
+	if err != nil {
+		log.Fatalf("failed to collect images: %s", err)
+	}
+
+	for _, name := range report.Removed {
+		fmt.Println("removed", name)
+	}
+	fmt.Printf("removed %d images, kept %d\n", len(report.Removed), report.Kept)
+}
+
+// Runs image garbage collection every IMAGE_GC_INTERVAL, defaulting to an hour. An interval of
+// 0 turns it off, for deployments running the gc command on a schedule instead.
+func collectImagesPeriodically(gc service.ImageGCService) {
+	interval := envDuration("IMAGE_GC_INTERVAL", time.Hour)
+	grace := envDuration("IMAGE_GC_GRACE", 24*time.Hour)
+	if interval <= 0 {
+		return
+	}
+
+	for range time.Tick(interval) {
+		report, err := gc.CollectImages(grace)
+		if err != nil {
+			log.Printf("failed to collect images: %s", err)
+			continue
+		}
+
+		if len(report.Removed) > 0 {
+			log.Printf("removed %d unreferenced images", len(report.Removed))
+		}
+	}
+}
+
+// Finishes the units of work cut short since startup, once they are older than grace.
+func recoverImagesPeriodically(is service.ImageService, grace time.Duration) {
+	if grace <= 0 {
+		return
+	}
+
+	for range time.Tick(grace) {
+		if err := is.RecoverImages(time.Now().Add(-grace)); err != nil {
+			log.Printf("failed to recover images: %s", err)
+		}
+	}
+}
+
+// Deletes the profiles whose deletion grace period is over every PROFILE_PURGE_INTERVAL,
+// defaulting to an hour. An interval of 0 turns it off.
+func purgeProfilesPeriodically(ps service.ProfileService) {
+	interval := envDuration("PROFILE_PURGE_INTERVAL", time.Hour)
+	if interval <= 0 {
+		return
+	}
+
+	for range time.Tick(interval) {
+		n, err := ps.PurgeProfiles()
+		if n > 0 {
+			log.Printf("deleted %d profiles", n)
+		}
+		if err != nil {
+			log.Printf("failed to purge profiles: %s", err)
+		}
+	}
+}
+
+func refreshKeysPeriodically(providers []middleware.Provider) {
+	interval := envDuration("JWKS_REFRESH_INTERVAL", time.Hour)
+	if interval <= 0 {
+		return
+	}
+
+	for range time.Tick(interval) {
+		refreshKeys(providers)
+	}
+}
+
+// failures are logged by the providers, which keep the keys they have
+func refreshKeys(providers []middleware.Provider) {
+	for _, p := range providers {
+		p.Refresh(context.Background())
+	}
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("invalid %s: %s", key, err)
+	}
+
+	return d
+}
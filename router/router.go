@@ -6,9 +6,16 @@ import (
 
 	"github.com/eciccone/rh/api/handler"
 	"github.com/eciccone/rh/api/middleware"
+	"github.com/eciccone/rh/api/repo/account"
+	"github.com/eciccone/rh/api/repo/admin"
+	"github.com/eciccone/rh/api/repo/group"
+	"github.com/eciccone/rh/api/repo/imageref"
+	"github.com/eciccone/rh/api/repo/notification"
 	"github.com/eciccone/rh/api/repo/profile"
 	"github.com/eciccone/rh/api/repo/recipe"
+	"github.com/eciccone/rh/api/repo/token"
 	"github.com/eciccone/rh/api/service"
+	"github.com/eciccone/rh/api/storage"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
@@ -38,28 +45,91 @@ func (r *Router) setConfiguration() {
 	}
 
 	r.Engine.Use(cors.New(config))
+
+	// no proxy is trusted to forward the client ip until SetTrustedProxies says otherwise, so
+	// clients can't pick their own ip to dodge rate limits
+	r.Engine.SetTrustedProxies(nil)
+}
+
+// SetTrustedProxies sets the addresses or CIDRs of the proxies trusted to forward the client ip
+// in X-Forwarded-For or X-Real-IP.
+func (r *Router) SetTrustedProxies(proxies []string) error {
+	return r.Engine.SetTrustedProxies(proxies)
 }
 
 func (r *Router) Run(addr string) {
 	r.Engine.Run(addr)
 }
 
-func (r *Router) BuildRoutes(db *sql.DB) {
+func (r *Router) BuildRoutes(db *sql.DB, store storage.Storage, policy service.UsernamePolicy, providers []middleware.Provider, localAuth *service.LocalAuthConfig, limiter *middleware.RateLimiter) {
 	pr := profile.NewRepo(db)
 	rr := recipe.NewRepo(db)
+	ir := imageref.NewRepo(db)
+	nr := notification.NewRepo(db)
+	adr := admin.NewRepo(db)
 
-	ps := service.NewProfileService(pr)
-	is := service.NewFileProcessor()
+	is := service.NewFileProcessor(store, ir)
+	ns := service.NewNotificationService(nr, is)
+	ps := service.NewProfileService(pr, is, ns, policy)
 	rs := service.NewRecipeService(rr, is)
+	ts := service.NewTokenService(token.NewRepo(db))
+	as := service.NewAdminService(adr, pr, rs, is)
+	gs := service.NewGroupService(group.NewRepo(db), is)
+	rps := service.NewReportService(adr, pr, rs)
 
 	ph := handler.NewProfileHandler(ps)
 	rh := handler.NewRecipeHandler(rs)
+	nh := handler.NewNotificationHandler(ns)
+	th := handler.NewTokenHandler(ts)
+	adh := handler.NewAdminHandler(as)
+	gh := handler.NewGroupHandler(gs)
+	rph := handler.NewReportHandler(rps)
+
+	// recipe images and avatars are served by the api only when they are stored on local disk,
+	// their urls are signed instead of requiring an access token so they work in <img> tags
+	if disk, ok := store.(*storage.Disk); ok {
+		r.Engine.GET(disk.URLPrefix+"/:name", handler.Handler(rh.GetImage))
+	}
 
-	// location for recipe image uploads
-	r.Engine.Static("/static/images", "./static/images")
+	// local accounts are only offered when configured
+	var ah handler.AuthHandler
+	if localAuth != nil {
+		ah = handler.NewAuthHandler(service.NewAuthService(account.NewRepo(db), *localAuth))
 
-	// all end points below must have a valid access token
-	r.Engine.Use(middleware.Validate())
+		auth := limiter.Limit("auth")
+		r.Engine.POST("/auth/register", auth, handler.Handler(ah.PostRegister))
+		r.Engine.POST("/auth/login", auth, handler.Handler(ah.PostLogin))
+		r.Engine.POST("/auth/refresh", auth, handler.Handler(ah.PostRefresh))
+		r.Engine.POST("/auth/logout", auth, handler.Handler(ah.PostLogout))
+	}
+
+	// all end points below must have a valid access token, personal access tokens can only use
+	// the end points listed here and only with the scope each needs
+	r.Engine.Use(limiter.Limit("validate"))
+	r.Engine.Use(middleware.Validate(providers, ts))
+	r.Engine.Use(limiter.Limit("api"))
+	r.Engine.Use(limiter.LimitWrites("write"))
+	r.Engine.Use(middleware.RequireScopes(middleware.Scopes{
+		"GET /feed":                           service.ScopeRecipesRead,
+		"GET /recipes":                        service.ScopeRecipesRead,
+		"GET /recipes/:id":                    service.ScopeRecipesRead,
+		"POST /recipes":                       service.ScopeRecipesWrite,
+		"PUT /recipes/:id":                    service.ScopeRecipesWrite,
+		"DELETE /recipes/:id":                 service.ScopeRecipesWrite,
+		"PUT /recipes/:id/image":              service.ScopeImagesWrite,
+		"POST /recipes/:id/images":            service.ScopeImagesWrite,
+		"PUT /recipes/:id/images":             service.ScopeImagesWrite,
+		"PUT /recipes/:id/images/:imageid":    service.ScopeImagesWrite,
+		"DELETE /recipes/:id/images/:imageid": service.ScopeImagesWrite,
+		"GET /recipes/:id/collaborators":      service.ScopeRecipesRead,
+	}))
+
+	if localAuth != nil {
+		r.Engine.PUT("/auth/password", handler.Handler(ah.PutPassword))
+	}
+
+	// uploads have a stricter limit of their own on top of the one for writes
+	images := limiter.Limit("images")
 
 	// profile routes
 	r.Engine.GET("/profile", handler.Handler(ph.GetProfile))
@@ -68,11 +138,77 @@ func (r *Router) BuildRoutes(db *sql.DB) {
 	// all end points below must have already created a profile with recihub
 	r.Engine.Use(middleware.Profile(ps))
 
+	r.Engine.PUT("/profile", handler.Handler(ph.PutProfile))
+	r.Engine.PUT("/profile/avatar", images, handler.Handler(ph.PutProfileAvatar))
+	r.Engine.PUT("/profile/username", handler.Handler(ph.PutProfileUsername))
+	r.Engine.DELETE("/profile", handler.Handler(ph.DeleteProfile))
+	r.Engine.POST("/profile/restore", handler.Handler(ph.PostProfileRestore))
+	r.Engine.GET("/profile/tokens", handler.Handler(th.GetTokens))
+	r.Engine.POST("/profile/tokens", handler.Handler(th.PostToken))
+	r.Engine.DELETE("/profile/tokens/:id", handler.Handler(th.DeleteToken))
+	r.Engine.GET("/profile/reports", handler.Handler(rph.GetOwnReports))
+
+	// user routes
+	r.Engine.GET("/users/:username", handler.Handler(ph.GetUser))
+	r.Engine.PUT("/users/:username/follow", handler.Handler(ph.PutFollow))
+	r.Engine.DELETE("/users/:username/follow", handler.Handler(ph.DeleteFollow))
+	r.Engine.GET("/users/:username/followers", handler.Handler(ph.GetFollowers))
+	r.Engine.GET("/users/:username/following", handler.Handler(ph.GetFollowing))
+
+	// notification routes
+	r.Engine.GET("/notifications", handler.Handler(nh.GetNotifications))
+	r.Engine.PUT("/notifications/read", handler.Handler(nh.PutNotificationsRead))
+	r.Engine.PUT("/notifications/:id/read", handler.Handler(nh.PutNotificationRead))
+	r.Engine.GET("/notifications/preferences", handler.Handler(nh.GetPreferences))
+	r.Engine.PUT("/notifications/preferences", handler.Handler(nh.PutPreferences))
+
+	// feed routes
+	r.Engine.GET("/feed", handler.Handler(rh.GetFeed))
+
 	// recipe routes
 	r.Engine.GET("/recipes/:id", handler.Handler(rh.GetRecipe))
 	r.Engine.GET("/recipes", handler.Handler(rh.GetRecipes))
 	r.Engine.POST("/recipes", handler.Handler(rh.PostRecipe))
 	r.Engine.PUT("/recipes/:id", handler.Handler(rh.PutRecipe))
-	r.Engine.PUT("/recipes/:id/image", handler.Handler(rh.PutRecipeImage))
+	r.Engine.PUT("/recipes/:id/image", images, handler.Handler(rh.PutRecipeImage))
+	r.Engine.POST("/recipes/:id/images", images, handler.Handler(rh.PostRecipeGalleryImage))
+	r.Engine.PUT("/recipes/:id/images", handler.Handler(rh.PutRecipeGalleryOrder))
+	r.Engine.PUT("/recipes/:id/images/:imageid", handler.Handler(rh.PutRecipeGalleryImage))
+	r.Engine.DELETE("/recipes/:id/images/:imageid", handler.Handler(rh.DeleteRecipeGalleryImage))
 	r.Engine.DELETE("/recipes/:id", handler.Handler(rh.DeleteRecipe))
+	r.Engine.GET("/recipes/:id/collaborators", handler.Handler(rh.GetCollaborators))
+	r.Engine.PUT("/recipes/:id/collaborators/:username", handler.Handler(rh.PutCollaborator))
+	r.Engine.DELETE("/recipes/:id/collaborators/:username", handler.Handler(rh.DeleteCollaborator))
+	r.Engine.POST("/recipes/:id/transfer", handler.Handler(rh.PostTransfer))
+
+	// group routes
+	r.Engine.GET("/groups", handler.Handler(gh.GetGroups))
+	r.Engine.POST("/groups", handler.Handler(gh.PostGroup))
+	r.Engine.POST("/groups/join", handler.Handler(gh.PostJoin))
+	r.Engine.GET("/groups/:id", handler.Handler(gh.GetGroup))
+	r.Engine.PUT("/groups/:id", handler.Handler(gh.PutGroup))
+	r.Engine.DELETE("/groups/:id", handler.Handler(gh.DeleteGroup))
+	r.Engine.POST("/groups/:id/invites", handler.Handler(gh.PostInvite))
+	r.Engine.DELETE("/groups/:id/invites", handler.Handler(gh.DeleteInvites))
+	r.Engine.PUT("/groups/:id/members/:username", handler.Handler(gh.PutMember))
+	r.Engine.DELETE("/groups/:id/members/:username", handler.Handler(gh.DeleteMember))
+
+	// report routes
+	r.Engine.POST("/reports", handler.Handler(rph.PostReport))
+
+	// moderator routes
+	moderation := r.Engine.Group("/admin", middleware.RequireRole(service.RoleModerator))
+	moderation.GET("/profiles", handler.Handler(adh.GetProfiles))
+	moderation.PUT("/profiles/:username/suspension", handler.Handler(adh.PutSuspension))
+	moderation.DELETE("/profiles/:username/suspension", handler.Handler(adh.DeleteSuspension))
+	moderation.PUT("/recipes/:id/hidden", handler.Handler(adh.PutRecipeHidden))
+	moderation.GET("/reports", handler.Handler(rph.GetReports))
+	moderation.PUT("/reports/:id", handler.Handler(rph.PutReport))
+
+	// admin routes
+	administration := r.Engine.Group("/admin", middleware.RequireRole(service.RoleAdmin))
+	administration.PUT("/profiles/:username/role", handler.Handler(adh.PutRole))
+	administration.DELETE("/recipes/:id", handler.Handler(adh.DeleteRecipe))
+	administration.GET("/stats", handler.Handler(adh.GetStats))
+	administration.GET("/audit", handler.Handler(adh.GetAuditLog))
 }